@@ -37,7 +37,7 @@ const Analytics = () => {
   useEffect(() => {
     // Fetch Bookings Over Time data
     axios.get('http://localhost:8080/admin/analytics/bookings-over-time', {
-      headers: { 'Role': 'admin' }
+      headers: { 'Authorization': `Bearer ${localStorage.getItem('token')}` }
     })
     .then(response => {
       const dates = response.data.map(item => new Date(item.date).toLocaleDateString());
@@ -60,7 +60,7 @@ const Analytics = () => {
 
     // Fetch Vehicle Status data
     axios.get('http://localhost:8080/admin/analytics/vehicle-status', {
-      headers: { 'Role': 'admin' }
+      headers: { 'Authorization': `Bearer ${localStorage.getItem('token')}` }
     })
     .then(response => {
       setVehicleStatusData({
@@ -77,7 +77,7 @@ const Analytics = () => {
 
     // Fetch Driver Performance data
     axios.get('http://localhost:8080/admin/analytics/driver-performance', {
-      headers: { 'Role': 'admin' }
+      headers: { 'Authorization': `Bearer ${localStorage.getItem('token')}` }
     })
     .then(response => {
       const drivers = response.data.map(item => item.driver_name);
@@ -99,7 +99,7 @@ const Analytics = () => {
 
     // Fetch Revenue Over Time data
     axios.get('http://localhost:8080/admin/analytics/revenue-over-time', {
-      headers: { 'Role': 'admin' }
+      headers: { 'Authorization': `Bearer ${localStorage.getItem('token')}` }
     })
     .then(response => {
       const dates = response.data.map(item => new Date(item.date).toLocaleDateString());
@@ -122,7 +122,7 @@ const Analytics = () => {
 
     // Fetch Booking Status Distribution data
     axios.get('http://localhost:8080/admin/analytics/booking-status-distribution', {
-      headers: { 'Role': 'admin' }
+      headers: { 'Authorization': `Bearer ${localStorage.getItem('token')}` }
     })
     .then(response => {
       const statuses = response.data.map(item => item.status);
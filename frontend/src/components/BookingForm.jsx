@@ -138,8 +138,7 @@ function BookingForm() {
         method: 'POST',
         headers: {
           'Content-Type': 'application/json',
-          'User-ID': userID,  // Send the User-ID from localStorage
-          'Role': role,        // Send the Role from localStorage
+          'Authorization': `Bearer ${localStorage.getItem('token')}`,  // Identify the user with the session token
         },
         body: JSON.stringify(bookingData),
       });
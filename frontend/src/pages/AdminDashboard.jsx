@@ -8,13 +8,13 @@ const AdminDashboard = () => {
 
   // Fetch all bookings
   const fetchAllBookings = async () => {
-    const role = localStorage.getItem('role');
+    const token = localStorage.getItem('token');
     try {
-      const response = await fetch('http://localhost:8080/admin/bookings', {
+      const response = await fetch('http://localhost:8080/admin/bookings?sort=-created_at', {
         method: 'GET',
         headers: {
           'Content-Type': 'application/json',
-          'Role': role,
+          'Authorization': `Bearer ${token}`,
         },
       });
 
@@ -23,7 +23,7 @@ const AdminDashboard = () => {
       }
 
       const data = await response.json();
-      setBookings(data || []); // Ensure bookings is an array
+      setBookings(data.items || []); // Newest page of bookings
     } catch (error) {
       console.error('Error fetching bookings:', error);
       setMessage(`An error occurred while fetching bookings: ${error.message}`);
@@ -32,13 +32,13 @@ const AdminDashboard = () => {
 
   // Fetch active bookings list for each driver
   const fetchActiveBookings = async () => {
-    const role = localStorage.getItem('role');
+    const token = localStorage.getItem('token');
     try {
       const response = await fetch('http://localhost:8080/admin/drivers/active-bookings', {
         method: 'GET',
         headers: {
           'Content-Type': 'application/json',
-          'Role': role,
+          'Authorization': `Bearer ${token}`,
         },
       });
 
@@ -56,13 +56,13 @@ const AdminDashboard = () => {
 
   // Mark a booking as complete
   const markBookingComplete = async (bookingId) => {
-    const role = localStorage.getItem('role');
+    const token = localStorage.getItem('token');
     try {
       const response = await fetch(`http://localhost:8080/admin/bookings/${bookingId}/complete`, {
         method: 'PUT',
         headers: {
           'Content-Type': 'application/json',
-          'Role': role,
+          'Authorization': `Bearer ${token}`,
         },
       });
 
@@ -19,18 +19,11 @@ const DriverDashboard = () => {
     }
 
     try {
-      console.log('Sending Request Headers:', {
-        'Content-Type': 'application/json',
-        'Driver-ID': driverID,
-        'Role': role,
-      });
-
       const response = await fetch('http://localhost:8080/driver/bookings/pending', {
         method: 'GET',
         headers: {
           'Content-Type': 'application/json',
-          'Driver-ID': driverID,
-          'Role': role,
+          'Authorization': `Bearer ${localStorage.getItem('token')}`,
         },
       });
 
@@ -64,8 +57,7 @@ const DriverDashboard = () => {
         method: 'PUT',
         headers: {
           'Content-Type': 'application/json',
-          'Driver-ID': driverID,  // Send Driver-ID from localStorage
-          'Role': role,
+          'Authorization': `Bearer ${localStorage.getItem('token')}`,  // Identify the driver with the session token
         },
       });
 
@@ -1,14 +1,88 @@
 import React, { useState } from 'react';
 import { useNavigate } from 'react-router-dom';
 
+const inputClass = "bg-gray-50 border border-gray-300 text-gray-900 rounded-lg focus:ring-primary-600 focus:border-primary-600 block w-full p-2.5 dark:bg-gray-700 dark:border-gray-600 dark:placeholder-gray-400 dark:text-white dark:focus:ring-blue-500 dark:focus:border-blue-500";
+const buttonClass = "w-full text-white bg-primary-600 hover:bg-primary-700 focus:ring-4 focus:outline-none focus:ring-primary-300 font-medium rounded-lg text-sm px-5 py-2.5 text-center dark:bg-primary-600 dark:hover:bg-primary-700 dark:focus:ring-primary-800";
+const labelClass = "block mb-2 text-sm font-medium text-gray-900 dark:text-white";
+
+// The login goes through these steps. Accounts with two-factor authentication
+// answer a challenge after the password; accounts whose role requires it but
+// that haven't set it up yet enroll first and then log in again.
+const STEP_PASSWORD = 'password';
+const STEP_CHALLENGE = 'challenge';
+const STEP_ENROLL = 'enroll';
+const STEP_RECOVERY_CODES = 'recovery-codes';
+
+// errorMessage turns an error response into something to show the user
+function errorMessage(response, data, fallback) {
+  if (response.status === 429) {
+    const seconds = response.headers.get('Retry-After');
+    return seconds
+      ? `Too many failed attempts, try again in ${seconds} seconds`
+      : 'Too many failed attempts, try again later';
+  }
+  return (data && data.error && data.error.message) || fallback;
+}
+
 function Login() {
   const [username, setUsername] = useState('');
   const [password, setPassword] = useState('');
   const [message, setMessage] = useState('');
+  const [step, setStep] = useState(STEP_PASSWORD);
+  const [mfaToken, setMfaToken] = useState('');
+  const [code, setCode] = useState('');
+  const [useRecoveryCode, setUseRecoveryCode] = useState(false);
+  const [enrollToken, setEnrollToken] = useState('');
+  const [enrollment, setEnrollment] = useState(null);
+  const [recoveryCodes, setRecoveryCodes] = useState([]);
   const navigate = useNavigate();
 
+  // finishLogin stores the session and opens the dashboard of the role
+  const finishLogin = (data) => {
+    // Destructure role, userID, and username from the response data
+    const { role, userID, access_token } = data;
+
+    // Save the session token, role and userID to localStorage
+    localStorage.setItem('token', access_token);
+    localStorage.setItem('userID', userID);
+    localStorage.setItem('role', role);
+
+    // Redirect based on role
+    if (role === 'user') {
+      navigate('/user-dashboard');
+    } else if (role === 'admin') {
+      navigate('/admin-dashboard');
+    } else if (role === 'driver') {
+      navigate('/driver-dashboard');
+    } else {
+      setMessage('Login failed: Unrecognized role');
+    }
+  };
+
+  // startEnrollment asks for a new authenticator secret with the limited token
+  // the login returned
+  const startEnrollment = async (token) => {
+    const response = await fetch('http://localhost:8080/account/mfa/enroll', {
+      method: 'POST',
+      headers: {
+        'Authorization': `Bearer ${token}`,
+      },
+    });
+    const data = await response.json();
+    if (!response.ok) {
+      setMessage(errorMessage(response, data, 'Could not start two-factor setup'));
+      return;
+    }
+
+    setEnrollToken(token);
+    setEnrollment(data);
+    setCode('');
+    setStep(STEP_ENROLL);
+  };
+
   const handleLogin = async (e) => {
     e.preventDefault();
+    setMessage('');
 
     try {
       const response = await fetch('http://localhost:8080/login', {
@@ -21,36 +95,246 @@ function Login() {
 
       const data = await response.json();
 
+      if (!response.ok) {
+        setMessage(errorMessage(response, data, 'Invalid credentials'));
+      } else if (data.mfa_required) {
+        setMfaToken(data.mfa_token);
+        setCode('');
+        setUseRecoveryCode(false);
+        setStep(STEP_CHALLENGE);
+      } else if (data.mfa_enrollment_required) {
+        await startEnrollment(data.access_token);
+      } else {
+        finishLogin(data);
+      }
+    } catch (error) {
+      setMessage('An error occurred during login');
+    }
+  };
+
+  const handleChallenge = async (e) => {
+    e.preventDefault();
+    setMessage('');
+
+    const body = useRecoveryCode
+      ? { mfa_token: mfaToken, recovery_code: code }
+      : { mfa_token: mfaToken, code };
+
+    try {
+      const response = await fetch('http://localhost:8080/login/mfa', {
+        method: 'POST',
+        headers: {
+          'Content-Type': 'application/json',
+        },
+        body: JSON.stringify(body),
+      });
+
+      const data = await response.json();
+
       if (response.ok) {
-        // Destructure role, userID, and username from the response data
-        const { role, userID, username } = data;
-
-        // Log the role and userID to the console
-        console.log('UserID:', userID);
-        console.log('Role:', role);
-
-        // Save role and userID to localStorage
-        localStorage.setItem('userID', userID);
-        localStorage.setItem('role', role);
-
-        // Redirect based on role
-        if (role === 'user') {
-          navigate('/user-dashboard');
-        } else if (role === 'admin') {
-          navigate('/admin-dashboard');
-        } else if (role === 'driver') {
-          navigate('/driver-dashboard');
-        } else {
-          setMessage('Login failed: Unrecognized role');
-        }
+        finishLogin(data);
+      } else if (data.error && data.error.code === 'invalid_mfa_token') {
+        // The challenge ran out, so the password has to be entered again
+        setStep(STEP_PASSWORD);
+        setPassword('');
+        setMessage('Your login timed out, please sign in again');
       } else {
-        setMessage('Invalid credentials');
+        setMessage(errorMessage(response, data, 'Invalid code'));
       }
     } catch (error) {
       setMessage('An error occurred during login');
     }
   };
 
+  const handleConfirmEnrollment = async (e) => {
+    e.preventDefault();
+    setMessage('');
+
+    try {
+      const response = await fetch('http://localhost:8080/account/mfa/confirm', {
+        method: 'POST',
+        headers: {
+          'Content-Type': 'application/json',
+          'Authorization': `Bearer ${enrollToken}`,
+        },
+        body: JSON.stringify({ code }),
+      });
+
+      const data = await response.json();
+
+      if (response.ok) {
+        setRecoveryCodes(data.recovery_codes || []);
+        setEnrollToken('');
+        setEnrollment(null);
+        setStep(STEP_RECOVERY_CODES);
+      } else {
+        setMessage(errorMessage(response, data, 'Invalid code'));
+      }
+    } catch (error) {
+      setMessage('An error occurred during two-factor setup');
+    }
+  };
+
+  // The enrollment token can't be used for anything else, so after saving the
+  // recovery codes the user logs in again, now with the second factor
+  const handleRecoveryCodesSaved = () => {
+    setRecoveryCodes([]);
+    setPassword('');
+    setCode('');
+    setMessage('');
+    setStep(STEP_PASSWORD);
+  };
+
+  const backToPassword = () => {
+    setMfaToken('');
+    setCode('');
+    setPassword('');
+    setMessage('');
+    setStep(STEP_PASSWORD);
+  };
+
+  const codeInput = (
+    <div>
+      <label htmlFor="code" className={labelClass}>
+        {useRecoveryCode && step === STEP_CHALLENGE ? 'Recovery code' : 'Authentication code'}
+      </label>
+      <input
+        type="text"
+        id="code"
+        value={code}
+        onChange={(e) => setCode(e.target.value)}
+        className={inputClass}
+        placeholder={useRecoveryCode && step === STEP_CHALLENGE ? 'xxxxx-xxxxx' : '123456'}
+        autoComplete="one-time-code"
+        inputMode={useRecoveryCode && step === STEP_CHALLENGE ? 'text' : 'numeric'}
+        required
+      />
+    </div>
+  );
+
+  let title = 'Log in to your account';
+  let content;
+  if (step === STEP_CHALLENGE) {
+    title = 'Two-factor authentication';
+    content = (
+      <form className="space-y-4 md:space-y-6" onSubmit={handleChallenge}>
+        <p className="text-sm text-gray-500 dark:text-gray-400">
+          {useRecoveryCode
+            ? 'Enter one of the recovery codes you saved when setting up two-factor authentication.'
+            : 'Enter the code from your authenticator app.'}
+        </p>
+        {codeInput}
+        <button type="submit" className={buttonClass}>
+          Verify
+        </button>
+        <p className="text-sm font-light text-gray-500 dark:text-gray-400">
+          <button
+            type="button"
+            onClick={() => { setUseRecoveryCode(!useRecoveryCode); setCode(''); }}
+            className="font-medium text-primary-600 hover:underline dark:text-primary-500"
+          >
+            {useRecoveryCode ? 'Use your authenticator app instead' : 'Lost your device? Use a recovery code'}
+          </button>
+          {' · '}
+          <button
+            type="button"
+            onClick={backToPassword}
+            className="font-medium text-primary-600 hover:underline dark:text-primary-500"
+          >
+            Back
+          </button>
+        </p>
+      </form>
+    );
+  } else if (step === STEP_ENROLL && enrollment) {
+    title = 'Set up two-factor authentication';
+    content = (
+      <form className="space-y-4 md:space-y-6" onSubmit={handleConfirmEnrollment}>
+        <p className="text-sm text-gray-500 dark:text-gray-400">
+          Your role requires two-factor authentication. Add this account to your
+          authenticator app with the key below, then enter the code it shows.
+        </p>
+        <div>
+          <p className={labelClass}>Setup key</p>
+          <code className="block break-all p-2.5 rounded-lg bg-gray-100 text-gray-900 dark:bg-gray-700 dark:text-white">
+            {enrollment.secret}
+          </code>
+          <a
+            href={enrollment.provisioning_uri}
+            className="text-sm font-medium text-primary-600 hover:underline dark:text-primary-500"
+          >
+            Open in authenticator app
+          </a>
+        </div>
+        {codeInput}
+        <button type="submit" className={buttonClass}>
+          Turn on two-factor authentication
+        </button>
+      </form>
+    );
+  } else if (step === STEP_RECOVERY_CODES) {
+    title = 'Save your recovery codes';
+    content = (
+      <div className="space-y-4 md:space-y-6">
+        <p className="text-sm text-gray-500 dark:text-gray-400">
+          Two-factor authentication is on. Each of these codes logs you in once
+          if you lose your device. Store them somewhere safe, they won't be shown again.
+        </p>
+        <ul className="grid grid-cols-2 gap-2 font-mono text-gray-900 dark:text-white">
+          {recoveryCodes.map((recoveryCode) => (
+            <li key={recoveryCode}>{recoveryCode}</li>
+          ))}
+        </ul>
+        <button type="button" onClick={handleRecoveryCodesSaved} className={buttonClass}>
+          I saved them, log in again
+        </button>
+      </div>
+    );
+  } else {
+    content = (
+      <form className="space-y-4 md:space-y-6" onSubmit={handleLogin}>
+        <div>
+          <label htmlFor="username" className={labelClass}>
+            Your Username
+          </label>
+          <input
+            type="text"
+            id="username"
+            value={username}
+            onChange={(e) => setUsername(e.target.value)}
+            className={inputClass}
+            placeholder="Username"
+            required
+          />
+        </div>
+        <div>
+          <label htmlFor="password" className={labelClass}>
+            Password
+          </label>
+          <input
+            type="password"
+            id="password"
+            value={password}
+            onChange={(e) => setPassword(e.target.value)}
+            className={inputClass}
+            placeholder="••••••••"
+            required
+          />
+        </div>
+
+        <button type="submit" className={buttonClass}>
+          Sign in
+        </button>
+        <p className="text-sm font-light text-gray-500 dark:text-gray-400">
+          Don’t have an account yet?{' '}
+          <a href="/register" className="font-medium text-primary-600 hover:underline dark:text-primary-500">
+            Sign up
+          </a>
+        </p>
+      </form>
+    );
+  }
+
   return  (
     <section className="bg-gray-50 dark:bg-gray-900">
       <div className="flex flex-col items-center justify-center px-6 py-8 mx-auto md:h-screen lg:py-0">
@@ -65,51 +349,9 @@ function Login() {
         <div className="w-full bg-white rounded-lg shadow dark:border md:mt-0 sm:max-w-md xl:p-0 dark:bg-gray-800 dark:border-gray-700">
           <div className="p-6 space-y-4 md:space-y-6 sm:p-8">
             <h1 className="text-xl font-bold leading-tight tracking-tight text-gray-900 md:text-2xl dark:text-white">
-              Log in to your account
+              {title}
             </h1>
-            <form className="space-y-4 md:space-y-6" onSubmit={handleLogin}>
-              <div>
-                <label htmlFor="username" className="block mb-2 text-sm font-medium text-gray-900 dark:text-white">
-                  Your Username
-                </label>
-                <input
-                  type="text"
-                  id="username"
-                  value={username}
-                  onChange={(e) => setUsername(e.target.value)}
-                  className="bg-gray-50 border border-gray-300 text-gray-900 rounded-lg focus:ring-primary-600 focus:border-primary-600 block w-full p-2.5 dark:bg-gray-700 dark:border-gray-600 dark:placeholder-gray-400 dark:text-white dark:focus:ring-blue-500 dark:focus:border-blue-500"
-                  placeholder="Username"
-                  required
-                />
-              </div>
-              <div>
-                <label htmlFor="password" className="block mb-2 text-sm font-medium text-gray-900 dark:text-white">
-                  Password
-                </label>
-                <input
-                  type="password"
-                  id="password"
-                  value={password}
-                  onChange={(e) => setPassword(e.target.value)}
-                  className="bg-gray-50 border border-gray-300 text-gray-900 rounded-lg focus:ring-primary-600 focus:border-primary-600 block w-full p-2.5 dark:bg-gray-700 dark:border-gray-600 dark:placeholder-gray-400 dark:text-white dark:focus:ring-blue-500 dark:focus:border-blue-500"
-                  placeholder="••••••••"
-                  required
-                />
-              </div>
-              
-              <button
-                type="submit"
-                className="w-full text-white bg-primary-600 hover:bg-primary-700 focus:ring-4 focus:outline-none focus:ring-primary-300 font-medium rounded-lg text-sm px-5 py-2.5 text-center dark:bg-primary-600 dark:hover:bg-primary-700 dark:focus:ring-primary-800"
-              >
-                Sign in
-              </button>
-              <p className="text-sm font-light text-gray-500 dark:text-gray-400">
-                Don’t have an account yet?{' '}
-                <a href="/register" className="font-medium text-primary-600 hover:underline dark:text-primary-500">
-                  Sign up
-                </a>
-              </p>
-            </form>
+            {content}
             {message && <p className="text-red-500">{message}</p>}
           </div>
         </div>
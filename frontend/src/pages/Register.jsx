@@ -60,7 +60,7 @@ function Register() {
         />
         <input
           type="text"
-          placeholder="Role (e.g., admin, user)"
+          placeholder="Role (user or driver)"
           value={role}
           onChange={(e) => setRole(e.target.value)}
           className="w-full p-2 border border-gray-300 rounded-lg mb-4 dark:bg-gray-700 dark:border-gray-600 dark:placeholder-gray-400 dark:text-white dark:focus:ring-blue-500 dark:focus:border-blue-500"
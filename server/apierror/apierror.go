@@ -0,0 +1,100 @@
+// Package apierror writes the API's error responses. Every error has the same
+// JSON body, e.g.
+//
+//	{"error": {"code": "booking_not_available", "message": "booking not available or already accepted", "request_id": "..."}}
+//
+// Validation errors add "details", one entry per offending field.
+package apierror
+
+import (
+    "encoding/json"
+    "errors"
+    "net/http"
+    "strings"
+    "unicode"
+    "unicode/utf8"
+
+    "fmc/logging"
+    "fmc/models"
+)
+
+// requestIDHeader is set on the response by the RequestID middleware before
+// any handler runs
+const requestIDHeader = "X-Request-ID"
+
+// Body is the JSON body of an error response
+type Body struct {
+    Error Detail `json:"error"`
+}
+
+type Detail struct {
+    Code      string              `json:"code"`
+    Message   string              `json:"message"`
+    Details   []models.FieldError `json:"details,omitempty"`
+    RequestID string              `json:"request_id,omitempty"`
+}
+
+// statuses maps each kind of domain error to its status code
+var statuses = map[models.ErrorKind]int{
+    models.KindNotFound:     http.StatusNotFound,
+    models.KindConflict:     http.StatusConflict,
+    models.KindValidation:   http.StatusBadRequest,
+    models.KindForbidden:    http.StatusForbidden,
+    models.KindUnauthorized: http.StatusUnauthorized,
+}
+
+// Write responds with err. Domain errors get the status of their kind and
+// their code, message and details. Anything else is logged and reported as
+// an internal error, so database errors and the like never reach clients.
+func Write(w http.ResponseWriter, r *http.Request, err error) {
+    var domainErr *models.Error
+    if errors.As(err, &domainErr) {
+        if status, ok := statuses[domainErr.Kind]; ok {
+            write(w, status, Detail{Code: domainErr.Code, Message: sentence(domainErr.Message), Details: domainErr.Details})
+            return
+        }
+    }
+
+    logging.FromContext(r.Context()).Error("Internal error", "error", err)
+    Respond(w, r, http.StatusInternalServerError, "Internal server error")
+}
+
+// Respond writes an error found by the handler itself, such as a malformed
+// body, with the generic code of status
+func Respond(w http.ResponseWriter, r *http.Request, status int, message string) {
+    RespondCode(w, r, status, Code(status), message)
+}
+
+// RespondCode is Respond with a specific code
+func RespondCode(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+    write(w, status, Detail{Code: code, Message: message})
+}
+
+// Code returns the generic code of status, e.g. "not_found" for 404
+func Code(status int) string {
+    switch status {
+    case http.StatusBadRequest:
+        return "invalid_request"
+    case http.StatusInternalServerError:
+        return "internal_error"
+    }
+    if text := http.StatusText(status); text != "" {
+        return strings.ReplaceAll(strings.ToLower(text), " ", "_")
+    }
+    return "error"
+}
+
+// sentence capitalises an error string, which by Go convention starts in
+// lower case, to match the messages written by handlers
+func sentence(s string) string {
+    r, size := utf8.DecodeRuneInString(s)
+    return string(unicode.ToUpper(r)) + s[size:]
+}
+
+func write(w http.ResponseWriter, status int, detail Detail) {
+    detail.RequestID = w.Header().Get(requestIDHeader)
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("X-Content-Type-Options", "nosniff")
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(Body{Error: detail})
+}
@@ -0,0 +1,110 @@
+package auth
+
+import (
+    "context"
+    "errors"
+    "sync"
+    "time"
+)
+
+// PermissionLoader returns the permissions granted to a role
+type PermissionLoader func(ctx context.Context, role string) ([]string, error)
+
+// SessionEpochLoader returns the current session epoch of a user, or
+// ErrInvalidToken if the user no longer exists
+type SessionEpochLoader func(ctx context.Context, userID int) (int, error)
+
+// Authorizer answers permission checks for roles and tells whether the
+// session of an access token is still current. It caches each role's
+// permission set and each user's session epoch for a short time so checks
+// don't hit the database on every request. Changes made on another
+// instance become visible once the cached entry expires.
+type Authorizer struct {
+    load      PermissionLoader
+    loadEpoch SessionEpochLoader
+    ttl       time.Duration
+
+    mu     sync.Mutex
+    cache  map[string]cachedPermissions
+    epochs map[int]cachedEpoch
+}
+
+type cachedPermissions struct {
+    permissions map[string]struct{}
+    loadedAt    time.Time
+}
+
+type cachedEpoch struct {
+    epoch    int
+    loadedAt time.Time
+}
+
+func NewAuthorizer(load PermissionLoader, loadEpoch SessionEpochLoader, ttl time.Duration) *Authorizer {
+    return &Authorizer{load: load, loadEpoch: loadEpoch, ttl: ttl, cache: map[string]cachedPermissions{}, epochs: map[int]cachedEpoch{}}
+}
+
+// HasPermission reports whether role grants permission
+func (a *Authorizer) HasPermission(ctx context.Context, role, permission string) (bool, error) {
+    a.mu.Lock()
+    entry, ok := a.cache[role]
+    a.mu.Unlock()
+
+    if !ok || time.Since(entry.loadedAt) > a.ttl {
+        loaded, err := a.load(ctx, role)
+        if err != nil {
+            return false, err
+        }
+        entry = cachedPermissions{permissions: make(map[string]struct{}, len(loaded)), loadedAt: time.Now()}
+        for _, p := range loaded {
+            entry.permissions[p] = struct{}{}
+        }
+
+        a.mu.Lock()
+        a.cache[role] = entry
+        a.mu.Unlock()
+    }
+
+    _, granted := entry.permissions[permission]
+    return granted, nil
+}
+
+// SessionCurrent reports whether an access token issued to the user in the
+// given session epoch still belongs to a live session. Revoking the sessions
+// of a user moves them to a newer epoch.
+func (a *Authorizer) SessionCurrent(ctx context.Context, userID, epoch int) (bool, error) {
+    a.mu.Lock()
+    entry, ok := a.epochs[userID]
+    a.mu.Unlock()
+
+    if !ok || time.Since(entry.loadedAt) > a.ttl {
+        loaded, err := a.loadEpoch(ctx, userID)
+        if errors.Is(err, ErrInvalidToken) {
+            return false, nil
+        }
+        if err != nil {
+            return false, err
+        }
+        entry = cachedEpoch{epoch: loaded, loadedAt: time.Now()}
+
+        a.mu.Lock()
+        a.epochs[userID] = entry
+        a.mu.Unlock()
+    }
+
+    // A newer epoch than the cached one means the cache is behind another instance
+    return epoch >= entry.epoch, nil
+}
+
+// InvalidateUser drops the cached session epoch of a user, e.g. after their sessions were revoked
+func (a *Authorizer) InvalidateUser(userID int) {
+    a.mu.Lock()
+    delete(a.epochs, userID)
+    a.mu.Unlock()
+}
+
+// Invalidate drops all cached permission sets, e.g. after a role was edited
+func (a *Authorizer) Invalidate() {
+    a.mu.Lock()
+    a.cache = map[string]cachedPermissions{}
+    a.mu.Unlock()
+}
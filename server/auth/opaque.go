@@ -0,0 +1,48 @@
+package auth
+
+import (
+    "context"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/hex"
+    "fmt"
+    "strings"
+)
+
+// NewOpaqueToken returns a random URL-safe token with 256 bits of entropy.
+// Opaque tokens are handed to the client once and only their hash is stored.
+func NewOpaqueToken() (string, error) {
+    b := make([]byte, 32)
+    if _, err := rand.Read(b); err != nil {
+        return "", fmt.Errorf("generating token: %w", err)
+    }
+    return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// HashToken returns the hex encoded SHA-256 digest used to look up an opaque token
+func HashToken(token string) string {
+    sum := sha256.Sum256([]byte(token))
+    return hex.EncodeToString(sum[:])
+}
+
+// APIKeyPrefix marks Fleetfy API keys so they are recognisable, e.g. by secret scanners
+const APIKeyPrefix = "fk_"
+
+// APIKeyResolver returns the principal an API key acts as
+type APIKeyResolver func(ctx context.Context, key string) (*Principal, error)
+
+// NewAPIKey returns a new API key of the form fk_<prefix>_<secret> together
+// with its prefix, which is safe to store and display
+func NewAPIKey() (key, prefix string, err error) {
+    secret, err := NewOpaqueToken()
+    if err != nil {
+        return "", "", err
+    }
+    id, err := NewOpaqueToken()
+    if err != nil {
+        return "", "", err
+    }
+    prefix = APIKeyPrefix + strings.NewReplacer("-", "", "_", "").Replace(id)[:8]
+    return prefix + "_" + secret, prefix, nil
+}
@@ -0,0 +1,37 @@
+package auth
+
+import (
+    "context"
+)
+
+// Principal is the authenticated caller of a request
+type Principal struct {
+    UserID int    `json:"user_id"`
+    Role   string `json:"role"`
+    // Scope is empty for full sessions, see ScopeMFAEnroll
+    Scope string `json:"scope,omitempty"`
+    // SessionEpoch is the session epoch the access token was issued in
+    SessionEpoch int `json:"-"`
+    // APIKeyID is set when the request authenticated with an API key. Such a
+    // principal only holds the permissions listed in Scopes.
+    APIKeyID int      `json:"api_key_id,omitempty"`
+    Scopes   []string `json:"scopes,omitempty"`
+}
+
+// IsAPIKey reports whether the principal authenticated with an API key rather than a user session
+func (p *Principal) IsAPIKey() bool {
+    return p.APIKeyID != 0
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying the given principal
+func NewContext(ctx context.Context, p *Principal) context.Context {
+    return context.WithValue(ctx, contextKey{}, p)
+}
+
+// FromContext returns the principal stored in ctx, if any
+func FromContext(ctx context.Context) (*Principal, bool) {
+    p, ok := ctx.Value(contextKey{}).(*Principal)
+    return p, ok && p != nil
+}
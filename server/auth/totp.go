@@ -0,0 +1,64 @@
+package auth
+
+import (
+    "crypto/rand"
+    "crypto/subtle"
+    "encoding/base32"
+    "strings"
+    "time"
+
+    "github.com/pquerna/otp"
+    "github.com/pquerna/otp/totp"
+)
+
+const totpPeriod = 30
+
+var totpOpts = totp.ValidateOpts{Period: totpPeriod, Digits: otp.DigitsSix, Algorithm: otp.AlgorithmSHA1}
+
+// GenerateTOTPSecret creates a new RFC 6238 secret for an account and the
+// otpauth:// URI authenticator apps read from a QR code
+func GenerateTOTPSecret(accountName string) (secret, provisioningURI string, err error) {
+    key, err := totp.Generate(totp.GenerateOpts{
+        Issuer:      "Fleetfy",
+        AccountName: accountName,
+        Period:      totpPeriod,
+        Digits:      otp.DigitsSix,
+        Algorithm:   otp.AlgorithmSHA1,
+    })
+    if err != nil {
+        return "", "", err
+    }
+    return key.Secret(), key.URL(), nil
+}
+
+// MatchTOTP checks code against the time steps around now, allowing one step
+// of clock drift either way. It returns the matched time step so callers can
+// refuse to accept the same code twice.
+func MatchTOTP(secret, code string, now time.Time) (int64, bool) {
+    step := now.Unix() / totpPeriod
+    for _, s := range []int64{step - 1, step, step + 1} {
+        expected, err := totp.GenerateCodeCustom(secret, time.Unix(s*totpPeriod, 0), totpOpts)
+        if err != nil {
+            return 0, false
+        }
+        if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+            return s, true
+        }
+    }
+    return 0, false
+}
+
+// NewRecoveryCode returns a random one-time recovery code formatted as xxxxx-xxxxx
+func NewRecoveryCode() (string, error) {
+    b := make([]byte, 10)
+    if _, err := rand.Read(b); err != nil {
+        return "", err
+    }
+    code := strings.ToLower(base32.StdEncoding.EncodeToString(b))[:10]
+    return code[:5] + "-" + code[5:], nil
+}
+
+// NormalizeRecoveryCode makes recovery code comparison ignore case and surrounding spaces
+func NormalizeRecoveryCode(code string) string {
+    return strings.ToLower(strings.TrimSpace(code))
+}
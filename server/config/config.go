@@ -0,0 +1,427 @@
+// Package config loads server settings from the environment, an optional
+// .env file and an optional JSON config file, and validates them at startup.
+package config
+
+import (
+    "encoding/json"
+    "errors"
+    "fmc/logging"
+    "fmt"
+    "log/slog"
+    "net/url"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/joho/godotenv"
+)
+
+// Config holds every setting the server needs. Values are looked up by key,
+// first in the environment (including .env), then in the config file, and
+// fall back to the defaults below.
+type Config struct {
+    Port           string
+    AllowedOrigins []string
+    TrustedProxies string
+    // LogLevel is the minimum level of the JSON logs: debug, info, warn or error
+    LogLevel slog.Level
+    // MetricsToken, when set, must be sent as a bearer token to read /metrics
+    MetricsToken string
+
+    Database Database
+    Auth     Auth
+    Mail     Mail
+    HTTP     HTTP
+    Tracing  Tracing
+    Bookings Bookings
+}
+
+// Database drivers
+const (
+    DriverPostgres = "postgres"
+    DriverSQLite   = "sqlite"
+)
+
+type Database struct {
+    // Driver is postgres, or sqlite for running locally and in CI without a
+    // database server; the DSN of sqlite is a file path or :memory:
+    Driver          string
+    DSN             string
+    AutoMigrate     bool // apply pending migrations when the server starts
+    MaxOpenConns    int
+    MaxIdleConns    int
+    ConnMaxLifetime time.Duration
+    ConnMaxIdleTime time.Duration
+}
+
+type Auth struct {
+    JWTSecret       string
+    AccessTokenTTL  time.Duration
+    RefreshTokenTTL time.Duration
+    // PermissionCacheTTL is how long role permissions are cached per instance
+    PermissionCacheTTL time.Duration
+}
+
+type Mail struct {
+    Mailer           string
+    Dir              string
+    SMTPAddr         string
+    SMTPUsername     string
+    SMTPPassword     string
+    From             string
+    PasswordResetURL string
+    PasswordResetTTL time.Duration
+}
+
+type HTTP struct {
+    ReadHeaderTimeout time.Duration
+    ReadTimeout       time.Duration
+    WriteTimeout      time.Duration
+    IdleTimeout       time.Duration
+    // ShutdownTimeout is how long in-flight requests may take to finish after SIGTERM
+    ShutdownTimeout time.Duration
+}
+
+type Bookings struct {
+    // PendingTTL is how long a booking waits for a driver before it expires;
+    // 0 keeps pending bookings forever
+    PendingTTL time.Duration
+}
+
+// Tracing exporters
+const (
+    TracingNone   = "none"
+    TracingOTLP   = "otlp"
+    TracingStdout = "stdout"
+    TracingFile   = "file"
+)
+
+type Tracing struct {
+    // Exporter is otlp to send spans to a collector, stdout or file to
+    // write them as JSON for local runs, or none
+    Exporter string
+    File     string
+}
+
+// MinJWTSecretLength mirrors the check in auth.NewTokenManager so a short
+// secret is reported together with every other configuration problem
+const MinJWTSecretLength = 32
+
+// Load reads the configuration. envFile is loaded if it exists; configFile is
+// optional but must exist when given. All problems are reported at once.
+func Load(envFile, configFile string) (*Config, error) {
+    if envFile != "" {
+        // Variables already set in the environment win over .env
+        if err := godotenv.Load(envFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+            return nil, fmt.Errorf("reading %s: %w", envFile, err)
+        }
+    }
+
+    file := map[string]string{}
+    if configFile != "" {
+        var err error
+        if file, err = readFile(configFile); err != nil {
+            return nil, err
+        }
+    }
+
+    l := &loader{file: file}
+    cfg := &Config{
+        Port:           l.string("PORT", "8080"),
+        AllowedOrigins: l.list("ALLOWED_ORIGINS", "http://localhost:5173"),
+        TrustedProxies: l.string("TRUSTED_PROXIES", ""),
+        LogLevel:       l.logLevel("LOG_LEVEL", slog.LevelInfo),
+        MetricsToken:   l.string("METRICS_TOKEN", ""),
+        Database: Database{
+            Driver:          l.string("DB_DRIVER", DriverPostgres),
+            DSN:             l.string("DATABASE_URL", ""),
+            AutoMigrate:     l.bool("AUTO_MIGRATE", true),
+            MaxOpenConns:    l.int("DB_MAX_OPEN_CONNS", 25),
+            MaxIdleConns:    l.int("DB_MAX_IDLE_CONNS", 25),
+            ConnMaxLifetime: l.duration("DB_CONN_MAX_LIFETIME", 30*time.Minute),
+            ConnMaxIdleTime: l.duration("DB_CONN_MAX_IDLE_TIME", 5*time.Minute),
+        },
+        Auth: Auth{
+            JWTSecret:          l.string("JWT_SECRET", ""),
+            AccessTokenTTL:     l.duration("ACCESS_TOKEN_TTL", 15*time.Minute),
+            RefreshTokenTTL:    l.duration("REFRESH_TOKEN_TTL", 30*24*time.Hour),
+            PermissionCacheTTL: l.duration("PERMISSION_CACHE_TTL", time.Minute),
+        },
+        Mail: Mail{
+            Mailer:           l.string("MAILER", "log"),
+            Dir:              l.string("MAIL_DIR", ""),
+            SMTPAddr:         l.string("SMTP_ADDR", ""),
+            SMTPUsername:     l.string("SMTP_USERNAME", ""),
+            SMTPPassword:     l.string("SMTP_PASSWORD", ""),
+            From:             l.string("MAIL_FROM", ""),
+            PasswordResetURL: l.string("PASSWORD_RESET_URL", "http://localhost:5173/reset-password"),
+            PasswordResetTTL: l.duration("PASSWORD_RESET_TTL", time.Hour),
+        },
+        HTTP: HTTP{
+            ReadHeaderTimeout: l.duration("HTTP_READ_HEADER_TIMEOUT", 5*time.Second),
+            ReadTimeout:       l.duration("HTTP_READ_TIMEOUT", 15*time.Second),
+            WriteTimeout:      l.duration("HTTP_WRITE_TIMEOUT", 30*time.Second),
+            IdleTimeout:       l.duration("HTTP_IDLE_TIMEOUT", 2*time.Minute),
+            ShutdownTimeout:   l.duration("HTTP_SHUTDOWN_TIMEOUT", 30*time.Second),
+        },
+        Tracing: Tracing{
+            Exporter: l.string("TRACING_EXPORTER", TracingNone),
+            File:     l.string("TRACING_FILE", "traces.json"),
+        },
+        Bookings: Bookings{
+            PendingTTL: l.duration("BOOKING_PENDING_TTL", 24*time.Hour),
+        },
+    }
+
+    // The DSN can also be given in parts, as in the .env used for local development
+    if cfg.Database.DSN == "" {
+        switch cfg.Database.Driver {
+        case DriverPostgres:
+            cfg.Database.DSN = l.postgresDSN()
+        case DriverSQLite:
+            cfg.Database.DSN = "fleetfy.db"
+        }
+    }
+
+    l.errs = append(l.errs, cfg.validate()...)
+    if len(l.errs) > 0 {
+        problems := make([]string, len(l.errs))
+        for i, err := range l.errs {
+            problems[i] = "  " + err.Error()
+        }
+        return nil, fmt.Errorf("invalid configuration:\n%s", strings.Join(problems, "\n"))
+    }
+    return cfg, nil
+}
+
+func (cfg *Config) validate() []error {
+    var errs []error
+    invalid := func(key, format string, args ...interface{}) {
+        errs = append(errs, fmt.Errorf("%s: %s", key, fmt.Sprintf(format, args...)))
+    }
+
+    if port, err := strconv.Atoi(cfg.Port); err != nil || port < 1 || port > 65535 {
+        invalid("PORT", "must be a number between 1 and 65535, got %q", cfg.Port)
+    }
+    if len(cfg.AllowedOrigins) == 0 {
+        invalid("ALLOWED_ORIGINS", "at least one origin is required")
+    }
+    for _, origin := range cfg.AllowedOrigins {
+        if u, err := url.Parse(origin); err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" {
+            invalid("ALLOWED_ORIGINS", "%q is not an origin like https://app.example.com", origin)
+        }
+    }
+
+    if cfg.Database.Driver != DriverPostgres && cfg.Database.Driver != DriverSQLite {
+        invalid("DB_DRIVER", "must be %s or %s, got %q", DriverPostgres, DriverSQLite, cfg.Database.Driver)
+    }
+    if cfg.Database.DSN == "" {
+        invalid("DATABASE_URL", "is required (or set DB_HOST, DB_USER, DB_PASSWORD and DB_NAME)")
+    }
+    if cfg.Database.MaxOpenConns < 0 {
+        invalid("DB_MAX_OPEN_CONNS", "must not be negative")
+    }
+    if cfg.Database.MaxIdleConns < 0 {
+        invalid("DB_MAX_IDLE_CONNS", "must not be negative")
+    }
+    if cfg.Database.MaxOpenConns > 0 && cfg.Database.MaxIdleConns > cfg.Database.MaxOpenConns {
+        invalid("DB_MAX_IDLE_CONNS", "must not exceed DB_MAX_OPEN_CONNS (%d)", cfg.Database.MaxOpenConns)
+    }
+
+    if cfg.Auth.JWTSecret == "" {
+        invalid("JWT_SECRET", "is required")
+    } else if len(cfg.Auth.JWTSecret) < MinJWTSecretLength {
+        invalid("JWT_SECRET", "must be at least %d bytes", MinJWTSecretLength)
+    }
+    positive := []struct {
+        key   string
+        value time.Duration
+    }{
+        {"ACCESS_TOKEN_TTL", cfg.Auth.AccessTokenTTL},
+        {"REFRESH_TOKEN_TTL", cfg.Auth.RefreshTokenTTL},
+        {"PASSWORD_RESET_TTL", cfg.Mail.PasswordResetTTL},
+        {"HTTP_READ_HEADER_TIMEOUT", cfg.HTTP.ReadHeaderTimeout},
+        {"HTTP_READ_TIMEOUT", cfg.HTTP.ReadTimeout},
+        {"HTTP_WRITE_TIMEOUT", cfg.HTTP.WriteTimeout},
+        {"HTTP_IDLE_TIMEOUT", cfg.HTTP.IdleTimeout},
+        {"HTTP_SHUTDOWN_TIMEOUT", cfg.HTTP.ShutdownTimeout},
+    }
+    for _, d := range positive {
+        if d.value <= 0 {
+            invalid(d.key, "must be a positive duration")
+        }
+    }
+    if cfg.Auth.RefreshTokenTTL > 0 && cfg.Auth.RefreshTokenTTL <= cfg.Auth.AccessTokenTTL {
+        invalid("REFRESH_TOKEN_TTL", "must be longer than ACCESS_TOKEN_TTL")
+    }
+    if cfg.Auth.PermissionCacheTTL < 0 {
+        invalid("PERMISSION_CACHE_TTL", "must not be negative")
+    }
+    if cfg.Bookings.PendingTTL < 0 {
+        invalid("BOOKING_PENDING_TTL", "must not be negative")
+    }
+
+    switch cfg.Mail.Mailer {
+    case "log":
+    case "file":
+        if cfg.Mail.Dir == "" {
+            invalid("MAIL_DIR", "is required when MAILER is file")
+        }
+    case "smtp":
+        if cfg.Mail.SMTPAddr == "" {
+            invalid("SMTP_ADDR", "is required when MAILER is smtp")
+        }
+        if cfg.Mail.From == "" {
+            invalid("MAIL_FROM", "is required when MAILER is smtp")
+        }
+    default:
+        invalid("MAILER", "must be log, file or smtp, got %q", cfg.Mail.Mailer)
+    }
+    if u, err := url.Parse(cfg.Mail.PasswordResetURL); err != nil || u.Scheme == "" || u.Host == "" {
+        invalid("PASSWORD_RESET_URL", "must be an absolute URL, got %q", cfg.Mail.PasswordResetURL)
+    }
+
+    switch cfg.Tracing.Exporter {
+    case TracingNone, TracingOTLP, TracingStdout:
+    case TracingFile:
+        if cfg.Tracing.File == "" {
+            invalid("TRACING_FILE", "is required when TRACING_EXPORTER is file")
+        }
+    default:
+        invalid("TRACING_EXPORTER", "must be %s, %s, %s or %s, got %q", TracingNone, TracingOTLP, TracingStdout, TracingFile, cfg.Tracing.Exporter)
+    }
+
+    return errs
+}
+
+// readFile reads a JSON object of settings keyed like the environment
+// variables, e.g. {"PORT": 8080, "ALLOWED_ORIGINS": ["https://fleetfy.app"]}
+func readFile(path string) (map[string]string, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, fmt.Errorf("reading config file: %w", err)
+    }
+
+    var raw map[string]interface{}
+    if err := json.Unmarshal(data, &raw); err != nil {
+        return nil, fmt.Errorf("parsing config file %s: %w", path, err)
+    }
+
+    values := make(map[string]string, len(raw))
+    for key, v := range raw {
+        switch v := v.(type) {
+        case string:
+            values[key] = v
+        case float64, bool:
+            values[key] = fmt.Sprint(v)
+        case []interface{}:
+            items := make([]string, len(v))
+            for i, item := range v {
+                items[i] = fmt.Sprint(item)
+            }
+            values[key] = strings.Join(items, ",")
+        default:
+            return nil, fmt.Errorf("config file %s: %s must be a string, number, boolean or list", path, key)
+        }
+    }
+    return values, nil
+}
+
+type loader struct {
+    file map[string]string
+    errs []error
+}
+
+func (l *loader) lookup(key string) (string, bool) {
+    if v, ok := os.LookupEnv(key); ok {
+        return v, true
+    }
+    v, ok := l.file[key]
+    return v, ok
+}
+
+func (l *loader) string(key, def string) string {
+    if v, ok := l.lookup(key); ok {
+        return v
+    }
+    return def
+}
+
+func (l *loader) list(key, def string) []string {
+    var items []string
+    for _, item := range strings.Split(l.string(key, def), ",") {
+        if item = strings.TrimSpace(item); item != "" {
+            items = append(items, item)
+        }
+    }
+    return items
+}
+
+func (l *loader) int(key string, def int) int {
+    v, ok := l.lookup(key)
+    if !ok || v == "" {
+        return def
+    }
+    n, err := strconv.Atoi(v)
+    if err != nil {
+        l.errs = append(l.errs, fmt.Errorf("%s: must be an integer, got %q", key, v))
+        return def
+    }
+    return n
+}
+
+func (l *loader) bool(key string, def bool) bool {
+    v, ok := l.lookup(key)
+    if !ok || v == "" {
+        return def
+    }
+    b, err := strconv.ParseBool(v)
+    if err != nil {
+        l.errs = append(l.errs, fmt.Errorf("%s: must be true or false, got %q", key, v))
+        return def
+    }
+    return b
+}
+
+// duration accepts Go durations such as "15m" or "720h"
+func (l *loader) duration(key string, def time.Duration) time.Duration {
+    v, ok := l.lookup(key)
+    if !ok || v == "" {
+        return def
+    }
+    d, err := time.ParseDuration(v)
+    if err != nil {
+        l.errs = append(l.errs, fmt.Errorf("%s: must be a duration like 30s or 15m, got %q", key, v))
+        return def
+    }
+    return d
+}
+
+func (l *loader) logLevel(key string, def slog.Level) slog.Level {
+    v, ok := l.lookup(key)
+    if !ok || v == "" {
+        return def
+    }
+    level, err := logging.ParseLevel(v)
+    if err != nil {
+        l.errs = append(l.errs, fmt.Errorf("%s: must be debug, info, warn or error, got %q", key, v))
+        return def
+    }
+    return level
+}
+
+func (l *loader) postgresDSN() string {
+    name := l.string("DB_NAME", "")
+    if name == "" {
+        return ""
+    }
+    dsn := url.URL{
+        Scheme:   "postgres",
+        User:     url.UserPassword(l.string("DB_USER", "postgres"), l.string("DB_PASSWORD", "")),
+        Host:     l.string("DB_HOST", "localhost") + ":" + l.string("DB_PORT", "5432"),
+        Path:     "/" + name,
+        RawQuery: "sslmode=" + l.string("DB_SSLMODE", "disable"),
+    }
+    return dsn.String()
+}
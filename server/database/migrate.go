@@ -0,0 +1,387 @@
+package database
+
+import (
+    "context"
+    "crypto/sha256"
+    "database/sql"
+    "embed"
+    "encoding/hex"
+    "errors"
+    "fmc/config"
+    "fmt"
+    "io/fs"
+    "log/slog"
+    "regexp"
+    "sort"
+    "strconv"
+    "time"
+)
+
+//go:embed migrations
+var migrationFiles embed.FS
+
+// migrationLockID is the Postgres advisory lock held while migrating, so
+// instances starting together behind nginx apply each migration once
+const migrationLockID = 7204539112
+
+// Migration is one versioned schema change, read from a pair of
+// NNNN_name.up.sql and NNNN_name.down.sql files. The files are written for
+// Postgres; a database whose SQL differs overrides them with files of the
+// same name in a subdirectory named after its driver, e.g. migrations/sqlite.
+type Migration struct {
+    Version  int
+    Name     string
+    Up       string
+    Down     string
+    Checksum string
+}
+
+// MigrationStatus describes a migration and whether it has been applied
+type MigrationStatus struct {
+    Version   int
+    Name      string
+    AppliedAt *time.Time
+}
+
+var migrationFilePattern = regexp.MustCompile(`^(\d+)_([a-z0-9_]+)\.(up|down)\.sql$`)
+
+// Migrations returns the embedded migrations for a database driver in version order
+func Migrations(driver string) ([]Migration, error) {
+    migrations, err := loadMigrations(migrationFiles, "migrations")
+    if err != nil || driver == config.DriverPostgres {
+        return migrations, err
+    }
+
+    overrides, err := loadMigrations(migrationFiles, "migrations/"+driver)
+    if err != nil && !errors.Is(err, fs.ErrNotExist) {
+        return nil, err
+    }
+    for _, o := range overrides {
+        i := sort.Search(len(migrations), func(i int) bool { return migrations[i].Version >= o.Version })
+        if i == len(migrations) || migrations[i].Version != o.Version || migrations[i].Name != o.Name {
+            return nil, fmt.Errorf("%s override %04d_%s has no matching migration", driver, o.Version, o.Name)
+        }
+        migrations[i] = o
+    }
+    return migrations, nil
+}
+
+func loadMigrations(fsys fs.FS, dir string) ([]Migration, error) {
+    entries, err := fs.ReadDir(fsys, dir)
+    if err != nil {
+        return nil, err
+    }
+
+    byVersion := map[int]*Migration{}
+    for _, entry := range entries {
+        if entry.IsDir() {
+            continue
+        }
+        match := migrationFilePattern.FindStringSubmatch(entry.Name())
+        if match == nil {
+            return nil, fmt.Errorf("unexpected file in migrations: %s", entry.Name())
+        }
+        version, _ := strconv.Atoi(match[1])
+        content, err := fs.ReadFile(fsys, dir+"/"+entry.Name())
+        if err != nil {
+            return nil, err
+        }
+
+        m, ok := byVersion[version]
+        if !ok {
+            m = &Migration{Version: version, Name: match[2]}
+            byVersion[version] = m
+        }
+        if m.Name != match[2] {
+            return nil, fmt.Errorf("migration %d has files with different names: %s and %s", version, m.Name, match[2])
+        }
+        if match[3] == "up" {
+            m.Up = string(content)
+            sum := sha256.Sum256(content)
+            m.Checksum = hex.EncodeToString(sum[:])
+        } else {
+            m.Down = string(content)
+        }
+    }
+
+    migrations := make([]Migration, 0, len(byVersion))
+    for _, m := range byVersion {
+        if m.Up == "" || m.Down == "" {
+            return nil, fmt.Errorf("migration %04d_%s needs both an up and a down file", m.Version, m.Name)
+        }
+        migrations = append(migrations, *m)
+    }
+    sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+    return migrations, nil
+}
+
+// appliedMigration is a row of the schema_migrations table
+type appliedMigration struct {
+    name      string
+    checksum  string
+    appliedAt time.Time
+}
+
+// Migrate applies every pending migration in order. Each migration runs in
+// its own transaction. It fails without changing anything if an applied
+// migration was edited or the database is newer than this binary.
+func Migrate(db *sql.DB, driver string) error {
+    migrations, err := Migrations(driver)
+    if err != nil {
+        return err
+    }
+    return withMigrationLock(db, driver, func(conn *sql.Conn) error {
+        applied, err := verifyApplied(conn, migrations)
+        if err != nil {
+            return err
+        }
+
+        for _, m := range migrations {
+            if _, ok := applied[m.Version]; ok {
+                continue
+            }
+            slog.Info("Applying migration", "version", m.Version, "name", m.Name)
+            if err := runMigration(conn, m.Up, `INSERT INTO schema_migrations (version, name, checksum, applied_at) VALUES ($1, $2, $3, $4)`,
+                m.Version, m.Name, m.Checksum, time.Now().UTC()); err != nil {
+                return fmt.Errorf("migration %04d_%s: %w", m.Version, m.Name, err)
+            }
+        }
+        return nil
+    })
+}
+
+// MigrateDown reverts the latest steps applied migrations, newest first
+func MigrateDown(db *sql.DB, driver string, steps int) error {
+    migrations, err := Migrations(driver)
+    if err != nil {
+        return err
+    }
+    return withMigrationLock(db, driver, func(conn *sql.Conn) error {
+        applied, err := verifyApplied(conn, migrations)
+        if err != nil {
+            return err
+        }
+
+        for i := len(migrations) - 1; i >= 0 && steps > 0; i-- {
+            m := migrations[i]
+            if _, ok := applied[m.Version]; !ok {
+                continue
+            }
+            slog.Info("Reverting migration", "version", m.Version, "name", m.Name)
+            if err := runMigration(conn, m.Down, `DELETE FROM schema_migrations WHERE version = $1`, m.Version); err != nil {
+                return fmt.Errorf("reverting migration %04d_%s: %w", m.Version, m.Name, err)
+            }
+            steps--
+        }
+        return nil
+    })
+}
+
+// Baseline records every migration up to version as applied without running
+// it, for databases whose schema was created by hand before migrations existed
+func Baseline(db *sql.DB, driver string, version int) error {
+    migrations, err := Migrations(driver)
+    if err != nil {
+        return err
+    }
+    return withMigrationLock(db, driver, func(conn *sql.Conn) error {
+        applied, err := verifyApplied(conn, migrations)
+        if err != nil {
+            return err
+        }
+
+        for _, m := range migrations {
+            if m.Version > version {
+                break
+            }
+            if _, ok := applied[m.Version]; ok {
+                continue
+            }
+            _, err := conn.ExecContext(context.Background(), `INSERT INTO schema_migrations (version, name, checksum, applied_at) VALUES ($1, $2, $3, $4)`,
+                m.Version, m.Name, m.Checksum, time.Now().UTC())
+            if err != nil {
+                return err
+            }
+            slog.Info("Marked migration as applied", "version", m.Version, "name", m.Name)
+        }
+        return nil
+    })
+}
+
+// Status lists every known migration and when it was applied
+func Status(db *sql.DB, driver string) ([]MigrationStatus, error) {
+    migrations, err := Migrations(driver)
+    if err != nil {
+        return nil, err
+    }
+
+    conn, err := db.Conn(context.Background())
+    if err != nil {
+        return nil, err
+    }
+    defer conn.Close()
+
+    if err := createMigrationsTable(conn); err != nil {
+        return nil, err
+    }
+    applied, err := appliedMigrations(conn)
+    if err != nil {
+        return nil, err
+    }
+
+    statuses := make([]MigrationStatus, len(migrations))
+    for i, m := range migrations {
+        statuses[i] = MigrationStatus{Version: m.Version, Name: m.Name}
+        if a, ok := applied[m.Version]; ok {
+            appliedAt := a.appliedAt
+            statuses[i].AppliedAt = &appliedAt
+        }
+    }
+    return statuses, nil
+}
+
+// PendingMigrations returns how many embedded migrations have not been applied yet
+func PendingMigrations(ctx context.Context, db *sql.DB, driver string) (int, error) {
+    migrations, err := Migrations(driver)
+    if err != nil {
+        return 0, err
+    }
+
+    // Rows of migrations this build doesn't ship, e.g. from a newer build
+    // during a rolling deploy, must not hide missing ones
+    rows, err := db.QueryContext(ctx, `SELECT version FROM schema_migrations`)
+    if err != nil {
+        return 0, err
+    }
+    defer rows.Close()
+    applied := map[int]bool{}
+    for rows.Next() {
+        var version int
+        if err := rows.Scan(&version); err != nil {
+            return 0, err
+        }
+        applied[version] = true
+    }
+    if err := rows.Err(); err != nil {
+        return 0, err
+    }
+
+    pending := 0
+    for _, m := range migrations {
+        if !applied[m.Version] {
+            pending++
+        }
+    }
+    return pending, nil
+}
+
+// withMigrationLock runs fn on a single connection. On Postgres it holds an
+// advisory lock meanwhile; SQLite is meant for a single local instance and
+// relies on its own write lock per migration.
+func withMigrationLock(db *sql.DB, driver string, fn func(conn *sql.Conn) error) error {
+    ctx := context.Background()
+
+    // Advisory locks belong to a session, so everything runs on one connection
+    conn, err := db.Conn(ctx)
+    if err != nil {
+        return err
+    }
+    defer conn.Close()
+
+    if driver != config.DriverPostgres {
+        if err := createMigrationsTable(conn); err != nil {
+            return err
+        }
+        return fn(conn)
+    }
+
+    if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationLockID); err != nil {
+        return fmt.Errorf("acquiring migration lock: %w", err)
+    }
+    defer func() {
+        if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, migrationLockID); err != nil {
+            slog.Error("Error releasing migration lock", "error", err)
+        }
+    }()
+
+    if err := createMigrationsTable(conn); err != nil {
+        return err
+    }
+    return fn(conn)
+}
+
+func createMigrationsTable(conn *sql.Conn) error {
+    _, err := conn.ExecContext(context.Background(), `
+        CREATE TABLE IF NOT EXISTS schema_migrations (
+            version     INTEGER PRIMARY KEY,
+            name        TEXT NOT NULL,
+            checksum    TEXT NOT NULL,
+            applied_at  TIMESTAMP NOT NULL
+        )`)
+    return err
+}
+
+func appliedMigrations(conn *sql.Conn) (map[int]appliedMigration, error) {
+    rows, err := conn.QueryContext(context.Background(), `SELECT version, name, checksum, applied_at FROM schema_migrations`)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    applied := map[int]appliedMigration{}
+    for rows.Next() {
+        var version int
+        var a appliedMigration
+        if err := rows.Scan(&version, &a.name, &a.checksum, &a.appliedAt); err != nil {
+            return nil, err
+        }
+        applied[version] = a
+    }
+    return applied, rows.Err()
+}
+
+// verifyApplied checks that every applied migration still exists unchanged
+func verifyApplied(conn *sql.Conn, migrations []Migration) (map[int]appliedMigration, error) {
+    applied, err := appliedMigrations(conn)
+    if err != nil {
+        return nil, err
+    }
+
+    known := make(map[int]Migration, len(migrations))
+    for _, m := range migrations {
+        known[m.Version] = m
+    }
+
+    var problems []error
+    for version, a := range applied {
+        m, ok := known[version]
+        if !ok {
+            problems = append(problems, fmt.Errorf("migration %04d_%s is applied but unknown to this build", version, a.name))
+            continue
+        }
+        if m.Checksum != a.checksum {
+            problems = append(problems, fmt.Errorf("migration %04d_%s was modified after it was applied", version, m.Name))
+        }
+    }
+    if len(problems) > 0 {
+        return nil, errors.Join(problems...)
+    }
+    return applied, nil
+}
+
+func runMigration(conn *sql.Conn, script, record string, args ...interface{}) error {
+    ctx := context.Background()
+    tx, err := conn.BeginTx(ctx, nil)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    if _, err := tx.ExecContext(ctx, script); err != nil {
+        return err
+    }
+    if _, err := tx.ExecContext(ctx, record, args...); err != nil {
+        return err
+    }
+    return tx.Commit()
+}
@@ -0,0 +1,39 @@
+CREATE TABLE roles (
+    name        TEXT PRIMARY KEY,
+    description TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE permissions (
+    name        TEXT PRIMARY KEY,
+    description TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE role_permissions (
+    role        TEXT NOT NULL REFERENCES roles(name) ON DELETE CASCADE,
+    permission  TEXT NOT NULL REFERENCES permissions(name) ON DELETE CASCADE,
+    PRIMARY KEY (role, permission)
+);
+
+INSERT INTO roles (name, description) VALUES
+    ('admin', 'Full access to fleet administration'),
+    ('driver', 'Accepts and delivers bookings'),
+    ('user', 'Books vehicles');
+
+INSERT INTO permissions (name, description) VALUES
+    ('bookings:create', 'Create bookings'),
+    ('bookings:accept', 'View pending bookings and accept them'),
+    ('bookings:read', 'View all bookings'),
+    ('bookings:complete', 'Mark accepted bookings as completed'),
+    ('vehicles:read', 'View the fleet'),
+    ('vehicles:write', 'Add and modify vehicles'),
+    ('analytics:read', 'View fleet and revenue analytics'),
+    ('users:read', 'View user accounts'),
+    ('users:write', 'Create, modify and disable user accounts'),
+    ('roles:manage', 'Define roles and their permissions');
+
+INSERT INTO role_permissions (role, permission)
+    SELECT 'admin', name FROM permissions;
+
+INSERT INTO role_permissions (role, permission) VALUES
+    ('driver', 'bookings:accept'),
+    ('user', 'bookings:create');
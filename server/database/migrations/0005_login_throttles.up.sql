@@ -0,0 +1,6 @@
+CREATE TABLE login_throttles (
+    key              TEXT PRIMARY KEY,
+    failures         INTEGER NOT NULL DEFAULT 0,
+    last_failure_at  TIMESTAMP NOT NULL,
+    locked_until     TIMESTAMP
+);
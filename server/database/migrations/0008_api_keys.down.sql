@@ -0,0 +1,4 @@
+DELETE FROM role_permissions WHERE permission = 'api_keys:manage';
+DELETE FROM permissions WHERE name = 'api_keys:manage';
+DELETE FROM roles WHERE name = 'service';
+DROP TABLE IF EXISTS api_keys;
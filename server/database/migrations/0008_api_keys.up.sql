@@ -0,0 +1,20 @@
+CREATE TABLE api_keys (
+    id            SERIAL PRIMARY KEY,
+    name          TEXT NOT NULL,
+    prefix        TEXT NOT NULL,
+    key_hash      TEXT NOT NULL UNIQUE,
+    user_id       INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    scopes        TEXT NOT NULL DEFAULT '',
+    created_by    INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    created_at    TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expires_at    TIMESTAMP,
+    last_used_at  TIMESTAMP,
+    revoked_at    TIMESTAMP
+);
+
+CREATE INDEX api_keys_user_id_idx ON api_keys (user_id);
+
+INSERT INTO roles (name, description) VALUES ('service', 'Machine-to-machine integrations authenticated with API keys');
+
+INSERT INTO permissions (name, description) VALUES ('api_keys:manage', 'Create and revoke API keys');
+INSERT INTO role_permissions (role, permission) VALUES ('admin', 'api_keys:manage');
@@ -0,0 +1,34 @@
+CREATE TABLE audit_log (
+    id              BIGSERIAL PRIMARY KEY,
+    occurred_at     TIMESTAMP NOT NULL,
+    actor_user_id   INTEGER,
+    actor_role      TEXT,
+    api_key_id      INTEGER,
+    action          TEXT NOT NULL,
+    entity_type     TEXT NOT NULL,
+    entity_id       TEXT,
+    before_state    TEXT,
+    after_state     TEXT,
+    ip              TEXT,
+    request_id      TEXT
+);
+
+CREATE INDEX audit_log_occurred_at_idx ON audit_log (occurred_at);
+CREATE INDEX audit_log_actor_idx ON audit_log (actor_user_id, occurred_at);
+CREATE INDEX audit_log_entity_idx ON audit_log (entity_type, entity_id, occurred_at);
+
+-- The audit log is append-only; actors are kept as plain IDs so entries outlive the accounts
+CREATE FUNCTION audit_log_immutable() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_log is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_log_no_update BEFORE UPDATE OR DELETE ON audit_log
+    FOR EACH ROW EXECUTE FUNCTION audit_log_immutable();
+
+CREATE TRIGGER audit_log_no_truncate BEFORE TRUNCATE ON audit_log
+    FOR EACH STATEMENT EXECUTE FUNCTION audit_log_immutable();
+
+INSERT INTO permissions (name, description) VALUES ('audit:read', 'Query the audit log');
+INSERT INTO role_permissions (role, permission) VALUES ('admin', 'audit:read');
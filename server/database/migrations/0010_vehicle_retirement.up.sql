@@ -0,0 +1,3 @@
+-- Retired vehicles are kept for the bookings that reference them but leave the
+-- active fleet
+ALTER TABLE vehicles ADD COLUMN retired_at TIMESTAMP;
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS vehicle_assignments;
+DROP INDEX IF EXISTS vehicles_driver_id_key;
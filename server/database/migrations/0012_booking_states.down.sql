@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS bookings_status_created_at_idx;
+UPDATE permissions SET description = 'Mark accepted bookings as completed' WHERE name = 'bookings:complete';
+UPDATE permissions SET description = 'View pending bookings and accept them' WHERE name = 'bookings:accept';
+DELETE FROM role_permissions WHERE permission IN ('bookings:cancel', 'bookings:cancel_any');
+DELETE FROM permissions WHERE name IN ('bookings:cancel', 'bookings:cancel_any');
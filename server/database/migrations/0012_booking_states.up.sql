@@ -0,0 +1,14 @@
+-- Bookings go through more statuses than pending, accepted and completed;
+-- customers may cancel their own, admins anyone's, and stale pending bookings
+-- expire
+INSERT INTO permissions (name, description) VALUES
+    ('bookings:cancel', 'Cancel own bookings before pickup'),
+    ('bookings:cancel_any', 'Cancel any booking before pickup');
+INSERT INTO role_permissions (role, permission) VALUES
+    ('admin', 'bookings:cancel'),
+    ('admin', 'bookings:cancel_any'),
+    ('user', 'bookings:cancel');
+UPDATE permissions SET description = 'View pending bookings, accept them and carry them out' WHERE name = 'bookings:accept';
+UPDATE permissions SET description = 'Mark bookings as completed' WHERE name = 'bookings:complete';
+
+CREATE INDEX bookings_status_created_at_idx ON bookings (status, created_at);
@@ -0,0 +1,38 @@
+-- Baseline schema the application was originally written against. Databases
+-- created before migrations existed already have these tables; record them with
+-- `migrate baseline` instead of running this file.
+CREATE TABLE users (
+    id          INTEGER PRIMARY KEY AUTOINCREMENT,
+    username    TEXT NOT NULL UNIQUE,
+    password    TEXT NOT NULL,
+    role        TEXT NOT NULL
+);
+
+CREATE TABLE drivers (
+    id          INTEGER PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    name        TEXT NOT NULL
+);
+
+CREATE TABLE vehicles (
+    id            INTEGER PRIMARY KEY AUTOINCREMENT,
+    type          TEXT NOT NULL,
+    availability  BOOLEAN NOT NULL DEFAULT TRUE,
+    driver_id     INTEGER REFERENCES users(id) ON DELETE SET NULL
+);
+
+CREATE TABLE bookings (
+    id                INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id           INTEGER NOT NULL REFERENCES users(id),
+    driver_id         INTEGER REFERENCES users(id),
+    vehicle_id        INTEGER REFERENCES vehicles(id),
+    pickup_location   TEXT NOT NULL,
+    dropoff_location  TEXT NOT NULL,
+    vehicle_type      TEXT NOT NULL,
+    estimated_cost    DOUBLE PRECISION NOT NULL DEFAULT 0,
+    status            TEXT NOT NULL DEFAULT 'pending',
+    created_at        TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX bookings_status_idx ON bookings (status);
+CREATE INDEX bookings_driver_id_idx ON bookings (driver_id);
+CREATE INDEX bookings_created_at_idx ON bookings (created_at);
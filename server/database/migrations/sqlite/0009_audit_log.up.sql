@@ -0,0 +1,32 @@
+CREATE TABLE audit_log (
+    id              INTEGER PRIMARY KEY AUTOINCREMENT,
+    occurred_at     TIMESTAMP NOT NULL,
+    actor_user_id   INTEGER,
+    actor_role      TEXT,
+    api_key_id      INTEGER,
+    action          TEXT NOT NULL,
+    entity_type     TEXT NOT NULL,
+    entity_id       TEXT,
+    before_state    TEXT,
+    after_state     TEXT,
+    ip              TEXT,
+    request_id      TEXT
+);
+
+CREATE INDEX audit_log_occurred_at_idx ON audit_log (occurred_at);
+CREATE INDEX audit_log_actor_idx ON audit_log (actor_user_id, occurred_at);
+CREATE INDEX audit_log_entity_idx ON audit_log (entity_type, entity_id, occurred_at);
+
+-- The audit log is append-only; actors are kept as plain IDs so entries outlive the accounts
+CREATE TRIGGER audit_log_no_update BEFORE UPDATE ON audit_log
+BEGIN
+    SELECT RAISE(ABORT, 'audit_log is append-only');
+END;
+
+CREATE TRIGGER audit_log_no_delete BEFORE DELETE ON audit_log
+BEGIN
+    SELECT RAISE(ABORT, 'audit_log is append-only');
+END;
+
+INSERT INTO permissions (name, description) VALUES ('audit:read', 'Query the audit log');
+INSERT INTO role_permissions (role, permission) VALUES ('admin', 'audit:read');
@@ -0,0 +1,14 @@
+-- A driver holds at most one vehicle at a time. vehicles.driver_id is the
+-- current holder; vehicle_assignments keeps who drove what when.
+CREATE UNIQUE INDEX vehicles_driver_id_key ON vehicles (driver_id);
+
+CREATE TABLE vehicle_assignments (
+    id             INTEGER PRIMARY KEY AUTOINCREMENT,
+    vehicle_id     INTEGER NOT NULL REFERENCES vehicles(id),
+    driver_id      INTEGER NOT NULL REFERENCES users(id),
+    assigned_at    TIMESTAMP NOT NULL,
+    unassigned_at  TIMESTAMP
+);
+
+CREATE INDEX vehicle_assignments_vehicle_idx ON vehicle_assignments (vehicle_id, assigned_at);
+CREATE INDEX vehicle_assignments_driver_idx ON vehicle_assignments (driver_id, assigned_at);
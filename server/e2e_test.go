@@ -0,0 +1,1882 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "database/sql"
+    "encoding/json"
+    "fmt"
+    "io"
+    "log/slog"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "path/filepath"
+    "regexp"
+    "strconv"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+
+    "fmc/apierror"
+    "fmc/auth"
+    "fmc/config"
+    "fmc/database"
+    "fmc/handler"
+    "fmc/logging"
+    "fmc/models"
+
+    "github.com/gorilla/mux"
+    "github.com/pquerna/otp/totp"
+    "go.opentelemetry.io/otel"
+    sdktrace "go.opentelemetry.io/otel/sdk/trace"
+    "go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+const testPassword = "Correct-horse-42"
+
+// testAPI is the complete API served from a fresh SQLite database of its own
+type testAPI struct {
+    t      *testing.T
+    db     *sql.DB
+    server *httptest.Server
+    logs   *syncBuffer
+}
+
+// syncBuffer collects the server's log lines while handlers write to it concurrently
+type syncBuffer struct {
+    mu  sync.Mutex
+    buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return b.buf.String()
+}
+
+func newTestAPI(t *testing.T) *testAPI {
+    t.Helper()
+    cfg := &config.Config{
+        Port:           "8080",
+        AllowedOrigins: []string{"http://localhost:5173"},
+        // Tests pick the client address with X-Forwarded-For, see loginAttempt
+        TrustedProxies: "127.0.0.1",
+        Database: config.Database{
+            Driver:       config.DriverSQLite,
+            DSN:          filepath.Join(t.TempDir(), "fleetfy.db"),
+            MaxOpenConns: 4,
+            MaxIdleConns: 4,
+        },
+        Auth: config.Auth{
+            JWTSecret:          strings.Repeat("s", config.MinJWTSecretLength),
+            AccessTokenTTL:     15 * time.Minute,
+            RefreshTokenTTL:    time.Hour,
+            PermissionCacheTTL: time.Minute,
+        },
+        Mail: config.Mail{
+            Mailer:           "log",
+            PasswordResetURL: "http://localhost:5173/reset-password",
+            PasswordResetTTL: time.Hour,
+        },
+    }
+
+    db, err := database.Open(cfg.Database)
+    if err != nil {
+        t.Fatalf("opening database: %v", err)
+    }
+    t.Cleanup(func() { db.Close() })
+    if err := database.Migrate(db, cfg.Database.Driver); err != nil {
+        t.Fatalf("migrating database: %v", err)
+    }
+
+    logs := &syncBuffer{}
+    router, err := NewRouter(cfg, db, logging.New(logs, slog.LevelDebug))
+    if err != nil {
+        t.Fatalf("building router: %v", err)
+    }
+    server := httptest.NewServer(router)
+    t.Cleanup(server.Close)
+
+    return &testAPI{t: t, db: db, server: server, logs: logs}
+}
+
+// call sends a JSON request and fails the test unless the response has the
+// wanted status. The response body is decoded into out when it isn't nil.
+func (api *testAPI) call(method, path, token string, body interface{}, wantStatus int, out interface{}) {
+    api.t.Helper()
+    status, respBody := api.send(method, path, token, body)
+    if status != wantStatus {
+        api.t.Fatalf("%s %s: got status %d, want %d: %s", method, path, status, wantStatus, respBody)
+    }
+    if out != nil {
+        if err := json.Unmarshal(respBody, out); err != nil {
+            api.t.Fatalf("%s %s: decoding %q: %v", method, path, respBody, err)
+        }
+    }
+}
+
+func (api *testAPI) send(method, path, token string, body interface{}) (int, []byte) {
+    api.t.Helper()
+    var reader io.Reader
+    if body != nil {
+        payload, err := json.Marshal(body)
+        if err != nil {
+            api.t.Fatal(err)
+        }
+        reader = bytes.NewReader(payload)
+    }
+
+    req, err := http.NewRequest(method, api.server.URL+path, reader)
+    if err != nil {
+        api.t.Fatal(err)
+    }
+    req.Header.Set("Content-Type", "application/json")
+    if token != "" {
+        req.Header.Set("Authorization", "Bearer "+token)
+    }
+
+    resp, err := api.server.Client().Do(req)
+    if err != nil {
+        api.t.Fatalf("%s %s: %v", method, path, err)
+    }
+    defer resp.Body.Close()
+    respBody, err := io.ReadAll(resp.Body)
+    if err != nil {
+        api.t.Fatal(err)
+    }
+    return resp.StatusCode, respBody
+}
+
+// testSession is what /login, /login/mfa and /refresh return
+type testSession struct {
+    AccessToken  string `json:"access_token"`
+    RefreshToken string `json:"refresh_token"`
+    UserID       int    `json:"userID"`
+}
+
+// session logs in with the test password and returns the whole session
+func (api *testAPI) session(username string) testSession {
+    api.t.Helper()
+    var session testSession
+    api.call("POST", "/login", "", map[string]string{"username": username, "password": testPassword}, http.StatusOK, &session)
+    return session
+}
+
+// refresh rotates a refresh token and fails the test unless the response has the wanted status
+func (api *testAPI) refresh(refreshToken string, wantStatus int) testSession {
+    api.t.Helper()
+    var session testSession
+    var out interface{}
+    if wantStatus == http.StatusOK {
+        out = &session
+    }
+    api.call("POST", "/refresh", "", map[string]string{"refresh_token": refreshToken}, wantStatus, out)
+    return session
+}
+
+// login starts a session and returns its access token and the user's ID
+func (api *testAPI) login(username string) (string, int) {
+    api.t.Helper()
+    var session struct {
+        AccessToken string `json:"access_token"`
+        UserID      int    `json:"userID"`
+    }
+    api.call("POST", "/login", "", map[string]string{"username": username, "password": testPassword}, http.StatusOK, &session)
+    return session.AccessToken, session.UserID
+}
+
+// admin returns a session of a new admin. Admins can't sign up, so the account
+// is created directly in the database as an operator would.
+func (api *testAPI) admin() string {
+    api.t.Helper()
+    if _, err := models.RegisterUser(context.Background(), api.db, "admin", "", testPassword, models.RoleAdmin, models.UserStatusActive, models.AuditActor{}); err != nil {
+        api.t.Fatalf("creating admin: %v", err)
+    }
+    token, _ := api.login("admin")
+    return token
+}
+
+// customer signs up a user and returns their session
+func (api *testAPI) customer(username string) string {
+    api.t.Helper()
+    api.call("POST", "/register", "", map[string]string{"username": username, "password": testPassword}, http.StatusCreated, nil)
+    token, _ := api.login(username)
+    return token
+}
+
+// driver signs up a driver, has the admin approve them and returns their session
+func (api *testAPI) driver(adminToken, username string) (string, int) {
+    api.t.Helper()
+    var registered struct {
+        Status string `json:"status"`
+    }
+    api.call("POST", "/register", "", map[string]string{"username": username, "password": testPassword, "role": models.RoleDriver}, http.StatusCreated, &registered)
+    if registered.Status != models.UserStatusPending {
+        api.t.Fatalf("new driver has status %q, want %q", registered.Status, models.UserStatusPending)
+    }
+    if status, _ := api.send("POST", "/login", "", map[string]string{"username": username, "password": testPassword}); status != http.StatusForbidden {
+        api.t.Fatalf("pending driver logged in with status %d, want %d", status, http.StatusForbidden)
+    }
+
+    var users struct {
+        Items []models.User `json:"items"`
+    }
+    api.call("GET", "/admin/users?username="+username, adminToken, nil, http.StatusOK, &users)
+    for _, u := range users.Items {
+        if u.Username == username {
+            api.call("PUT", fmt.Sprintf("/admin/users/%d/status", u.ID), adminToken, map[string]string{"status": models.UserStatusActive}, http.StatusOK, nil)
+            vehicleID := api.vehicle(adminToken, models.VehicleMedium)
+            api.call("PUT", fmt.Sprintf("/admin/vehicles/%d/driver", vehicleID), adminToken, map[string]int{"driver_id": u.ID}, http.StatusOK, nil)
+            return api.login(username)
+        }
+    }
+    api.t.Fatalf("driver %s missing from /admin/users", username)
+    return "", 0
+}
+
+// vehicle adds an available vehicle of the given type to the fleet
+func (api *testAPI) vehicle(adminToken, vehicleType string) int {
+    api.t.Helper()
+    var created struct {
+        VehicleID int `json:"vehicle_id"`
+    }
+    api.call("POST", "/admin/vehicles", adminToken, map[string]interface{}{"type": vehicleType, "availability": true}, http.StatusOK, &created)
+    return created.VehicleID
+}
+
+func (api *testAPI) createBooking(token string) int {
+    api.t.Helper()
+    var created struct {
+        BookingID int `json:"booking_id"`
+    }
+    api.call("POST", "/user/bookings", token, map[string]interface{}{
+        "pickup_location":  "Warehouse 4, Dock Road",
+        "dropoff_location": "12 High Street",
+        "vehicle_type":     models.VehicleMedium,
+        "estimated_cost":   42.5,
+    }, http.StatusOK, &created)
+    if created.BookingID == 0 {
+        api.t.Fatal("booking created without an ID")
+    }
+    return created.BookingID
+}
+
+func (api *testAPI) booking(adminToken string, bookingID int) models.Booking {
+    api.t.Helper()
+    var bookings struct {
+        Items []models.Booking `json:"items"`
+    }
+    api.call("GET", fmt.Sprintf("/admin/bookings?id=%d", bookingID), adminToken, nil, http.StatusOK, &bookings)
+    for _, b := range bookings.Items {
+        if b.ID == bookingID {
+            return b
+        }
+    }
+    api.t.Fatalf("booking %d missing from /admin/bookings", bookingID)
+    return models.Booking{}
+}
+
+// TestRegisterRoles checks that public sign-up only creates customers and
+// drivers, and that drivers can't act until an admin approves them
+func TestRegisterRoles(t *testing.T) {
+    api := newTestAPI(t)
+    adminToken := api.admin()
+
+    var errBody apierror.Body
+    for _, role := range []string{models.RoleAdmin, models.RoleService, "dispatcher"} {
+        api.call("POST", "/register", "", map[string]string{"username": "mallory", "password": testPassword, "role": role}, http.StatusBadRequest, &errBody)
+        if errBody.Error.Code != "validation_failed" || len(errBody.Error.Details) != 1 || errBody.Error.Details[0].Field != "role" {
+            t.Fatalf("signing up as %s: got %+v, want a validation error on role", role, errBody.Error)
+        }
+    }
+    api.call("POST", "/login", "", map[string]string{"username": "mallory", "password": testPassword}, http.StatusUnauthorized, nil)
+
+    var registered struct {
+        Status string `json:"status"`
+    }
+    api.call("POST", "/register", "", map[string]string{"username": "dan", "password": testPassword, "role": models.RoleDriver}, http.StatusCreated, &registered)
+    if registered.Status != models.UserStatusPending {
+        t.Fatalf("new driver has status %q, want %q", registered.Status, models.UserStatusPending)
+    }
+    api.call("POST", "/login", "", map[string]string{"username": "dan", "password": testPassword}, http.StatusForbidden, &errBody)
+    if errBody.Error.Code != "account_not_active" {
+        t.Fatalf("pending driver logging in: got code %q, want account_not_active", errBody.Error.Code)
+    }
+
+    var pending struct {
+        Items []models.User `json:"items"`
+    }
+    api.call("GET", "/admin/users?status="+models.UserStatusPending, adminToken, nil, http.StatusOK, &pending)
+    if len(pending.Items) != 1 || pending.Items[0].Username != "dan" || pending.Items[0].Role != models.RoleDriver {
+        t.Fatalf("pending accounts are %+v, want dan", pending.Items)
+    }
+    api.call("PUT", fmt.Sprintf("/admin/users/%d/status", pending.Items[0].ID), adminToken, map[string]string{"status": models.UserStatusActive}, http.StatusOK, nil)
+    driverToken, _ := api.login("dan")
+    api.call("GET", "/driver/bookings/pending", driverToken, nil, http.StatusOK, nil)
+}
+
+func TestBookingLifecycle(t *testing.T) {
+    api := newTestAPI(t)
+    adminToken := api.admin()
+    customerToken := api.customer("alice")
+    driverToken, driverID := api.driver(adminToken, "bob")
+
+    bookingID := api.createBooking(customerToken)
+    if b := api.booking(adminToken, bookingID); b.Status != "pending" || b.DriverID != nil {
+        t.Fatalf("new booking is %q with driver %v, want pending without driver", b.Status, b.DriverID)
+    }
+
+    var pending []models.Booking
+    api.call("GET", "/driver/bookings/pending", driverToken, nil, http.StatusOK, &pending)
+    if len(pending) != 1 || pending[0].ID != bookingID {
+        t.Fatalf("driver sees pending bookings %+v, want only %d", pending, bookingID)
+    }
+
+    api.call("PUT", fmt.Sprintf("/driver/bookings/%d/accept", bookingID), driverToken, nil, http.StatusOK, nil)
+    b := api.booking(adminToken, bookingID)
+    if b.Status != "accepted" || b.DriverID == nil || *b.DriverID != driverID {
+        t.Fatalf("accepted booking is %q with driver %v, want accepted by %d", b.Status, b.DriverID, driverID)
+    }
+    api.call("GET", "/driver/bookings/pending", driverToken, nil, http.StatusOK, &pending)
+    if len(pending) != 0 {
+        t.Fatalf("accepted booking still pending: %+v", pending)
+    }
+
+    api.call("PUT", fmt.Sprintf("/admin/bookings/%d/complete", bookingID), adminToken, nil, http.StatusOK, nil)
+    if b := api.booking(adminToken, bookingID); b.Status != "completed" {
+        t.Fatalf("completed booking is %q", b.Status)
+    }
+
+    var revenue []models.RevenueData
+    api.call("GET", "/admin/analytics/revenue-over-time", adminToken, nil, http.StatusOK, &revenue)
+    if len(revenue) != 1 || revenue[0].Revenue != 42.5 {
+        t.Fatalf("revenue over time is %+v, want one day of 42.5", revenue)
+    }
+
+    var entries []models.AuditEntry
+    api.call("GET", fmt.Sprintf("/admin/audit?entity_type=booking&entity_id=%d", bookingID), adminToken, nil, http.StatusOK, &entries)
+    var actions []string
+    for _, e := range entries {
+        actions = append(actions, e.Action)
+    }
+    if got := strings.Join(actions, ","); got != "booking.complete,booking.accept,booking.create" {
+        t.Fatalf("audit log of the booking has %s", got)
+    }
+}
+
+func TestAcceptBookingTwice(t *testing.T) {
+    api := newTestAPI(t)
+    adminToken := api.admin()
+    customerToken := api.customer("alice")
+    firstToken, firstID := api.driver(adminToken, "bob")
+    secondToken, _ := api.driver(adminToken, "carol")
+
+    bookingID := api.createBooking(customerToken)
+    accept := fmt.Sprintf("/driver/bookings/%d/accept", bookingID)
+    api.call("PUT", accept, firstToken, nil, http.StatusOK, nil)
+    api.call("PUT", accept, firstToken, nil, http.StatusConflict, nil)
+    var body apierror.Body
+    api.call("PUT", accept, secondToken, nil, http.StatusConflict, &body)
+    if body.Error.Code != "booking_not_available" || body.Error.RequestID == "" {
+        t.Fatalf("error body is %+v", body)
+    }
+
+    if b := api.booking(adminToken, bookingID); b.DriverID == nil || *b.DriverID != firstID {
+        t.Fatalf("booking went to driver %v, want %d", b.DriverID, firstID)
+    }
+    api.call("PUT", "/driver/bookings/999/accept", firstToken, nil, http.StatusNotFound, nil)
+}
+
+func TestAcceptBookingConcurrently(t *testing.T) {
+    api := newTestAPI(t)
+    adminToken := api.admin()
+    customerToken := api.customer("alice")
+    var drivers []string
+    for i := 0; i < 5; i++ {
+        token, _ := api.driver(adminToken, fmt.Sprintf("driver%d", i))
+        drivers = append(drivers, token)
+    }
+
+    bookingID := api.createBooking(customerToken)
+    statuses := make(chan int, len(drivers))
+    var wg sync.WaitGroup
+    for _, token := range drivers {
+        wg.Add(1)
+        go func(token string) {
+            defer wg.Done()
+            status, _ := api.send("PUT", fmt.Sprintf("/driver/bookings/%d/accept", bookingID), token, nil)
+            statuses <- status
+        }(token)
+    }
+    wg.Wait()
+    close(statuses)
+
+    accepted := 0
+    for status := range statuses {
+        switch status {
+        case http.StatusOK:
+            accepted++
+        case http.StatusConflict:
+        default:
+            t.Errorf("concurrent accept returned %d", status)
+        }
+    }
+    if accepted != 1 {
+        t.Fatalf("%d drivers accepted the same booking, want 1", accepted)
+    }
+}
+
+func TestCompleteBookingNotAccepted(t *testing.T) {
+    api := newTestAPI(t)
+    adminToken := api.admin()
+    customerToken := api.customer("alice")
+    driverToken, _ := api.driver(adminToken, "bob")
+
+    bookingID := api.createBooking(customerToken)
+    complete := fmt.Sprintf("/admin/bookings/%d/complete", bookingID)
+    api.call("PUT", complete, adminToken, nil, http.StatusConflict, nil)
+    if b := api.booking(adminToken, bookingID); b.Status != "pending" {
+        t.Fatalf("completing a pending booking left it %q", b.Status)
+    }
+
+    api.call("PUT", fmt.Sprintf("/driver/bookings/%d/accept", bookingID), driverToken, nil, http.StatusOK, nil)
+    api.call("PUT", complete, adminToken, nil, http.StatusOK, nil)
+    api.call("PUT", complete, adminToken, nil, http.StatusConflict, nil)
+    api.call("PUT", "/admin/bookings/999/complete", adminToken, nil, http.StatusNotFound, nil)
+}
+
+func TestBookingRoutesNeedPermission(t *testing.T) {
+    api := newTestAPI(t)
+    adminToken := api.admin()
+    customerToken := api.customer("alice")
+    driverToken, _ := api.driver(adminToken, "bob")
+
+    bookingID := api.createBooking(customerToken)
+    api.call("PUT", fmt.Sprintf("/driver/bookings/%d/accept", bookingID), customerToken, nil, http.StatusForbidden, nil)
+    api.call("PUT", fmt.Sprintf("/admin/bookings/%d/complete", bookingID), driverToken, nil, http.StatusForbidden, nil)
+    api.call("PUT", fmt.Sprintf("/driver/bookings/%d/status", bookingID), customerToken, map[string]string{"status": models.BookingPickedUp}, http.StatusForbidden, nil)
+    api.call("PUT", fmt.Sprintf("/user/bookings/%d/cancel", bookingID), driverToken, nil, http.StatusForbidden, nil)
+
+    // A customer can't use the admin route to cancel another customer's booking
+    otherToken := api.customer("dave")
+    api.call("PUT", fmt.Sprintf("/admin/bookings/%d/cancel", bookingID), otherToken, nil, http.StatusForbidden, nil)
+    api.call("PUT", fmt.Sprintf("/admin/bookings/%d/cancel", bookingID), customerToken, nil, http.StatusForbidden, nil)
+    if b := api.booking(adminToken, bookingID); b.Status != models.BookingPending {
+        t.Fatalf("booking is %q after cancel attempts on the admin route", b.Status)
+    }
+    api.call("POST", "/user/bookings", "", map[string]string{}, http.StatusUnauthorized, nil)
+}
+
+func TestHealthEndpoints(t *testing.T) {
+    api := newTestAPI(t)
+    api.call("GET", "/healthz", "", nil, http.StatusOK, nil)
+
+    var readiness struct {
+        Status string            `json:"status"`
+        Checks map[string]string `json:"checks"`
+    }
+    api.call("GET", "/readyz", "", nil, http.StatusOK, &readiness)
+    if readiness.Status != "ok" {
+        t.Fatalf("readiness is %+v", readiness)
+    }
+
+    if err := database.MigrateDown(api.db, config.DriverSQLite, 1); err != nil {
+        t.Fatal(err)
+    }
+    api.call("GET", "/readyz", "", nil, http.StatusServiceUnavailable, &readiness)
+    if readiness.Checks["migrations"] != "1 pending" {
+        t.Fatalf("readiness with a pending migration is %+v", readiness)
+    }
+
+    // A migration of a newer build doesn't make up for one of ours that is missing
+    if _, err := api.db.Exec(`INSERT INTO schema_migrations (version, name, checksum, applied_at) VALUES (9999, 'from_a_newer_build', 'x', $1)`, time.Now().UTC()); err != nil {
+        t.Fatal(err)
+    }
+    api.call("GET", "/readyz", "", nil, http.StatusServiceUnavailable, &readiness)
+    if readiness.Checks["migrations"] != "1 pending" {
+        t.Fatalf("readiness with a pending migration and an unknown one is %+v", readiness)
+    }
+
+    api.db.Close()
+    api.call("GET", "/readyz", "", nil, http.StatusServiceUnavailable, &readiness)
+    if readiness.Checks["database"] != "unreachable" {
+        t.Fatalf("readiness without a database is %+v", readiness)
+    }
+    api.call("GET", "/healthz", "", nil, http.StatusOK, nil)
+}
+
+func TestRequestLogging(t *testing.T) {
+    api := newTestAPI(t)
+    token := api.customer("alice")
+
+    req, err := http.NewRequest("GET", api.server.URL+"/driver/bookings/pending", nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    req.Header.Set("Authorization", "Bearer "+token)
+    req.Header.Set("X-Request-ID", "trace-42")
+    resp, err := api.server.Client().Do(req)
+    if err != nil {
+        t.Fatal(err)
+    }
+    resp.Body.Close()
+    if got := resp.Header.Get("X-Request-ID"); got != "trace-42" {
+        t.Fatalf("X-Request-ID: got %q, want trace-42", got)
+    }
+
+    // The request line is written after the response, so wait for the handler to return
+    api.server.Close()
+
+    var line map[string]interface{}
+    for _, raw := range strings.Split(strings.TrimSpace(api.logs.String()), "\n") {
+        var entry map[string]interface{}
+        if err := json.Unmarshal([]byte(raw), &entry); err != nil {
+            t.Fatalf("log line %q is not JSON: %v", raw, err)
+        }
+        if entry["msg"] == "request" && entry["request_id"] == "trace-42" {
+            line = entry
+        }
+    }
+    if line == nil {
+        t.Fatalf("no request line for trace-42 in:\n%s", api.logs.String())
+    }
+    if line["status"] != float64(http.StatusForbidden) || line["path"] != "/driver/bookings/pending" || line["method"] != "GET" {
+        t.Errorf("request line: got %v", line)
+    }
+    if line["role"] != models.RoleUser || line["user_id"] == nil {
+        t.Errorf("request line lacks the principal: %v", line)
+    }
+}
+
+// TestServerErrorsAreLogged checks that handlers answering with a generic 500
+// log the cause, since the response doesn't carry it
+func TestServerErrorsAreLogged(t *testing.T) {
+    api := newTestAPI(t)
+    adminToken := api.admin()
+    customer := api.customer("carol")
+    if _, err := api.db.Exec(`DROP TABLE bookings`); err != nil {
+        t.Fatal(err)
+    }
+
+    api.call("POST", "/user/bookings", customer, map[string]interface{}{
+        "pickup_location":  "Warehouse 4, Dock Road",
+        "dropoff_location": "12 High Street",
+        "vehicle_type":     models.VehicleMedium,
+        "estimated_cost":   42.5,
+    }, http.StatusInternalServerError, nil)
+    api.call("GET", "/admin/analytics/bookings-over-time", adminToken, nil, http.StatusInternalServerError, nil)
+    api.call("GET", "/admin/analytics/driver-performance", adminToken, nil, http.StatusInternalServerError, nil)
+    api.server.Close()
+
+    logged := map[string]bool{}
+    for _, raw := range strings.Split(strings.TrimSpace(api.logs.String()), "\n") {
+        var entry map[string]interface{}
+        if err := json.Unmarshal([]byte(raw), &entry); err != nil {
+            t.Fatalf("log line %q is not JSON: %v", raw, err)
+        }
+        if entry["level"] == "ERROR" && entry["error"] != nil && entry["request_id"] != nil {
+            logged[entry["msg"].(string)] = true
+        }
+    }
+    for _, msg := range []string{"Error creating booking", "Error fetching bookings over time", "Error fetching driver performance"} {
+        if !logged[msg] {
+            t.Errorf("no %q error with its cause in:\n%s", msg, api.logs.String())
+        }
+    }
+}
+
+func TestMetrics(t *testing.T) {
+    api := newTestAPI(t)
+    adminToken := api.admin()
+    driverToken, _ := api.driver(adminToken, "dave")
+    customerToken := api.customer("alice")
+    api.createBooking(customerToken)
+    bookingID := api.createBooking(customerToken)
+    api.call("PUT", fmt.Sprintf("/driver/bookings/%d/accept", bookingID), driverToken, nil, http.StatusOK, nil)
+
+    status, body := api.send("GET", "/metrics", "", nil)
+    if status != http.StatusOK {
+        t.Fatalf("GET /metrics: got status %d: %s", status, body)
+    }
+    for _, want := range []string{
+        // Latency is tracked per route template, not per booking ID
+        `fleetfy_http_request_duration_seconds_count{method="PUT",route="/driver/bookings/{id}/accept",status="200"}`,
+        `fleetfy_http_request_duration_seconds_count{method="POST",route="/user/bookings",status="200"}`,
+        `fleetfy_bookings_accepted_total`,
+        `fleetfy_pending_bookings 1`,
+        `fleetfy_bookings{status="accepted"} 1`,
+        `go_sql_max_open_connections{db_name="fleetfy"} 4`,
+    } {
+        if !strings.Contains(string(body), want) {
+            t.Errorf("metrics lack %s", want)
+        }
+    }
+}
+
+func TestTracing(t *testing.T) {
+    spans := tracetest.NewInMemoryExporter()
+    previous := otel.GetTracerProvider()
+    otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(spans)))
+    t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+    api := newTestAPI(t)
+    adminToken := api.admin()
+    driverToken, _ := api.driver(adminToken, "dave")
+    bookingID := api.createBooking(api.customer("alice"))
+
+    // The accept request continues the trace started by the caller
+    const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+    req, err := http.NewRequest("PUT", fmt.Sprintf("%s/driver/bookings/%d/accept", api.server.URL, bookingID), nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    req.Header.Set("Authorization", "Bearer "+driverToken)
+    req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+    resp, err := api.server.Client().Do(req)
+    if err != nil {
+        t.Fatal(err)
+    }
+    resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        t.Fatalf("accepting booking: got status %d", resp.StatusCode)
+    }
+    api.server.Close()
+
+    var request sdktrace.ReadOnlySpan
+    queries := 0
+    for _, span := range spans.GetSpans().Snapshots() {
+        if span.SpanContext().TraceID().String() != traceID {
+            continue
+        }
+        if span.Name() == "PUT /driver/bookings/{id}/accept" {
+            request = span
+        }
+        if strings.HasPrefix(span.Name(), "sql.") {
+            queries++
+        }
+    }
+    if request == nil {
+        t.Fatalf("no span for the accept request in trace %s", traceID)
+    }
+    if request.Parent().SpanID().String() != "00f067aa0ba902b7" {
+        t.Errorf("request span has parent %s, want the caller's span", request.Parent().SpanID())
+    }
+    if queries == 0 {
+        t.Errorf("no query spans in trace %s", traceID)
+    }
+
+    var hashed bool
+    for _, span := range spans.GetSpans().Snapshots() {
+        hashed = hashed || span.Name() == "bcrypt.compare"
+    }
+    if !hashed {
+        t.Errorf("logins weren't traced down to bcrypt")
+    }
+}
+
+func TestErrorEnvelope(t *testing.T) {
+    api := newTestAPI(t)
+    customerToken := api.customer("alice")
+
+    for _, tc := range []struct {
+        method, path, token string
+        body                interface{}
+        status              int
+        code                string
+    }{
+        {"GET", "/no/such/route", "", nil, http.StatusNotFound, "not_found"},
+        {"DELETE", "/login", "", nil, http.StatusMethodNotAllowed, "method_not_allowed"},
+        {"GET", "/admin/bookings", "", nil, http.StatusUnauthorized, "unauthorized"},
+        {"GET", "/admin/bookings", customerToken, nil, http.StatusForbidden, "forbidden"},
+        {"POST", "/register", "", map[string]string{"username": "alice", "password": testPassword}, http.StatusConflict, "username_taken"},
+        {"POST", "/login", "", map[string]string{"username": "alice", "password": "wrong-password"}, http.StatusUnauthorized, "invalid_credentials"},
+    } {
+        var body apierror.Body
+        api.call(tc.method, tc.path, tc.token, tc.body, tc.status, &body)
+        if body.Error.Code != tc.code || body.Error.Message == "" || body.Error.RequestID == "" {
+            t.Errorf("%s %s: error body is %+v, want code %s", tc.method, tc.path, body, tc.code)
+        }
+    }
+}
+
+func TestRequestValidation(t *testing.T) {
+    api := newTestAPI(t)
+    customerToken := api.customer("alice")
+
+    var body apierror.Body
+    api.call("POST", "/user/bookings", customerToken, map[string]interface{}{
+        "pickup_location": "Depot",
+        "pickup_lat":      91,
+        "vehicle_type":    "van",
+        "estimated_cost":  -5,
+    }, http.StatusBadRequest, &body)
+    if body.Error.Code != "validation_failed" {
+        t.Errorf("code is %q, want validation_failed", body.Error.Code)
+    }
+    got := map[string]string{}
+    for _, d := range body.Error.Details {
+        got[d.Field] = d.Message
+    }
+    want := map[string]string{
+        "pickup_lat":       "must be at most 90",
+        "dropoff_location": "is required",
+        "vehicle_type":     "must be one of small, medium, large",
+        "estimated_cost":   "must be at least 0",
+    }
+    if len(got) != len(want) {
+        t.Errorf("details are %v, want %v", got, want)
+    }
+    for field, msg := range want {
+        if got[field] != msg {
+            t.Errorf("%s: message is %q, want %q", field, got[field], msg)
+        }
+    }
+
+    for _, tc := range []struct {
+        name   string
+        body   interface{}
+        status int
+        code   string
+        field  string
+    }{
+        {"unknown field", map[string]string{"username": "bob", "password": testPassword, "is_admin": "true"}, http.StatusBadRequest, "unknown_field", "is_admin"},
+        {"wrong type", map[string]interface{}{"username": 42, "password": testPassword}, http.StatusBadRequest, "invalid_type", "username"},
+        {"bad email", map[string]string{"username": "bob", "email": "bob@", "password": testPassword}, http.StatusBadRequest, "validation_failed", "email"},
+        {"too large", map[string]string{"username": strings.Repeat("b", 2<<20), "password": testPassword}, http.StatusRequestEntityTooLarge, "request_too_large", ""},
+    } {
+        var body apierror.Body
+        api.call("POST", "/register", "", tc.body, tc.status, &body)
+        if body.Error.Code != tc.code {
+            t.Errorf("%s: code is %q, want %q", tc.name, body.Error.Code, tc.code)
+        }
+        if tc.field != "" && (len(body.Error.Details) != 1 || body.Error.Details[0].Field != tc.field) {
+            t.Errorf("%s: details are %+v, want field %s", tc.name, body.Error.Details, tc.field)
+        }
+    }
+}
+
+func TestListBookingsPaging(t *testing.T) {
+    api := newTestAPI(t)
+    adminToken := api.admin()
+    customerToken := api.customer("alice")
+
+    costs := []float64{30, 10, 50, 20, 40, 10}
+    for _, cost := range costs {
+        api.call("POST", "/user/bookings", customerToken, map[string]interface{}{
+            "pickup_location":  "Depot",
+            "dropoff_location": "Market",
+            "vehicle_type":     models.VehicleSmall,
+            "estimated_cost":   cost,
+        }, http.StatusOK, nil)
+    }
+    acceptedID := api.createBooking(customerToken)
+    driverToken, _ := api.driver(adminToken, "dave")
+    api.call("PUT", fmt.Sprintf("/driver/bookings/%d/accept", acceptedID), driverToken, nil, http.StatusOK, nil)
+
+    type bookingPage struct {
+        Items      []models.Booking `json:"items"`
+        NextCursor string           `json:"next_cursor"`
+    }
+    // Walks every page and returns the costs in the order they were listed
+    walk := func(query string) []float64 {
+        var listed []float64
+        cursor := ""
+        for pages := 0; pages < 10; pages++ {
+            path := "/admin/bookings?limit=2&" + query
+            if cursor != "" {
+                path += "&cursor=" + url.QueryEscape(cursor)
+            }
+            var p bookingPage
+            api.call("GET", path, adminToken, nil, http.StatusOK, &p)
+            if len(p.Items) > 2 {
+                t.Fatalf("%s: page has %d items, want at most 2", path, len(p.Items))
+            }
+            for _, b := range p.Items {
+                listed = append(listed, b.EstimatedCost)
+            }
+            if cursor = p.NextCursor; cursor == "" {
+                return listed
+            }
+        }
+        t.Fatalf("%s: more pages than bookings", query)
+        return nil
+    }
+
+    for _, tc := range []struct {
+        query string
+        want  []float64
+    }{
+        {"status=pending&sort=-estimated_cost", []float64{50, 40, 30, 20, 10, 10}},
+        {"status=pending&estimated_cost_min=20&estimated_cost_max=40&sort=estimated_cost", []float64{20, 30, 40}},
+        {"status=pending,accepted&vehicle_type=small&sort=created_at", costs},
+        {"status=accepted", []float64{42.5}},
+        {"created_at_from=" + url.QueryEscape(time.Now().Add(time.Hour).UTC().Format(time.RFC3339)), nil},
+    } {
+        if got := walk(tc.query); fmt.Sprint(got) != fmt.Sprint(tc.want) {
+            t.Errorf("%s: listed %v, want %v", tc.query, got, tc.want)
+        }
+    }
+
+    var body apierror.Body
+    api.call("GET", "/admin/bookings?sort=pickup_location&colour=red&limit=0", adminToken, nil, http.StatusBadRequest, &body)
+    if body.Error.Code != "validation_failed" || len(body.Error.Details) != 3 {
+        t.Errorf("error body is %+v, want 3 invalid parameters", body.Error)
+    }
+
+    var first bookingPage
+    api.call("GET", "/admin/bookings?limit=1&sort=estimated_cost", adminToken, nil, http.StatusOK, &first)
+    api.call("GET", "/admin/bookings?sort=created_at&cursor="+url.QueryEscape(first.NextCursor), adminToken, nil, http.StatusBadRequest, &body)
+    if body.Error.Code != "invalid_cursor" {
+        t.Errorf("cursor of another sort order: code is %q, want invalid_cursor", body.Error.Code)
+    }
+}
+
+func TestVehicleCRUD(t *testing.T) {
+    api := newTestAPI(t)
+    adminToken := api.admin()
+
+    var created struct {
+        VehicleID int `json:"vehicle_id"`
+    }
+    api.call("POST", "/admin/vehicles", adminToken, map[string]interface{}{"type": models.VehicleSmall, "availability": true}, http.StatusOK, &created)
+    path := fmt.Sprintf("/admin/vehicles/%d", created.VehicleID)
+
+    var vehicle models.Vehicle
+    api.call("PATCH", path, adminToken, map[string]interface{}{"type": models.VehicleLarge, "availability": false}, http.StatusOK, &vehicle)
+    if vehicle.Type != models.VehicleLarge || vehicle.Availability {
+        t.Fatalf("updated vehicle is %+v", vehicle)
+    }
+    api.call("PATCH", path, adminToken, map[string]interface{}{}, http.StatusBadRequest, nil)
+
+    var status models.VehicleStatus
+    api.call("GET", "/admin/analytics/vehicle-status", adminToken, nil, http.StatusOK, &status)
+    if status.Active != 1 {
+        t.Fatalf("vehicle status is %+v, want the vehicle in use", status)
+    }
+
+    // A vehicle out of service can be retired as long as no driver holds it
+    api.call("DELETE", path, adminToken, nil, http.StatusOK, nil)
+
+    api.call("GET", path, adminToken, nil, http.StatusOK, &vehicle)
+    if vehicle.RetiredAt == nil || vehicle.Type != models.VehicleLarge {
+        t.Fatalf("retired vehicle is %+v", vehicle)
+    }
+    api.call("PATCH", path, adminToken, map[string]interface{}{"availability": false}, http.StatusConflict, nil)
+    api.call("DELETE", path, adminToken, nil, http.StatusConflict, nil)
+
+    var fleet struct {
+        Items []models.Vehicle `json:"items"`
+    }
+    api.call("GET", "/admin/vehicles", adminToken, nil, http.StatusOK, &fleet)
+    api.call("GET", "/admin/analytics/vehicle-status", adminToken, nil, http.StatusOK, &status)
+    if len(fleet.Items) != 0 || status.Active+status.Idle != 0 {
+        t.Errorf("retired vehicle still counted: fleet %+v, status %+v", fleet.Items, status)
+    }
+
+    api.call("GET", "/admin/vehicles/999", adminToken, nil, http.StatusNotFound, nil)
+    api.call("PATCH", "/admin/vehicles/999", adminToken, map[string]interface{}{"type": models.VehicleSmall}, http.StatusNotFound, nil)
+}
+
+func TestVehicleAssignment(t *testing.T) {
+    api := newTestAPI(t)
+    adminToken := api.admin()
+    customerToken := api.customer("alice")
+    driverToken, driverID := api.driver(adminToken, "bob")
+
+    type assignmentPage struct {
+        Items []models.VehicleAssignment `json:"items"`
+    }
+    var history assignmentPage
+    api.call("GET", fmt.Sprintf("/admin/vehicle-assignments?driver_id=%d", driverID), adminToken, nil, http.StatusOK, &history)
+    if len(history.Items) != 1 || history.Items[0].UnassignedAt != nil {
+        t.Fatalf("assignment history is %+v, want the helper's vehicle", history.Items)
+    }
+    mediumID := history.Items[0].VehicleID
+    smallID := api.vehicle(adminToken, models.VehicleSmall)
+
+    expectCode := func(method, path string, body interface{}, status int, code string) {
+        t.Helper()
+        var resp apierror.Body
+        api.call(method, path, adminToken, body, status, &resp)
+        if resp.Error.Code != code {
+            t.Errorf("%s %s: code is %q, want %q", method, path, resp.Error.Code, code)
+        }
+    }
+    small := fmt.Sprintf("/admin/vehicles/%d/driver", smallID)
+    medium := fmt.Sprintf("/admin/vehicles/%d/driver", mediumID)
+    expectCode("PUT", small, map[string]int{"driver_id": driverID}, http.StatusConflict, "driver_has_vehicle")
+    expectCode("PUT", small, map[string]int{"driver_id": 1}, http.StatusBadRequest, "not_a_driver")
+    expectCode("DELETE", fmt.Sprintf("/admin/vehicles/%d", mediumID), nil, http.StatusConflict, "vehicle_assigned")
+
+    smallBooking := func() int {
+        var created struct {
+            BookingID int `json:"booking_id"`
+        }
+        api.call("POST", "/user/bookings", customerToken, map[string]interface{}{
+            "pickup_location": "Depot", "dropoff_location": "Market", "vehicle_type": models.VehicleSmall,
+        }, http.StatusOK, &created)
+        return created.BookingID
+    }
+    smallBookingID := smallBooking()
+    accept := fmt.Sprintf("/driver/bookings/%d/accept", smallBookingID)
+    var resp apierror.Body
+    api.call("PUT", accept, driverToken, nil, http.StatusConflict, &resp)
+    if resp.Error.Code != "vehicle_type_mismatch" {
+        t.Errorf("accepting a small booking with a medium vehicle: code is %q", resp.Error.Code)
+    }
+
+    mediumBookingID := api.createBooking(customerToken)
+    api.call("PUT", fmt.Sprintf("/driver/bookings/%d/accept", mediumBookingID), driverToken, nil, http.StatusOK, nil)
+    if b := api.booking(adminToken, mediumBookingID); b.VehicleID == nil || *b.VehicleID != mediumID {
+        t.Errorf("accepted booking has vehicle %v, want %d", b.VehicleID, mediumID)
+    }
+
+    expectCode("DELETE", medium, nil, http.StatusConflict, "vehicle_in_use")
+    api.call("PUT", fmt.Sprintf("/admin/bookings/%d/complete", mediumBookingID), adminToken, nil, http.StatusOK, nil)
+    api.call("DELETE", medium, adminToken, nil, http.StatusOK, nil)
+    expectCode("DELETE", medium, nil, http.StatusConflict, "vehicle_not_assigned")
+    api.call("PUT", accept, driverToken, nil, http.StatusConflict, &resp)
+    if resp.Error.Code != "no_vehicle_assigned" {
+        t.Errorf("accepting without a vehicle: code is %q", resp.Error.Code)
+    }
+
+    api.call("PUT", small, adminToken, map[string]int{"driver_id": driverID}, http.StatusOK, nil)
+    api.call("PUT", small, adminToken, map[string]int{"driver_id": driverID}, http.StatusOK, nil)
+    api.call("PUT", accept, driverToken, nil, http.StatusOK, nil)
+
+    api.call("GET", fmt.Sprintf("/admin/vehicle-assignments?driver_id=%d&sort=assigned_at", driverID), adminToken, nil, http.StatusOK, &history)
+    if len(history.Items) != 2 || history.Items[0].VehicleID != mediumID || history.Items[0].UnassignedAt == nil ||
+        history.Items[1].VehicleID != smallID || history.Items[1].UnassignedAt != nil {
+        t.Errorf("assignment history is %+v, want medium then small", history.Items)
+    }
+}
+
+func TestVehicleAvailabilityFollowsBookings(t *testing.T) {
+    api := newTestAPI(t)
+    adminToken := api.admin()
+    customerToken := api.customer("alice")
+    driverToken, _ := api.driver(adminToken, "bob")
+
+    var fleet struct {
+        Items []models.Vehicle `json:"items"`
+    }
+    api.call("GET", "/admin/vehicles", adminToken, nil, http.StatusOK, &fleet)
+    if len(fleet.Items) != 1 {
+        t.Fatalf("fleet is %+v, want the driver's vehicle", fleet.Items)
+    }
+    path := fmt.Sprintf("/admin/vehicles/%d", fleet.Items[0].ID)
+    expectStatus := func(want models.VehicleStatus) {
+        t.Helper()
+        var status models.VehicleStatus
+        api.call("GET", "/admin/analytics/vehicle-status", adminToken, nil, http.StatusOK, &status)
+        if status != want {
+            t.Errorf("vehicle status is %+v, want %+v", status, want)
+        }
+    }
+    expectCode := func(method, path, token string, body interface{}, code string) {
+        t.Helper()
+        var resp apierror.Body
+        api.call(method, path, token, body, http.StatusConflict, &resp)
+        if resp.Error.Code != code {
+            t.Errorf("%s %s: code is %q, want %q", method, path, resp.Error.Code, code)
+        }
+    }
+
+    first, second := api.createBooking(customerToken), api.createBooking(customerToken)
+    api.call("PUT", fmt.Sprintf("/driver/bookings/%d/accept", first), driverToken, nil, http.StatusOK, nil)
+    expectStatus(models.VehicleStatus{Active: 1})
+
+    // The vehicle stays with the booking until it ends
+    secondAccept := fmt.Sprintf("/driver/bookings/%d/accept", second)
+    expectCode("PUT", secondAccept, driverToken, nil, "vehicle_unavailable")
+    expectCode("PATCH", path, adminToken, map[string]interface{}{"availability": true}, "vehicle_in_use")
+
+    api.call("PUT", fmt.Sprintf("/admin/bookings/%d/complete", first), adminToken, nil, http.StatusOK, nil)
+    expectStatus(models.VehicleStatus{Idle: 1})
+
+    // A vehicle taken out of service can't take bookings either
+    api.call("PATCH", path, adminToken, map[string]interface{}{"availability": false}, http.StatusOK, nil)
+    expectCode("PUT", secondAccept, driverToken, nil, "vehicle_unavailable")
+    api.call("PATCH", path, adminToken, map[string]interface{}{"availability": true}, http.StatusOK, nil)
+    api.call("PUT", secondAccept, driverToken, nil, http.StatusOK, nil)
+    expectStatus(models.VehicleStatus{Active: 1})
+}
+
+func TestBookingStateMachine(t *testing.T) {
+    api := newTestAPI(t)
+    adminToken := api.admin()
+    customerToken := api.customer("alice")
+    otherCustomerToken := api.customer("dave")
+    driverToken, _ := api.driver(adminToken, "bob")
+    otherDriverToken, _ := api.driver(adminToken, "carol")
+
+    expectCode := func(method, path, token string, body interface{}, status int, code string) {
+        t.Helper()
+        var resp apierror.Body
+        api.call(method, path, token, body, status, &resp)
+        if resp.Error.Code != code {
+            t.Errorf("%s %s: code is %q, want %q", method, path, resp.Error.Code, code)
+        }
+    }
+    // A trip goes through every stage, in order and only by its driver
+    bookingID := api.createBooking(customerToken)
+    api.call("PUT", fmt.Sprintf("/driver/bookings/%d/accept", bookingID), driverToken, nil, http.StatusOK, nil)
+    path := fmt.Sprintf("/driver/bookings/%d/status", bookingID)
+    expectCode("PUT", path, driverToken, map[string]string{"status": models.BookingInTransit}, http.StatusConflict, "illegal_transition")
+    expectCode("PUT", path, otherDriverToken, map[string]string{"status": models.BookingEnRouteToPickup}, http.StatusForbidden, "booking_forbidden")
+    expectCode("PUT", path, driverToken, map[string]string{"status": models.BookingCompleted}, http.StatusBadRequest, "validation_failed")
+    for _, status := range []string{models.BookingEnRouteToPickup, models.BookingPickedUp, models.BookingInTransit} {
+        var b models.Booking
+        api.call("PUT", path, driverToken, map[string]string{"status": status}, http.StatusOK, &b)
+        if b.Status != status {
+            t.Fatalf("booking moved to %q, want %q", b.Status, status)
+        }
+    }
+    expectCode("PUT", fmt.Sprintf("/user/bookings/%d/cancel", bookingID), customerToken, nil, http.StatusConflict, "illegal_transition")
+
+    // Delivering frees the vehicle; the admin closes the booking afterwards
+    api.call("PUT", path, driverToken, map[string]string{"status": models.BookingDelivered}, http.StatusOK, nil)
+    var status models.VehicleStatus
+    api.call("GET", "/admin/analytics/vehicle-status", adminToken, nil, http.StatusOK, &status)
+    if status.Active != 0 {
+        t.Errorf("vehicle status after delivery is %+v, want no vehicle in use", status)
+    }
+    api.call("PUT", fmt.Sprintf("/admin/bookings/%d/complete", bookingID), adminToken, nil, http.StatusOK, nil)
+    expectCode("PUT", path, driverToken, map[string]string{"status": models.BookingDelivered}, http.StatusConflict, "illegal_transition")
+
+    // Customers cancel their own bookings before pickup, which frees the vehicle
+    bookingID = api.createBooking(customerToken)
+    api.call("PUT", fmt.Sprintf("/driver/bookings/%d/accept", bookingID), driverToken, nil, http.StatusOK, nil)
+    cancel := fmt.Sprintf("/user/bookings/%d/cancel", bookingID)
+    expectCode("PUT", cancel, otherCustomerToken, nil, http.StatusForbidden, "booking_forbidden")
+    api.call("PUT", cancel, customerToken, nil, http.StatusOK, nil)
+    expectCode("PUT", cancel, customerToken, nil, http.StatusConflict, "illegal_transition")
+    api.call("GET", "/admin/analytics/vehicle-status", adminToken, nil, http.StatusOK, &status)
+    if status.Active != 0 {
+        t.Errorf("vehicle status after cancelling is %+v, want no vehicle in use", status)
+    }
+    api.call("PUT", fmt.Sprintf("/admin/bookings/%d/cancel", api.createBooking(customerToken)), adminToken, nil, http.StatusOK, nil)
+
+    // Pending bookings expire and can't be accepted anymore
+    bookingID = api.createBooking(customerToken)
+    expired, err := models.NewSQLiteStore(api.db).ExpireBookings(context.Background(), time.Now().Add(time.Minute))
+    if err != nil || expired != 1 {
+        t.Fatalf("expired %d bookings (%v), want 1", expired, err)
+    }
+    if b := api.booking(adminToken, bookingID); b.Status != models.BookingExpired {
+        t.Fatalf("booking is %q after expiry", b.Status)
+    }
+    var entries []models.AuditEntry
+    api.call("GET", fmt.Sprintf("/admin/audit?entity_type=booking&entity_id=%d", bookingID), adminToken, nil, http.StatusOK, &entries)
+    if len(entries) == 0 || entries[0].Action != "booking.expire" || entries[0].ActorRole == nil || *entries[0].ActorRole != string(models.ActorSystem) {
+        t.Fatalf("latest audit entry of the expired booking is %+v, want booking.expire by system", entries)
+    }
+    expectCode("PUT", fmt.Sprintf("/driver/bookings/%d/accept", bookingID), driverToken, nil, http.StatusConflict, "booking_not_available")
+}
+
+// TestAuditFailureRollsBackChange checks that a change whose audit entry
+// can't be written isn't made either, so a retry doesn't repeat it
+func TestAuditFailureRollsBackChange(t *testing.T) {
+    api := newTestAPI(t)
+    adminToken := api.admin()
+    if _, err := api.db.Exec(`DROP TABLE audit_log`); err != nil {
+        t.Fatal(err)
+    }
+
+    api.call("POST", "/admin/vehicles", adminToken, map[string]interface{}{"type": models.VehicleSmall, "availability": true}, http.StatusInternalServerError, nil)
+
+    var vehicles int
+    if err := api.db.QueryRow(`SELECT COUNT(*) FROM vehicles`).Scan(&vehicles); err != nil {
+        t.Fatal(err)
+    }
+    if vehicles != 0 {
+        t.Fatalf("%d vehicles after a failed audit, want the change rolled back", vehicles)
+    }
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+    api := newTestAPI(t)
+    admin := api.admin()
+
+    var errBody apierror.Body
+    api.call("POST", "/admin/api-keys", admin, map[string]interface{}{"name": "escalator", "scopes": []string{models.PermRolesManage}}, http.StatusBadRequest, &errBody)
+    if errBody.Error.Code != "scope_not_grantable" {
+        t.Fatalf("key with roles:manage: got code %q, want scope_not_grantable", errBody.Error.Code)
+    }
+
+    // A role that may manage keys can only hand out what it holds itself
+    api.call("POST", "/admin/roles", admin, map[string]interface{}{"name": "integrator", "permissions": []string{models.PermAPIKeysManage, models.PermBookingsRead}}, http.StatusCreated, nil)
+    api.call("POST", "/admin/users", admin, map[string]string{"username": "ivy", "password": testPassword, "role": "integrator"}, http.StatusCreated, nil)
+    integrator, _ := api.login("ivy")
+
+    api.call("POST", "/admin/api-keys", integrator, map[string]interface{}{"name": "sneaky", "scopes": []string{models.PermUsersWrite}}, http.StatusForbidden, &errBody)
+    if errBody.Error.Code != "scope_not_held" {
+        t.Fatalf("key with users:write: got code %q, want scope_not_held", errBody.Error.Code)
+    }
+
+    var created struct {
+        Key string `json:"key"`
+    }
+    api.call("POST", "/admin/api-keys", integrator, map[string]interface{}{"name": "reporting", "scopes": []string{models.PermBookingsRead}}, http.StatusCreated, &created)
+    api.call("GET", "/admin/bookings", created.Key, nil, http.StatusOK, nil)
+}
+
+// TestRoleAssignmentNeedsHeldPermissions checks that accounts with users:write
+// can only give out roles whose permissions they hold themselves, so they
+// can't create or promote an account above their own access
+func TestRoleAssignmentNeedsHeldPermissions(t *testing.T) {
+    api := newTestAPI(t)
+    admin := api.admin()
+    api.call("POST", "/admin/roles", admin, map[string]interface{}{"name": "dispatcher", "permissions": []string{models.PermUsersRead, models.PermUsersWrite, models.PermBookingsRead}}, http.StatusCreated, nil)
+    api.call("POST", "/admin/roles", admin, map[string]interface{}{"name": "viewer", "permissions": []string{models.PermBookingsRead}}, http.StatusCreated, nil)
+    api.call("POST", "/admin/users", admin, map[string]string{"username": "dora", "password": testPassword, "role": "dispatcher"}, http.StatusCreated, nil)
+    dispatcher, _ := api.login("dora")
+
+    var errBody apierror.Body
+    api.call("POST", "/admin/users", dispatcher, map[string]string{"username": "mallory", "password": testPassword, "role": models.RoleAdmin}, http.StatusForbidden, &errBody)
+    if errBody.Error.Code != "role_not_held" {
+        t.Fatalf("creating an admin: got code %q, want role_not_held", errBody.Error.Code)
+    }
+    var created struct {
+        UserID int `json:"user_id"`
+    }
+    api.call("POST", "/admin/users", dispatcher, map[string]string{"username": "vic", "password": testPassword, "role": "viewer"}, http.StatusCreated, &created)
+
+    rolePath := fmt.Sprintf("/admin/users/%d/role", created.UserID)
+    api.call("PUT", rolePath, dispatcher, map[string]string{"role": models.RoleAdmin}, http.StatusForbidden, &errBody)
+    if errBody.Error.Code != "role_not_held" {
+        t.Fatalf("promoting to admin: got code %q, want role_not_held", errBody.Error.Code)
+    }
+    api.call("PUT", rolePath, dispatcher, map[string]string{"role": "dispatcher"}, http.StatusOK, nil)
+
+    // API keys are held to their scopes rather than their account's role
+    var key struct {
+        Key string `json:"key"`
+    }
+    api.call("POST", "/admin/api-keys", admin, map[string]interface{}{"name": "hr-sync", "scopes": []string{models.PermUsersWrite, models.PermBookingsRead}}, http.StatusCreated, &key)
+    api.call("POST", "/admin/users", key.Key, map[string]string{"username": "eve", "password": testPassword, "role": models.RoleAdmin}, http.StatusForbidden, nil)
+    api.call("PUT", rolePath, key.Key, map[string]string{"role": models.RoleAdmin}, http.StatusForbidden, nil)
+    api.call("POST", "/admin/users", key.Key, map[string]string{"username": "walt", "password": testPassword, "role": "viewer"}, http.StatusCreated, nil)
+}
+
+// TestPasswordChangeRevokesSessions checks that a new password and the end
+// of the old sessions are one change, so neither happens without the other
+func TestPasswordChangeRevokesSessions(t *testing.T) {
+    api := newTestAPI(t)
+    api.customer("carol")
+    carol := api.session("carol")
+    other := api.session("carol")
+
+    // A failing revocation leaves the old password in place
+    if _, err := api.db.Exec(`CREATE TRIGGER fail_revoke BEFORE UPDATE ON refresh_tokens BEGIN SELECT RAISE(ABORT, 'revoke failed'); END`); err != nil {
+        t.Fatal(err)
+    }
+    change := map[string]string{"current_password": testPassword, "new_password": "Battery-staple-43"}
+    api.call("PUT", "/account/password", carol.AccessToken, change, http.StatusInternalServerError, nil)
+    if _, err := api.db.Exec(`DROP TRIGGER fail_revoke`); err != nil {
+        t.Fatal(err)
+    }
+    api.login("carol")
+
+    var changed testSession
+    api.call("PUT", "/account/password", carol.AccessToken, change, http.StatusOK, &changed)
+    api.refresh(other.RefreshToken, http.StatusUnauthorized)
+    api.call("POST", "/login", "", map[string]string{"username": "carol", "password": testPassword}, http.StatusUnauthorized, nil)
+    api.refresh(changed.RefreshToken, http.StatusOK)
+}
+
+func TestPasswordReset(t *testing.T) {
+    api := newTestAPI(t)
+    api.call("POST", "/register", "", map[string]string{"username": "erin", "email": "erin@example.com", "password": testPassword}, http.StatusCreated, nil)
+    var session struct {
+        RefreshToken string `json:"refresh_token"`
+    }
+    api.call("POST", "/login", "", map[string]string{"username": "erin", "password": testPassword}, http.StatusOK, &session)
+
+    api.call("POST", "/password/forgot", "", map[string]string{"login": "erin@example.com"}, http.StatusAccepted, nil)
+    // Asking again right away, in any case, is refused before another mail goes out
+    var errBody apierror.Body
+    api.call("POST", "/password/forgot", "", map[string]string{"login": "Erin@Example.com"}, http.StatusTooManyRequests, &errBody)
+    if errBody.Error.Code != "password_reset_throttled" {
+        t.Fatalf("second reset request: got code %q, want password_reset_throttled", errBody.Error.Code)
+    }
+
+    // The log mailer writes the link to the server log, in the background
+    link := regexp.MustCompile(`token=([A-Za-z0-9_%-]+)`)
+    var token string
+    for deadline := time.Now().Add(5 * time.Second); token == "" && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+        if m := link.FindStringSubmatch(api.logs.String()); m != nil {
+            token, _ = url.QueryUnescape(m[1])
+        }
+    }
+    if token == "" {
+        t.Fatal("no reset link was mailed")
+    }
+    if n := strings.Count(api.logs.String(), "Reset your Fleetfy password"); n != 1 {
+        t.Fatalf("%d reset mails sent, want 1", n)
+    }
+
+    newPassword := "Battery-staple-43"
+    api.call("POST", "/password/reset", "", map[string]string{"token": token, "new_password": newPassword}, http.StatusOK, nil)
+    api.call("POST", "/password/reset", "", map[string]string{"token": token, "new_password": newPassword}, http.StatusBadRequest, nil)
+
+    // Sessions from before the reset are gone
+    api.call("POST", "/refresh", "", map[string]string{"refresh_token": session.RefreshToken}, http.StatusUnauthorized, nil)
+    api.call("POST", "/login", "", map[string]string{"username": "erin", "password": newPassword}, http.StatusOK, nil)
+}
+
+// testStore is everything the store-backed handlers need
+type testStore interface {
+    models.BookingStore
+    models.VehicleStore
+    models.UserStore
+    models.AuditStore
+    models.SessionStore
+    models.ThrottleStore
+    models.RoleStore
+    models.MFAStore
+    models.APIKeyStore
+    models.PasswordStore
+}
+
+// eachStore runs test once on the in-memory store and once on SQLite
+func eachStore(t *testing.T, test func(t *testing.T, store testStore)) {
+    stores := []struct {
+        name string
+        new  func(t *testing.T) testStore
+    }{
+        {"memory", func(t *testing.T) testStore { return models.NewMemoryStore() }},
+        {"sqlite", func(t *testing.T) testStore { return models.NewSQLiteStore(newTestAPI(t).db) }},
+    }
+    for _, tc := range stores {
+        t.Run(tc.name, func(t *testing.T) {
+            test(t, tc.new(t))
+        })
+    }
+}
+
+// storeCaller serves requests from r, as if Authenticate had let them through
+// for the given principal. A nil principal sends the request without one.
+func storeCaller(t *testing.T, r http.Handler) func(method, path string, principal *auth.Principal, body interface{}, wantStatus int, out interface{}) {
+    return func(method, path string, principal *auth.Principal, body interface{}, wantStatus int, out interface{}) {
+        t.Helper()
+        payload, _ := json.Marshal(body)
+        req := httptest.NewRequest(method, path, bytes.NewReader(payload))
+        req.Header.Set("Content-Type", "application/json")
+        if principal != nil {
+            req = req.WithContext(auth.NewContext(req.Context(), principal))
+        }
+        rec := httptest.NewRecorder()
+        r.ServeHTTP(rec, req)
+        if rec.Code != wantStatus {
+            t.Fatalf("%s %s: got status %d, want %d: %s", method, path, rec.Code, wantStatus, rec.Body)
+        }
+        if out != nil {
+            if err := json.Unmarshal(rec.Body.Bytes(), out); err != nil {
+                t.Fatalf("%s %s: decoding %q: %v", method, path, rec.Body, err)
+            }
+        }
+    }
+}
+
+// TestHandlersOnEachStore runs the booking handlers on the in-memory store
+// and on SQLite, so the two implementations keep following the same rules
+func TestHandlersOnEachStore(t *testing.T) {
+    eachStore(t, func(t *testing.T, store testStore) {
+        ctx := context.Background()
+        register := func(username, role string) int {
+            t.Helper()
+            id, err := store.RegisterUser(ctx, username, "", testPassword, role, models.UserStatusActive, models.AuditActor{})
+            if err != nil {
+                t.Fatalf("registering %s: %v", username, err)
+            }
+            return id
+        }
+        adminID := register("admin", models.RoleAdmin)
+        customerID := register("carol", models.RoleUser)
+        otherCustomerID := register("dave", models.RoleUser)
+        driverID := register("dan", models.RoleDriver)
+
+        r := mux.NewRouter()
+        r.Handle("/vehicles", handler.CreateVehicleHandler(store)).Methods("POST")
+        r.Handle("/vehicles/{id}/driver", handler.AssignVehicleHandler(store)).Methods("PUT")
+        r.Handle("/bookings", handler.CreateBookingHandler(store)).Methods("POST")
+        r.Handle("/bookings/{id}/accept", handler.AcceptBookingHandler(store)).Methods("PUT")
+        r.Handle("/bookings/{id}/status", handler.UpdateTripStatusHandler(store)).Methods("PUT")
+        r.Handle("/bookings/{id}/cancel", handler.CancelBookingHandler(store, models.ActorCustomer)).Methods("PUT")
+
+        // call serves a request as the given user
+        serve := storeCaller(t, r)
+        call := func(method, path string, userID int, role string, body interface{}, wantStatus int, out interface{}) {
+            t.Helper()
+            serve(method, path, &auth.Principal{UserID: userID, Role: role}, body, wantStatus, out)
+        }
+
+        var vehicle struct {
+            VehicleID int `json:"vehicle_id"`
+        }
+        call("POST", "/vehicles", adminID, models.RoleAdmin, map[string]interface{}{"type": models.VehicleMedium, "availability": true}, http.StatusOK, &vehicle)
+        call("PUT", fmt.Sprintf("/vehicles/%d/driver", vehicle.VehicleID), adminID, models.RoleAdmin, map[string]int{"driver_id": driverID}, http.StatusOK, nil)
+
+        var booking struct {
+            BookingID int `json:"booking_id"`
+        }
+        call("POST", "/bookings", customerID, models.RoleUser, map[string]interface{}{
+            "pickup_location":  "Warehouse 4, Dock Road",
+            "dropoff_location": "12 High Street",
+            "vehicle_type":     models.VehicleMedium,
+            "estimated_cost":   42.5,
+        }, http.StatusOK, &booking)
+        path := fmt.Sprintf("/bookings/%d", booking.BookingID)
+
+        var errBody apierror.Body
+        call("PUT", path+"/cancel", otherCustomerID, models.RoleUser, nil, http.StatusForbidden, &errBody)
+        if errBody.Error.Code != "booking_forbidden" {
+            t.Fatalf("cancelling someone else's booking: got code %q", errBody.Error.Code)
+        }
+        call("PUT", path+"/accept", driverID, models.RoleDriver, nil, http.StatusOK, nil)
+        call("PUT", path+"/accept", driverID, models.RoleDriver, nil, http.StatusConflict, &errBody)
+        if errBody.Error.Code != "booking_not_available" {
+            t.Fatalf("accepting twice: got code %q", errBody.Error.Code)
+        }
+        call("PUT", path+"/status", driverID, models.RoleDriver, map[string]string{"status": models.BookingEnRouteToPickup}, http.StatusOK, nil)
+        call("PUT", path+"/cancel", customerID, models.RoleUser, nil, http.StatusOK, nil)
+
+        if v, err := store.GetVehicle(ctx, vehicle.VehicleID); err != nil || !v.Availability {
+            t.Fatalf("vehicle after cancelling is %+v (%v), want it available", v, err)
+        }
+        entries, err := store.QueryAudit(ctx, models.AuditFilter{EntityType: "booking", EntityID: strconv.Itoa(booking.BookingID), Limit: 10})
+        if err != nil {
+            t.Fatal(err)
+        }
+        var actions []string
+        for _, e := range entries {
+            actions = append(actions, e.Action)
+        }
+        if got := strings.Join(actions, ","); got != "booking.cancel,booking.status,booking.accept,booking.create" {
+            t.Fatalf("audit log of the booking has %s", got)
+        }
+    })
+}
+
+// loginAttempt is the answer to a login sent from a client IP
+type loginAttempt struct {
+    status     int
+    retryAfter string
+    code       string
+    message    string
+}
+
+// attemptLogin logs in as username from ip, which reaches the API through the
+// trusted local proxy
+func (api *testAPI) attemptLogin(ip, username, password string) loginAttempt {
+    api.t.Helper()
+    payload, _ := json.Marshal(map[string]string{"username": username, "password": password})
+    req, err := http.NewRequest("POST", api.server.URL+"/login", bytes.NewReader(payload))
+    if err != nil {
+        api.t.Fatal(err)
+    }
+    req.Header.Set("Content-Type", "application/json")
+    req.Header.Set("X-Forwarded-For", ip)
+    resp, err := api.server.Client().Do(req)
+    if err != nil {
+        api.t.Fatal(err)
+    }
+    defer resp.Body.Close()
+
+    var body apierror.Body
+    json.NewDecoder(resp.Body).Decode(&body)
+    return loginAttempt{status: resp.StatusCode, retryAfter: resp.Header.Get("Retry-After"), code: body.Error.Code, message: body.Error.Message}
+}
+
+// expireLoginDelays ends every running login delay as if its time had passed,
+// keeping the failure counts
+func (api *testAPI) expireLoginDelays() {
+    api.t.Helper()
+    if _, err := api.db.Exec(`UPDATE login_throttles SET locked_until = NULL`); err != nil {
+        api.t.Fatal(err)
+    }
+}
+
+// TestLoginThrottling checks the delays after failed logins per username: a
+// few free attempts, then a delay that doubles with each failure, then a
+// lockout that only time or an admin lifts
+func TestLoginThrottling(t *testing.T) {
+    api := newTestAPI(t)
+    adminToken := api.admin()
+    api.customer("carol")
+    const ip = "203.0.113.10"
+
+    for i := 1; i <= models.DefaultLoginThrottle.User.FreeAttempts; i++ {
+        if got := api.attemptLogin(ip, "carol", "wrong-password"); got.status != http.StatusUnauthorized || got.retryAfter != "" {
+            t.Fatalf("free attempt %d: got %+v, want 401 without Retry-After", i, got)
+        }
+    }
+
+    // Every further failure doubles the delay until the lockout. During a
+    // delay even the right password is refused with 429 and Retry-After.
+    want := map[int]string{4: "1", 5: "2", 6: "4", 7: "8", 8: "16", 9: "32", 10: "900"}
+    for failures := models.DefaultLoginThrottle.User.FreeAttempts + 1; failures <= models.DefaultLoginThrottle.User.LockoutAfter; failures++ {
+        api.expireLoginDelays()
+        if got := api.attemptLogin(ip, "carol", "wrong-password"); got.status != http.StatusUnauthorized {
+            t.Fatalf("failure %d: got %+v, want 401", failures, got)
+        }
+        got := api.attemptLogin(ip, "carol", testPassword)
+        if got.status != http.StatusTooManyRequests || got.code != "login_throttled" || got.retryAfter != want[failures] {
+            t.Fatalf("after failure %d: got %+v, want 429 login_throttled with Retry-After %s", failures, got, want[failures])
+        }
+    }
+
+    // The lockout is listed for admins and an admin can lift it
+    var lockouts []models.Lockout
+    api.call("GET", "/admin/lockouts", adminToken, nil, http.StatusOK, &lockouts)
+    if len(lockouts) != 1 || lockouts[0].Key != models.UserThrottleKey("carol") || lockouts[0].Failures != models.DefaultLoginThrottle.User.LockoutAfter {
+        t.Fatalf("lockouts are %+v, want carol's", lockouts)
+    }
+    var carolID int
+    if err := api.db.QueryRow(`SELECT id FROM users WHERE username = 'carol'`).Scan(&carolID); err != nil {
+        t.Fatal(err)
+    }
+    api.call("POST", fmt.Sprintf("/admin/users/%d/unlock", carolID), adminToken, nil, http.StatusOK, nil)
+    if got := api.attemptLogin(ip, "carol", testPassword); got.status != http.StatusOK {
+        t.Fatalf("after unlocking: got %+v, want 200", got)
+    }
+    api.call("GET", "/admin/lockouts", adminToken, nil, http.StatusOK, &lockouts)
+    if len(lockouts) != 0 {
+        t.Fatalf("lockouts after unlocking are %+v, want none", lockouts)
+    }
+}
+
+// TestLoginThrottlingPerIP checks that failures are also counted per client
+// IP, so guessing across many usernames from one address gets throttled
+// without affecting other addresses
+func TestLoginThrottlingPerIP(t *testing.T) {
+    api := newTestAPI(t)
+    adminToken := api.admin()
+    api.customer("carol")
+    const attacker, other = "203.0.113.20", "198.51.100.7"
+
+    // One guess per username stays below the per-user limit
+    for i := 1; i <= models.DefaultLoginThrottle.IP.FreeAttempts+1; i++ {
+        if got := api.attemptLogin(attacker, fmt.Sprintf("guess%d", i), "wrong-password"); got.status != http.StatusUnauthorized {
+            t.Fatalf("guess %d: got %+v, want 401", i, got)
+        }
+    }
+    if got := api.attemptLogin(attacker, "carol", testPassword); got.status != http.StatusTooManyRequests || got.retryAfter != "1" {
+        t.Fatalf("from the guessing IP: got %+v, want 429 with Retry-After 1", got)
+    }
+    if got := api.attemptLogin(other, "carol", testPassword); got.status != http.StatusOK {
+        t.Fatalf("from another IP: got %+v, want 200", got)
+    }
+
+    var lockouts []models.Lockout
+    api.call("GET", "/admin/lockouts", adminToken, nil, http.StatusOK, &lockouts)
+    if len(lockouts) != 1 || lockouts[0].Key != models.IPThrottleKey(attacker) {
+        t.Fatalf("lockouts are %+v, want the guessing IP", lockouts)
+    }
+    api.call("DELETE", "/admin/lockouts/ip/"+attacker, adminToken, nil, http.StatusOK, nil)
+    if got := api.attemptLogin(attacker, "carol", testPassword); got.status != http.StatusOK {
+        t.Fatalf("after unlocking the IP: got %+v, want 200", got)
+    }
+}
+
+// TestLoginDoesNotRevealAccounts checks that a wrong password and an unknown
+// username get the same answer, both before and during throttling
+func TestLoginDoesNotRevealAccounts(t *testing.T) {
+    api := newTestAPI(t)
+    api.customer("carol")
+    const ip = "203.0.113.30"
+
+    wrongPassword := api.attemptLogin(ip, "carol", "wrong-password")
+    unknownUser := api.attemptLogin(ip, "nobody", "wrong-password")
+    if wrongPassword.status != http.StatusUnauthorized || wrongPassword != unknownUser {
+        t.Fatalf("wrong password got %+v, unknown username got %+v, want the same 401", wrongPassword, unknownUser)
+    }
+
+    for i := 1; i < models.DefaultLoginThrottle.User.FreeAttempts+1; i++ {
+        api.attemptLogin(ip, "carol", "wrong-password")
+        api.attemptLogin(ip, "nobody", "wrong-password")
+    }
+    wrongPassword = api.attemptLogin(ip, "carol", "wrong-password")
+    unknownUser = api.attemptLogin(ip, "nobody", "wrong-password")
+    if wrongPassword.status != http.StatusTooManyRequests || wrongPassword != unknownUser {
+        t.Fatalf("throttled wrong password got %+v, unknown username got %+v, want the same 429", wrongPassword, unknownUser)
+    }
+}
+
+// TestAccountHandlersOnEachStore runs login, sessions, lockouts, roles, API
+// keys and password changes on the in-memory store and on SQLite
+func TestAccountHandlersOnEachStore(t *testing.T) {
+    eachStore(t, func(t *testing.T, store testStore) {
+        ctx := context.Background()
+        tokens, err := auth.NewTokenManager(strings.Repeat("k", 32), time.Minute, time.Hour)
+        if err != nil {
+            t.Fatal(err)
+        }
+        throttle := models.LoginThrottle{
+            User: models.ThrottlePolicy{FreeAttempts: 5, LockoutAfter: 2, LockoutFor: time.Hour, Window: time.Hour},
+            IP:   models.ThrottlePolicy{FreeAttempts: 100, Window: time.Hour},
+        }
+        adminID, err := store.RegisterUser(ctx, "admin", "", testPassword, models.RoleAdmin, models.UserStatusActive, models.AuditActor{})
+        if err != nil {
+            t.Fatal(err)
+        }
+        carolID, err := store.RegisterUser(ctx, "carol", "carol@example.com", testPassword, models.RoleUser, models.UserStatusActive, models.AuditActor{})
+        if err != nil {
+            t.Fatal(err)
+        }
+        admin := &auth.Principal{UserID: adminID, Role: models.RoleAdmin}
+        carol := &auth.Principal{UserID: carolID, Role: models.RoleUser}
+
+        authz := auth.NewAuthorizer(store.FetchRolePermissions, handler.SessionEpochLoader(store), 0)
+
+        r := mux.NewRouter()
+        r.Handle("/login", handler.LoginHandler(store, store, store, store, tokens, throttle)).Methods("POST")
+        r.Handle("/refresh", handler.RefreshHandler(store, store, tokens)).Methods("POST")
+        r.Handle("/logout", handler.LogoutHandler(store)).Methods("POST")
+        r.Handle("/password", handler.ChangePasswordHandler(store, store, store, tokens, authz)).Methods("PUT")
+        r.Handle("/users/{id}/unlock", handler.UnlockUserHandler(store)).Methods("POST")
+        r.Handle("/lockouts", handler.ListLockoutsHandler(store)).Methods("GET")
+        r.Handle("/roles", handler.ListRolesHandler(store)).Methods("GET")
+        r.Handle("/roles", handler.CreateRoleHandler(store)).Methods("POST")
+        r.Handle("/roles/{name}", handler.DeleteRoleHandler(store, authz)).Methods("DELETE")
+        r.Handle("/api-keys", handler.ListAPIKeysHandler(store)).Methods("GET")
+        r.Handle("/api-keys", handler.CreateAPIKeyHandler(store, store)).Methods("POST")
+        r.Handle("/api-keys/{id}", handler.RevokeAPIKeyHandler(store)).Methods("DELETE")
+        call := storeCaller(t, r)
+        login := func(password string, wantStatus int) testSession {
+            t.Helper()
+            var session testSession
+            var out interface{}
+            if wantStatus == http.StatusOK {
+                out = &session
+            }
+            call("POST", "/login", nil, map[string]string{"username": "carol", "password": password}, wantStatus, out)
+            return session
+        }
+
+        // Sessions rotate on refresh and end on logout
+        session := login(testPassword, http.StatusOK)
+        var rotated testSession
+        call("POST", "/refresh", nil, map[string]string{"refresh_token": session.RefreshToken}, http.StatusOK, &rotated)
+        call("POST", "/refresh", nil, map[string]string{"refresh_token": session.RefreshToken}, http.StatusUnauthorized, nil)
+        call("POST", "/logout", nil, map[string]string{"refresh_token": rotated.RefreshToken}, http.StatusOK, nil)
+        call("POST", "/refresh", nil, map[string]string{"refresh_token": rotated.RefreshToken}, http.StatusUnauthorized, nil)
+
+        // Failed logins lock the account until an admin unlocks it
+        login("wrong-password", http.StatusUnauthorized)
+        login("wrong-password", http.StatusUnauthorized)
+        login(testPassword, http.StatusTooManyRequests)
+        var lockouts []models.Lockout
+        call("GET", "/lockouts", admin, nil, http.StatusOK, &lockouts)
+        if len(lockouts) != 1 || lockouts[0].Key != models.UserThrottleKey("carol") {
+            t.Fatalf("lockouts are %+v, want one for carol", lockouts)
+        }
+        call("POST", fmt.Sprintf("/users/%d/unlock", carolID), admin, nil, http.StatusOK, nil)
+        login(testPassword, http.StatusOK)
+
+        // Changing the password replaces the old one and ends other sessions
+        other := login(testPassword, http.StatusOK)
+        call("PUT", "/password", carol, map[string]string{"current_password": testPassword, "new_password": "Battery-staple-43"}, http.StatusOK, nil)
+        call("POST", "/refresh", nil, map[string]string{"refresh_token": other.RefreshToken}, http.StatusUnauthorized, nil)
+        login(testPassword, http.StatusUnauthorized)
+        login("Battery-staple-43", http.StatusOK)
+
+        // Roles can be defined and removed while no account holds them
+        call("POST", "/roles", admin, models.Role{Name: "dispatcher", Permissions: []string{models.PermBookingsRead}}, http.StatusCreated, nil)
+        call("POST", "/roles", admin, models.Role{Name: "dispatcher"}, http.StatusConflict, nil)
+        var roles []models.Role
+        call("GET", "/roles", admin, nil, http.StatusOK, &roles)
+        var names []string
+        for _, role := range roles {
+            names = append(names, role.Name)
+        }
+        if !strings.Contains(strings.Join(names, ","), "dispatcher") {
+            t.Fatalf("roles are %v, want dispatcher among them", names)
+        }
+        call("DELETE", "/roles/dispatcher", admin, nil, http.StatusOK, nil)
+        call("DELETE", "/roles/"+models.RoleUser, admin, nil, http.StatusConflict, nil)
+
+        // API keys get at most the scopes of their creator
+        call("POST", "/api-keys", carol, map[string]interface{}{"name": "fleet", "scopes": []string{models.PermVehiclesWrite}, "user_id": carolID}, http.StatusForbidden, nil)
+        var key struct {
+            ID  int    `json:"id"`
+            Key string `json:"key"`
+        }
+        call("POST", "/api-keys", admin, map[string]interface{}{"name": "fleet-sync", "scopes": []string{models.PermVehiclesRead}}, http.StatusCreated, &key)
+        if resolved, _, err := store.ResolveAPIKey(ctx, auth.HashToken(key.Key), time.Now()); err != nil || resolved.ID != key.ID {
+            t.Fatalf("resolving the new key gave %+v (%v)", resolved, err)
+        }
+        call("DELETE", fmt.Sprintf("/api-keys/%d", key.ID), admin, nil, http.StatusOK, nil)
+        var keys []models.APIKey
+        call("GET", "/api-keys", admin, nil, http.StatusOK, &keys)
+        if len(keys) != 1 || keys[0].RevokedAt == nil {
+            t.Fatalf("API keys are %+v, want the one revoked key", keys)
+        }
+        if resolved, _, err := store.ResolveAPIKey(ctx, auth.HashToken(key.Key), time.Now()); err == nil {
+            t.Fatalf("revoked key still resolves to %+v", resolved)
+        }
+    })
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+    api := newTestAPI(t)
+    api.customer("carol")
+    first := api.session("carol")
+    otherDevice := api.session("carol")
+
+    second := api.refresh(first.RefreshToken, http.StatusOK)
+    if second.RefreshToken == "" || second.RefreshToken == first.RefreshToken {
+        t.Fatalf("refresh returned refresh token %q, want a new one", second.RefreshToken)
+    }
+    api.createBooking(second.AccessToken)
+    third := api.refresh(second.RefreshToken, http.StatusOK)
+
+    // Replaying a rotated token looks like theft, so the whole family is revoked
+    var errBody apierror.Body
+    api.call("POST", "/refresh", "", map[string]string{"refresh_token": first.RefreshToken}, http.StatusUnauthorized, &errBody)
+    if errBody.Error.Code != "invalid_refresh_token" {
+        t.Fatalf("reused refresh token: got code %q, want invalid_refresh_token", errBody.Error.Code)
+    }
+    api.refresh(third.RefreshToken, http.StatusUnauthorized)
+
+    // Sessions started by other logins are separate families
+    api.refresh(otherDevice.RefreshToken, http.StatusOK)
+    api.refresh("not-a-token", http.StatusUnauthorized)
+}
+
+func TestLogout(t *testing.T) {
+    api := newTestAPI(t)
+    api.customer("carol")
+    session := api.session("carol")
+    otherDevice := api.session("carol")
+    rotated := api.refresh(session.RefreshToken, http.StatusOK)
+
+    // Logging out with the latest token ends the session it belongs to
+    api.call("POST", "/logout", "", map[string]string{"refresh_token": rotated.RefreshToken}, http.StatusOK, nil)
+    api.refresh(rotated.RefreshToken, http.StatusUnauthorized)
+    api.call("POST", "/logout", "", map[string]string{"refresh_token": rotated.RefreshToken}, http.StatusOK, nil)
+
+    api.refresh(otherDevice.RefreshToken, http.StatusOK)
+}
+
+// TestRevokedSessionsRejectAccessTokens checks that access tokens stop
+// working as soon as the sessions they belong to are revoked, rather than
+// when they expire
+func TestRevokedSessionsRejectAccessTokens(t *testing.T) {
+    api := newTestAPI(t)
+    adminToken := api.admin()
+    api.customer("carol")
+    carol := api.session("carol")
+    api.createBooking(carol.AccessToken)
+
+    api.call("DELETE", fmt.Sprintf("/admin/users/%d/sessions", carol.UserID), adminToken, nil, http.StatusOK, nil)
+    api.call("POST", "/user/bookings", carol.AccessToken, map[string]interface{}{
+        "pickup_location":  "Warehouse 4, Dock Road",
+        "dropoff_location": "12 High Street",
+        "vehicle_type":     models.VehicleMedium,
+        "estimated_cost":   42.5,
+    }, http.StatusUnauthorized, nil)
+    api.call("PUT", "/account/password", carol.AccessToken, map[string]string{"current_password": testPassword, "new_password": "Battery-staple-43"}, http.StatusUnauthorized, nil)
+
+    // A new login gets a token of the current epoch
+    carol = api.session("carol")
+    api.createBooking(carol.AccessToken)
+
+    // Changing the role or disabling the account ends sessions the same way
+    api.call("PUT", fmt.Sprintf("/admin/users/%d/role", carol.UserID), adminToken, map[string]string{"role": models.RoleDriver}, http.StatusOK, nil)
+    api.call("GET", "/driver/bookings/pending", carol.AccessToken, nil, http.StatusUnauthorized, nil)
+    driver := api.session("carol")
+    api.call("GET", "/driver/bookings/pending", driver.AccessToken, nil, http.StatusOK, nil)
+    api.call("PUT", fmt.Sprintf("/admin/users/%d/status", carol.UserID), adminToken, map[string]string{"status": models.UserStatusDisabled}, http.StatusOK, nil)
+    api.call("GET", "/driver/bookings/pending", driver.AccessToken, nil, http.StatusUnauthorized, nil)
+}
+
+// totpCode returns the code an authenticator app shows for secret at t
+func totpCode(t *testing.T, secret string, at time.Time) string {
+    t.Helper()
+    code, err := totp.GenerateCode(secret, at)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return code
+}
+
+// enrollMFA sets up TOTP with token, which may be a session or an enrollment
+// token, and returns the secret and the recovery codes
+func (api *testAPI) enrollMFA(token string) (string, []string) {
+    api.t.Helper()
+    var enrollment struct {
+        Secret          string `json:"secret"`
+        ProvisioningURI string `json:"provisioning_uri"`
+    }
+    api.call("POST", "/account/mfa/enroll", token, nil, http.StatusOK, &enrollment)
+    if !strings.HasPrefix(enrollment.ProvisioningURI, "otpauth://totp/") {
+        api.t.Fatalf("provisioning URI is %q", enrollment.ProvisioningURI)
+    }
+    api.call("POST", "/account/mfa/confirm", token, map[string]string{"code": "123-not-a-code"}, http.StatusBadRequest, nil)
+
+    var confirmed struct {
+        RecoveryCodes []string `json:"recovery_codes"`
+    }
+    api.call("POST", "/account/mfa/confirm", token, map[string]string{"code": totpCode(api.t, enrollment.Secret, time.Now())}, http.StatusOK, &confirmed)
+    if len(confirmed.RecoveryCodes) != 10 {
+        api.t.Fatalf("got %d recovery codes, want 10", len(confirmed.RecoveryCodes))
+    }
+    return enrollment.Secret, confirmed.RecoveryCodes
+}
+
+// mfaLogin is the first login step of an account with MFA or an MFA requirement
+type mfaLogin struct {
+    AccessToken           string `json:"access_token"`
+    RefreshToken          string `json:"refresh_token"`
+    MFARequired           bool   `json:"mfa_required"`
+    MFAToken              string `json:"mfa_token"`
+    MFAEnrollmentRequired bool   `json:"mfa_enrollment_required"`
+}
+
+func TestMFALogin(t *testing.T) {
+    api := newTestAPI(t)
+    api.customer("carol")
+    secret, recoveryCodes := api.enrollMFA(api.session("carol").AccessToken)
+
+    // The password alone only gets a challenge
+    var login mfaLogin
+    api.call("POST", "/login", "", map[string]string{"username": "carol", "password": testPassword}, http.StatusOK, &login)
+    if !login.MFARequired || login.MFAToken == "" || login.AccessToken != "" || login.RefreshToken != "" {
+        t.Fatalf("password login of an MFA account returned %+v, want only a challenge", login)
+    }
+    api.call("POST", "/user/bookings", login.MFAToken, nil, http.StatusUnauthorized, nil)
+    api.call("POST", "/login/mfa", "", map[string]string{"mfa_token": login.MFAToken, "code": "000000x"}, http.StatusUnauthorized, nil)
+    var errBody apierror.Body
+    api.call("POST", "/login/mfa", "", map[string]string{"mfa_token": "forged", "code": totpCode(t, secret, time.Now())}, http.StatusUnauthorized, &errBody)
+    if errBody.Error.Code != "invalid_mfa_token" {
+        t.Fatalf("forged MFA token: got code %q, want invalid_mfa_token", errBody.Error.Code)
+    }
+
+    // Enrollment used the current code, so the next one completes the login and can't be replayed
+    code := totpCode(t, secret, time.Now().Add(30*time.Second))
+    var session testSession
+    api.call("POST", "/login/mfa", "", map[string]string{"mfa_token": login.MFAToken, "code": code}, http.StatusOK, &session)
+    api.createBooking(session.AccessToken)
+    api.call("POST", "/login/mfa", "", map[string]string{"mfa_token": login.MFAToken, "code": code}, http.StatusUnauthorized, nil)
+
+    // Recovery codes work once each, in any case
+    api.call("POST", "/login/mfa", "", map[string]string{"mfa_token": login.MFAToken, "recovery_code": " " + strings.ToUpper(recoveryCodes[0]) + " "}, http.StatusOK, nil)
+    api.call("POST", "/login/mfa", "", map[string]string{"mfa_token": login.MFAToken, "recovery_code": recoveryCodes[0]}, http.StatusUnauthorized, nil)
+
+    // Account changes need a fresh second factor; a code already used doesn't count
+    api.call("POST", "/account/mfa/recovery-codes", session.AccessToken, map[string]string{"code": code}, http.StatusForbidden, nil)
+    api.call("DELETE", "/account/mfa", session.AccessToken, map[string]string{"recovery_code": recoveryCodes[0]}, http.StatusForbidden, nil)
+    api.call("DELETE", "/account/mfa", session.AccessToken, map[string]string{"recovery_code": recoveryCodes[1]}, http.StatusOK, nil)
+
+    // Without MFA the password is enough again
+    api.session("carol")
+}
+
+func TestRoleRequiresMFA(t *testing.T) {
+    api := newTestAPI(t)
+    adminToken := api.admin()
+    api.customer("dave")
+    before := api.session("dave")
+
+    api.call("PUT", "/admin/roles/"+models.RoleUser+"/mfa", adminToken, map[string]bool{"required": true}, http.StatusOK, nil)
+
+    // Sessions from before the requirement can't be refreshed into full tokens
+    var refreshed mfaLogin
+    api.call("POST", "/refresh", "", map[string]string{"refresh_token": before.RefreshToken}, http.StatusOK, &refreshed)
+    if !refreshed.MFAEnrollmentRequired || refreshed.RefreshToken != "" {
+        t.Fatalf("refresh after MFA became required returned %+v, want an enrollment token only", refreshed)
+    }
+    api.refresh(before.RefreshToken, http.StatusUnauthorized)
+
+    var login mfaLogin
+    api.call("POST", "/login", "", map[string]string{"username": "dave", "password": testPassword}, http.StatusOK, &login)
+    if !login.MFAEnrollmentRequired || login.AccessToken == "" || login.RefreshToken != "" {
+        t.Fatalf("login without MFA for a role that requires it returned %+v", login)
+    }
+
+    // The enrollment token only works for enrolling
+    enrollToken := login.AccessToken
+    api.call("POST", "/user/bookings", enrollToken, nil, http.StatusUnauthorized, nil)
+    api.call("POST", "/account/mfa/recovery-codes", enrollToken, map[string]string{"code": "000000"}, http.StatusUnauthorized, nil)
+    secret, recoveryCodes := api.enrollMFA(enrollToken)
+
+    api.call("POST", "/login", "", map[string]string{"username": "dave", "password": testPassword}, http.StatusOK, &login)
+    if !login.MFARequired {
+        t.Fatalf("login after enrolling returned %+v, want an MFA challenge", login)
+    }
+    var session testSession
+    api.call("POST", "/login/mfa", "", map[string]string{"mfa_token": login.MFAToken, "code": totpCode(t, secret, time.Now().Add(30*time.Second))}, http.StatusOK, &session)
+    api.refresh(session.RefreshToken, http.StatusOK)
+
+    // MFA can't be turned off while the role requires it
+    var errBody apierror.Body
+    api.call("DELETE", "/account/mfa", session.AccessToken, map[string]string{"recovery_code": recoveryCodes[0]}, http.StatusConflict, &errBody)
+    if errBody.Error.Code != "mfa_required_for_role" {
+        t.Fatalf("disabling required MFA: got code %q, want mfa_required_for_role", errBody.Error.Code)
+    }
+}
+
+func TestCORSPreflight(t *testing.T) {
+    api := newTestAPI(t)
+    preflight := func(origin, header string) *http.Response {
+        t.Helper()
+        req, err := http.NewRequest("OPTIONS", api.server.URL+"/admin/bookings", nil)
+        if err != nil {
+            t.Fatal(err)
+        }
+        req.Header.Set("Origin", origin)
+        req.Header.Set("Access-Control-Request-Method", "GET")
+        req.Header.Set("Access-Control-Request-Headers", header)
+        resp, err := api.server.Client().Do(req)
+        if err != nil {
+            t.Fatal(err)
+        }
+        resp.Body.Close()
+        return resp
+    }
+
+    for _, header := range []string{"Authorization", "X-API-Key", "X-Request-ID"} {
+        resp := preflight("http://localhost:5173", header)
+        if resp.StatusCode != http.StatusOK || resp.Header.Get("Access-Control-Allow-Origin") != "http://localhost:5173" {
+            t.Errorf("preflight with %s: got status %d and allowed origin %q", header, resp.StatusCode, resp.Header.Get("Access-Control-Allow-Origin"))
+        }
+    }
+    if resp := preflight("https://evil.example", "Authorization"); resp.Header.Get("Access-Control-Allow-Origin") != "" {
+        t.Errorf("preflight from an unknown origin was allowed for %q", resp.Header.Get("Access-Control-Allow-Origin"))
+    }
+}
+
+func TestBookingsOverTime(t *testing.T) {
+    api := newTestAPI(t)
+    adminToken := api.admin()
+    customerToken := api.customer("carol")
+    api.createBooking(customerToken)
+
+    // A booking from just before the week started, written by another client
+    // as ISO 8601, compares as a time rather than as text
+    old := api.createBooking(customerToken)
+    createdAt := time.Now().UTC().AddDate(0, 0, -7).Add(-time.Hour).Format("2006-01-02T15:04:05Z")
+    if _, err := api.db.Exec(`UPDATE bookings SET created_at = $1 WHERE id = $2`, createdAt, old); err != nil {
+        t.Fatal(err)
+    }
+
+    var days []models.BookingsOverTime
+    api.call("GET", "/admin/analytics/bookings-over-time", adminToken, nil, http.StatusOK, &days)
+    total := 0
+    for _, d := range days {
+        total += d.Count
+    }
+    if total != 1 {
+        t.Fatalf("bookings over the last week are %+v, want just the new one", days)
+    }
+}
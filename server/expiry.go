@@ -0,0 +1,36 @@
+package main
+
+import (
+    "context"
+    "log/slog"
+    "time"
+
+    "fmc/metrics"
+    "fmc/models"
+)
+
+// expiryInterval is how often pending bookings are checked for expiry
+const expiryInterval = time.Minute
+
+// expireBookings expires bookings left pending for longer than ttl until ctx
+// is cancelled. Every instance runs it; expiring a booking twice is harmless.
+func expireBookings(ctx context.Context, bookings models.BookingStore, ttl time.Duration, logger *slog.Logger) {
+    ticker := time.NewTicker(expiryInterval)
+    defer ticker.Stop()
+    for {
+        expired, err := bookings.ExpireBookings(ctx, time.Now().Add(-ttl))
+        if err != nil && ctx.Err() == nil {
+            logger.Error("Error expiring pending bookings", "error", err)
+        }
+        if expired > 0 {
+            metrics.BookingsExpired.Add(float64(expired))
+            logger.Info("Expired pending bookings", "count", expired)
+        }
+
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+        }
+    }
+}
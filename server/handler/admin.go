@@ -1,50 +1,58 @@
 package handler
 
 import (
-    "database/sql"
     "encoding/json"
     "net/http"
-	"log"
     "github.com/gorilla/mux"
+    "strconv"
     "time"
-    
+
+    "fmc/apierror"
+    "fmc/auth"
+    "fmc/logging"
+    "fmc/metrics"
     "fmc/models"
 )
 
-func GetAllVehiclesHandler(db *sql.DB) http.HandlerFunc {
+// GetAllVehiclesHandler returns a page of the fleet, see parseListQuery for the parameters
+func GetAllVehiclesHandler(vehicles models.VehicleStore) http.HandlerFunc {
     return func(w http.ResponseWriter, r *http.Request) {
-        vehicles, err := models.FetchAllVehicles(db)
+        q, err := parseListQuery(r, models.VehicleListSpec)
         if err != nil {
-            http.Error(w, "Could not fetch vehicles", http.StatusInternalServerError)
+            apierror.Write(w, r, err)
             return
         }
 
-        json.NewEncoder(w).Encode(vehicles)
+        fleet, next, err := vehicles.ListVehicles(r.Context(), q)
+        if err != nil {
+            logging.FromContext(r.Context()).Error("Error fetching vehicles", "error", err)
+            apierror.Respond(w, r, http.StatusInternalServerError, "Could not fetch vehicles")
+            return
+        }
+
+        writePage(w, fleet, next)
     }
 }
 
-func CreateVehicleHandler(db *sql.DB) http.HandlerFunc {
+func CreateVehicleHandler(vehicles models.VehicleStore) http.HandlerFunc {
     return func(w http.ResponseWriter, r *http.Request) {
         var req struct {
-            Type         string `json:"type"`
+            Type         string `json:"type" validate:"required,oneof=small medium large"`
             Availability bool   `json:"availability"`
         }
 
-        // Parse the JSON request body
-        err := json.NewDecoder(r.Body).Decode(&req)
-        if err != nil {
-            http.Error(w, "Invalid request payload", http.StatusBadRequest)
+        // Parse and validate the JSON request body
+        if !decodeJSON(w, r, &req) {
             return
         }
 
         // Create the vehicle in the database
-        vehicleID, err := models.CreateVehicle(db, req.Type, req.Availability)
+        vehicleID, err := vehicles.CreateVehicle(r.Context(), req.Type, req.Availability, auditActor(r))
         if err != nil {
-            log.Printf("Error creating vehicle: %v", err)
-            http.Error(w, "Could not create vehicle", http.StatusInternalServerError)
+            logging.FromContext(r.Context()).Error("Error creating vehicle", "error", err)
+            apierror.Respond(w, r, http.StatusInternalServerError, "Could not create vehicle")
             return
         }
-
         // Return a success response
         json.NewEncoder(w).Encode(map[string]interface{}{
             "message":    "Vehicle created",
@@ -53,241 +61,286 @@ func CreateVehicleHandler(db *sql.DB) http.HandlerFunc {
     }
 }
 
-// GetAllBookingsHandler fetches all bookings for admin
-func GetAllBookingsHandler(db *sql.DB) http.HandlerFunc {
+// GetVehicleHandler returns one vehicle, including retired ones
+func GetVehicleHandler(vehicles models.VehicleStore) http.HandlerFunc {
     return func(w http.ResponseWriter, r *http.Request) {
-        rows, err := db.Query(`SELECT id, user_id, driver_id, pickup_location, dropoff_location, vehicle_type, estimated_cost, status FROM bookings`)
+        vehicleID, ok := routeVehicleID(w, r)
+        if !ok {
+            return
+        }
+
+        vehicle, err := vehicles.GetVehicle(r.Context(), vehicleID)
+        if err != nil {
+            apierror.Write(w, r, err)
+            return
+        }
+
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(vehicle)
+    }
+}
+
+// UpdateVehicleHandler changes the type or availability of a vehicle. Fields
+// left out of the request keep their value.
+func UpdateVehicleHandler(vehicles models.VehicleStore) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        vehicleID, ok := routeVehicleID(w, r)
+        if !ok {
+            return
+        }
+
+        var req struct {
+            Type         *string `json:"type" validate:"oneof=small medium large"`
+            Availability *bool   `json:"availability"`
+        }
+        if !decodeJSON(w, r, &req) {
+            return
+        }
+        if req.Type == nil && req.Availability == nil {
+            apierror.Write(w, r, models.Validation("empty_update", "", "Nothing to update, pass type or availability"))
+            return
+        }
+
+        err := vehicles.UpdateVehicle(r.Context(), vehicleID, models.VehicleUpdate{Type: req.Type, Availability: req.Availability}, auditActor(r))
         if err != nil {
-            log.Printf("Error fetching bookings: %v", err)
-            http.Error(w, "Error fetching bookings", http.StatusInternalServerError)
+            apierror.Write(w, r, err)
             return
         }
-        defer rows.Close()
-
-        var bookings []struct {
-            ID             int     `json:"id"`
-            UserID         int     `json:"user_id"`
-            DriverID       *int    `json:"driver_id"` // Pointer to handle NULL values
-            PickupLocation string  `json:"pickup_location"`
-            DropoffLocation string `json:"dropoff_location"`
-            VehicleType    string  `json:"vehicle_type"`
-            EstimatedCost  float64 `json:"estimated_cost"`
-            Status         string  `json:"status"`
-        }
-
-        for rows.Next() {
-            var booking struct {
-                ID             int     `json:"id"`
-                UserID         int     `json:"user_id"`
-                DriverID       *int    `json:"driver_id"`
-                PickupLocation string  `json:"pickup_location"`
-                DropoffLocation string `json:"dropoff_location"`
-                VehicleType    string  `json:"vehicle_type"`
-                EstimatedCost  float64 `json:"estimated_cost"`
-                Status         string  `json:"status"`
-            }
-            err := rows.Scan(&booking.ID, &booking.UserID, &booking.DriverID, &booking.PickupLocation, &booking.DropoffLocation, &booking.VehicleType, &booking.EstimatedCost, &booking.Status)
-            if err != nil {
-                log.Printf("Error scanning booking row: %v", err)
-                http.Error(w, "Error processing bookings", http.StatusInternalServerError)
-                return
-            }
-            bookings = append(bookings, booking)
+        after, err := vehicles.GetVehicle(r.Context(), vehicleID)
+        if err != nil {
+            apierror.Write(w, r, err)
+            return
         }
 
         w.Header().Set("Content-Type", "application/json")
-        json.NewEncoder(w).Encode(bookings)
+        json.NewEncoder(w).Encode(after)
     }
 }
 
-// CompleteBookingHandler marks a booking as complete
-func CompleteBookingHandler(db *sql.DB) http.HandlerFunc {
+// RetireVehicleHandler takes a vehicle out of the fleet. The row is kept for
+// the bookings that reference it.
+func RetireVehicleHandler(vehicles models.VehicleStore) http.HandlerFunc {
     return func(w http.ResponseWriter, r *http.Request) {
-        bookingID := mux.Vars(r)["id"]
+        vehicleID, ok := routeVehicleID(w, r)
+        if !ok {
+            return
+        }
 
-        query := `UPDATE bookings SET status = 'completed' WHERE id = $1 AND status = 'accepted'`
-        result, err := db.Exec(query, bookingID)
+        err := vehicles.RetireVehicle(r.Context(), vehicleID, time.Now(), auditActor(r))
         if err != nil {
-            log.Printf("Error marking booking as complete: %v", err)
-            http.Error(w, "Error completing booking", http.StatusInternalServerError)
+            apierror.Write(w, r, err)
             return
         }
 
-        rowsAffected, err := result.RowsAffected()
-        if err != nil || rowsAffected == 0 {
-            http.Error(w, "No booking found or booking is not in an accepted state", http.StatusBadRequest)
+        json.NewEncoder(w).Encode(map[string]string{"message": "Vehicle retired"})
+    }
+}
+
+// AssignVehicleHandler hands a vehicle to a driver, who can then accept
+// bookings for its type
+func AssignVehicleHandler(vehicles models.VehicleStore) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        vehicleID, ok := routeVehicleID(w, r)
+        if !ok {
             return
         }
 
-        w.WriteHeader(http.StatusOK)
-        json.NewEncoder(w).Encode(map[string]string{"message": "Booking marked as complete"})
+        var req struct {
+            DriverID int `json:"driver_id" validate:"required"`
+        }
+        if !decodeJSON(w, r, &req) {
+            return
+        }
+
+        err := vehicles.AssignVehicle(r.Context(), vehicleID, req.DriverID, time.Now(), auditActor(r))
+        if err != nil {
+            apierror.Write(w, r, err)
+            return
+        }
+
+        json.NewEncoder(w).Encode(map[string]string{"message": "Vehicle assigned"})
     }
 }
 
-// GetDriverActiveBookingsCount fetches the count of active bookings for each driver
-func GetDriverActiveBookingsCount(db *sql.DB) http.HandlerFunc {
+// UnassignVehicleHandler takes a vehicle away from its driver
+func UnassignVehicleHandler(vehicles models.VehicleStore) http.HandlerFunc {
     return func(w http.ResponseWriter, r *http.Request) {
-        rows, err := db.Query(`
-            SELECT driver_id, COUNT(*) as active_bookings
-            FROM bookings
-            WHERE status = 'accepted'
-            GROUP BY driver_id
-        `)
+        vehicleID, ok := routeVehicleID(w, r)
+        if !ok {
+            return
+        }
+
+        err := vehicles.UnassignVehicle(r.Context(), vehicleID, time.Now(), auditActor(r))
         if err != nil {
-            log.Printf("Error fetching driver active bookings: %v", err)
-            http.Error(w, "Error fetching driver active bookings", http.StatusInternalServerError)
+            apierror.Write(w, r, err)
             return
         }
-        defer rows.Close()
 
-        var driverBookings []struct {
-            DriverID      int `json:"driver_id"`
-            ActiveBookings int `json:"active_bookings"`
+        json.NewEncoder(w).Encode(map[string]string{"message": "Vehicle unassigned"})
+    }
+}
+
+// ListAssignmentsHandler returns a page of the history of who drove what
+// when, filtered by vehicle_id, driver_id or assigned_at_from/to. See
+// parseListQuery for paging and sorting.
+func ListAssignmentsHandler(vehicles models.VehicleStore) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        q, err := parseListQuery(r, models.AssignmentListSpec)
+        if err != nil {
+            apierror.Write(w, r, err)
+            return
         }
 
-        for rows.Next() {
-            var db struct {
-                DriverID      int `json:"driver_id"`
-                ActiveBookings int `json:"active_bookings"`
-            }
-            err := rows.Scan(&db.DriverID, &db.ActiveBookings)
-            if err != nil {
-                log.Printf("Error scanning row: %v", err)
-                http.Error(w, "Error processing data", http.StatusInternalServerError)
-                return
-            }
-            driverBookings = append(driverBookings, db)
+        assignments, next, err := vehicles.ListAssignments(r.Context(), q)
+        if err != nil {
+            logging.FromContext(r.Context()).Error("Error fetching vehicle assignments", "error", err)
+            apierror.Respond(w, r, http.StatusInternalServerError, "Error fetching vehicle assignments")
+            return
         }
 
-        w.Header().Set("Content-Type", "application/json")
-        json.NewEncoder(w).Encode(driverBookings)
+        writePage(w, assignments, next)
     }
 }
 
-type VehicleStatus struct {
-    Active int `json:"active"`
-    Idle   int `json:"idle"`
+// routeVehicleID parses the {id} route variable of vehicle routes
+func routeVehicleID(w http.ResponseWriter, r *http.Request) (int, bool) {
+    vehicleID, err := strconv.Atoi(mux.Vars(r)["id"])
+    if err != nil {
+        apierror.Respond(w, r, http.StatusBadRequest, "Invalid vehicle ID")
+        return 0, false
+    }
+    return vehicleID, true
 }
 
-func GetVehicleStatus(db *sql.DB) http.HandlerFunc {
+// GetAllBookingsHandler returns a page of bookings for admins, filtered by
+// status, user_id, driver_id, vehicle_type, estimated_cost_min/max and
+// created_at_from/to. See parseListQuery for paging and sorting.
+func GetAllBookingsHandler(bookings models.BookingStore) http.HandlerFunc {
     return func(w http.ResponseWriter, r *http.Request) {
-        var status VehicleStatus
-
-        // Count active vehicles (in use)
-        err := db.QueryRow(`SELECT COUNT(*) FROM vehicles WHERE availability = FALSE`).Scan(&status.Active)
+        q, err := parseListQuery(r, models.BookingListSpec)
         if err != nil {
-            http.Error(w, "Error fetching active vehicles", http.StatusInternalServerError)
+            apierror.Write(w, r, err)
             return
         }
 
-        // Count idle vehicles (available)
-        err = db.QueryRow(`SELECT COUNT(*) FROM vehicles WHERE availability = TRUE`).Scan(&status.Idle)
+        all, next, err := bookings.ListBookings(r.Context(), q)
         if err != nil {
-            http.Error(w, "Error fetching idle vehicles", http.StatusInternalServerError)
+            logging.FromContext(r.Context()).Error("Error fetching bookings", "error", err)
+            apierror.Respond(w, r, http.StatusInternalServerError, "Error fetching bookings")
             return
         }
 
-        w.Header().Set("Content-Type", "application/json")
-        json.NewEncoder(w).Encode(status)
+        writePage(w, all, next)
     }
 }
-type DriverPerformance struct {
-    DriverName   string `json:"driver_name"`
-    Deliveries   int    `json:"deliveries"`
+
+// CompleteBookingHandler marks a booking as complete. Admins may close a trip
+// at any stage once a driver has accepted it.
+func CompleteBookingHandler(bookings models.BookingStore) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if changeBookingStatus(w, r, bookings, models.BookingCompleted, models.ActorAdmin) == nil {
+            return
+        }
+        metrics.BookingsCompleted.Inc()
+
+        w.WriteHeader(http.StatusOK)
+        json.NewEncoder(w).Encode(map[string]string{"message": "Booking marked as complete"})
+    }
 }
 
-func GetDriverPerformance(db *sql.DB) http.HandlerFunc {
+// RevokeUserSessionsHandler revokes every refresh token of a user, e.g. when a
+// driver leaves. Access tokens already issued are rejected from then on.
+func RevokeUserSessionsHandler(users models.UserStore, authz *auth.Authorizer) http.HandlerFunc {
     return func(w http.ResponseWriter, r *http.Request) {
-        rows, err := db.Query(`
-            SELECT drivers.name, COUNT(bookings.id) 
-            FROM drivers 
-            JOIN bookings ON drivers.id = bookings.driver_id
-            WHERE bookings.status = 'completed'
-            GROUP BY drivers.name
-        `)
+        userID, err := strconv.Atoi(mux.Vars(r)["id"])
         if err != nil {
-            http.Error(w, "Error fetching driver performance", http.StatusInternalServerError)
+            apierror.Respond(w, r, http.StatusBadRequest, "Invalid user ID")
             return
         }
-        defer rows.Close()
 
-        var data []DriverPerformance
-        for rows.Next() {
-            var performance DriverPerformance
-            if err := rows.Scan(&performance.DriverName, &performance.Deliveries); err != nil {
-                http.Error(w, "Error processing data", http.StatusInternalServerError)
-                return
-            }
-            data = append(data, performance)
+        revoked, err := users.RevokeUserSessions(r.Context(), userID, auditActor(r))
+        if err != nil {
+            logging.FromContext(r.Context()).Error("Error revoking sessions", "target_user_id", userID, "error", err)
+            apierror.Respond(w, r, http.StatusInternalServerError, "Error revoking sessions")
+            return
         }
+        authz.InvalidateUser(userID)
 
-        w.Header().Set("Content-Type", "application/json")
-        json.NewEncoder(w).Encode(data)
+        json.NewEncoder(w).Encode(map[string]interface{}{
+            "message":          "Sessions revoked",
+            "revoked_sessions": revoked,
+        })
     }
 }
-type RevenueData struct {
-    Date    time.Time `json:"date"`
-    Revenue float64   `json:"revenue"`
+
+// GetDriverActiveBookingsCount fetches the count of active bookings for each driver
+func GetDriverActiveBookingsCount(analytics models.AnalyticsStore) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        driverBookings, err := analytics.FetchDriverActiveBookings(r.Context())
+        if err != nil {
+            logging.FromContext(r.Context()).Error("Error fetching driver active bookings", "error", err)
+            apierror.Respond(w, r, http.StatusInternalServerError, "Error fetching driver active bookings")
+            return
+        }
+
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(driverBookings)
+    }
 }
 
-func GetRevenueOverTime(db *sql.DB) http.HandlerFunc {
+func GetVehicleStatus(analytics models.AnalyticsStore) http.HandlerFunc {
     return func(w http.ResponseWriter, r *http.Request) {
-        rows, err := db.Query(`
-            SELECT date_trunc('day', created_at) AS day, SUM(estimated_cost) 
-            FROM bookings 
-            WHERE status = 'completed' 
-            GROUP BY day
-            ORDER BY day
-        `)
+        // Count active (in use) and idle (available) vehicles
+        status, err := analytics.FetchVehicleStatus(r.Context())
         if err != nil {
-            http.Error(w, "Error fetching revenue data", http.StatusInternalServerError)
+            logging.FromContext(r.Context()).Error("Error fetching vehicle status", "error", err)
+            apierror.Respond(w, r, http.StatusInternalServerError, "Error fetching vehicle status")
             return
         }
-        defer rows.Close()
 
-        var data []RevenueData
-        for rows.Next() {
-            var revenue RevenueData
-            if err := rows.Scan(&revenue.Date, &revenue.Revenue); err != nil {
-                http.Error(w, "Error processing data", http.StatusInternalServerError)
-                return
-            }
-            data = append(data, revenue)
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(status)
+    }
+}
+
+func GetDriverPerformance(analytics models.AnalyticsStore) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        data, err := analytics.FetchDriverPerformance(r.Context())
+        if err != nil {
+            logging.FromContext(r.Context()).Error("Error fetching driver performance", "error", err)
+            apierror.Respond(w, r, http.StatusInternalServerError, "Error fetching driver performance")
+            return
         }
 
         w.Header().Set("Content-Type", "application/json")
         json.NewEncoder(w).Encode(data)
     }
 }
-type BookingStatus struct {
-    Status string `json:"status"`
-    Count  int    `json:"count"`
-}
 
-func GetBookingStatusDistribution(db *sql.DB) http.HandlerFunc {
+func GetRevenueOverTime(analytics models.AnalyticsStore) http.HandlerFunc {
     return func(w http.ResponseWriter, r *http.Request) {
-        rows, err := db.Query(`
-            SELECT status, COUNT(*) 
-            FROM bookings 
-            GROUP BY status
-        `)
+        data, err := analytics.FetchRevenueOverTime(r.Context())
         if err != nil {
-            http.Error(w, "Error fetching booking statuses", http.StatusInternalServerError)
+            logging.FromContext(r.Context()).Error("Error fetching revenue over time", "error", err)
+            apierror.Respond(w, r, http.StatusInternalServerError, "Error fetching revenue data")
             return
         }
-        defer rows.Close()
 
-        var data []BookingStatus
-        for rows.Next() {
-            var status BookingStatus
-            if err := rows.Scan(&status.Status, &status.Count); err != nil {
-                http.Error(w, "Error processing data", http.StatusInternalServerError)
-                return
-            }
-            data = append(data, status)
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(data)
+    }
+}
+
+func GetBookingStatusDistribution(analytics models.AnalyticsStore) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        data, err := analytics.FetchBookingStatusDistribution(r.Context())
+        if err != nil {
+            logging.FromContext(r.Context()).Error("Error fetching booking status distribution", "error", err)
+            apierror.Respond(w, r, http.StatusInternalServerError, "Error fetching booking statuses")
+            return
         }
 
         w.Header().Set("Content-Type", "application/json")
         json.NewEncoder(w).Encode(data)
     }
-}
\ No newline at end of file
+}
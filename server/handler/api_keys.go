@@ -0,0 +1,166 @@
+package handler
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "net/http"
+    "regexp"
+    "strconv"
+    "strings"
+    "time"
+
+    "fmc/apierror"
+    "fmc/auth"
+    "fmc/logging"
+    "fmc/models"
+
+    "github.com/gorilla/mux"
+)
+
+var serviceNameCleaner = regexp.MustCompile(`[^a-z0-9]+`)
+
+// APIKeyResolver maps an API key presented to the auth middleware to the service principal it acts as
+func APIKeyResolver(keys models.APIKeyStore) auth.APIKeyResolver {
+    return func(ctx context.Context, key string) (*auth.Principal, error) {
+        apiKey, role, err := keys.ResolveAPIKey(ctx, auth.HashToken(key), time.Now())
+        if errors.Is(err, models.ErrInvalidAPIKey) {
+            return nil, auth.ErrInvalidToken
+        }
+        if err != nil {
+            return nil, err
+        }
+        return &auth.Principal{UserID: apiKey.UserID, Role: role, APIKeyID: apiKey.ID, Scopes: apiKey.Scopes}, nil
+    }
+}
+
+// CreateAPIKeyHandler issues a scoped API key. Scopes must be permissions the
+// caller holds, other than managing roles or API keys. Without a user_id a new
+// service account named after the key is created. The key itself is only
+// returned here.
+func CreateAPIKeyHandler(keys models.APIKeyStore, roles models.RoleStore) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        principal, ok := auth.FromContext(r.Context())
+        if !ok {
+            apierror.Respond(w, r, http.StatusUnauthorized, "Unauthorized")
+            return
+        }
+
+        var req struct {
+            Name      string     `json:"name" validate:"required,max=50"`
+            Scopes    []string   `json:"scopes" validate:"required"`
+            UserID    int        `json:"user_id" validate:"min=1"`
+            ExpiresAt *time.Time `json:"expires_at"`
+        }
+        if !decodeJSON(w, r, &req) {
+            return
+        }
+
+        req.Name = strings.TrimSpace(req.Name)
+        if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+            apierror.Write(w, r, models.InvalidFields("validation_failed", models.FieldError{Field: "expires_at", Message: "must be in the future"}))
+            return
+        }
+
+        // A key gets at most what its creator holds, so managing keys doesn't
+        // hand out more access than the creator's role has
+        held, err := heldPermissions(r.Context(), roles, principal)
+        if err != nil {
+            logging.FromContext(r.Context()).Error("Error loading role permissions", "error", err)
+            apierror.Respond(w, r, http.StatusInternalServerError, "Error creating API key")
+            return
+        }
+        if err := keys.CheckAPIKeyScopes(r.Context(), req.Scopes, held); err != nil {
+            apierror.Write(w, r, err)
+            return
+        }
+
+        key, prefix, err := auth.NewAPIKey()
+        if err != nil {
+            logging.FromContext(r.Context()).Error("Error generating API key", "error", err)
+            apierror.Respond(w, r, http.StatusInternalServerError, "Error creating API key")
+            return
+        }
+
+        if req.UserID == 0 {
+            req.UserID, err = createServiceAccount(r.Context(), keys, req.Name, auditActor(r))
+            if errors.Is(err, models.ErrUsernameTaken) {
+                apierror.RespondCode(w, r, http.StatusConflict, "username_taken", "A service account with this name already exists, pass its user_id")
+                return
+            }
+            if err != nil {
+                apierror.Write(w, r, err)
+                return
+            }
+        }
+
+        createdBy := principal.UserID
+        apiKey := models.APIKey{
+            Name:      req.Name,
+            Prefix:    prefix,
+            UserID:    req.UserID,
+            Scopes:    req.Scopes,
+            CreatedBy: &createdBy,
+            ExpiresAt: req.ExpiresAt,
+        }
+        keyID, err := keys.CreateAPIKey(r.Context(), apiKey, auth.HashToken(key), auditActor(r))
+        if err != nil {
+            apierror.Write(w, r, err)
+            return
+        }
+
+        w.Header().Set("Cache-Control", "no-store")
+        w.WriteHeader(http.StatusCreated)
+        json.NewEncoder(w).Encode(map[string]interface{}{
+            "message": "API key created, store it now as it won't be shown again",
+            "id":      keyID,
+            "key":     key,
+            "prefix":  prefix,
+            "user_id": req.UserID,
+        })
+    }
+}
+
+// ListAPIKeysHandler lists API keys without their secrets
+func ListAPIKeysHandler(keys models.APIKeyStore) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        all, err := keys.FetchAllAPIKeys(r.Context())
+        if err != nil {
+            logging.FromContext(r.Context()).Error("Error fetching API keys", "error", err)
+            apierror.Respond(w, r, http.StatusInternalServerError, "Error fetching API keys")
+            return
+        }
+
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(all)
+    }
+}
+
+// RevokeAPIKeyHandler revokes an API key
+func RevokeAPIKeyHandler(keys models.APIKeyStore) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        keyID, err := strconv.Atoi(mux.Vars(r)["id"])
+        if err != nil {
+            apierror.Respond(w, r, http.StatusBadRequest, "Invalid API key ID")
+            return
+        }
+
+        err = keys.RevokeAPIKey(r.Context(), keyID, auditActor(r))
+        if err != nil {
+            apierror.Write(w, r, err)
+            return
+        }
+
+        json.NewEncoder(w).Encode(map[string]string{"message": "API key revoked"})
+    }
+}
+
+// createServiceAccount creates the service user a new API key acts as
+func createServiceAccount(ctx context.Context, keys models.APIKeyStore, keyName string, by models.AuditActor) (int, error) {
+    password, err := auth.NewOpaqueToken()
+    if err != nil {
+        return 0, err
+    }
+    username := "service-" + strings.Trim(serviceNameCleaner.ReplaceAllString(strings.ToLower(keyName), "-"), "-")
+    return keys.CreateServiceAccount(ctx, username, password, by)
+}
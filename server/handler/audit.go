@@ -0,0 +1,97 @@
+package handler
+
+import (
+    "encoding/json"
+    "fmc/apierror"
+    "fmc/auth"
+    "fmc/logging"
+    "fmc/middleware"
+    "fmc/models"
+    "net/http"
+    "strconv"
+    "time"
+)
+
+const (
+    defaultAuditLimit = 100
+    maxAuditLimit     = 500
+)
+
+// auditActor returns who makes the request, for the model function to record
+// in the audit entry of the change it makes
+func auditActor(r *http.Request) models.AuditActor {
+    var by models.AuditActor
+    if principal, ok := auth.FromContext(r.Context()); ok {
+        by.UserID = &principal.UserID
+        by.Role = &principal.Role
+        if principal.IsAPIKey() {
+            by.APIKeyID = &principal.APIKeyID
+        }
+    }
+    if ip := middleware.ClientIP(r); ip != "" {
+        by.IP = &ip
+    }
+    if requestID := middleware.RequestIDFromContext(r.Context()); requestID != "" {
+        by.RequestID = &requestID
+    }
+    return by
+}
+
+// ListAuditHandler queries the audit log. Supported filters are actor_user_id,
+// action, entity_type, entity_id, from and to (RFC 3339), before_id and limit.
+func ListAuditHandler(audit models.AuditStore) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        query := r.URL.Query()
+        filter := models.AuditFilter{
+            Action:     query.Get("action"),
+            EntityType: query.Get("entity_type"),
+            EntityID:   query.Get("entity_id"),
+            Limit:      defaultAuditLimit,
+        }
+
+        var err error
+        if v := query.Get("actor_user_id"); v != "" {
+            if filter.ActorUserID, err = strconv.Atoi(v); err != nil {
+                apierror.Respond(w, r, http.StatusBadRequest, "Invalid actor_user_id")
+                return
+            }
+        }
+        if v := query.Get("before_id"); v != "" {
+            if filter.BeforeID, err = strconv.ParseInt(v, 10, 64); err != nil {
+                apierror.Respond(w, r, http.StatusBadRequest, "Invalid before_id")
+                return
+            }
+        }
+        if v := query.Get("from"); v != "" {
+            if filter.From, err = time.Parse(time.RFC3339, v); err != nil {
+                apierror.Respond(w, r, http.StatusBadRequest, "Invalid from, expected RFC 3339 time")
+                return
+            }
+        }
+        if v := query.Get("to"); v != "" {
+            if filter.To, err = time.Parse(time.RFC3339, v); err != nil {
+                apierror.Respond(w, r, http.StatusBadRequest, "Invalid to, expected RFC 3339 time")
+                return
+            }
+        }
+        if v := query.Get("limit"); v != "" {
+            if filter.Limit, err = strconv.Atoi(v); err != nil || filter.Limit < 1 {
+                apierror.Respond(w, r, http.StatusBadRequest, "Invalid limit")
+                return
+            }
+            if filter.Limit > maxAuditLimit {
+                filter.Limit = maxAuditLimit
+            }
+        }
+
+        entries, err := audit.QueryAudit(r.Context(), filter)
+        if err != nil {
+            logging.FromContext(r.Context()).Error("Error querying audit log", "error", err)
+            apierror.Respond(w, r, http.StatusInternalServerError, "Error fetching audit log")
+            return
+        }
+
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(entries)
+    }
+}
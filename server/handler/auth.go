@@ -1,72 +1,298 @@
 package handler
 
 import (
-    "database/sql"
+    "context"
     "encoding/json"
+    "errors"
+    "math"
     "net/http"
+    "strconv"
+    "time"
+    "fmc/apierror"
+    "fmc/auth"
+    "fmc/logging"
+    "fmc/middleware"
     "fmc/models"
-    "log"
 )
 
-func RegisterHandler(db *sql.DB) http.HandlerFunc {
+func RegisterHandler(users models.UserStore) http.HandlerFunc {
     return func(w http.ResponseWriter, r *http.Request) {
+        // Public sign-up may only create customers or drivers
         var req struct {
-            Username string `json:"username"`
-            Password string `json:"password"`
-            Role     string `json:"role"`
+            Username string `json:"username" validate:"required,max=50"`
+            Email    string `json:"email" validate:"max=254,email"`
+            Password string `json:"password" validate:"required,max=72"`
+            Role     string `json:"role" validate:"oneof=user driver"`
         }
 
-        err := json.NewDecoder(r.Body).Decode(&req)
-        if err != nil {
-            http.Error(w, "Invalid request", http.StatusBadRequest)
+        if !decodeJSON(w, r, &req) {
             return
         }
-
-        // Validate input
-        if req.Username == "" || req.Password == "" || req.Role == "" {
-            http.Error(w, "All fields are required", http.StatusBadRequest)
+        if err := models.ValidatePassword(req.Password); err != nil {
+            apierror.Write(w, r, err)
             return
         }
 
+        // Drivers wait for admin approval
+        status := models.UserStatusActive
+        switch req.Role {
+        case "":
+            req.Role = models.RoleUser
+        case models.RoleDriver:
+            status = models.UserStatusPending
+        }
+
         // Register the user in the database
-        err = models.RegisterUser(db, req.Username, req.Password, req.Role)
+        _, err := users.RegisterUser(r.Context(), req.Username, req.Email, req.Password, req.Role, status, auditActor(r))
         if err != nil {
-            // Log and return error if registration failed
-            log.Printf("Error registering user: %v", err)
-            http.Error(w, "Error registering user", http.StatusInternalServerError)
+            apierror.Write(w, r, err)
             return
         }
 
+        message := "User registered"
+        if status == models.UserStatusPending {
+            message = "Driver registered, pending admin approval"
+        }
+
         // Success
         w.WriteHeader(http.StatusCreated)
-        json.NewEncoder(w).Encode(map[string]string{"message": "User registered"})
+        json.NewEncoder(w).Encode(map[string]string{"message": message, "status": status})
+    }
+}
+
+// LoginHandler checks credentials and starts a session. Failed attempts are
+// throttled per submitted username and per client IP; a blocked key is
+// rejected before any password hashing happens.
+func LoginHandler(users models.UserStore, roles models.RoleStore, sessions models.SessionStore, throttles models.ThrottleStore, tokens *auth.TokenManager, throttle models.LoginThrottle) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        var req struct {
+            Username string `json:"username" validate:"required"`
+            Password string `json:"password" validate:"required"`
+        }
+
+        if !decodeJSON(w, r, &req) {
+            return
+        }
+
+        now := time.Now()
+        userKey := models.UserThrottleKey(req.Username)
+        ipKey := models.IPThrottleKey(middleware.ClientIP(r))
+
+        lockedUntil, err := throttles.LoginLockedUntil(r.Context(), now, userKey, ipKey)
+        if err != nil {
+            logging.FromContext(r.Context()).Error("Error checking login throttle", "error", err)
+            apierror.Respond(w, r, http.StatusInternalServerError, "Could not log in")
+            return
+        }
+        if !lockedUntil.IsZero() {
+            writeTooManyAttempts(w, r, lockedUntil.Sub(now))
+            return
+        }
+
+        user, err := users.AuthenticateUser(r.Context(), req.Username, req.Password)
+        if errors.Is(err, models.ErrInvalidCredentials) {
+            recordLoginFailure(r.Context(), throttles, throttle, userKey, ipKey, now)
+        }
+        if err != nil {
+            apierror.Write(w, r, err)
+            return
+        }
+
+        // The password alone is not enough for accounts with a second factor
+        if user.MFAEnabled {
+            writeMFAChallenge(w, r, tokens, user)
+            return
+        }
+
+        mfaRequired, err := roles.RoleRequiresMFA(r.Context(), user.Role)
+        if err != nil {
+            logging.FromContext(r.Context()).Error("Error checking MFA requirement", "role", user.Role, "error", err)
+            apierror.Respond(w, r, http.StatusInternalServerError, "Could not log in")
+            return
+        }
+        if mfaRequired {
+            writeMFAEnrollmentRequired(w, r, tokens, user)
+            return
+        }
+
+        if err := throttles.ClearLoginFailures(r.Context(), userKey); err != nil {
+            logging.FromContext(r.Context()).Error("Error clearing failed logins", "error", err)
+        }
+
+        startSession(w, r, sessions, tokens, user, "Login successful")
     }
 }
 
-func LoginHandler(db *sql.DB) http.HandlerFunc {
+// RefreshHandler rotates a refresh token and issues a new access token.
+// Accounts whose role has come to require MFA but that haven't enrolled get
+// the limited enrollment token instead and their session ends.
+func RefreshHandler(sessions models.SessionStore, roles models.RoleStore, tokens *auth.TokenManager) http.HandlerFunc {
     return func(w http.ResponseWriter, r *http.Request) {
         var req struct {
-            Username string `json:"username"`
-            Password string `json:"password"`
+            RefreshToken string `json:"refresh_token" validate:"required"`
+        }
+
+        if !decodeJSON(w, r, &req) {
+            return
+        }
+
+        refreshToken, refreshExpiresAt, err := newRefreshToken(tokens)
+        if err != nil {
+            logging.FromContext(r.Context()).Error("Error creating refresh token", "error", err)
+            apierror.Respond(w, r, http.StatusInternalServerError, "Could not refresh session")
+            return
         }
 
-        err := json.NewDecoder(r.Body).Decode(&req)
+        user, err := sessions.RotateRefreshToken(r.Context(), auth.HashToken(req.RefreshToken), auth.HashToken(refreshToken), refreshExpiresAt)
+        if errors.Is(err, models.ErrRefreshTokenReused) {
+            logging.FromContext(r.Context()).Warn("Refresh token reuse detected, session family revoked")
+        }
+        // The client only learns that the token can't be used anymore
+        if errors.Is(err, models.ErrRefreshTokenReused) || errors.Is(err, models.ErrAccountNotActive) {
+            err = models.ErrInvalidRefreshToken
+        }
         if err != nil {
-            http.Error(w, "Invalid request", http.StatusBadRequest)
+            apierror.Write(w, r, err)
+            return
+        }
+
+        // A session started before the role required MFA ends at its next refresh
+        if !user.MFAEnabled {
+            mfaRequired, err := roles.RoleRequiresMFA(r.Context(), user.Role)
+            if err != nil {
+                logging.FromContext(r.Context()).Error("Error checking MFA requirement", "role", user.Role, "error", err)
+                apierror.Respond(w, r, http.StatusInternalServerError, "Could not refresh session")
+                return
+            }
+            if mfaRequired {
+                if err := sessions.RevokeRefreshToken(r.Context(), auth.HashToken(refreshToken)); err != nil {
+                    logging.FromContext(r.Context()).Error("Error revoking refresh token", "error", err)
+                    apierror.Respond(w, r, http.StatusInternalServerError, "Could not refresh session")
+                    return
+                }
+                writeMFAEnrollmentRequired(w, r, tokens, user)
+                return
+            }
+        }
+
+        writeSession(w, r, tokens, user, refreshToken, refreshExpiresAt, "Session refreshed")
+    }
+}
+
+// LogoutHandler revokes the session the presented refresh token belongs to
+func LogoutHandler(sessions models.SessionStore) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        var req struct {
+            RefreshToken string `json:"refresh_token" validate:"required"`
+        }
+
+        if !decodeJSON(w, r, &req) {
             return
         }
 
-        user, err := models.AuthenticateUser(db, req.Username, req.Password)
+        err := sessions.RevokeRefreshToken(r.Context(), auth.HashToken(req.RefreshToken))
         if err != nil {
-            http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+            logging.FromContext(r.Context()).Error("Error revoking refresh token", "error", err)
+            apierror.Respond(w, r, http.StatusInternalServerError, "Could not log out")
             return
         }
 
-        json.NewEncoder(w).Encode(map[string]interface{}{
-            "message":  "Login successful",
-            "username": user.Username,
-            "userID":   user.ID,
-            "role":     user.Role,
-        })
+        json.NewEncoder(w).Encode(map[string]string{"message": "Logged out"})
+    }
+}
+
+// SessionEpochLoader gives the auth middleware the session epoch of a user,
+// so access tokens of revoked sessions are rejected
+func SessionEpochLoader(sessions models.SessionStore) auth.SessionEpochLoader {
+    return func(ctx context.Context, userID int) (int, error) {
+        epoch, err := sessions.SessionEpoch(ctx, userID)
+        if errors.Is(err, models.ErrUserNotFound) {
+            return 0, auth.ErrInvalidToken
+        }
+        return epoch, err
+    }
+}
+
+// recordLoginFailure counts a failed login against both the username and the client IP
+func recordLoginFailure(ctx context.Context, throttles models.ThrottleStore, throttle models.LoginThrottle, userKey, ipKey string, now time.Time) {
+    if err := throttles.RecordLoginFailure(ctx, userKey, throttle.User, now); err != nil {
+        logging.FromContext(ctx).Error("Error recording failed login", "error", err)
+    }
+    if err := throttles.RecordLoginFailure(ctx, ipKey, throttle.IP, now); err != nil {
+        logging.FromContext(ctx).Error("Error recording failed login", "error", err)
+    }
+}
+
+// writeTooManyAttempts rejects a throttled login without saying whether the account exists
+func writeTooManyAttempts(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+    setRetryAfter(w, retryAfter)
+    apierror.RespondCode(w, r, http.StatusTooManyRequests, "login_throttled", "Too many failed login attempts, try again later")
+}
+
+// setRetryAfter tells the client how many whole seconds to wait, at least one
+func setRetryAfter(w http.ResponseWriter, retryAfter time.Duration) {
+    seconds := int(math.Ceil(retryAfter.Seconds()))
+    if seconds < 1 {
+        seconds = 1
+    }
+    w.Header().Set("Retry-After", strconv.Itoa(seconds))
+}
+
+// startSession begins a new refresh token family for the user and writes the session
+func startSession(w http.ResponseWriter, r *http.Request, sessions models.SessionStore, tokens *auth.TokenManager, user *models.User, message string) {
+    familyID, err := auth.NewOpaqueToken()
+    if err != nil {
+        logging.FromContext(r.Context()).Error("Error creating session family", "error", err)
+        apierror.Respond(w, r, http.StatusInternalServerError, "Could not create session")
+        return
+    }
+
+    refreshToken, refreshExpiresAt, err := newRefreshToken(tokens)
+    if err != nil {
+        logging.FromContext(r.Context()).Error("Error creating refresh token", "error", err)
+        apierror.Respond(w, r, http.StatusInternalServerError, "Could not create session")
+        return
+    }
+
+    err = sessions.CreateRefreshToken(r.Context(), user.ID, familyID, auth.HashToken(refreshToken), refreshExpiresAt)
+    if err != nil {
+        logging.FromContext(r.Context()).Error("Error storing refresh token", "error", err)
+        apierror.Respond(w, r, http.StatusInternalServerError, "Could not create session")
+        return
     }
+
+    writeSession(w, r, tokens, user, refreshToken, refreshExpiresAt, message)
+}
+
+// newRefreshToken generates a refresh token and its expiry
+func newRefreshToken(tokens *auth.TokenManager) (string, time.Time, error) {
+    token, err := auth.NewOpaqueToken()
+    if err != nil {
+        return "", time.Time{}, err
+    }
+    return token, time.Now().Add(tokens.RefreshTTL()), nil
+}
+
+// writeSession issues an access token for the user and writes it together with the refresh token
+func writeSession(w http.ResponseWriter, r *http.Request, tokens *auth.TokenManager, user *models.User, refreshToken string, refreshExpiresAt time.Time, message string) {
+    accessToken, expiresAt, err := tokens.IssueAccessToken(user.ID, user.Role, user.SessionEpoch)
+    if err != nil {
+        logging.FromContext(r.Context()).Error("Error issuing access token", "error", err)
+        apierror.Respond(w, r, http.StatusInternalServerError, "Could not create session")
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("Cache-Control", "no-store")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "message":            message,
+        "username":           user.Username,
+        "userID":             user.ID,
+        "role":               user.Role,
+        "access_token":       accessToken,
+        "token_type":         "Bearer",
+        "expires_at":         expiresAt,
+        "refresh_token":      refreshToken,
+        "refresh_expires_at": refreshExpiresAt,
+    })
 }
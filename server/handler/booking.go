@@ -1,52 +1,53 @@
 package handler
 
 import (
-    "database/sql"
     "encoding/json"
    
     "strconv"
+    "fmc/apierror"
+    "fmc/auth"
     "fmc/models"
 	"github.com/gorilla/mux"
     "net/http"
-    "log"
+    "fmc/logging"
+    "fmc/metrics"
     "time"
 	
 )
 
-func CreateBookingHandler(db *sql.DB) http.HandlerFunc {
+func CreateBookingHandler(bookings models.BookingStore) http.HandlerFunc {
     return func(w http.ResponseWriter, r *http.Request) {
+        // The coordinates come from the map picker; only the addresses are stored
         var req struct {
-            PickupLocation  string  `json:"pickup_location"`
-            DropoffLocation string  `json:"dropoff_location"`
-            VehicleType     string  `json:"vehicle_type"`
-            EstimatedCost   float64 `json:"estimated_cost"`
+            PickupLocation  string   `json:"pickup_location" validate:"required,max=255"`
+            PickupLat       *float64 `json:"pickup_lat" validate:"min=-90,max=90"`
+            PickupLng       *float64 `json:"pickup_lng" validate:"min=-180,max=180"`
+            DropoffLocation string   `json:"dropoff_location" validate:"required,max=255"`
+            DropoffLat      *float64 `json:"dropoff_lat" validate:"min=-90,max=90"`
+            DropoffLng      *float64 `json:"dropoff_lng" validate:"min=-180,max=180"`
+            VehicleType     string   `json:"vehicle_type" validate:"required,oneof=small medium large"`
+            EstimatedCost   float64  `json:"estimated_cost" validate:"min=0"`
         }
 
-        err := json.NewDecoder(r.Body).Decode(&req)
-        if err != nil {
-            http.Error(w, "Invalid request payload", http.StatusBadRequest)
+        if !decodeJSON(w, r, &req) {
             return
         }
 
-        // Get User-ID from the header
-        userIDStr := r.Header.Get("User-ID")
-        if userIDStr == "" {
-            http.Error(w, "User ID is required", http.StatusBadRequest)
-            return
-        }
-
-        userID, err := strconv.Atoi(userIDStr)
-        if err != nil {
-            http.Error(w, "Invalid User ID", http.StatusBadRequest)
+        // The booking belongs to the authenticated user
+        principal, ok := auth.FromContext(r.Context())
+        if !ok {
+            apierror.Respond(w, r, http.StatusUnauthorized, "Unauthorized")
             return
         }
 
         // Create the booking
-        bookingID, err := models.CreateBooking(db, userID, req.PickupLocation, req.DropoffLocation, req.VehicleType, req.EstimatedCost)
+        bookingID, err := bookings.CreateBooking(r.Context(), principal.UserID, req.PickupLocation, req.DropoffLocation, req.VehicleType, req.EstimatedCost, auditActor(r))
         if err != nil {
-            http.Error(w, "Could not create booking", http.StatusInternalServerError)
+            logging.FromContext(r.Context()).Error("Error creating booking", "error", err)
+            apierror.Respond(w, r, http.StatusInternalServerError, "Could not create booking")
             return
         }
+        metrics.BookingsCreated.Inc()
 
         json.NewEncoder(w).Encode(map[string]interface{}{
             "message": "Booking created",
@@ -56,131 +57,123 @@ func CreateBookingHandler(db *sql.DB) http.HandlerFunc {
 }
 
 
-func AcceptBookingHandler(db *sql.DB) http.HandlerFunc {
+func AcceptBookingHandler(bookings models.BookingStore) http.HandlerFunc {
     return func(w http.ResponseWriter, r *http.Request) {
-        driverIDStr := r.Header.Get("Driver-ID")
-        driverID, err := strconv.Atoi(driverIDStr)
-        if err != nil {
-            log.Printf("Invalid Driver ID: %s", driverIDStr)
-            http.Error(w, "Invalid Driver ID", http.StatusBadRequest)
+        principal, ok := auth.FromContext(r.Context())
+        if !ok {
+            apierror.Respond(w, r, http.StatusUnauthorized, "Unauthorized")
             return
         }
+        driverID := principal.UserID
 
         // Get the booking ID from the URL path
         vars := mux.Vars(r)
         bookingID, err := strconv.Atoi(vars["id"])
         if err != nil {
-            log.Printf("Invalid booking ID: %v", err)
-            http.Error(w, "Invalid booking ID", http.StatusBadRequest)
+            apierror.Respond(w, r, http.StatusBadRequest, "Invalid booking ID")
             return
         }
 
-        log.Printf("Driver ID: %d is attempting to accept Booking ID: %d", driverID, bookingID)
+        logging.FromContext(r.Context()).Debug("Driver is attempting to accept booking", "booking_id", bookingID)
 
         // Try to accept the booking in the database
-        err = models.AcceptBooking(db, driverID, bookingID)
+        err = bookings.AcceptBooking(r.Context(), driverID, bookingID, auditActor(r))
         if err != nil {
-            log.Printf("Error accepting booking: %v", err)
-            http.Error(w, err.Error(), http.StatusInternalServerError)
+            apierror.Write(w, r, err)
             return
         }
+        metrics.BookingsAccepted.Inc()
 
         json.NewEncoder(w).Encode(map[string]string{
             "message": "Booking accepted",
         })
     }
 }
-// GetPendingBookingsHandler fetches unassigned bookings for drivers
-func GetPendingBookingsHandler(db *sql.DB) http.HandlerFunc {
+// CancelBookingHandler cancels a booking before pickup. actor is the customer
+// on the user route, who may only cancel their own bookings, or an admin.
+func CancelBookingHandler(bookings models.BookingStore, actor models.Actor) http.HandlerFunc {
     return func(w http.ResponseWriter, r *http.Request) {
-        role := r.Header.Get("Role")  // Get role from headers
-        driverID := r.Header.Get("Driver-ID")  // Get driver ID if applicable
-
-        // Ensure the role is "driver"
-        if role != "driver" || driverID == "" {
-            http.Error(w, "Unauthorized access", http.StatusUnauthorized)
+        if changeBookingStatus(w, r, bookings, models.BookingCancelled, actor) == nil {
             return
         }
+        metrics.BookingsCancelled.Inc()
 
-        // Fetch only unassigned pending bookings
-        rows, err := db.Query(`SELECT id, user_id, pickup_location, dropoff_location, vehicle_type, estimated_cost, status FROM bookings WHERE status = 'pending' AND driver_id IS NULL`)
-        if err != nil {
-            log.Printf("Error fetching pending bookings: %v", err)
-            http.Error(w, "Error fetching bookings", http.StatusInternalServerError)
-            return
-        }
-        defer rows.Close()
-
-        var bookings []struct {
-            ID             int     `json:"id"`
-            UserID         int     `json:"user_id"`
-            PickupLocation string  `json:"pickup_location"`
-            DropoffLocation string `json:"dropoff_location"`
-            VehicleType    string  `json:"vehicle_type"`
-            EstimatedCost  float64 `json:"estimated_cost"`
-            Status         string  `json:"status"`
-        }
+        json.NewEncoder(w).Encode(map[string]string{"message": "Booking cancelled"})
+    }
+}
 
-        for rows.Next() {
-            var booking struct {
-                ID             int     `json:"id"`
-                UserID         int     `json:"user_id"`
-                PickupLocation string  `json:"pickup_location"`
-                DropoffLocation string `json:"dropoff_location"`
-                VehicleType    string  `json:"vehicle_type"`
-                EstimatedCost  float64 `json:"estimated_cost"`
-                Status         string  `json:"status"`
-            }
-            err := rows.Scan(&booking.ID, &booking.UserID, &booking.PickupLocation, &booking.DropoffLocation, &booking.VehicleType, &booking.EstimatedCost, &booking.Status)
-            if err != nil {
-                log.Printf("Error scanning booking row: %v", err)
-                http.Error(w, "Error processing bookings", http.StatusInternalServerError)
-                return
-            }
-            bookings = append(bookings, booking)
+// UpdateTripStatusHandler lets a driver move a booking they accepted to the
+// next stage of the trip, e.g. {"status": "picked_up"}
+func UpdateTripStatusHandler(bookings models.BookingStore) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        var req struct {
+            Status string `json:"status" validate:"required,oneof=en_route_to_pickup picked_up in_transit delivered"`
+        }
+        if !decodeJSON(w, r, &req) {
+            return
         }
 
-        if err := rows.Err(); err != nil {
-            log.Printf("Error after rows.Next(): %v", err)
-            http.Error(w, "Error processing bookings", http.StatusInternalServerError)
+        after := changeBookingStatus(w, r, bookings, req.Status, models.ActorDriver)
+        if after == nil {
             return
         }
 
         w.Header().Set("Content-Type", "application/json")
-        json.NewEncoder(w).Encode(bookings)
+        json.NewEncoder(w).Encode(after)
     }
 }
 
-type BookingsOverTime struct {
-    Date  time.Time `json:"date"`
-    Count int       `json:"count"`
+// changeBookingStatus moves the booking in the URL to status to on behalf of
+// the caller acting as actor. It returns the changed booking, or writes the
+// error and returns nil.
+func changeBookingStatus(w http.ResponseWriter, r *http.Request, bookings models.BookingStore, to string, actor models.Actor) *models.Booking {
+    bookingID, err := strconv.Atoi(mux.Vars(r)["id"])
+    if err != nil {
+        apierror.Respond(w, r, http.StatusBadRequest, "Invalid booking ID")
+        return nil
+    }
+    principal, ok := auth.FromContext(r.Context())
+    if !ok {
+        apierror.Respond(w, r, http.StatusUnauthorized, "Unauthorized")
+        return nil
+    }
+
+    if err := bookings.TransitionBooking(r.Context(), bookingID, to, actor, principal.UserID, auditActor(r)); err != nil {
+        apierror.Write(w, r, err)
+        return nil
+    }
+    after, err := bookings.GetBooking(r.Context(), bookingID)
+    if err != nil {
+        apierror.Write(w, r, err)
+        return nil
+    }
+    return after
 }
 
-// GetBookingsOverTime fetches the number of bookings created over the past 7 days
-func GetBookingsOverTime(db *sql.DB) http.HandlerFunc {
+// GetPendingBookingsHandler fetches unassigned bookings for drivers
+func GetPendingBookingsHandler(bookings models.BookingStore) http.HandlerFunc {
     return func(w http.ResponseWriter, r *http.Request) {
-        // Query to fetch booking counts per day for the last 7 days
-        rows, err := db.Query(`
-            SELECT date_trunc('day', created_at) AS day, COUNT(*) 
-            FROM bookings 
-            WHERE created_at >= NOW() - INTERVAL '7 days'
-            GROUP BY day
-            ORDER BY day
-        `)
+        // Fetch only unassigned pending bookings
+        pending, err := bookings.FetchPendingBookings(r.Context())
         if err != nil {
-            http.Error(w, "Error fetching data", http.StatusInternalServerError)
+            logging.FromContext(r.Context()).Error("Error fetching pending bookings", "error", err)
+            apierror.Respond(w, r, http.StatusInternalServerError, "Error fetching bookings")
             return
         }
-        defer rows.Close()
-
-        var data []BookingsOverTime
-        for rows.Next() {
-            var booking BookingsOverTime
-            if err := rows.Scan(&booking.Date, &booking.Count); err != nil {
-                http.Error(w, "Error processing data", http.StatusInternalServerError)
-                return
-            }
-            data = append(data, booking)
+
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(pending)
+    }
+}
+
+// GetBookingsOverTime fetches the number of bookings created over the past 7 days
+func GetBookingsOverTime(analytics models.AnalyticsStore) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        data, err := analytics.FetchBookingsOverTime(r.Context(), time.Now().AddDate(0, 0, -7))
+        if err != nil {
+            logging.FromContext(r.Context()).Error("Error fetching bookings over time", "error", err)
+            apierror.Respond(w, r, http.StatusInternalServerError, "Error fetching data")
+            return
         }
 
         w.Header().Set("Content-Type", "application/json")
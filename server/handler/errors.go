@@ -0,0 +1,21 @@
+package handler
+
+import (
+    "net/http"
+
+    "fmc/apierror"
+)
+
+// NotFoundHandler answers requests for paths the API doesn't have
+func NotFoundHandler() http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        apierror.Respond(w, r, http.StatusNotFound, "Not found")
+    }
+}
+
+// MethodNotAllowedHandler answers requests using a method the path doesn't support
+func MethodNotAllowedHandler() http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        apierror.Respond(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+    }
+}
@@ -0,0 +1,61 @@
+package handler
+
+import (
+    "context"
+    "database/sql"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "time"
+
+    "fmc/database"
+    "fmc/logging"
+)
+
+// readinessTimeout bounds the checks of /readyz so a hanging database fails
+// the probe instead of piling up requests
+const readinessTimeout = 2 * time.Second
+
+// HealthzHandler reports that the process is up. It checks nothing else, so
+// a database outage doesn't get every instance restarted.
+func HealthzHandler() http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
+        w.Header().Set("Cache-Control", "no-store")
+        json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+    }
+}
+
+// ReadyzHandler reports whether this instance can serve traffic: the database
+// answers and every migration of this build has been applied
+func ReadyzHandler(db *sql.DB, driver string) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+        defer cancel()
+
+        checks := map[string]string{"database": "ok", "migrations": "ok"}
+        ready := true
+        if err := db.PingContext(ctx); err != nil {
+            logging.FromContext(r.Context()).Warn("Readiness check: database unreachable", "error", err)
+            checks["database"] = "unreachable"
+            checks["migrations"] = "unknown"
+            ready = false
+        } else if pending, err := database.PendingMigrations(ctx, db, driver); err != nil {
+            logging.FromContext(r.Context()).Warn("Readiness check: reading migrations failed", "error", err)
+            checks["migrations"] = "unknown"
+            ready = false
+        } else if pending > 0 {
+            checks["migrations"] = fmt.Sprintf("%d pending", pending)
+            ready = false
+        }
+
+        status := "ok"
+        w.Header().Set("Content-Type", "application/json")
+        w.Header().Set("Cache-Control", "no-store")
+        if !ready {
+            status = "unavailable"
+            w.WriteHeader(http.StatusServiceUnavailable)
+        }
+        json.NewEncoder(w).Encode(map[string]interface{}{"status": status, "checks": checks})
+    }
+}
@@ -0,0 +1,170 @@
+package handler
+
+import (
+    "encoding/json"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+
+    "fmc/models"
+)
+
+const (
+    defaultPageSize = 50
+    maxPageSize     = 200
+)
+
+// page is the response body of list endpoints. NextCursor is passed back as
+// the cursor parameter to get the following page and is empty on the last one.
+type page struct {
+    Items      interface{} `json:"items"`
+    NextCursor string      `json:"next_cursor,omitempty"`
+}
+
+func writePage(w http.ResponseWriter, items interface{}, next string) {
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(page{Items: items, NextCursor: next})
+}
+
+// parseListQuery reads the query string of a list request:
+//
+//	limit=N                  page size, 50 by default and at most 200
+//	sort=field, sort=-field  a sortable field of spec, descending with "-"; id by default
+//	cursor=...               the next_cursor of the previous page
+//	field=a,b                rows whose field is one of the values
+//	field_min, field_max     inclusive bounds of number fields
+//	field_from, field_to     time fields from (inclusive) and to (exclusive), RFC 3339
+//
+// Every problem with the parameters is reported at once as a validation error.
+func parseListQuery(r *http.Request, spec models.ListSpec) (models.ListQuery, error) {
+    params := r.URL.Query()
+    q := models.ListQuery{Limit: defaultPageSize}
+    var details []models.FieldError
+    invalid := func(param, msg string) {
+        details = append(details, models.FieldError{Field: param, Message: msg})
+    }
+
+    // Visit parameters in order so the details don't change between requests
+    names := make([]string, 0, len(params))
+    for name := range params {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+
+    for _, name := range names {
+        value := strings.Join(params[name], ",")
+        switch name {
+        case "limit":
+            limit, err := strconv.Atoi(value)
+            if err != nil || limit < 1 {
+                invalid(name, "must be a positive number")
+                continue
+            }
+            q.Limit = min(limit, maxPageSize)
+        case "sort":
+            q.Sort, q.Desc = strings.TrimPrefix(value, "-"), strings.HasPrefix(value, "-")
+            if field, ok := spec.Fields[q.Sort]; !ok || !field.Sortable {
+                invalid(name, "must be one of "+strings.Join(sortableFields(spec), ", ")+", optionally prefixed with -")
+            }
+        case "cursor":
+        default:
+            filter, msg := parseFilter(spec, name, params[name])
+            if msg != "" {
+                invalid(name, msg)
+                continue
+            }
+            q.Filters = append(q.Filters, filter)
+        }
+    }
+
+    // The cursor is read last since it must match the sort order
+    if value := params.Get("cursor"); value != "" && len(details) == 0 {
+        cursor, err := models.ParseCursor(value, spec, sortOrID(q.Sort), q.Desc)
+        if err != nil {
+            return q, err
+        }
+        q.After = cursor
+    }
+
+    if len(details) > 0 {
+        return q, models.InvalidFields("validation_failed", details...)
+    }
+    return q, nil
+}
+
+// parseFilter turns one filter parameter into a filter of spec, or returns
+// what is wrong with it
+func parseFilter(spec models.ListSpec, name string, values []string) (models.Filter, string) {
+    fieldName, op := name, models.OpIn
+    for suffix, suffixOp := range map[string]models.Op{"_min": models.OpGte, "_max": models.OpLte, "_from": models.OpGte, "_to": models.OpLt} {
+        base := strings.TrimSuffix(name, suffix)
+        if base == name {
+            continue
+        }
+        field, ok := spec.Fields[base]
+        if !ok {
+            continue
+        }
+        numeric := field.Type == models.FieldInt || field.Type == models.FieldFloat
+        isTime := field.Type == models.FieldTime
+        if (suffix == "_min" || suffix == "_max") && numeric || (suffix == "_from" || suffix == "_to") && isTime {
+            fieldName, op = base, suffixOp
+        }
+    }
+
+    field, ok := spec.Fields[fieldName]
+    if !ok {
+        return models.Filter{}, "is not a known parameter"
+    }
+
+    var raw []string
+    for _, v := range values {
+        raw = append(raw, strings.Split(v, ",")...)
+    }
+    if op != models.OpIn && len(raw) != 1 {
+        return models.Filter{}, "takes a single value"
+    }
+
+    filter := models.Filter{Field: fieldName, Op: op}
+    for _, s := range raw {
+        v, err := field.Type.Parse(strings.TrimSpace(s))
+        if err != nil {
+            return models.Filter{}, "must be " + typeName(field.Type)
+        }
+        filter.Values = append(filter.Values, v)
+    }
+    return filter, ""
+}
+
+func sortableFields(spec models.ListSpec) []string {
+    var fields []string
+    for name, field := range spec.Fields {
+        if field.Sortable {
+            fields = append(fields, name)
+        }
+    }
+    sort.Strings(fields)
+    return fields
+}
+
+func sortOrID(field string) string {
+    if field == "" {
+        return "id"
+    }
+    return field
+}
+
+func typeName(t models.FieldType) string {
+    switch t {
+    case models.FieldInt:
+        return "a whole number"
+    case models.FieldFloat:
+        return "a number"
+    case models.FieldTime:
+        return "an RFC 3339 time"
+    case models.FieldBool:
+        return "true or false"
+    }
+    return "text"
+}
@@ -0,0 +1,402 @@
+package handler
+
+import (
+    "context"
+    "encoding/json"
+    "net/http"
+    "time"
+
+    "fmc/apierror"
+    "fmc/auth"
+    "fmc/logging"
+    "fmc/middleware"
+    "fmc/models"
+
+    "github.com/gorilla/mux"
+)
+
+const (
+    mfaChallengeTTL   = 5 * time.Minute
+    mfaEnrollmentTTL  = 10 * time.Minute
+    recoveryCodeCount = 10
+)
+
+// LoginMFAHandler completes a login started with a password by checking a
+// TOTP code or a recovery code against the MFA challenge token. Wrong codes
+// count as failed logins for throttling.
+func LoginMFAHandler(users models.UserStore, mfa models.MFAStore, sessions models.SessionStore, throttles models.ThrottleStore, tokens *auth.TokenManager, throttle models.LoginThrottle) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        var req struct {
+            MFAToken     string `json:"mfa_token" validate:"required"`
+            Code         string `json:"code" validate:"max=64"`
+            RecoveryCode string `json:"recovery_code" validate:"max=64"`
+        }
+        if !decodeJSON(w, r, &req) {
+            return
+        }
+
+        challenge, err := tokens.ParseScopedToken(req.MFAToken, auth.ScopeMFAChallenge)
+        if err != nil {
+            apierror.RespondCode(w, r, http.StatusUnauthorized, "invalid_mfa_token", "Invalid or expired MFA token")
+            return
+        }
+
+        // A challenge issued before the sessions of the user were revoked is stale
+        user, err := users.GetUser(r.Context(), challenge.UserID)
+        if err != nil || user.Status != models.UserStatusActive || user.SessionEpoch != challenge.SessionEpoch {
+            apierror.RespondCode(w, r, http.StatusUnauthorized, "invalid_mfa_token", "Invalid or expired MFA token")
+            return
+        }
+
+        now := time.Now()
+        userKey := models.UserThrottleKey(user.Username)
+        ipKey := models.IPThrottleKey(middleware.ClientIP(r))
+
+        lockedUntil, err := throttles.LoginLockedUntil(r.Context(), now, userKey, ipKey)
+        if err != nil {
+            logging.FromContext(r.Context()).Error("Error checking login throttle", "error", err)
+            apierror.Respond(w, r, http.StatusInternalServerError, "Could not log in")
+            return
+        }
+        if !lockedUntil.IsZero() {
+            writeTooManyAttempts(w, r, lockedUntil.Sub(now))
+            return
+        }
+
+        ok, err := verifySecondFactor(r.Context(), mfa, user.ID, req.Code, req.RecoveryCode, now)
+        if err != nil {
+            logging.FromContext(r.Context()).Error("Error verifying second factor", "user_id", user.ID, "error", err)
+            apierror.Respond(w, r, http.StatusInternalServerError, "Could not log in")
+            return
+        }
+        if !ok {
+            recordLoginFailure(r.Context(), throttles, throttle, userKey, ipKey, now)
+            apierror.Respond(w, r, http.StatusUnauthorized, "Invalid code")
+            return
+        }
+
+        if err := throttles.ClearLoginFailures(r.Context(), userKey); err != nil {
+            logging.FromContext(r.Context()).Error("Error clearing failed logins", "error", err)
+        }
+
+        startSession(w, r, sessions, tokens, user, "Login successful")
+    }
+}
+
+// EnrollMFAHandler starts TOTP enrollment by generating a secret. The returned
+// provisioning URI can be rendered as a QR code for authenticator apps.
+func EnrollMFAHandler(users models.UserStore, mfa models.MFAStore) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        principal, ok := auth.FromContext(r.Context())
+        if !ok {
+            apierror.Respond(w, r, http.StatusUnauthorized, "Unauthorized")
+            return
+        }
+
+        user, err := users.GetUser(r.Context(), principal.UserID)
+        if err != nil {
+            logging.FromContext(r.Context()).Error("Error fetching user", "error", err)
+            apierror.Respond(w, r, http.StatusInternalServerError, "Error starting enrollment")
+            return
+        }
+
+        secret, uri, err := auth.GenerateTOTPSecret(user.Username)
+        if err != nil {
+            logging.FromContext(r.Context()).Error("Error generating TOTP secret", "error", err)
+            apierror.Respond(w, r, http.StatusInternalServerError, "Error starting enrollment")
+            return
+        }
+
+        err = mfa.StartMFAEnrollment(r.Context(), user.ID, secret)
+        if err != nil {
+            apierror.Write(w, r, err)
+            return
+        }
+
+        w.Header().Set("Cache-Control", "no-store")
+        json.NewEncoder(w).Encode(map[string]string{
+            "secret":           secret,
+            "provisioning_uri": uri,
+        })
+    }
+}
+
+// ConfirmMFAHandler finishes enrollment with a code from the authenticator app
+// and returns the recovery codes, which are shown only this once
+func ConfirmMFAHandler(mfa models.MFAStore) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        principal, ok := auth.FromContext(r.Context())
+        if !ok {
+            apierror.Respond(w, r, http.StatusUnauthorized, "Unauthorized")
+            return
+        }
+
+        var req struct {
+            Code string `json:"code" validate:"required,max=64"`
+        }
+        if !decodeJSON(w, r, &req) {
+            return
+        }
+
+        state, err := mfa.GetMFAState(r.Context(), principal.UserID)
+        if err != nil {
+            logging.FromContext(r.Context()).Error("Error fetching MFA state", "error", err)
+            apierror.Respond(w, r, http.StatusInternalServerError, "Error confirming enrollment")
+            return
+        }
+        if state.Enabled {
+            apierror.Write(w, r, models.ErrMFAAlreadyEnabled)
+            return
+        }
+        if state.Secret == nil {
+            apierror.RespondCode(w, r, http.StatusConflict, "mfa_not_enrolled", "Start enrollment first")
+            return
+        }
+
+        step, ok := auth.MatchTOTP(*state.Secret, req.Code, time.Now())
+        if !ok {
+            apierror.Respond(w, r, http.StatusBadRequest, "Invalid code")
+            return
+        }
+
+        codes, hashes, err := newRecoveryCodes()
+        if err != nil {
+            logging.FromContext(r.Context()).Error("Error generating recovery codes", "error", err)
+            apierror.Respond(w, r, http.StatusInternalServerError, "Error confirming enrollment")
+            return
+        }
+
+        err = mfa.ConfirmMFAEnrollment(r.Context(), principal.UserID, step, hashes, auditActor(r))
+        if err != nil {
+            apierror.Write(w, r, err)
+            return
+        }
+
+        w.Header().Set("Cache-Control", "no-store")
+        json.NewEncoder(w).Encode(map[string]interface{}{
+            "message":        "Two-factor authentication enabled",
+            "recovery_codes": codes,
+        })
+    }
+}
+
+// DisableMFAHandler turns off two-factor authentication after checking a
+// current code. Accounts whose role requires MFA cannot turn it off.
+func DisableMFAHandler(mfa models.MFAStore, roles models.RoleStore) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        principal, ok := auth.FromContext(r.Context())
+        if !ok {
+            apierror.Respond(w, r, http.StatusUnauthorized, "Unauthorized")
+            return
+        }
+
+        var req struct {
+            Code         string `json:"code" validate:"max=64"`
+            RecoveryCode string `json:"recovery_code" validate:"max=64"`
+        }
+        if !decodeJSON(w, r, &req) {
+            return
+        }
+
+        required, err := roles.RoleRequiresMFA(r.Context(), principal.Role)
+        if err != nil {
+            logging.FromContext(r.Context()).Error("Error checking MFA requirement", "error", err)
+            apierror.Respond(w, r, http.StatusInternalServerError, "Error disabling two-factor authentication")
+            return
+        }
+        if required {
+            apierror.Write(w, r, models.ErrMFARequiredForRole)
+            return
+        }
+
+        if !requireSecondFactor(w, r, mfa, principal.UserID, req.Code, req.RecoveryCode) {
+            return
+        }
+
+        if err := mfa.DisableMFA(r.Context(), principal.UserID, auditActor(r)); err != nil {
+            logging.FromContext(r.Context()).Error("Error disabling MFA", "error", err)
+            apierror.Respond(w, r, http.StatusInternalServerError, "Error disabling two-factor authentication")
+            return
+        }
+
+        json.NewEncoder(w).Encode(map[string]string{"message": "Two-factor authentication disabled"})
+    }
+}
+
+// RegenerateRecoveryCodesHandler replaces all recovery codes after checking a current code
+func RegenerateRecoveryCodesHandler(mfa models.MFAStore) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        principal, ok := auth.FromContext(r.Context())
+        if !ok {
+            apierror.Respond(w, r, http.StatusUnauthorized, "Unauthorized")
+            return
+        }
+
+        var req struct {
+            Code string `json:"code" validate:"required,max=64"`
+        }
+        if !decodeJSON(w, r, &req) {
+            return
+        }
+
+        if !requireSecondFactor(w, r, mfa, principal.UserID, req.Code, "") {
+            return
+        }
+
+        codes, hashes, err := newRecoveryCodes()
+        if err != nil {
+            logging.FromContext(r.Context()).Error("Error generating recovery codes", "error", err)
+            apierror.Respond(w, r, http.StatusInternalServerError, "Error generating recovery codes")
+            return
+        }
+        if err := mfa.ReplaceRecoveryCodes(r.Context(), principal.UserID, hashes, auditActor(r)); err != nil {
+            logging.FromContext(r.Context()).Error("Error storing recovery codes", "error", err)
+            apierror.Respond(w, r, http.StatusInternalServerError, "Error generating recovery codes")
+            return
+        }
+
+        w.Header().Set("Cache-Control", "no-store")
+        json.NewEncoder(w).Encode(map[string]interface{}{"recovery_codes": codes})
+    }
+}
+
+// ResetUserMFAHandler lets an admin remove the second factor of a user who
+// lost their device. The user's sessions are revoked.
+func ResetUserMFAHandler(mfa models.MFAStore, authz *auth.Authorizer) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        userID, ok := targetUserID(w, r)
+        if !ok {
+            return
+        }
+
+        err := mfa.ResetMFA(r.Context(), userID, auditActor(r))
+        if err != nil {
+            apierror.Write(w, r, err)
+            return
+        }
+
+        authz.InvalidateUser(userID)
+
+        json.NewEncoder(w).Encode(map[string]string{"message": "Two-factor authentication reset"})
+    }
+}
+
+// SetRoleMFAHandler turns enforcement of two-factor authentication for a role on or off
+func SetRoleMFAHandler(roles models.RoleStore) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        role := mux.Vars(r)["name"]
+
+        var req struct {
+            Required bool `json:"required"`
+        }
+        if !decodeJSON(w, r, &req) {
+            return
+        }
+
+        err := roles.SetRoleMFARequired(r.Context(), role, req.Required, auditActor(r))
+        if err != nil {
+            apierror.Write(w, r, err)
+            return
+        }
+
+        json.NewEncoder(w).Encode(map[string]interface{}{
+            "message":      "Role MFA requirement updated",
+            "mfa_required": req.Required,
+        })
+    }
+}
+
+// writeMFAChallenge answers a correct password for an account with MFA enabled
+// with a short-lived token to present together with the second factor
+func writeMFAChallenge(w http.ResponseWriter, r *http.Request, tokens *auth.TokenManager, user *models.User) {
+    token, expiresAt, err := tokens.IssueScopedToken(user.ID, user.Role, auth.ScopeMFAChallenge, user.SessionEpoch, mfaChallengeTTL)
+    if err != nil {
+        logging.FromContext(r.Context()).Error("Error issuing MFA challenge", "error", err)
+        apierror.Respond(w, r, http.StatusInternalServerError, "Could not log in")
+        return
+    }
+
+    w.Header().Set("Cache-Control", "no-store")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "message":      "Two-factor authentication required",
+        "mfa_required": true,
+        "mfa_token":    token,
+        "expires_at":   expiresAt,
+    })
+}
+
+// writeMFAEnrollmentRequired answers a correct password for an account whose
+// role requires MFA but that hasn't enrolled yet. The returned token only
+// works on the enrollment endpoints.
+func writeMFAEnrollmentRequired(w http.ResponseWriter, r *http.Request, tokens *auth.TokenManager, user *models.User) {
+    token, expiresAt, err := tokens.IssueScopedToken(user.ID, user.Role, auth.ScopeMFAEnroll, user.SessionEpoch, mfaEnrollmentTTL)
+    if err != nil {
+        logging.FromContext(r.Context()).Error("Error issuing MFA enrollment token", "error", err)
+        apierror.Respond(w, r, http.StatusInternalServerError, "Could not log in")
+        return
+    }
+
+    w.Header().Set("Cache-Control", "no-store")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "message":                 "Set up two-factor authentication, then log in again",
+        "mfa_enrollment_required": true,
+        "access_token":            token,
+        "token_type":              "Bearer",
+        "expires_at":              expiresAt,
+    })
+}
+
+// verifySecondFactor checks a TOTP code, or a recovery code if no TOTP code is
+// given, and consumes it so it can't be used again
+func verifySecondFactor(ctx context.Context, mfa models.MFAStore, userID int, code, recoveryCode string, now time.Time) (bool, error) {
+    state, err := mfa.GetMFAState(ctx, userID)
+    if err != nil {
+        return false, err
+    }
+    if !state.Enabled || state.Secret == nil {
+        return false, nil
+    }
+
+    if code != "" {
+        step, ok := auth.MatchTOTP(*state.Secret, code, now)
+        if !ok {
+            return false, nil
+        }
+        return mfa.ConsumeMFAStep(ctx, userID, step)
+    }
+    if recoveryCode != "" {
+        return mfa.ConsumeRecoveryCode(ctx, userID, auth.HashToken(auth.NormalizeRecoveryCode(recoveryCode)))
+    }
+    return false, nil
+}
+
+// requireSecondFactor verifies a second factor for a sensitive account change and
+// writes an error response if it fails
+func requireSecondFactor(w http.ResponseWriter, r *http.Request, mfa models.MFAStore, userID int, code, recoveryCode string) bool {
+    ok, err := verifySecondFactor(r.Context(), mfa, userID, code, recoveryCode, time.Now())
+    if err != nil {
+        logging.FromContext(r.Context()).Error("Error verifying second factor", "error", err)
+        apierror.Respond(w, r, http.StatusInternalServerError, "Error verifying code")
+        return false
+    }
+    if !ok {
+        apierror.Respond(w, r, http.StatusForbidden, "Invalid code")
+        return false
+    }
+    return true
+}
+
+// newRecoveryCodes generates a fresh set of recovery codes and their hashes
+func newRecoveryCodes() ([]string, []string, error) {
+    codes := make([]string, recoveryCodeCount)
+    hashes := make([]string, recoveryCodeCount)
+    for i := range codes {
+        code, err := auth.NewRecoveryCode()
+        if err != nil {
+            return nil, nil, err
+        }
+        codes[i] = code
+        hashes[i] = auth.HashToken(code)
+    }
+    return codes, hashes, nil
+}
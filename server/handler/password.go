@@ -0,0 +1,180 @@
+package handler
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "net/url"
+    "time"
+
+    "fmc/apierror"
+    "fmc/auth"
+    "fmc/logging"
+    "fmc/mailer"
+    "fmc/middleware"
+    "fmc/models"
+)
+
+// PasswordReset configures the forgot-password flow
+type PasswordReset struct {
+    Mailer mailer.Mailer
+    // URL of the frontend page that accepts the token, e.g. http://localhost:5173/reset-password
+    URL string
+    TTL time.Duration
+}
+
+// ChangePasswordHandler lets an authenticated user set a new password. All
+// existing sessions are revoked and a fresh one is returned.
+func ChangePasswordHandler(passwords models.PasswordStore, users models.UserStore, sessions models.SessionStore, tokens *auth.TokenManager, authz *auth.Authorizer) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        principal, ok := auth.FromContext(r.Context())
+        if !ok {
+            apierror.Respond(w, r, http.StatusUnauthorized, "Unauthorized")
+            return
+        }
+
+        var req struct {
+            CurrentPassword string `json:"current_password" validate:"required"`
+            NewPassword     string `json:"new_password" validate:"required,max=72"`
+        }
+        if !decodeJSON(w, r, &req) {
+            return
+        }
+        if err := models.ValidatePassword(req.NewPassword); err != nil {
+            apierror.Write(w, r, err)
+            return
+        }
+
+        err := passwords.ChangePassword(r.Context(), principal.UserID, req.CurrentPassword, req.NewPassword, auditActor(r))
+        if err != nil {
+            apierror.Write(w, r, err)
+            return
+        }
+
+        authz.InvalidateUser(principal.UserID)
+
+        user, err := users.GetUser(r.Context(), principal.UserID)
+        if err != nil {
+            logging.FromContext(r.Context()).Error("Error fetching user", "error", err)
+            apierror.Respond(w, r, http.StatusInternalServerError, "Password changed, please log in again")
+            return
+        }
+
+        startSession(w, r, sessions, tokens, user, "Password changed")
+    }
+}
+
+// ForgotPasswordHandler emails a single-use reset link to the account matching
+// the submitted username or email. The response is the same whether or not an
+// account matched, and mail is sent in the background so timing doesn't tell either.
+// Requests are throttled per submitted login and per client IP, whether or not
+// an account matched, before any token is created.
+func ForgotPasswordHandler(passwords models.PasswordStore, throttles models.ThrottleStore, reset PasswordReset, throttle models.LoginThrottle) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        var req struct {
+            Login string `json:"login" validate:"required,max=254"`
+        }
+        if !decodeJSON(w, r, &req) {
+            return
+        }
+
+        now := time.Now()
+        loginKey := models.PasswordResetThrottleKey(models.UserThrottleKey(req.Login))
+        ipKey := models.PasswordResetThrottleKey(models.IPThrottleKey(middleware.ClientIP(r)))
+
+        lockedUntil, err := throttles.LoginLockedUntil(r.Context(), now, loginKey, ipKey)
+        if err != nil {
+            logging.FromContext(r.Context()).Error("Error checking password reset throttle", "error", err)
+            apierror.Respond(w, r, http.StatusInternalServerError, "Could not request a password reset")
+            return
+        }
+        if !lockedUntil.IsZero() {
+            setRetryAfter(w, lockedUntil.Sub(now))
+            apierror.RespondCode(w, r, http.StatusTooManyRequests, "password_reset_throttled", "A reset link was requested recently, try again later")
+            return
+        }
+        recordLoginFailure(r.Context(), throttles, throttle, loginKey, ipKey, now)
+
+        w.WriteHeader(http.StatusAccepted)
+        json.NewEncoder(w).Encode(map[string]string{
+            "message": "If an account with a registered email matches, a reset link has been sent",
+        })
+
+        go sendPasswordReset(context.WithoutCancel(r.Context()), passwords, reset, req.Login)
+    }
+}
+
+// ResetPasswordHandler sets a new password using a reset token and revokes all
+// sessions of the user. The reset fails if the sessions can't be revoked.
+func ResetPasswordHandler(passwords models.PasswordStore, users models.UserStore, throttles models.ThrottleStore, authz *auth.Authorizer) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        var req struct {
+            Token       string `json:"token" validate:"required"`
+            NewPassword string `json:"new_password" validate:"required,max=72"`
+        }
+        if !decodeJSON(w, r, &req) {
+            return
+        }
+        if err := models.ValidatePassword(req.NewPassword); err != nil {
+            apierror.Write(w, r, err)
+            return
+        }
+
+        userID, err := passwords.ResetPassword(r.Context(), auth.HashToken(req.Token), req.NewPassword, auditActor(r))
+        if err != nil {
+            apierror.Write(w, r, err)
+            return
+        }
+
+        authz.InvalidateUser(userID)
+
+        if user, err := users.GetUser(r.Context(), userID); err == nil {
+            if err := throttles.ClearLoginFailures(r.Context(), models.UserThrottleKey(user.Username)); err != nil {
+                logging.FromContext(r.Context()).Error("Error clearing failed logins", "error", err)
+            }
+        }
+
+        json.NewEncoder(w).Encode(map[string]string{"message": "Password has been reset, please log in"})
+    }
+}
+
+func sendPasswordReset(ctx context.Context, passwords models.PasswordStore, reset PasswordReset, login string) {
+    user, err := passwords.FindUserByLogin(ctx, login)
+    if errors.Is(err, models.ErrUserNotFound) {
+        return
+    }
+    if err != nil {
+        logging.FromContext(ctx).Error("Error looking up user for password reset", "error", err)
+        return
+    }
+    if user.Email == nil {
+        logging.FromContext(ctx).Warn("Password reset requested for an account without an email address", "user_id", user.ID)
+        return
+    }
+
+    token, err := auth.NewOpaqueToken()
+    if err != nil {
+        logging.FromContext(ctx).Error("Error creating reset token", "error", err)
+        return
+    }
+    if err := passwords.CreatePasswordResetToken(ctx, user.ID, auth.HashToken(token), time.Now().Add(reset.TTL)); err != nil {
+        logging.FromContext(ctx).Error("Error storing reset token", "error", err)
+        return
+    }
+
+    link := reset.URL + "?token=" + url.QueryEscape(token)
+    msg := mailer.Message{
+        To:      *user.Email,
+        Subject: "Reset your Fleetfy password",
+        Body: fmt.Sprintf("Hi %s,\n\nUse the link below to choose a new password. It expires in %s and can be used once.\n\n%s\n\nIf you didn't ask for this, you can ignore this email.\n",
+            user.Username, reset.TTL, link),
+    }
+
+    ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+    defer cancel()
+    if err := reset.Mailer.Send(ctx, msg); err != nil {
+        logging.FromContext(ctx).Error("Error sending password reset email", "user_id", user.ID, "error", err)
+    }
+}
@@ -0,0 +1,75 @@
+package handler
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "strings"
+
+    "fmc/apierror"
+    "fmc/models"
+    "fmc/validate"
+)
+
+// maxBodyBytes bounds request bodies; every payload of the API is far smaller
+const maxBodyBytes = 1 << 20
+
+// decodeJSON reads the request body into v and checks it against the
+// validate tags of v. Unknown fields, bodies over maxBodyBytes and trailing
+// data are rejected. It writes the error response and returns false when
+// the body isn't acceptable.
+func decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+    dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+    dec.DisallowUnknownFields()
+
+    err := dec.Decode(v)
+    if err == nil {
+        if _, extra := dec.Token(); extra != io.EOF {
+            err = errors.New("trailing data after the JSON value")
+        }
+    }
+    if err != nil {
+        writeDecodeError(w, r, err)
+        return false
+    }
+
+    if err := validate.Struct(v); err != nil {
+        apierror.Write(w, r, err)
+        return false
+    }
+    return true
+}
+
+func writeDecodeError(w http.ResponseWriter, r *http.Request, err error) {
+    var tooLarge *http.MaxBytesError
+    var typeErr *json.UnmarshalTypeError
+    switch {
+    case errors.As(err, &tooLarge):
+        apierror.RespondCode(w, r, http.StatusRequestEntityTooLarge, "request_too_large", fmt.Sprintf("Request body must not exceed %d bytes", tooLarge.Limit))
+    case errors.As(err, &typeErr) && typeErr.Field != "":
+        apierror.Write(w, r, models.InvalidFields("invalid_type", models.FieldError{Field: typeErr.Field, Message: "must be a " + jsonType(typeErr.Type.Kind().String())}))
+    case strings.HasPrefix(err.Error(), "json: unknown field "):
+        // encoding/json has no error type for unknown fields
+        name := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+        apierror.Write(w, r, models.InvalidFields("unknown_field", models.FieldError{Field: name, Message: "is not a known field"}))
+    case errors.Is(err, io.EOF):
+        apierror.RespondCode(w, r, http.StatusBadRequest, "invalid_json", "Request body is empty")
+    default:
+        apierror.RespondCode(w, r, http.StatusBadRequest, "invalid_json", "Request body is not valid JSON")
+    }
+}
+
+// jsonType names a Go kind the way clients know it
+func jsonType(kind string) string {
+    switch {
+    case strings.HasPrefix(kind, "int"), strings.HasPrefix(kind, "uint"), strings.HasPrefix(kind, "float"):
+        return "number"
+    case kind == "slice" || kind == "array":
+        return "list"
+    case kind == "struct" || kind == "map":
+        return "object"
+    }
+    return kind
+}
@@ -0,0 +1,126 @@
+package handler
+
+import (
+    "context"
+    "encoding/json"
+    "net/http"
+
+    "fmc/apierror"
+    "fmc/auth"
+    "fmc/logging"
+    "fmc/models"
+
+    "github.com/gorilla/mux"
+)
+
+// ListRolesHandler returns every role with the permissions it grants
+func ListRolesHandler(roles models.RoleStore) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        all, err := roles.FetchAllRoles(r.Context())
+        if err != nil {
+            logging.FromContext(r.Context()).Error("Error fetching roles", "error", err)
+            apierror.Respond(w, r, http.StatusInternalServerError, "Error fetching roles")
+            return
+        }
+
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(all)
+    }
+}
+
+// ListPermissionsHandler returns every permission that can be granted to a role
+func ListPermissionsHandler(roles models.RoleStore) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        permissions, err := roles.FetchAllPermissions(r.Context())
+        if err != nil {
+            logging.FromContext(r.Context()).Error("Error fetching permissions", "error", err)
+            apierror.Respond(w, r, http.StatusInternalServerError, "Error fetching permissions")
+            return
+        }
+
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(permissions)
+    }
+}
+
+// CreateRoleHandler defines a new role such as "dispatcher" or "finance"
+func CreateRoleHandler(roles models.RoleStore) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        var req models.Role
+        if !decodeJSON(w, r, &req) {
+            return
+        }
+
+        err := roles.CreateRole(r.Context(), req, auditActor(r))
+        if err != nil {
+            apierror.Write(w, r, err)
+            return
+        }
+
+        w.WriteHeader(http.StatusCreated)
+        json.NewEncoder(w).Encode(map[string]string{"message": "Role created"})
+    }
+}
+
+// UpdateRolePermissionsHandler replaces the permissions granted to a role
+func UpdateRolePermissionsHandler(roles models.RoleStore, authz *auth.Authorizer) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        role := mux.Vars(r)["name"]
+
+        var req struct {
+            Permissions []string `json:"permissions"`
+        }
+        if !decodeJSON(w, r, &req) {
+            return
+        }
+
+        // Don't let admins lock everyone out of role management
+        if role == models.RoleAdmin && !containsString(req.Permissions, models.PermRolesManage) {
+            apierror.Respond(w, r, http.StatusConflict, "The admin role must keep roles:manage")
+            return
+        }
+
+        err := roles.SetRolePermissions(r.Context(), role, req.Permissions, auditActor(r))
+        if err != nil {
+            apierror.Write(w, r, err)
+            return
+        }
+
+        authz.Invalidate()
+        json.NewEncoder(w).Encode(map[string]string{"message": "Role permissions updated"})
+    }
+}
+
+// DeleteRoleHandler removes a custom role that is not assigned to anyone
+func DeleteRoleHandler(roles models.RoleStore, authz *auth.Authorizer) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        role := mux.Vars(r)["name"]
+
+        err := roles.DeleteRole(r.Context(), role, auditActor(r))
+        if err != nil {
+            apierror.Write(w, r, err)
+            return
+        }
+
+        authz.Invalidate()
+        json.NewEncoder(w).Encode(map[string]string{"message": "Role deleted"})
+    }
+}
+
+// heldPermissions returns what the caller may hand on: the scopes of an API
+// key, or else the permissions of the caller's role
+func heldPermissions(ctx context.Context, roles models.RoleStore, principal *auth.Principal) ([]string, error) {
+    if principal.IsAPIKey() {
+        return principal.Scopes, nil
+    }
+    return roles.FetchRolePermissions(ctx, principal.Role)
+}
+
+func containsString(values []string, want string) bool {
+    for _, v := range values {
+        if v == want {
+            return true
+        }
+    }
+    return false
+}
@@ -0,0 +1,261 @@
+package handler
+
+import (
+    "encoding/json"
+    "net"
+    "net/http"
+    "strconv"
+    "time"
+
+    "fmc/apierror"
+    "fmc/auth"
+    "fmc/logging"
+    "fmc/models"
+
+    "github.com/gorilla/mux"
+)
+
+// ListUsersHandler returns a page of accounts for the admin user list,
+// filtered by username, role or status. See parseListQuery for the parameters.
+func ListUsersHandler(users models.UserStore) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        q, err := parseListQuery(r, models.UserListSpec)
+        if err != nil {
+            apierror.Write(w, r, err)
+            return
+        }
+
+        all, next, err := users.ListUsers(r.Context(), q)
+        if err != nil {
+            logging.FromContext(r.Context()).Error("Error fetching users", "error", err)
+            apierror.Respond(w, r, http.StatusInternalServerError, "Error fetching users")
+            return
+        }
+
+        writePage(w, all, next)
+    }
+}
+
+// CreateUserHandler lets an admin provision an account with any role whose
+// permissions the admin holds
+func CreateUserHandler(users models.UserStore, roles models.RoleStore) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        var req struct {
+            Username string `json:"username" validate:"required,max=50"`
+            Email    string `json:"email" validate:"max=254,email"`
+            Password string `json:"password" validate:"required,max=72"`
+            Role     string `json:"role" validate:"required"`
+        }
+
+        if !decodeJSON(w, r, &req) {
+            return
+        }
+        if err := models.ValidatePassword(req.Password); err != nil {
+            apierror.Write(w, r, err)
+            return
+        }
+        if !roleExists(w, r, users, req.Role) || !roleGrantable(w, r, roles, req.Role) {
+            return
+        }
+
+        userID, err := users.RegisterUser(r.Context(), req.Username, req.Email, req.Password, req.Role, models.UserStatusActive, auditActor(r))
+        if err != nil {
+            apierror.Write(w, r, err)
+            return
+        }
+
+        w.WriteHeader(http.StatusCreated)
+        json.NewEncoder(w).Encode(map[string]interface{}{
+            "message": "User created",
+            "user_id": userID,
+        })
+    }
+}
+
+// UpdateUserRoleHandler changes the role of an account and ends its sessions
+// so the new role takes effect on the next login. The caller must hold every
+// permission of the new role.
+func UpdateUserRoleHandler(users models.UserStore, roles models.RoleStore, authz *auth.Authorizer) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        userID, ok := targetUserID(w, r)
+        if !ok {
+            return
+        }
+
+        var req struct {
+            Role string `json:"role" validate:"required"`
+        }
+        if !decodeJSON(w, r, &req) {
+            return
+        }
+        if !roleExists(w, r, users, req.Role) || !roleGrantable(w, r, roles, req.Role) {
+            return
+        }
+
+        err := users.UpdateUserRole(r.Context(), userID, req.Role, auditActor(r))
+        if err != nil {
+            apierror.Write(w, r, err)
+            return
+        }
+
+        authz.InvalidateUser(userID)
+
+        json.NewEncoder(w).Encode(map[string]string{"message": "User role updated"})
+    }
+}
+
+// UpdateUserStatusHandler enables, disables or approves an account. Disabling ends its sessions.
+func UpdateUserStatusHandler(users models.UserStore, authz *auth.Authorizer) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        userID, ok := targetUserID(w, r)
+        if !ok {
+            return
+        }
+
+        var req struct {
+            Status string `json:"status" validate:"required,oneof=active pending disabled"`
+        }
+        if !decodeJSON(w, r, &req) {
+            return
+        }
+
+        err := users.UpdateUserStatus(r.Context(), userID, req.Status, auditActor(r))
+        if err != nil {
+            apierror.Write(w, r, err)
+            return
+        }
+
+        authz.InvalidateUser(userID)
+
+        json.NewEncoder(w).Encode(map[string]string{"message": "User status updated"})
+    }
+}
+
+// DeleteUserHandler removes an account. Accounts that own bookings must be disabled instead.
+func DeleteUserHandler(users models.UserStore, authz *auth.Authorizer) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        userID, ok := targetUserID(w, r)
+        if !ok {
+            return
+        }
+
+        err := users.DeleteUser(r.Context(), userID, auditActor(r))
+        if err != nil {
+            apierror.Write(w, r, err)
+            return
+        }
+        authz.InvalidateUser(userID)
+
+        json.NewEncoder(w).Encode(map[string]string{"message": "User deleted"})
+    }
+}
+
+// UnlockUserHandler clears failed logins recorded against a user's username
+func UnlockUserHandler(throttles models.ThrottleStore) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        userID, err := strconv.Atoi(mux.Vars(r)["id"])
+        if err != nil {
+            apierror.Respond(w, r, http.StatusBadRequest, "Invalid user ID")
+            return
+        }
+
+        if err := throttles.UnlockUser(r.Context(), userID, auditActor(r)); err != nil {
+            apierror.Write(w, r, err)
+            return
+        }
+
+        json.NewEncoder(w).Encode(map[string]string{"message": "User unlocked"})
+    }
+}
+
+// ListLockoutsHandler returns the usernames and IPs that are currently locked out
+func ListLockoutsHandler(throttles models.ThrottleStore) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        lockouts, err := throttles.FetchActiveLockouts(r.Context(), time.Now())
+        if err != nil {
+            logging.FromContext(r.Context()).Error("Error fetching lockouts", "error", err)
+            apierror.Respond(w, r, http.StatusInternalServerError, "Error fetching lockouts")
+            return
+        }
+
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(lockouts)
+    }
+}
+
+// UnlockIPHandler clears failed logins recorded against a client IP
+func UnlockIPHandler(throttles models.ThrottleStore) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        ip := net.ParseIP(mux.Vars(r)["ip"])
+        if ip == nil {
+            apierror.Respond(w, r, http.StatusBadRequest, "Invalid IP address")
+            return
+        }
+
+        if err := throttles.UnlockIP(r.Context(), ip.String(), auditActor(r)); err != nil {
+            logging.FromContext(r.Context()).Error("Error unlocking IP", "target_ip", ip, "error", err)
+            apierror.Respond(w, r, http.StatusInternalServerError, "Error unlocking IP")
+            return
+        }
+
+        json.NewEncoder(w).Encode(map[string]string{"message": "IP unlocked"})
+    }
+}
+
+// targetUserID parses the {id} route variable and stops admins from modifying their own account
+func targetUserID(w http.ResponseWriter, r *http.Request) (int, bool) {
+    userID, err := strconv.Atoi(mux.Vars(r)["id"])
+    if err != nil {
+        apierror.Respond(w, r, http.StatusBadRequest, "Invalid user ID")
+        return 0, false
+    }
+
+    if principal, ok := auth.FromContext(r.Context()); ok && principal.UserID == userID {
+        apierror.Respond(w, r, http.StatusConflict, "Admins cannot modify their own account")
+        return 0, false
+    }
+
+    return userID, true
+}
+
+// roleExists checks that role is defined and writes an error response if it isn't
+func roleExists(w http.ResponseWriter, r *http.Request, users models.UserStore, role string) bool {
+    exists, err := users.RoleExists(r.Context(), role)
+    if err != nil {
+        logging.FromContext(r.Context()).Error("Error looking up role", "target_role", role, "error", err)
+        apierror.Respond(w, r, http.StatusInternalServerError, "Error looking up role")
+        return false
+    }
+    if !exists {
+        apierror.Respond(w, r, http.StatusBadRequest, "Unknown role")
+        return false
+    }
+    return true
+}
+
+// roleGrantable rejects the request with 403 unless the caller holds every
+// permission of role, using the same rule as the scopes of new API keys
+func roleGrantable(w http.ResponseWriter, r *http.Request, roles models.RoleStore, role string) bool {
+    principal, ok := auth.FromContext(r.Context())
+    if !ok {
+        apierror.Respond(w, r, http.StatusUnauthorized, "Unauthorized")
+        return false
+    }
+    held, err := heldPermissions(r.Context(), roles, principal)
+    if err != nil {
+        logging.FromContext(r.Context()).Error("Error loading role permissions", "error", err)
+        apierror.Respond(w, r, http.StatusInternalServerError, "Error looking up role")
+        return false
+    }
+    granted, err := roles.FetchRolePermissions(r.Context(), role)
+    if err != nil {
+        logging.FromContext(r.Context()).Error("Error loading role permissions", "target_role", role, "error", err)
+        apierror.Respond(w, r, http.StatusInternalServerError, "Error looking up role")
+        return false
+    }
+    if err := models.CheckRoleGrantable(granted, held); err != nil {
+        apierror.Write(w, r, err)
+        return false
+    }
+    return true
+}
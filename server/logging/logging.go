@@ -0,0 +1,87 @@
+// Package logging sets up the structured logger and carries a request-scoped
+// logger through a context, so everything logged while serving a request can
+// be correlated by its request ID.
+package logging
+
+import (
+    "context"
+    "fmt"
+    "io"
+    "log/slog"
+    "strings"
+    "sync"
+)
+
+// New returns a logger writing JSON lines to w at the given level
+func New(w io.Writer, level slog.Level) *slog.Logger {
+    return slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level}))
+}
+
+// ParseLevel reads debug, info, warn or error
+func ParseLevel(s string) (slog.Level, error) {
+    var level slog.Level
+    switch strings.ToLower(s) {
+    case "debug":
+        level = slog.LevelDebug
+    case "info":
+        level = slog.LevelInfo
+    case "warn", "warning":
+        level = slog.LevelWarn
+    case "error":
+        level = slog.LevelError
+    default:
+        return level, fmt.Errorf("unknown log level %q", s)
+    }
+    return level, nil
+}
+
+type contextKey struct{}
+
+// scope is what a request context carries: the logger and attributes that
+// were learned while handling the request, such as the authenticated user
+type scope struct {
+    logger *slog.Logger
+    mu     *sync.Mutex
+    attrs  *[]any
+}
+
+// NewContext returns a context carrying logger. Attributes added with With
+// on derived contexts are collected for Attrs.
+func NewContext(ctx context.Context, logger *slog.Logger) context.Context {
+    return context.WithValue(ctx, contextKey{}, scope{logger: logger, mu: &sync.Mutex{}, attrs: &[]any{}})
+}
+
+// FromContext returns the request-scoped logger, or the default logger
+// outside of a request
+func FromContext(ctx context.Context) *slog.Logger {
+    if s, ok := ctx.Value(contextKey{}).(scope); ok {
+        return s.logger
+    }
+    return slog.Default()
+}
+
+// With returns a context whose logger includes args. They are also recorded
+// for the request log line, which is written by a middleware that only sees
+// the original context.
+func With(ctx context.Context, args ...any) context.Context {
+    s, ok := ctx.Value(contextKey{}).(scope)
+    if !ok {
+        return NewContext(ctx, slog.Default().With(args...))
+    }
+    s.mu.Lock()
+    *s.attrs = append(*s.attrs, args...)
+    s.mu.Unlock()
+    s.logger = s.logger.With(args...)
+    return context.WithValue(ctx, contextKey{}, s)
+}
+
+// Attrs returns the arguments added with With during the request
+func Attrs(ctx context.Context) []any {
+    s, ok := ctx.Value(contextKey{}).(scope)
+    if !ok {
+        return nil
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return append([]any(nil), *s.attrs...)
+}
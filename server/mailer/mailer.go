@@ -0,0 +1,107 @@
+package mailer
+
+import (
+    "context"
+    "fmc/logging"
+    "fmt"
+    "net"
+    "net/smtp"
+    "os"
+    "path/filepath"
+    "strings"
+    "time"
+)
+
+// Message is a plain text email
+type Message struct {
+    To      string
+    Subject string
+    Body    string
+}
+
+// Mailer delivers messages to users
+type Mailer interface {
+    Send(ctx context.Context, msg Message) error
+}
+
+// LogMailer writes messages to the server log instead of sending them. Meant for local development.
+type LogMailer struct{}
+
+func (LogMailer) Send(ctx context.Context, msg Message) error {
+    logging.FromContext(ctx).Info("Mail", "to", msg.To, "subject", msg.Subject, "body", msg.Body)
+    return nil
+}
+
+// FileMailer writes each message to its own .eml file in Dir. Meant for local development.
+type FileMailer struct {
+    Dir  string
+    From string
+}
+
+func (m FileMailer) Send(ctx context.Context, msg Message) error {
+    if err := os.MkdirAll(m.Dir, 0o700); err != nil {
+        return fmt.Errorf("creating mail directory: %w", err)
+    }
+    name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), sanitizeFileName(msg.To))
+    return os.WriteFile(filepath.Join(m.Dir, name), format(m.From, msg), 0o600)
+}
+
+// SMTPMailer sends messages through an SMTP relay using PLAIN auth when a username is set
+type SMTPMailer struct {
+    Addr     string
+    Username string
+    Password string
+    From     string
+}
+
+func (m SMTPMailer) Send(ctx context.Context, msg Message) error {
+    var smtpAuth smtp.Auth
+    if m.Username != "" {
+        host, _, err := net.SplitHostPort(m.Addr)
+        if err != nil {
+            return fmt.Errorf("invalid SMTP address %q: %w", m.Addr, err)
+        }
+        smtpAuth = smtp.PlainAuth("", m.Username, m.Password, host)
+    }
+    return smtp.SendMail(m.Addr, smtpAuth, m.From, []string{msg.To}, format(m.From, msg))
+}
+
+// New returns the mailer selected by kind: "log", "file" or "smtp"
+func New(kind, dir, smtpAddr, smtpUsername, smtpPassword, from string) (Mailer, error) {
+    switch kind {
+    case "", "log":
+        return LogMailer{}, nil
+    case "file":
+        if dir == "" {
+            return nil, fmt.Errorf("file mailer needs a directory")
+        }
+        return FileMailer{Dir: dir, From: from}, nil
+    case "smtp":
+        if smtpAddr == "" || from == "" {
+            return nil, fmt.Errorf("smtp mailer needs an address and a from address")
+        }
+        return SMTPMailer{Addr: smtpAddr, Username: smtpUsername, Password: smtpPassword, From: from}, nil
+    }
+    return nil, fmt.Errorf("unknown mailer %q", kind)
+}
+
+func format(from string, msg Message) []byte {
+    var b strings.Builder
+    fmt.Fprintf(&b, "From: %s\r\n", from)
+    fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+    fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+    fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+    b.WriteString("MIME-Version: 1.0\r\n")
+    b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+    b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+    return []byte(b.String())
+}
+
+func sanitizeFileName(s string) string {
+    return strings.Map(func(r rune) rune {
+        if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' {
+            return r
+        }
+        return '_'
+    }, s)
+}
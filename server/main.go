@@ -1,70 +1,113 @@
 package main
 
 import (
+    "context"
+    "flag"
+    "fmc/config"
     "fmc/database"
-    "fmc/handler"
-    "fmc/middleware"
-    "log"
+    "fmc/logging"
+    "fmc/tracing"
+    "log/slog"
     "net/http"
     "os"
-
-    "github.com/gorilla/mux"
-    "github.com/gorilla/handlers"
+    "os/signal"
+    "syscall"
 )
 
 func main() {
-    // Initialize the database
-    database.InitDB()
-    db := database.DB
+    // Settings come from the environment, .env and an optional JSON file; bad values stop startup
+    configFile := flag.String("config", os.Getenv("CONFIG_FILE"), "path to a JSON config file")
+    flag.Parse()
+    cfg, err := config.Load(".env", *configFile)
+    if err != nil {
+        fatal("Error loading configuration", err)
+    }
 
-    // Initialize the router
-    r := mux.NewRouter()
+    // Everything is logged as JSON lines to stdout; handlers log through the request's logger
+    logger := logging.New(os.Stdout, cfg.LogLevel)
+    slog.SetDefault(logger)
 
-    // Apply global CORS middleware
-    r.Use(middleware.CORS)
+    // Install the tracer provider before the database pool is opened, so queries are traced
+    shutdownTracing, err := tracing.Setup(context.Background(), cfg.Tracing)
+    if err != nil {
+        fatal("Error setting up tracing", err)
+    }
 
-    // Authentication routes (User registration and login)
-    r.HandleFunc("/register", handler.RegisterHandler(db)).Methods("POST")
-    r.HandleFunc("/login", handler.LoginHandler(db)).Methods("POST")
+    // Initialize the database
+    database.InitDB(cfg.Database)
+    db := database.DB
 
-    // Protected routes for Admin
-    adminRouter := r.PathPrefix("/admin").Subrouter()
-    adminRouter.Use(middleware.RoleMiddleware("admin"))  // Protect with admin role middleware
-    adminRouter.HandleFunc("/getVehicles", handler.GetAllVehiclesHandler(db)).Methods("GET")  // Admin gets all vehicles
-	adminRouter.HandleFunc("/vehicles", handler.CreateVehicleHandler(db)).Methods("POST")  // Admin creates a vehicle
-    adminRouter.HandleFunc("/bookings", handler.GetAllBookingsHandler(db)).Methods("GET")  // Get all bookings
-    adminRouter.HandleFunc("/bookings/{id}/complete", handler.CompleteBookingHandler(db)).Methods("PUT")  // Mark a booking as complete
-    adminRouter.HandleFunc("/drivers/active-bookings", handler.GetDriverActiveBookingsCount(db)).Methods("GET")  // Get active bookings count per driver
-    adminRouter.HandleFunc("/analytics/vehicle-status", handler.GetVehicleStatus(db)).Methods("GET")
-    adminRouter.HandleFunc("/analytics/driver-performance", handler.GetDriverPerformance(db)).Methods("GET")
-    adminRouter.HandleFunc("/analytics/revenue-over-time", handler.GetRevenueOverTime(db)).Methods("GET")
-    adminRouter.HandleFunc("/analytics/booking-status-distribution", handler.GetBookingStatusDistribution(db)).Methods("GET")
-    adminRouter.HandleFunc("/analytics/bookings-over-time", handler.GetBookingsOverTime(db)).Methods("GET")
-    // adminRouter.HandleFunc("/bookings/pending", handler.GetPendingBookingsHandler(db)).Methods("GET")
-    // adminRouter.Use(middleware.RoleMiddleware("admin", "driver"))  // Allow both 'admin' and 'driver'
+    // `server migrate ...` manages the schema and exits
+    if flag.Arg(0) == "migrate" {
+        if err := runMigrate(db, cfg.Database.Driver, flag.Args()[1:]); err != nil {
+            fatal("Error running migrate", err)
+        }
+        return
+    }
+    if cfg.Database.AutoMigrate {
+        if err := database.Migrate(db, cfg.Database.Driver); err != nil {
+            fatal("Error migrating database", err)
+        }
+    }
 
+    router, err := NewRouter(cfg, db, logger)
+    if err != nil {
+        fatal("Error building router", err)
+    }
+    if cfg.MetricsToken == "" {
+        logger.Warn("METRICS_TOKEN is not set, so anyone who can reach the server can read /metrics")
+    }
+
+    server := &http.Server{
+        Addr:              ":" + cfg.Port,
+        Handler:           router,
+        ReadHeaderTimeout: cfg.HTTP.ReadHeaderTimeout,
+        ReadTimeout:       cfg.HTTP.ReadTimeout,
+        WriteTimeout:      cfg.HTTP.WriteTimeout,
+        IdleTimeout:       cfg.HTTP.IdleTimeout,
+    }
 
-    // Routes for Users to book vehicles
-    userRouter := r.PathPrefix("/user").Subrouter()
-    userRouter.Use(middleware.RoleMiddleware("user"))  // Protect with user role middleware
-    userRouter.HandleFunc("/bookings", handler.CreateBookingHandler(db)).Methods("POST")  // Create a booking
+    // Bookings no driver accepts in time expire in the background
+    expiryCtx, stopExpiry := context.WithCancel(context.Background())
+    defer stopExpiry()
+    if cfg.Bookings.PendingTTL > 0 {
+        go expireBookings(expiryCtx, newStore(cfg, db), cfg.Bookings.PendingTTL, logger)
+    }
 
-    // Routes for Drivers to accept bookings
-    driverRouter := r.PathPrefix("/driver").Subrouter()
-    driverRouter.Use(middleware.RoleMiddleware("driver"))  // Protect with driver role middleware
-    driverRouter.HandleFunc("/bookings/pending", handler.GetPendingBookingsHandler(db)).Methods("GET")
-    driverRouter.HandleFunc("/bookings/{id}/accept", handler.AcceptBookingHandler(db)).Methods("PUT")  // Driver accepts booking
+    // On SIGTERM stop accepting connections and let in-flight requests finish
+    // before the database pool is closed, so deploys don't drop bookings
+    stop := make(chan os.Signal, 1)
+    signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+    serverErr := make(chan error, 1)
+    go func() {
+        logger.Info("Server is running", "port", cfg.Port)
+        serverErr <- server.ListenAndServe()
+    }()
 
-    // Add CORS support for frontend
-    headers := handlers.AllowedHeaders([]string{"X-Requested-With", "Content-Type", "Authorization", "User-ID", "Driver-ID", "Role"})
-    methods := handlers.AllowedMethods([]string{"GET", "POST", "PUT", "DELETE", "OPTIONS"})
-    origins := handlers.AllowedOrigins([]string{"http://localhost:5173"}) // Allow Vite dev server requests
+    select {
+    case err := <-serverErr:
+        fatal("Server failed", err)
+    case sig := <-stop:
+        logger.Info("Shutting down", "signal", sig.String())
+    }
 
-    port := os.Getenv("PORT")
-    if port == "" {
-        port = "8080"
+    ctx, cancel := context.WithTimeout(context.Background(), cfg.HTTP.ShutdownTimeout)
+    defer cancel()
+    if err := server.Shutdown(ctx); err != nil {
+        logger.Error("Error draining requests", "error", err)
+    }
+    stopExpiry()
+    if err := db.Close(); err != nil {
+        logger.Error("Error closing the database", "error", err)
+    }
+    if err := shutdownTracing(ctx); err != nil {
+        logger.Error("Error flushing traces", "error", err)
     }
+    logger.Info("Server stopped")
+}
 
-    log.Printf("Server is running on port %s...", port)
-    log.Fatal(http.ListenAndServe(":"+port, handlers.CORS(origins, headers, methods)(r)))
-}
\ No newline at end of file
+// fatal logs err and exits
+func fatal(msg string, err error) {
+    slog.Error(msg, "error", err)
+    os.Exit(1)
+}
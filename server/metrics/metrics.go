@@ -0,0 +1,194 @@
+// Package metrics exposes the server's Prometheus metrics: request latency
+// per route, the database pool and figures about bookings and the fleet.
+package metrics
+
+import (
+    "context"
+    "crypto/subtle"
+    "database/sql"
+    "net/http"
+    "strconv"
+    "time"
+
+    "fmc/apierror"
+    "fmc/logging"
+    "fmc/models"
+
+    "github.com/gorilla/mux"
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/client_golang/prometheus/collectors"
+    "github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "fleetfy"
+
+// scrapeTimeout bounds the queries run for the domain gauges on each scrape
+const scrapeTimeout = 5 * time.Second
+
+var (
+    requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+        Namespace: namespace,
+        Name:      "http_request_duration_seconds",
+        Help:      "Latency of HTTP requests by route.",
+        Buckets:   prometheus.DefBuckets,
+    }, []string{"method", "route", "status"})
+
+    // BookingsCreated counts bookings placed by users
+    BookingsCreated = prometheus.NewCounter(prometheus.CounterOpts{
+        Namespace: namespace,
+        Name:      "bookings_created_total",
+        Help:      "Bookings created.",
+    })
+    // BookingsAccepted counts bookings taken by a driver
+    BookingsAccepted = prometheus.NewCounter(prometheus.CounterOpts{
+        Namespace: namespace,
+        Name:      "bookings_accepted_total",
+        Help:      "Bookings accepted by a driver.",
+    })
+    // BookingsCompleted counts bookings marked as completed
+    BookingsCompleted = prometheus.NewCounter(prometheus.CounterOpts{
+        Namespace: namespace,
+        Name:      "bookings_completed_total",
+        Help:      "Bookings completed.",
+    })
+    // BookingsCancelled counts bookings cancelled by their customer or an admin
+    BookingsCancelled = prometheus.NewCounter(prometheus.CounterOpts{
+        Namespace: namespace,
+        Name:      "bookings_cancelled_total",
+        Help:      "Bookings cancelled.",
+    })
+    // BookingsExpired counts pending bookings no driver accepted in time
+    BookingsExpired = prometheus.NewCounter(prometheus.CounterOpts{
+        Namespace: namespace,
+        Name:      "bookings_expired_total",
+        Help:      "Pending bookings expired.",
+    })
+)
+
+// NewRegistry returns a registry with the process, Go runtime, request and
+// booking metrics, the pool statistics of db and gauges read from analytics
+// whenever the registry is scraped
+func NewRegistry(db *sql.DB, analytics models.AnalyticsStore) *prometheus.Registry {
+    reg := prometheus.NewRegistry()
+    reg.MustRegister(
+        collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+        collectors.NewGoCollector(),
+        collectors.NewDBStatsCollector(db, namespace),
+        requestDuration,
+        BookingsCreated,
+        BookingsAccepted,
+        BookingsCompleted,
+        BookingsCancelled,
+        BookingsExpired,
+        &domainCollector{analytics: analytics},
+    )
+    return reg
+}
+
+// Handler serves the metrics of reg in the Prometheus text format. With a
+// token, only requests bearing it are answered.
+func Handler(reg *prometheus.Registry, token string) http.Handler {
+    h := promhttp.HandlerFor(reg, promhttp.HandlerOpts{Registry: reg})
+    if token == "" {
+        return h
+    }
+    want := []byte("Bearer " + token)
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+            apierror.Respond(w, r, http.StatusUnauthorized, "Unauthorized")
+            return
+        }
+        h.ServeHTTP(w, r)
+    })
+}
+
+// Instrument records the latency of every request routed by mux. Requests are
+// labelled with the route's name, or its path template for unnamed routes, so
+// IDs in the path don't create a series per booking.
+func Instrument(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        start := time.Now()
+        recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+        next.ServeHTTP(recorder, r)
+        requestDuration.WithLabelValues(r.Method, routeName(r), strconv.Itoa(recorder.status)).Observe(time.Since(start).Seconds())
+    })
+}
+
+func routeName(r *http.Request) string {
+    route := mux.CurrentRoute(r)
+    if route == nil {
+        return "unmatched"
+    }
+    if name := route.GetName(); name != "" {
+        return name
+    }
+    if template, err := route.GetPathTemplate(); err == nil {
+        return template
+    }
+    return "unmatched"
+}
+
+// statusRecorder remembers the status code written by a handler
+type statusRecorder struct {
+    http.ResponseWriter
+    status      int
+    wroteHeader bool
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+    if !w.wroteHeader {
+        w.status = status
+        w.wroteHeader = true
+    }
+    w.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+    return w.ResponseWriter
+}
+
+var (
+    pendingBookingsDesc = prometheus.NewDesc(namespace+"_pending_bookings", "Bookings waiting for a driver.", nil, nil)
+    bookingsDesc        = prometheus.NewDesc(namespace+"_bookings", "Bookings by status.", []string{"status"}, nil)
+    vehiclesDesc        = prometheus.NewDesc(namespace+"_vehicles", "Vehicles by state: active vehicles are in use, idle ones are available.", []string{"state"}, nil)
+)
+
+// domainCollector reads the booking queue and the fleet from the database on each scrape
+type domainCollector struct {
+    analytics models.AnalyticsStore
+}
+
+func (c *domainCollector) Describe(ch chan<- *prometheus.Desc) {
+    ch <- pendingBookingsDesc
+    ch <- bookingsDesc
+    ch <- vehiclesDesc
+}
+
+func (c *domainCollector) Collect(ch chan<- prometheus.Metric) {
+    ctx, cancel := context.WithTimeout(context.Background(), scrapeTimeout)
+    defer cancel()
+
+    if distribution, err := c.analytics.FetchBookingStatusDistribution(ctx); err != nil {
+        logging.FromContext(ctx).Error("Error collecting booking metrics", "error", err)
+        ch <- prometheus.NewInvalidMetric(bookingsDesc, err)
+    } else {
+        pending := 0
+        for _, s := range distribution {
+            if s.Status == models.BookingPending {
+                pending = s.Count
+            }
+            ch <- prometheus.MustNewConstMetric(bookingsDesc, prometheus.GaugeValue, float64(s.Count), s.Status)
+        }
+        ch <- prometheus.MustNewConstMetric(pendingBookingsDesc, prometheus.GaugeValue, float64(pending))
+    }
+
+    // The same figures as the vehicle status on the admin dashboard
+    if status, err := c.analytics.FetchVehicleStatus(ctx); err != nil {
+        logging.FromContext(ctx).Error("Error collecting vehicle metrics", "error", err)
+        ch <- prometheus.NewInvalidMetric(vehiclesDesc, err)
+    } else {
+        ch <- prometheus.MustNewConstMetric(vehiclesDesc, prometheus.GaugeValue, float64(status.Active), "active")
+        ch <- prometheus.MustNewConstMetric(vehiclesDesc, prometheus.GaugeValue, float64(status.Idle), "idle")
+    }
+}
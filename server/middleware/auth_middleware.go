@@ -1,23 +1,170 @@
 package middleware
 
 import (
+    "errors"
     "net/http"
     "strings"
+
+    "fmc/apierror"
+    "fmc/auth"
+    "fmc/logging"
 )
 
-func RoleMiddleware(allowedRoles ...string) func(http.Handler) http.Handler {
+// Authenticate verifies the bearer access token on the request and stores the
+// authenticated principal in the request context. Tokens issued before the
+// sessions of their user were revoked are rejected, see Authorizer.SessionCurrent.
+// When apiKeys is not nil an API key, sent as X-API-Key or as a bearer token,
+// is accepted instead. Requests without valid credentials are rejected before
+// reaching the handler.
+func Authenticate(tokens *auth.TokenManager, authz *auth.Authorizer, apiKeys auth.APIKeyResolver) func(http.Handler) http.Handler {
+    return func(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            if key, ok := apiKey(r); ok && apiKeys != nil {
+                principal, err := apiKeys(r.Context(), key)
+                if errors.Is(err, auth.ErrInvalidToken) {
+                    apierror.Respond(w, r, http.StatusUnauthorized, "Unauthorized")
+                    return
+                }
+                if err != nil {
+                    logging.FromContext(r.Context()).Error("Error resolving API key", "error", err)
+                    apierror.Respond(w, r, http.StatusInternalServerError, "Error checking credentials")
+                    return
+                }
+                next.ServeHTTP(w, r.WithContext(withPrincipal(r.Context(), principal)))
+                return
+            }
+
+            token, ok := bearerToken(r)
+            if !ok {
+                w.Header().Set("WWW-Authenticate", `Bearer realm="fleetfy"`)
+                apierror.Respond(w, r, http.StatusUnauthorized, "Unauthorized")
+                return
+            }
+
+            principal, err := tokens.ParseAccessToken(token)
+            if err != nil {
+                w.Header().Set("WWW-Authenticate", `Bearer realm="fleetfy", error="invalid_token"`)
+                apierror.Respond(w, r, http.StatusUnauthorized, "Unauthorized")
+                return
+            }
+            if !sessionCurrent(w, r, authz, principal) {
+                return
+            }
+
+            next.ServeHTTP(w, r.WithContext(withPrincipal(r.Context(), principal)))
+        })
+    }
+}
+
+// AuthenticateEnrollment works like Authenticate but also accepts the limited
+// tokens given to accounts that must enroll in two-factor authentication
+// before they get a full session. Only MFA enrollment routes should use it.
+func AuthenticateEnrollment(tokens *auth.TokenManager, authz *auth.Authorizer) func(http.Handler) http.Handler {
     return func(next http.Handler) http.Handler {
         return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-            role := r.Header.Get("Role") // In real-world apps, this should be from JWT or session
+            token, ok := bearerToken(r)
+            if !ok {
+                w.Header().Set("WWW-Authenticate", `Bearer realm="fleetfy"`)
+                apierror.Respond(w, r, http.StatusUnauthorized, "Unauthorized")
+                return
+            }
+
+            principal, err := tokens.ParseScopedToken(token, "", auth.ScopeMFAEnroll)
+            if err != nil {
+                w.Header().Set("WWW-Authenticate", `Bearer realm="fleetfy", error="invalid_token"`)
+                apierror.Respond(w, r, http.StatusUnauthorized, "Unauthorized")
+                return
+            }
+            if !sessionCurrent(w, r, authz, principal) {
+                return
+            }
 
-            for _, allowedRole := range allowedRoles {
-                if strings.EqualFold(role, allowedRole) {
-                    next.ServeHTTP(w, r)
+            next.ServeHTTP(w, r.WithContext(withPrincipal(r.Context(), principal)))
+        })
+    }
+}
+
+// RequirePermission allows the request through only if the role of the
+// authenticated principal grants the permission. It must run after Authenticate.
+func RequirePermission(authz *auth.Authorizer, permission string) func(http.Handler) http.Handler {
+    return func(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            principal, ok := auth.FromContext(r.Context())
+            if !ok {
+                apierror.Respond(w, r, http.StatusUnauthorized, "Unauthorized")
+                return
+            }
+
+            // API keys are limited to their own scopes regardless of the service account's role
+            if principal.IsAPIKey() {
+                if !containsString(principal.Scopes, permission) {
+                    apierror.Respond(w, r, http.StatusForbidden, "Missing permission "+permission)
                     return
                 }
+                next.ServeHTTP(w, r)
+                return
             }
 
-            http.Error(w, "Forbidden", http.StatusForbidden)
+            granted, err := authz.HasPermission(r.Context(), principal.Role, permission)
+            if err != nil {
+                logging.FromContext(r.Context()).Error("Error loading role permissions", "error", err)
+                apierror.Respond(w, r, http.StatusInternalServerError, "Error checking permissions")
+                return
+            }
+            if !granted {
+                apierror.Respond(w, r, http.StatusForbidden, "Missing permission "+permission)
+                return
+            }
+
+            next.ServeHTTP(w, r)
         })
     }
 }
+
+// sessionCurrent rejects the request unless the access token of principal
+// belongs to a session that hasn't been revoked since it was issued
+func sessionCurrent(w http.ResponseWriter, r *http.Request, authz *auth.Authorizer, principal *auth.Principal) bool {
+    current, err := authz.SessionCurrent(r.Context(), principal.UserID, principal.SessionEpoch)
+    if err != nil {
+        logging.FromContext(r.Context()).Error("Error loading session epoch", "error", err)
+        apierror.Respond(w, r, http.StatusInternalServerError, "Error checking credentials")
+        return false
+    }
+    if !current {
+        w.Header().Set("WWW-Authenticate", `Bearer realm="fleetfy", error="invalid_token"`)
+        apierror.Respond(w, r, http.StatusUnauthorized, "Unauthorized")
+        return false
+    }
+    return true
+}
+
+// bearerToken extracts the token from an "Authorization: Bearer <token>" header
+func bearerToken(r *http.Request) (string, bool) {
+    header := r.Header.Get("Authorization")
+    scheme, token, found := strings.Cut(header, " ")
+    if !found || !strings.EqualFold(scheme, "Bearer") {
+        return "", false
+    }
+    token = strings.TrimSpace(token)
+    return token, token != ""
+}
+
+// apiKey extracts an API key from the X-API-Key header or an Authorization bearer token
+func apiKey(r *http.Request) (string, bool) {
+    if key := strings.TrimSpace(r.Header.Get("X-API-Key")); key != "" {
+        return key, true
+    }
+    if token, ok := bearerToken(r); ok && strings.HasPrefix(token, auth.APIKeyPrefix) {
+        return token, true
+    }
+    return "", false
+}
+
+func containsString(values []string, want string) bool {
+    for _, v := range values {
+        if v == want {
+            return true
+        }
+    }
+    return false
+}
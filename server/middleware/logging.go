@@ -0,0 +1,90 @@
+package middleware
+
+import (
+    "context"
+    "log/slog"
+    "net/http"
+    "time"
+
+    "fmc/auth"
+    "fmc/logging"
+
+    "go.opentelemetry.io/otel/attribute"
+    "go.opentelemetry.io/otel/trace"
+)
+
+// statusRecorder remembers the status code and size of a response
+type statusRecorder struct {
+    http.ResponseWriter
+    status int
+    bytes  int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+    if w.status == 0 {
+        w.status = status
+    }
+    w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+    if w.status == 0 {
+        w.status = http.StatusOK
+    }
+    n, err := w.ResponseWriter.Write(b)
+    w.bytes += n
+    return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+    return w.ResponseWriter
+}
+
+// RequestLogger gives every request a logger tagged with its request ID, and
+// trace ID when it is traced, and writes one line per request with its outcome and, once authenticated, the
+// principal. It must run inside RequestID.
+func RequestLogger(logger *slog.Logger) func(http.Handler) http.Handler {
+    return func(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            start := time.Now()
+            requestID := RequestIDFromContext(r.Context())
+            requestLogger := logger.With("request_id", requestID)
+            if span := trace.SpanFromContext(r.Context()); span.SpanContext().IsValid() {
+                // Link the trace and the logs both ways
+                requestLogger = requestLogger.With("trace_id", span.SpanContext().TraceID().String())
+                span.SetAttributes(attribute.String("request.id", requestID))
+            }
+            ctx := logging.NewContext(r.Context(), requestLogger)
+            recorder := &statusRecorder{ResponseWriter: w}
+
+            next.ServeHTTP(recorder, r.WithContext(ctx))
+
+            if recorder.status == 0 {
+                recorder.status = http.StatusOK
+            }
+            level := slog.LevelInfo
+            if recorder.status >= 500 {
+                level = slog.LevelError
+            }
+            args := []any{
+                "method", r.Method,
+                "path", r.URL.Path,
+                "status", recorder.status,
+                "duration_ms", float64(time.Since(start).Microseconds()) / 1000,
+                "bytes", recorder.bytes,
+                "ip", ClientIP(r),
+            }
+            requestLogger.Log(ctx, level, "request", append(args, logging.Attrs(ctx)...)...)
+        })
+    }
+}
+
+// withPrincipal stores the authenticated principal in ctx and adds it to the request's logs
+func withPrincipal(ctx context.Context, p *auth.Principal) context.Context {
+    args := []any{"user_id", p.UserID, "role", p.Role}
+    if p.IsAPIKey() {
+        args = append(args, "api_key_id", p.APIKeyID)
+    }
+    return auth.NewContext(logging.With(ctx, args...), p)
+}
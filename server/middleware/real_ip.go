@@ -0,0 +1,79 @@
+package middleware
+
+import (
+    "fmt"
+    "net"
+    "net/http"
+    "strings"
+)
+
+// RealIP replaces r.RemoteAddr with the client address reported by
+// X-Forwarded-For when the request came through one of the trusted proxies
+// (nginx in production). Forwarded headers from anyone else are ignored so
+// clients can't spoof their address.
+func RealIP(trustedProxies []*net.IPNet) func(http.Handler) http.Handler {
+    return func(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            if isTrusted(net.ParseIP(ClientIP(r)), trustedProxies) {
+                // Walk the chain from the nearest hop and stop at the first untrusted address
+                hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+                for i := len(hops) - 1; i >= 0; i-- {
+                    ip := net.ParseIP(strings.TrimSpace(hops[i]))
+                    if ip == nil {
+                        break
+                    }
+                    r.RemoteAddr = ip.String()
+                    if !isTrusted(ip, trustedProxies) {
+                        break
+                    }
+                }
+            }
+            next.ServeHTTP(w, r)
+        })
+    }
+}
+
+// ClientIP returns the IP address of the client that sent the request
+func ClientIP(r *http.Request) string {
+    host, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        return r.RemoteAddr
+    }
+    return host
+}
+
+// ParseTrustedProxies parses a comma separated list of IPs and CIDR ranges
+func ParseTrustedProxies(list string) ([]*net.IPNet, error) {
+    var networks []*net.IPNet
+    for _, entry := range strings.Split(list, ",") {
+        entry = strings.TrimSpace(entry)
+        if entry == "" {
+            continue
+        }
+        if !strings.Contains(entry, "/") {
+            if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+                entry += "/32"
+            } else {
+                entry += "/128"
+            }
+        }
+        _, network, err := net.ParseCIDR(entry)
+        if err != nil {
+            return nil, fmt.Errorf("invalid trusted proxy %q: %w", entry, err)
+        }
+        networks = append(networks, network)
+    }
+    return networks, nil
+}
+
+func isTrusted(ip net.IP, trustedProxies []*net.IPNet) bool {
+    if ip == nil {
+        return false
+    }
+    for _, network := range trustedProxies {
+        if network.Contains(ip) {
+            return true
+        }
+    }
+    return false
+}
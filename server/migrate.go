@@ -0,0 +1,65 @@
+package main
+
+import (
+    "database/sql"
+    "errors"
+    "fmc/database"
+    "fmt"
+    "os"
+    "strconv"
+)
+
+const migrateUsage = `usage: server migrate <command>
+
+commands:
+  up                apply all pending migrations
+  down [n]          revert the last n migrations (default 1)
+  status            list migrations and when they were applied
+  baseline <version>
+                    record migrations up to version as applied without running them,
+                    for databases created before migrations existed`
+
+// runMigrate implements the migrate subcommand
+func runMigrate(db *sql.DB, driver string, args []string) error {
+    if len(args) == 0 {
+        return errors.New(migrateUsage)
+    }
+
+    switch args[0] {
+    case "up":
+        return database.Migrate(db, driver)
+    case "down":
+        steps := 1
+        if len(args) > 1 {
+            n, err := strconv.Atoi(args[1])
+            if err != nil || n < 1 {
+                return fmt.Errorf("down takes a positive number of migrations, got %q", args[1])
+            }
+            steps = n
+        }
+        return database.MigrateDown(db, driver, steps)
+    case "status":
+        statuses, err := database.Status(db, driver)
+        if err != nil {
+            return err
+        }
+        for _, s := range statuses {
+            applied := "pending"
+            if s.AppliedAt != nil {
+                applied = "applied " + s.AppliedAt.Format("2006-01-02 15:04:05")
+            }
+            fmt.Fprintf(os.Stdout, "%04d_%-30s %s\n", s.Version, s.Name, applied)
+        }
+        return nil
+    case "baseline":
+        if len(args) < 2 {
+            return fmt.Errorf("baseline needs the version the database is at")
+        }
+        version, err := strconv.Atoi(args[1])
+        if err != nil {
+            return fmt.Errorf("invalid version %q", args[1])
+        }
+        return database.Baseline(db, driver, version)
+    }
+    return fmt.Errorf("unknown migrate command %q\n\n%s", args[0], migrateUsage)
+}
@@ -0,0 +1,186 @@
+package models
+
+import (
+    "context"
+    "database/sql"
+    "time"
+)
+
+type VehicleStatus struct {
+    Active int `json:"active"`
+    Idle   int `json:"idle"`
+}
+
+type DriverPerformance struct {
+    DriverName string `json:"driver_name"`
+    Deliveries int    `json:"deliveries"`
+}
+
+type RevenueData struct {
+    Date    time.Time `json:"date"`
+    Revenue float64   `json:"revenue"`
+}
+
+type BookingStatus struct {
+    Status string `json:"status"`
+    Count  int    `json:"count"`
+}
+
+type BookingsOverTime struct {
+    Date  time.Time `json:"date"`
+    Count int       `json:"count"`
+}
+
+type DriverActiveBookings struct {
+    DriverID       int `json:"driver_id"`
+    ActiveBookings int `json:"active_bookings"`
+}
+
+// FetchVehicleStatus counts vehicles in use (active) and available (idle).
+// Retired vehicles aren't counted.
+func FetchVehicleStatus(ctx context.Context, db *sql.DB) (VehicleStatus, error) {
+    var status VehicleStatus
+    err := db.QueryRowContext(ctx, `
+        SELECT
+            COALESCE(SUM(CASE WHEN availability THEN 0 ELSE 1 END), 0),
+            COALESCE(SUM(CASE WHEN availability THEN 1 ELSE 0 END), 0)
+        FROM vehicles
+        WHERE retired_at IS NULL
+    `).Scan(&status.Active, &status.Idle)
+    return status, err
+}
+
+// FetchDriverPerformance counts completed bookings per driver
+func FetchDriverPerformance(ctx context.Context, db *sql.DB) ([]DriverPerformance, error) {
+    rows, err := db.QueryContext(ctx, `
+        SELECT drivers.name, COUNT(bookings.id)
+        FROM drivers
+        JOIN bookings ON drivers.id = bookings.driver_id
+        WHERE bookings.status = 'completed'
+        GROUP BY drivers.name
+    `)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    data := []DriverPerformance{}
+    for rows.Next() {
+        var performance DriverPerformance
+        if err := rows.Scan(&performance.DriverName, &performance.Deliveries); err != nil {
+            return nil, err
+        }
+        data = append(data, performance)
+    }
+    return data, rows.Err()
+}
+
+// FetchRevenueOverTime sums the cost of completed bookings per day
+func FetchRevenueOverTime(ctx context.Context, db *sql.DB, dialect Dialect) ([]RevenueData, error) {
+    rows, err := db.QueryContext(ctx, `
+        SELECT ` + dialect.day("created_at") + ` AS day, SUM(estimated_cost)
+        FROM bookings
+        WHERE status = 'completed'
+        GROUP BY day
+        ORDER BY day
+    `)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    data := []RevenueData{}
+    for rows.Next() {
+        var revenue RevenueData
+        var day string
+        if err := rows.Scan(&day, &revenue.Revenue); err != nil {
+            return nil, err
+        }
+        if revenue.Date, err = parseDay(day); err != nil {
+            return nil, err
+        }
+        data = append(data, revenue)
+    }
+    return data, rows.Err()
+}
+
+// FetchBookingStatusDistribution counts bookings per status
+func FetchBookingStatusDistribution(ctx context.Context, db *sql.DB) ([]BookingStatus, error) {
+    rows, err := db.QueryContext(ctx, `
+        SELECT status, COUNT(*)
+        FROM bookings
+        GROUP BY status
+    `)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    data := []BookingStatus{}
+    for rows.Next() {
+        var status BookingStatus
+        if err := rows.Scan(&status.Status, &status.Count); err != nil {
+            return nil, err
+        }
+        data = append(data, status)
+    }
+    return data, rows.Err()
+}
+
+// FetchBookingsOverTime counts bookings created per day since the given time
+func FetchBookingsOverTime(ctx context.Context, db *sql.DB, dialect Dialect, since time.Time) ([]BookingsOverTime, error) {
+    rows, err := db.QueryContext(ctx, `
+        SELECT ` + dialect.day("created_at") + ` AS day, COUNT(*)
+        FROM bookings
+        WHERE ` + dialect.timestamp("created_at") + ` >= ` + dialect.timestamp("$1") + `
+        GROUP BY day
+        ORDER BY day
+    `, since.UTC())
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    data := []BookingsOverTime{}
+    for rows.Next() {
+        var booking BookingsOverTime
+        var day string
+        if err := rows.Scan(&day, &booking.Count); err != nil {
+            return nil, err
+        }
+        if booking.Date, err = parseDay(day); err != nil {
+            return nil, err
+        }
+        data = append(data, booking)
+    }
+    return data, rows.Err()
+}
+
+// FetchDriverActiveBookings counts active bookings per driver
+func FetchDriverActiveBookings(ctx context.Context, db *sql.DB) ([]DriverActiveBookings, error) {
+    rows, err := db.QueryContext(ctx, `
+        SELECT driver_id, COUNT(*) as active_bookings
+        FROM bookings
+        WHERE status IN `+activeBookingStatuses+`
+        GROUP BY driver_id
+    `)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    data := []DriverActiveBookings{}
+    for rows.Next() {
+        var d DriverActiveBookings
+        if err := rows.Scan(&d.DriverID, &d.ActiveBookings); err != nil {
+            return nil, err
+        }
+        data = append(data, d)
+    }
+    return data, rows.Err()
+}
+
+// parseDay reads a day bucket as returned by Dialect.day, as midnight UTC
+func parseDay(day string) (time.Time, error) {
+    return time.Parse("2006-01-02", day)
+}
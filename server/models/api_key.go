@@ -0,0 +1,221 @@
+package models
+
+import (
+    "context"
+    "database/sql"
+    "errors"
+    "strings"
+    "time"
+)
+
+var (
+    ErrAPIKeyNotFound    = NotFound("api_key_not_found", "API key not found or already revoked")
+    ErrInvalidAPIKey     = Unauthorized("invalid_api_key", "invalid, expired or revoked API key")
+    ErrNotServiceUser    = Validation("not_service_user", "user_id", "API keys can only belong to service accounts")
+    ErrScopeNotGrantable = Validation("scope_not_grantable", "scopes", "API keys can't manage roles or API keys")
+    ErrScopeNotHeld      = Forbidden("scope_not_held", "API keys can only get permissions their creator holds")
+)
+
+// APIKey is a credential for machine-to-machine integrations. It acts as its
+// service account user and is limited to the permissions listed in Scopes.
+// Only the hash of the key is stored; Prefix identifies it in listings.
+type APIKey struct {
+    ID         int        `json:"id"`
+    Name       string     `json:"name"`
+    Prefix     string     `json:"prefix"`
+    UserID     int        `json:"user_id"`
+    Scopes     []string   `json:"scopes"`
+    CreatedBy  *int       `json:"created_by"`
+    CreatedAt  time.Time  `json:"created_at"`
+    ExpiresAt  *time.Time `json:"expires_at"`
+    LastUsedAt *time.Time `json:"last_used_at"`
+    RevokedAt  *time.Time `json:"revoked_at"`
+}
+
+// lastUsedResolution limits how often last_used_at is written for a busy key
+const lastUsedResolution = time.Minute
+
+// CreateAPIKey stores a new key for a service account and returns its ID
+func CreateAPIKey(ctx context.Context, db *sql.DB, key APIKey, keyHash string, by AuditActor) (int, error) {
+    role, err := userRole(ctx, db, key.UserID)
+    if err != nil {
+        return 0, err
+    }
+    if role != RoleService {
+        return 0, ErrNotServiceUser
+    }
+
+    if err := checkPermissionsExist(ctx, db, key.Scopes); err != nil {
+        return 0, err
+    }
+
+    var expiresAt interface{}
+    if key.ExpiresAt != nil {
+        expiresAt = key.ExpiresAt.UTC()
+    }
+
+    tx, err := db.BeginTx(ctx, nil)
+    if err != nil {
+        return 0, err
+    }
+    defer tx.Rollback()
+
+    key.CreatedAt = time.Now().UTC()
+    query := `
+        INSERT INTO api_keys (name, prefix, key_hash, user_id, scopes, created_by, created_at, expires_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id`
+    err = tx.QueryRowContext(ctx, query, key.Name, key.Prefix, keyHash, key.UserID, strings.Join(key.Scopes, ","), key.CreatedBy, key.CreatedAt, expiresAt).Scan(&key.ID)
+    if err != nil {
+        return 0, err
+    }
+    if err := recordChange(ctx, tx, by, "api_key.create", "api_key", key.ID, nil, key); err != nil {
+        return 0, err
+    }
+    return key.ID, tx.Commit()
+}
+
+// ungrantableScopes would let a key widen its own access or mint other keys
+var ungrantableScopes = []string{PermAPIKeysManage, PermRolesManage}
+
+// CheckAPIKeyScopes returns why a creator who holds the permissions in held
+// can't give a key scopes, or nil. Keys never get more than their creator.
+func CheckAPIKeyScopes(ctx context.Context, db *sql.DB, scopes, held []string) error {
+    if err := checkPermissionsExist(ctx, db, scopes); err != nil {
+        return err
+    }
+    return checkScopesGrantable(scopes, held)
+}
+
+// checkScopesGrantable is CheckAPIKeyScopes for scopes known to exist
+func checkScopesGrantable(scopes, held []string) error {
+    for _, scope := range scopes {
+        if containsString(ungrantableScopes, scope) {
+            return ErrScopeNotGrantable
+        }
+        if !containsString(held, scope) {
+            return ErrScopeNotHeld
+        }
+    }
+    return nil
+}
+
+// checkPermissionsExist returns ErrUnknownPermission unless every name is a permission
+func checkPermissionsExist(ctx context.Context, db *sql.DB, names []string) error {
+    for _, name := range names {
+        var exists bool
+        if err := db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM permissions WHERE name = $1)`, name).Scan(&exists); err != nil {
+            return err
+        }
+        if !exists {
+            return ErrUnknownPermission
+        }
+    }
+    return nil
+}
+
+// CreateServiceAccount creates a user with the service role that API keys can
+// act as. Its password is random and never shown, so it can't log in.
+func CreateServiceAccount(ctx context.Context, db *sql.DB, username, randomPassword string, by AuditActor) (int, error) {
+    return RegisterUser(ctx, db, username, "", randomPassword, RoleService, UserStatusActive, by)
+}
+
+// FetchAllAPIKeys lists every API key, newest first
+func FetchAllAPIKeys(ctx context.Context, db *sql.DB) ([]APIKey, error) {
+    rows, err := db.QueryContext(ctx, `
+        SELECT id, name, prefix, user_id, scopes, created_by, created_at, expires_at, last_used_at, revoked_at
+        FROM api_keys
+        ORDER BY id DESC
+    `)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    keys := []APIKey{}
+    for rows.Next() {
+        var k APIKey
+        var scopes string
+        if err := rows.Scan(&k.ID, &k.Name, &k.Prefix, &k.UserID, &scopes, &k.CreatedBy, &k.CreatedAt, &k.ExpiresAt, &k.LastUsedAt, &k.RevokedAt); err != nil {
+            return nil, err
+        }
+        k.Scopes = splitScopes(scopes)
+        keys = append(keys, k)
+    }
+    return keys, rows.Err()
+}
+
+// RevokeAPIKey stops a key from working
+func RevokeAPIKey(ctx context.Context, db *sql.DB, keyID int, by AuditActor) error {
+    tx, err := db.BeginTx(ctx, nil)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    result, err := tx.ExecContext(ctx, `UPDATE api_keys SET revoked_at = $1 WHERE id = $2 AND revoked_at IS NULL`, time.Now().UTC(), keyID)
+    if err := expectAffected(result, err, ErrAPIKeyNotFound); err != nil {
+        return err
+    }
+    if err := recordChange(ctx, tx, by, "api_key.revoke", "api_key", keyID, nil, nil); err != nil {
+        return err
+    }
+    return tx.Commit()
+}
+
+// ResolveAPIKey looks up a live key by hash together with the role of its
+// service account and records that it was used
+func ResolveAPIKey(ctx context.Context, db *sql.DB, keyHash string, now time.Time) (*APIKey, string, error) {
+    var k APIKey
+    var scopes, role, status string
+    query := `
+        SELECT api_keys.id, api_keys.name, api_keys.user_id, api_keys.scopes, api_keys.expires_at, api_keys.revoked_at, users.role, users.status
+        FROM api_keys
+        JOIN users ON users.id = api_keys.user_id
+        WHERE api_keys.key_hash = $1`
+    err := db.QueryRowContext(ctx, query, keyHash).Scan(&k.ID, &k.Name, &k.UserID, &scopes, &k.ExpiresAt, &k.RevokedAt, &role, &status)
+    if errors.Is(err, sql.ErrNoRows) {
+        return nil, "", ErrInvalidAPIKey
+    }
+    if err != nil {
+        return nil, "", err
+    }
+
+    if k.RevokedAt != nil || (k.ExpiresAt != nil && !now.Before(*k.ExpiresAt)) || status != UserStatusActive {
+        return nil, "", ErrInvalidAPIKey
+    }
+    k.Scopes = splitScopes(scopes)
+
+    now = now.UTC()
+    _, err = db.ExecContext(ctx, `UPDATE api_keys SET last_used_at = $1 WHERE id = $2 AND (last_used_at IS NULL OR last_used_at < $3)`,
+        now, k.ID, now.Add(-lastUsedResolution))
+    if err != nil {
+        return nil, "", err
+    }
+
+    return &k, role, nil
+}
+
+func userRole(ctx context.Context, db *sql.DB, userID int) (string, error) {
+    var role string
+    err := db.QueryRowContext(ctx, `SELECT role FROM users WHERE id = $1`, userID).Scan(&role)
+    if errors.Is(err, sql.ErrNoRows) {
+        return "", ErrUserNotFound
+    }
+    return role, err
+}
+
+func splitScopes(scopes string) []string {
+    if scopes == "" {
+        return []string{}
+    }
+    return strings.Split(scopes, ",")
+}
+
+func containsString(values []string, want string) bool {
+    for _, v := range values {
+        if v == want {
+            return true
+        }
+    }
+    return false
+}
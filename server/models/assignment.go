@@ -0,0 +1,161 @@
+package models
+
+import (
+    "context"
+    "database/sql"
+    "errors"
+    "time"
+)
+
+var (
+    ErrNotADriver         = Validation("not_a_driver", "driver_id", "user is not a driver")
+    ErrDriverHasVehicle   = Conflict("driver_has_vehicle", "driver already holds a vehicle; unassign it first")
+    ErrVehicleAssigned    = Conflict("vehicle_assigned", "vehicle is assigned to a driver; unassign it first")
+    ErrVehicleNotAssigned = Conflict("vehicle_not_assigned", "vehicle is not assigned to a driver")
+)
+
+// VehicleAssignment is a period in which a driver held a vehicle.
+// UnassignedAt is nil while the driver still holds it.
+type VehicleAssignment struct {
+    ID           int        `json:"id"`
+    VehicleID    int        `json:"vehicle_id"`
+    DriverID     int        `json:"driver_id"`
+    AssignedAt   time.Time  `json:"assigned_at"`
+    UnassignedAt *time.Time `json:"unassigned_at"`
+}
+
+var AssignmentListSpec = ListSpec{Fields: map[string]ListField{
+    "id":          {Column: "id", Type: FieldInt, Sortable: true},
+    "vehicle_id":  {Column: "vehicle_id", Type: FieldInt},
+    "driver_id":   {Column: "driver_id", Type: FieldInt},
+    "assigned_at": {Column: "assigned_at", Type: FieldTime, Sortable: true},
+}}
+
+// AssignVehicle hands a vehicle to a driver. A driver holds at most one
+// vehicle and a vehicle has at most one driver; assigning a vehicle to the
+// driver who already holds it changes nothing.
+func AssignVehicle(ctx context.Context, db *sql.DB, vehicleID, driverID int, at time.Time, by AuditActor) error {
+    tx, err := db.BeginTx(ctx, nil)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    var role string
+    err = tx.QueryRowContext(ctx, `SELECT role FROM users WHERE id = $1`, driverID).Scan(&role)
+    if errors.Is(err, sql.ErrNoRows) {
+        return ErrUserNotFound
+    }
+    if err != nil {
+        return err
+    }
+    if role != RoleDriver {
+        return ErrNotADriver
+    }
+
+    before, err := getVehicle(ctx, tx, vehicleID)
+    if err != nil {
+        return err
+    }
+    result, err := tx.ExecContext(ctx, `
+        UPDATE vehicles SET driver_id = $1
+        WHERE id = $2 AND retired_at IS NULL AND driver_id IS NULL`, driverID, vehicleID)
+    if isUniqueViolation(err) {
+        return ErrDriverHasVehicle
+    }
+    err = expectAffected(result, err, ErrVehicleAssigned)
+    if errors.Is(err, ErrVehicleAssigned) {
+        switch {
+        case before.RetiredAt != nil:
+            return ErrVehicleRetired
+        case before.DriverID != nil && *before.DriverID == driverID:
+            return nil
+        }
+        return ErrVehicleAssigned
+    }
+    if err != nil {
+        return err
+    }
+
+    _, err = tx.ExecContext(ctx, `INSERT INTO vehicle_assignments (vehicle_id, driver_id, assigned_at) VALUES ($1, $2, $3)`,
+        vehicleID, driverID, at.UTC())
+    if err != nil {
+        return err
+    }
+
+    after, err := getVehicle(ctx, tx, vehicleID)
+    if err != nil {
+        return err
+    }
+    if err := recordChange(ctx, tx, by, "vehicle.assign", "vehicle", vehicleID, before, after); err != nil {
+        return err
+    }
+    return tx.Commit()
+}
+
+// UnassignVehicle takes a vehicle away from its driver, unless the vehicle is
+// busy with a booking
+func UnassignVehicle(ctx context.Context, db *sql.DB, vehicleID int, at time.Time, by AuditActor) error {
+    tx, err := db.BeginTx(ctx, nil)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    before, err := getVehicle(ctx, tx, vehicleID)
+    if err != nil {
+        return err
+    }
+    result, err := tx.ExecContext(ctx, `UPDATE vehicles SET driver_id = NULL WHERE id = $1 AND driver_id IS NOT NULL AND NOT `+vehicleBusy, vehicleID)
+    err = expectAffected(result, err, ErrVehicleNotAssigned)
+    if errors.Is(err, ErrVehicleNotAssigned) {
+        if before.DriverID != nil {
+            return ErrVehicleInUse
+        }
+        return ErrVehicleNotAssigned
+    }
+    if err != nil {
+        return err
+    }
+
+    _, err = tx.ExecContext(ctx, `UPDATE vehicle_assignments SET unassigned_at = $1 WHERE vehicle_id = $2 AND unassigned_at IS NULL`,
+        at.UTC(), vehicleID)
+    if err != nil {
+        return err
+    }
+
+    after, err := getVehicle(ctx, tx, vehicleID)
+    if err != nil {
+        return err
+    }
+    if err := recordChange(ctx, tx, by, "vehicle.unassign", "vehicle", vehicleID, before, after); err != nil {
+        return err
+    }
+    return tx.Commit()
+}
+
+// ListAssignments returns a page of the assignment history and the cursor of
+// the next page, which is empty on the last page
+func ListAssignments(ctx context.Context, db *sql.DB, d Dialect, q ListQuery) ([]VehicleAssignment, string, error) {
+    clause, args := q.sql(AssignmentListSpec, d)
+    rows, err := db.QueryContext(ctx, `SELECT id, vehicle_id, driver_id, assigned_at, unassigned_at FROM vehicle_assignments`+clause, args...)
+    if err != nil {
+        return nil, "", err
+    }
+    defer rows.Close()
+
+    assignments := []VehicleAssignment{}
+    for rows.Next() {
+        var a VehicleAssignment
+        if err := rows.Scan(&a.ID, &a.VehicleID, &a.DriverID, &a.AssignedAt, &a.UnassignedAt); err != nil {
+            return nil, "", err
+        }
+        assignments = append(assignments, a)
+    }
+    if err := rows.Err(); err != nil {
+        return nil, "", err
+    }
+
+    assignments, next := nextPage(assignments, q)
+    return assignments, next, nil
+}
@@ -0,0 +1,197 @@
+package models
+
+import (
+    "context"
+    "database/sql"
+    "encoding/json"
+    "fmt"
+    "strings"
+    "time"
+)
+
+// AuditEntry records one state-changing action: who did it, to what, and
+// what the entity looked like before and after. Entries are never modified.
+type AuditEntry struct {
+    ID          int64           `json:"id"`
+    OccurredAt  time.Time       `json:"occurred_at"`
+    ActorUserID *int            `json:"actor_user_id"`
+    ActorRole   *string         `json:"actor_role"`
+    APIKeyID    *int            `json:"api_key_id"`
+    Action      string          `json:"action"`
+    EntityType  string          `json:"entity_type"`
+    EntityID    *string         `json:"entity_id"`
+    Before      json.RawMessage `json:"before"`
+    After       json.RawMessage `json:"after"`
+    IP          *string         `json:"ip"`
+    RequestID   *string         `json:"request_id"`
+}
+
+// AuditFilter narrows an audit log query. Zero values don't filter.
+type AuditFilter struct {
+    ActorUserID int
+    Action      string
+    EntityType  string
+    EntityID    string
+    From        time.Time
+    To          time.Time
+    // BeforeID returns only entries older than the given ID, for paging
+    BeforeID int64
+    Limit    int
+}
+
+// AuditActor is who makes a change and from where. Functions that change
+// state take one and write the audit entry in the transaction of the change,
+// so the log holds exactly the changes that were made.
+type AuditActor struct {
+    UserID    *int
+    Role      *string
+    APIKeyID  *int
+    IP        *string
+    RequestID *string
+}
+
+// execer is a *sql.DB or a *sql.Tx
+type execer interface {
+    ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// querier is a *sql.DB or a *sql.Tx, for reads that must see the changes of
+// the transaction they run in
+type querier interface {
+    execer
+    QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+    QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// auditEntry returns the entry recording that by did action to an entity.
+// before and after are snapshots of the entity and may be nil.
+func auditEntry(by AuditActor, action, entityType string, entityID interface{}, before, after interface{}) (AuditEntry, error) {
+    entry := AuditEntry{
+        OccurredAt:  time.Now(),
+        ActorUserID: by.UserID,
+        ActorRole:   by.Role,
+        APIKeyID:    by.APIKeyID,
+        Action:      action,
+        EntityType:  entityType,
+        IP:          by.IP,
+        RequestID:   by.RequestID,
+    }
+    if entityID != nil {
+        id := fmt.Sprint(entityID)
+        entry.EntityID = &id
+    }
+
+    var err error
+    if entry.Before, err = auditSnapshot(before); err != nil {
+        return AuditEntry{}, err
+    }
+    if entry.After, err = auditSnapshot(after); err != nil {
+        return AuditEntry{}, err
+    }
+    return entry, nil
+}
+
+func auditSnapshot(v interface{}) (json.RawMessage, error) {
+    if v == nil {
+        return nil, nil
+    }
+    data, err := json.Marshal(v)
+    if err != nil {
+        return nil, fmt.Errorf("encoding audit snapshot: %w", err)
+    }
+    // A nil pointer, e.g. the entity before it was created, is stored as no snapshot
+    if string(data) == "null" {
+        return nil, nil
+    }
+    return data, nil
+}
+
+// recordChange writes the audit entry of a change in the transaction that makes it
+func recordChange(ctx context.Context, tx execer, by AuditActor, action, entityType string, entityID interface{}, before, after interface{}) error {
+    entry, err := auditEntry(by, action, entityType, entityID, before, after)
+    if err != nil {
+        return err
+    }
+    return insertAudit(ctx, tx, entry)
+}
+
+// insertAudit appends an entry to the audit log, inside a transaction when db is one
+func insertAudit(ctx context.Context, db execer, entry AuditEntry) error {
+    query := `
+        INSERT INTO audit_log (occurred_at, actor_user_id, actor_role, api_key_id, action, entity_type, entity_id, before_state, after_state, ip, request_id)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`
+    _, err := db.ExecContext(ctx, query, entry.OccurredAt.UTC(), entry.ActorUserID, entry.ActorRole, entry.APIKeyID, entry.Action, entry.EntityType,
+        entry.EntityID, rawOrNull(entry.Before), rawOrNull(entry.After), entry.IP, entry.RequestID)
+    return err
+}
+
+// QueryAudit returns matching audit entries, newest first
+func QueryAudit(ctx context.Context, db *sql.DB, filter AuditFilter) ([]AuditEntry, error) {
+    var conditions []string
+    var args []interface{}
+    where := func(condition string, arg interface{}) {
+        args = append(args, arg)
+        conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+    }
+
+    if filter.ActorUserID != 0 {
+        where("actor_user_id = $%d", filter.ActorUserID)
+    }
+    if filter.Action != "" {
+        where("action = $%d", filter.Action)
+    }
+    if filter.EntityType != "" {
+        where("entity_type = $%d", filter.EntityType)
+    }
+    if filter.EntityID != "" {
+        where("entity_id = $%d", filter.EntityID)
+    }
+    if !filter.From.IsZero() {
+        where("occurred_at >= $%d", filter.From.UTC())
+    }
+    if !filter.To.IsZero() {
+        where("occurred_at < $%d", filter.To.UTC())
+    }
+    if filter.BeforeID != 0 {
+        where("id < $%d", filter.BeforeID)
+    }
+
+    query := `SELECT id, occurred_at, actor_user_id, actor_role, api_key_id, action, entity_type, entity_id, before_state, after_state, ip, request_id FROM audit_log`
+    if len(conditions) > 0 {
+        query += " WHERE " + strings.Join(conditions, " AND ")
+    }
+    args = append(args, filter.Limit)
+    query += fmt.Sprintf(" ORDER BY id DESC LIMIT $%d", len(args))
+
+    rows, err := db.QueryContext(ctx, query, args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    entries := []AuditEntry{}
+    for rows.Next() {
+        var e AuditEntry
+        var before, after sql.NullString
+        err := rows.Scan(&e.ID, &e.OccurredAt, &e.ActorUserID, &e.ActorRole, &e.APIKeyID, &e.Action, &e.EntityType, &e.EntityID,
+            &before, &after, &e.IP, &e.RequestID)
+        if err != nil {
+            return nil, err
+        }
+        if before.Valid {
+            e.Before = json.RawMessage(before.String)
+        }
+        if after.Valid {
+            e.After = json.RawMessage(after.String)
+        }
+        entries = append(entries, e)
+    }
+    return entries, rows.Err()
+}
+
+func rawOrNull(raw json.RawMessage) interface{} {
+    if len(raw) == 0 {
+        return nil
+    }
+    return string(raw)
+}
@@ -1,18 +1,17 @@
 package models
 
 import (
+    "context"
     "database/sql"
     "errors"
     "time"
-	"log"
-   
 )
 
 type Booking struct {
     ID             int       `json:"id"`
     UserID         int       `json:"user_id"`
-    DriverID       int       `json:"driver_id"`
-    VehicleID      int       `json:"vehicle_id"`
+    DriverID       *int      `json:"driver_id"`
+    VehicleID      *int      `json:"vehicle_id"`
     PickupLocation string    `json:"pickup_location"`
     DropoffLocation string   `json:"dropoff_location"`
     VehicleType    string    `json:"vehicle_type"`
@@ -21,43 +20,186 @@ type Booking struct {
     CreatedAt      time.Time `json:"created_at"`
 }
 
+var (
+    ErrBookingNotFound     = NotFound("booking_not_found", "booking not found")
+    ErrBookingNotAvailable = Conflict("booking_not_available", "booking not available or already accepted")
+    ErrNoVehicleAssigned   = Conflict("no_vehicle_assigned", "driver has no vehicle assigned")
+    ErrVehicleTypeMismatch = Conflict("vehicle_type_mismatch", "booking needs a different vehicle type than the driver's")
+    ErrVehicleUnavailable  = Conflict("vehicle_unavailable", "driver's vehicle is busy with another booking or out of service")
+)
+
+const bookingColumns = `id, user_id, driver_id, vehicle_id, pickup_location, dropoff_location, vehicle_type, estimated_cost, status, created_at`
+
+type rowScanner interface {
+    Scan(dest ...interface{}) error
+}
+
+func scanBooking(row rowScanner) (*Booking, error) {
+    var b Booking
+    err := row.Scan(&b.ID, &b.UserID, &b.DriverID, &b.VehicleID, &b.PickupLocation, &b.DropoffLocation, &b.VehicleType, &b.EstimatedCost, &b.Status, &b.CreatedAt)
+    if err != nil {
+        return nil, err
+    }
+    return &b, nil
+}
+
+// GetBooking fetches a single booking by ID
+func GetBooking(ctx context.Context, db *sql.DB, bookingID int) (*Booking, error) {
+    return getBooking(ctx, db, bookingID)
+}
+
+func getBooking(ctx context.Context, q querier, bookingID int) (*Booking, error) {
+    b, err := scanBooking(q.QueryRowContext(ctx, `SELECT `+bookingColumns+` FROM bookings WHERE id = $1`, bookingID))
+    if errors.Is(err, sql.ErrNoRows) {
+        return nil, ErrBookingNotFound
+    }
+    return b, err
+}
+
+// ListBookings returns a page of bookings for the admin dashboard and the
+// cursor of the next page, which is empty on the last page
+func ListBookings(ctx context.Context, db *sql.DB, d Dialect, q ListQuery) ([]Booking, string, error) {
+    clause, args := q.sql(BookingListSpec, d)
+    bookings, err := queryBookings(ctx, db, `SELECT `+bookingColumns+` FROM bookings`+clause, args...)
+    if err != nil {
+        return nil, "", err
+    }
+
+    bookings, next := nextPage(bookings, q)
+    return bookings, next, nil
+}
+
+// FetchPendingBookings fetches the unassigned bookings drivers can accept
+func FetchPendingBookings(ctx context.Context, db *sql.DB) ([]Booking, error) {
+    return queryBookings(ctx, db, `SELECT `+bookingColumns+` FROM bookings WHERE status = $1 AND driver_id IS NULL ORDER BY id`, BookingPending)
+}
+
+func queryBookings(ctx context.Context, db *sql.DB, query string, args ...interface{}) ([]Booking, error) {
+    rows, err := db.QueryContext(ctx, query, args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    bookings := []Booking{}
+    for rows.Next() {
+        b, err := scanBooking(rows)
+        if err != nil {
+            return nil, err
+        }
+        bookings = append(bookings, *b)
+    }
+    return bookings, rows.Err()
+}
+
 // CreateBooking creates a new booking for a user
-func CreateBooking(db *sql.DB, userID int, pickupLocation, dropoffLocation, vehicleType string, estimatedCost float64) (int, error) {
+func CreateBooking(ctx context.Context, db *sql.DB, userID int, pickupLocation, dropoffLocation, vehicleType string, estimatedCost float64, by AuditActor) (int, error) {
+    tx, err := db.BeginTx(ctx, nil)
+    if err != nil {
+        return 0, err
+    }
+    defer tx.Rollback()
+
     var bookingID int
     query := `
         INSERT INTO bookings (user_id, pickup_location, dropoff_location, vehicle_type, estimated_cost, status)
-        VALUES ($1, $2, $3, $4, $5, 'pending') RETURNING id`
+        VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`
     
-    err := db.QueryRow(query, userID, pickupLocation, dropoffLocation, vehicleType, estimatedCost).Scan(&bookingID)
+    err = tx.QueryRowContext(ctx, query, userID, pickupLocation, dropoffLocation, vehicleType, estimatedCost, BookingPending).Scan(&bookingID)
     if err != nil {
-        log.Printf("Error executing SQL query: %v", err) // Log the query error
         return 0, err
     }
 
-    return bookingID, nil
+    after, err := getBooking(ctx, tx, bookingID)
+    if err != nil {
+        return 0, err
+    }
+    if err := recordChange(ctx, tx, by, "booking.create", "booking", bookingID, nil, after); err != nil {
+        return 0, err
+    }
+    return bookingID, tx.Commit()
 }
 
-func AcceptBooking(db *sql.DB, driverID, bookingID int) error {
-    // SQL to update the booking to accepted, checking if it is still pending
-    query := `UPDATE bookings 
-              SET driver_id = $1, status = 'accepted' 
-              WHERE id = $2 AND status = 'pending'`
+// AcceptBooking assigns a pending booking to a driver and the vehicle the
+// driver holds, which must be free and of the type the booking asks for. The
+// vehicle is marked busy in the same transaction.
+func AcceptBooking(ctx context.Context, db *sql.DB, driverID, bookingID int, by AuditActor) error {
+    tx, err := db.BeginTx(ctx, nil)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    // Claim the vehicle first, so a vehicle taken by a concurrent accept is
+    // seen as busy rather than accepted twice
+    result, err := tx.ExecContext(ctx, `
+        UPDATE vehicles SET availability = FALSE
+        WHERE driver_id = $1 AND retired_at IS NULL AND availability`, driverID)
+    err = expectAffected(result, err, ErrVehicleUnavailable)
+    if errors.Is(err, ErrVehicleUnavailable) {
+        tx.Rollback()
+        return acceptError(ctx, db, driverID, bookingID)
+    }
+    if err != nil {
+        return err
+    }
+
+    var vehicleID int
+    var vehicleType string
+    err = tx.QueryRowContext(ctx, `SELECT id, type FROM vehicles WHERE driver_id = $1 AND retired_at IS NULL`, driverID).Scan(&vehicleID, &vehicleType)
+    if err != nil {
+        return err
+    }
+    before, err := getBooking(ctx, tx, bookingID)
+    if err != nil {
+        return err
+    }
 
-    result, err := db.Exec(query, driverID, bookingID)
+    result, err = tx.ExecContext(ctx, `
+        UPDATE bookings SET driver_id = $1, vehicle_id = $2, status = $3
+        WHERE id = $4 AND status = $5 AND vehicle_type = $6`, driverID, vehicleID, BookingAccepted, bookingID, BookingPending, vehicleType)
+    err = expectAffected(result, err, ErrBookingNotAvailable)
+    if errors.Is(err, ErrBookingNotAvailable) {
+        tx.Rollback()
+        return acceptError(ctx, db, driverID, bookingID)
+    }
     if err != nil {
         return err
     }
 
-    rowsAffected, err := result.RowsAffected()
+    after, err := getBooking(ctx, tx, bookingID)
     if err != nil {
         return err
     }
+    if err := recordChange(ctx, tx, by, "booking.accept", "booking", bookingID, before, after); err != nil {
+        return err
+    }
+    return tx.Commit()
+}
 
-    if rowsAffected == 0 {
-        return errors.New("booking not available or already accepted")
+// acceptError explains why a driver couldn't accept a booking
+func acceptError(ctx context.Context, db *sql.DB, driverID, bookingID int) error {
+    b, err := GetBooking(ctx, db, bookingID)
+    if err != nil {
+        return err
+    }
+    if b.Status != BookingPending {
+        return ErrBookingNotAvailable
     }
 
-    return nil
+    v, err := scanVehicle(db.QueryRowContext(ctx, `SELECT `+vehicleColumns+` FROM vehicles WHERE driver_id = $1 AND retired_at IS NULL`, driverID))
+    switch {
+    case errors.Is(err, sql.ErrNoRows):
+        return ErrNoVehicleAssigned
+    case err != nil:
+        return err
+    case !v.Availability:
+        return ErrVehicleUnavailable
+    case v.Type != b.VehicleType:
+        return ErrVehicleTypeMismatch
+    }
+    // The booking or the vehicle changed after the accept failed
+    return ErrBookingNotAvailable
 }
 
 
@@ -0,0 +1,233 @@
+package models
+
+import (
+    "context"
+    "database/sql"
+    "encoding/json"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Booking statuses. A booking starts pending, is accepted by a driver who
+// then drives to the pickup, loads, travels and delivers, and ends completed,
+// cancelled or expired.
+const (
+    BookingPending         = "pending"
+    BookingAccepted        = "accepted"
+    BookingEnRouteToPickup = "en_route_to_pickup"
+    BookingPickedUp        = "picked_up"
+    BookingInTransit       = "in_transit"
+    BookingDelivered       = "delivered"
+    BookingCompleted       = "completed"
+    BookingCancelled       = "cancelled"
+    BookingExpired         = "expired"
+)
+
+// Actor is who changes the status of a booking
+type Actor string
+
+const (
+    ActorCustomer Actor = "customer" // the user who made the booking
+    ActorDriver   Actor = "driver"   // the driver who accepted it
+    ActorAdmin    Actor = "admin"
+    ActorSystem   Actor = "system" // the server itself, e.g. expiring stale bookings
+)
+
+// bookingTransitions says which actors may move a booking from a status to
+// another. Moves not listed are illegal. Accepting is listed for completeness
+// but goes through AcceptBooking, which also assigns the driver's vehicle.
+var bookingTransitions = map[string]map[string][]Actor{
+    BookingPending: {
+        BookingAccepted:  {ActorDriver},
+        BookingCancelled: {ActorCustomer, ActorAdmin},
+        BookingExpired:   {ActorSystem},
+    },
+    BookingAccepted: {
+        BookingEnRouteToPickup: {ActorDriver},
+        BookingCancelled:       {ActorCustomer, ActorAdmin},
+        BookingCompleted:       {ActorAdmin},
+    },
+    BookingEnRouteToPickup: {
+        BookingPickedUp:  {ActorDriver},
+        BookingCancelled: {ActorCustomer, ActorAdmin},
+        BookingCompleted: {ActorAdmin},
+    },
+    BookingPickedUp: {
+        BookingInTransit: {ActorDriver},
+        BookingCompleted: {ActorAdmin},
+    },
+    BookingInTransit: {
+        BookingDelivered: {ActorDriver},
+        BookingCompleted: {ActorAdmin},
+    },
+    BookingDelivered: {
+        BookingCompleted: {ActorAdmin},
+    },
+}
+
+// DriverBookingStatuses are the statuses a driver moves their own trips to
+var DriverBookingStatuses = []string{BookingEnRouteToPickup, BookingPickedUp, BookingInTransit, BookingDelivered}
+
+var (
+    ErrBookingForbidden     = Forbidden("booking_forbidden", "booking belongs to another user or driver")
+    ErrBookingStatusChanged = Conflict("booking_status_changed", "booking changed meanwhile; reload it and try again")
+)
+
+// errIllegalTransition reports that a booking can't move between two
+// statuses, or not by the actor asking
+func errIllegalTransition(from, to string) *Error {
+    return Conflict("illegal_transition", "booking can't go from "+from+" to "+to)
+}
+
+// CanTransition reports whether actor may move a booking from one status to another
+func CanTransition(from, to string, actor Actor) bool {
+    for _, a := range bookingTransitions[from][to] {
+        if a == actor {
+            return true
+        }
+    }
+    return false
+}
+
+// BookingActive reports whether a booking in status holds its vehicle, from
+// being accepted until the goods are delivered
+func BookingActive(status string) bool {
+    switch status {
+    case BookingAccepted, BookingEnRouteToPickup, BookingPickedUp, BookingInTransit:
+        return true
+    }
+    return false
+}
+
+// activeBookingStatuses lists, for SQL, the statuses of BookingActive
+var activeBookingStatuses = "('" + strings.Join([]string{BookingAccepted, BookingEnRouteToPickup, BookingPickedUp, BookingInTransit}, "', '") + "')"
+
+// checkTransition returns why actorID, acting as actor, can't move b to
+// status to, or nil. Customers may only change their own bookings and drivers
+// only the ones they accepted.
+func checkTransition(b *Booking, to string, actor Actor, actorID int) error {
+    switch actor {
+    case ActorCustomer:
+        if b.UserID != actorID {
+            return ErrBookingForbidden
+        }
+    case ActorDriver:
+        if b.DriverID == nil || *b.DriverID != actorID {
+            return ErrBookingForbidden
+        }
+    }
+    if !CanTransition(b.Status, to, actor) {
+        return errIllegalTransition(b.Status, to)
+    }
+    return nil
+}
+
+// TransitionBooking moves a booking to status to on behalf of actorID acting
+// as actor. A booking that stops being active frees its vehicle in the same
+// transaction.
+func TransitionBooking(ctx context.Context, db *sql.DB, bookingID int, to string, actor Actor, actorID int, by AuditActor) error {
+    tx, err := db.BeginTx(ctx, nil)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    before, err := getBooking(ctx, tx, bookingID)
+    if err != nil {
+        return err
+    }
+    if err := checkTransition(before, to, actor, actorID); err != nil {
+        return err
+    }
+
+    // The status is checked again in case the booking changed since it was read
+    result, err := tx.ExecContext(ctx, `UPDATE bookings SET status = $1 WHERE id = $2 AND status = $3`, to, bookingID, before.Status)
+    if err := expectAffected(result, err, ErrBookingStatusChanged); err != nil {
+        return err
+    }
+    if BookingActive(before.Status) && !BookingActive(to) {
+        if err := releaseVehicle(ctx, tx, bookingID); err != nil {
+            return err
+        }
+    }
+
+    after, err := getBooking(ctx, tx, bookingID)
+    if err != nil {
+        return err
+    }
+    if err := recordChange(ctx, tx, by, transitionAction(to), "booking", bookingID, before, after); err != nil {
+        return err
+    }
+    return tx.Commit()
+}
+
+// transitionAction is the audit action of moving a booking to status to
+func transitionAction(to string) string {
+    switch to {
+    case BookingCancelled:
+        return "booking.cancel"
+    case BookingCompleted:
+        return "booking.complete"
+    }
+    return "booking.status"
+}
+
+// ExpireBookings moves bookings still pending since before the given time to
+// expired and returns how many expired. Each expiry is written to the audit
+// log in the same transaction.
+func ExpireBookings(ctx context.Context, db *sql.DB, d Dialect, before time.Time) (int64, error) {
+    tx, err := db.BeginTx(ctx, nil)
+    if err != nil {
+        return 0, err
+    }
+    defer tx.Rollback()
+
+    rows, err := tx.QueryContext(ctx, `UPDATE bookings SET status = $1 WHERE status = $2 AND `+d.timestamp("created_at")+` < `+d.timestamp("$3")+` RETURNING id`,
+        BookingExpired, BookingPending, before.UTC())
+    if err != nil {
+        return 0, err
+    }
+    var ids []int
+    for rows.Next() {
+        var id int
+        if err := rows.Scan(&id); err != nil {
+            rows.Close()
+            return 0, err
+        }
+        ids = append(ids, id)
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return 0, err
+    }
+
+    now := time.Now()
+    for _, id := range ids {
+        if err := insertAudit(ctx, tx, expiryAuditEntry(id, now)); err != nil {
+            return 0, err
+        }
+    }
+    return int64(len(ids)), tx.Commit()
+}
+
+// expiryAuditEntry is the audit entry of a booking the server expired
+func expiryAuditEntry(bookingID int, at time.Time) AuditEntry {
+    role := string(ActorSystem)
+    entityID := strconv.Itoa(bookingID)
+    return AuditEntry{
+        OccurredAt: at,
+        ActorRole:  &role,
+        Action:     "booking.expire",
+        EntityType: "booking",
+        EntityID:   &entityID,
+        Before:     json.RawMessage(`{"status":"` + BookingPending + `"}`),
+        After:      json.RawMessage(`{"status":"` + BookingExpired + `"}`),
+    }
+}
+
+// releaseVehicle makes the vehicle of a booking that has ended available again
+func releaseVehicle(ctx context.Context, tx *sql.Tx, bookingID int) error {
+    _, err := tx.ExecContext(ctx, `UPDATE vehicles SET availability = TRUE WHERE id = (SELECT vehicle_id FROM bookings WHERE id = $1)`, bookingID)
+    return err
+}
@@ -0,0 +1,55 @@
+package models
+
+import (
+    "errors"
+
+    "modernc.org/sqlite"
+    sqlite3 "modernc.org/sqlite/lib"
+)
+
+// Dialect names the SQL database behind a SQLStore. Queries are written for
+// Postgres and kept to SQL that SQLite understands as well; the few
+// expressions that differ are produced by the methods below.
+type Dialect string
+
+const (
+    DialectPostgres Dialect = "postgres"
+    DialectSQLite   Dialect = "sqlite"
+)
+
+// day returns an expression for the UTC day of a timestamp column as
+// YYYY-MM-DD, the portable form of date_trunc('day', column)
+func (d Dialect) day(column string) string {
+    if d == DialectSQLite {
+        return "strftime('%Y-%m-%d', " + column + ")"
+    }
+    return "to_char(date_trunc('day', " + column + "), 'YYYY-MM-DD')"
+}
+
+// timestamp returns an expression that compares and sorts a timestamp column
+// or parameter by time. SQLite keeps timestamps as text, and CURRENT_TIMESTAMP
+// writes a different format than the driver does.
+func (d Dialect) timestamp(expr string) string {
+    if d == DialectSQLite {
+        return "julianday(" + expr + ")"
+    }
+    return expr
+}
+
+// sqliteErrorCode returns the extended result code of a SQLite error, or 0
+func sqliteErrorCode(err error) int {
+    var sqliteErr *sqlite.Error
+    if errors.As(err, &sqliteErr) {
+        return sqliteErr.Code()
+    }
+    return 0
+}
+
+func isSQLiteUniqueViolation(err error) bool {
+    code := sqliteErrorCode(err)
+    return code == sqlite3.SQLITE_CONSTRAINT_UNIQUE || code == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY
+}
+
+func isSQLiteForeignKeyViolation(err error) bool {
+    return sqliteErrorCode(err) == sqlite3.SQLITE_CONSTRAINT_FOREIGNKEY
+}
@@ -0,0 +1,71 @@
+package models
+
+import "strconv"
+
+// ErrorKind says what went wrong in terms a client can act on. The API turns
+// each kind into one status code, so handlers don't pick codes case by case.
+type ErrorKind string
+
+const (
+    KindNotFound     ErrorKind = "not_found"
+    KindConflict     ErrorKind = "conflict"
+    KindValidation   ErrorKind = "validation"
+    KindForbidden    ErrorKind = "forbidden"
+    KindUnauthorized ErrorKind = "unauthorized"
+)
+
+// FieldError describes a problem with one field of a request
+type FieldError struct {
+    Field   string `json:"field"`
+    Message string `json:"message"`
+}
+
+// Error is a domain error. Code is a stable identifier such as
+// "booking_not_available" that clients can branch on; Message is meant for
+// people. The exported Err* values are compared with errors.Is.
+type Error struct {
+    Kind    ErrorKind
+    Code    string
+    Message string
+    Details []FieldError
+}
+
+func (e *Error) Error() string {
+    return e.Message
+}
+
+func NotFound(code, message string) *Error {
+    return &Error{Kind: KindNotFound, Code: code, Message: message}
+}
+
+func Conflict(code, message string) *Error {
+    return &Error{Kind: KindConflict, Code: code, Message: message}
+}
+
+func Forbidden(code, message string) *Error {
+    return &Error{Kind: KindForbidden, Code: code, Message: message}
+}
+
+func Unauthorized(code, message string) *Error {
+    return &Error{Kind: KindUnauthorized, Code: code, Message: message}
+}
+
+// Validation reports an invalid value of field. The field may be left empty
+// when the same error is returned for differently named fields.
+func Validation(code, field, message string) *Error {
+    e := &Error{Kind: KindValidation, Code: code, Message: message}
+    if field != "" {
+        e.Details = []FieldError{{Field: field, Message: message}}
+    }
+    return e
+}
+
+// InvalidFields reports problems with the given fields of a request, e.g.
+// {Field: "vehicle_type", Message: "must be one of small, medium, large"}
+func InvalidFields(code string, details ...FieldError) *Error {
+    message := "Invalid " + details[0].Field + ": " + details[0].Message
+    if len(details) > 1 {
+        message = strconv.Itoa(len(details)) + " fields are invalid"
+    }
+    return &Error{Kind: KindValidation, Code: code, Message: message, Details: details}
+}
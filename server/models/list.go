@@ -0,0 +1,383 @@
+package models
+
+import (
+    "encoding/base64"
+    "encoding/json"
+    "fmt"
+    "reflect"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// FieldType says how values of a list field are read from a query string and compared
+type FieldType int
+
+const (
+    FieldText FieldType = iota
+    FieldInt
+    FieldFloat
+    FieldTime
+    FieldBool
+)
+
+// ListField is a column a list can be filtered by, and sorted by if Sortable
+type ListField struct {
+    Column   string
+    Type     FieldType
+    Sortable bool
+}
+
+// ListSpec declares the fields of a list. Field names are the JSON names of
+// the listed model, so clients filter and sort by what they see, and every
+// listed model has an "id" that breaks ties between equal sort values. Scope
+// is an SQL condition every listed row meets, such as not being deleted.
+type ListSpec struct {
+    Fields map[string]ListField
+    Scope  string
+}
+
+var BookingListSpec = ListSpec{Fields: map[string]ListField{
+    "id":             {Column: "id", Type: FieldInt, Sortable: true},
+    "status":         {Column: "status", Type: FieldText, Sortable: true},
+    "user_id":        {Column: "user_id", Type: FieldInt},
+    "driver_id":      {Column: "driver_id", Type: FieldInt},
+    "vehicle_type":   {Column: "vehicle_type", Type: FieldText},
+    "estimated_cost": {Column: "estimated_cost", Type: FieldFloat, Sortable: true},
+    "created_at":     {Column: "created_at", Type: FieldTime, Sortable: true},
+}}
+
+var VehicleListSpec = ListSpec{Fields: map[string]ListField{
+    "id":           {Column: "id", Type: FieldInt, Sortable: true},
+    "type":         {Column: "type", Type: FieldText, Sortable: true},
+    "availability": {Column: "availability", Type: FieldBool},
+    "driver_id":    {Column: "driver_id", Type: FieldInt},
+}, Scope: "retired_at IS NULL"}
+
+var UserListSpec = ListSpec{Fields: map[string]ListField{
+    "id":       {Column: "id", Type: FieldInt, Sortable: true},
+    "username": {Column: "username", Type: FieldText, Sortable: true},
+    "role":     {Column: "role", Type: FieldText, Sortable: true},
+    "status":   {Column: "status", Type: FieldText, Sortable: true},
+}}
+
+// Op compares a field with the values of a filter
+type Op string
+
+const (
+    OpIn  Op = "in"  // equal to one of the values
+    OpGte Op = "gte" // at least the value
+    OpLte Op = "lte" // at most the value
+    OpLt  Op = "lt"  // less than the value
+)
+
+// Filter keeps the rows whose field compares to Values with Op. Values are
+// parsed with the field's type; every op but OpIn takes a single value.
+type Filter struct {
+    Field  string
+    Op     Op
+    Values []interface{}
+}
+
+// ListQuery selects one page of a list. Sort is a sortable field, "id" when
+// empty. Limit 0 returns every row.
+type ListQuery struct {
+    Filters []Filter
+    Sort    string
+    Desc    bool
+    After   *Cursor
+    Limit   int
+}
+
+// Cursor marks the last row of a page by its sort value and ID, so the next
+// page starts after it however many rows were added or removed meanwhile.
+// Clients get it as an opaque string.
+type Cursor struct {
+    Sort  string `json:"s"`
+    Desc  bool   `json:"d,omitempty"`
+    Value string `json:"v"`
+    ID    int    `json:"id"`
+}
+
+var ErrInvalidCursor = Validation("invalid_cursor", "cursor", "cursor is malformed or was issued for another sort order")
+
+func (c Cursor) String() string {
+    data, _ := json.Marshal(c)
+    return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// ParseCursor reads a cursor issued for a list of spec sorted by sort
+func ParseCursor(s string, spec ListSpec, sort string, desc bool) (*Cursor, error) {
+    data, err := base64.RawURLEncoding.DecodeString(s)
+    if err != nil {
+        return nil, ErrInvalidCursor
+    }
+    var c Cursor
+    if err := json.Unmarshal(data, &c); err != nil || c.Sort != sort || c.Desc != desc {
+        return nil, ErrInvalidCursor
+    }
+    if _, err := spec.Fields[sort].Type.Parse(c.Value); err != nil {
+        return nil, ErrInvalidCursor
+    }
+    return &c, nil
+}
+
+// Parse reads a filter or cursor value of the type from a query string
+func (t FieldType) Parse(s string) (interface{}, error) {
+    switch t {
+    case FieldInt:
+        return strconv.Atoi(s)
+    case FieldFloat:
+        return strconv.ParseFloat(s, 64)
+    case FieldTime:
+        v, err := time.Parse(time.RFC3339Nano, s)
+        return v.UTC(), err
+    case FieldBool:
+        return strconv.ParseBool(s)
+    }
+    return s, nil
+}
+
+// formatValue writes a cursor value the way FieldType.Parse reads it
+func formatValue(v interface{}) string {
+    if tm, ok := v.(time.Time); ok {
+        return tm.UTC().Format(time.RFC3339Nano)
+    }
+    return fmt.Sprint(v)
+}
+
+func (q ListQuery) sortField() string {
+    if q.Sort == "" {
+        return "id"
+    }
+    return q.Sort
+}
+
+// sql returns the WHERE, ORDER BY and LIMIT clauses of q with their
+// arguments. One row more than the limit is asked for, to tell whether
+// there is a next page.
+func (q ListQuery) sql(spec ListSpec, d Dialect) (string, []interface{}) {
+    var conditions []string
+    if spec.Scope != "" {
+        conditions = append(conditions, spec.Scope)
+    }
+    var args []interface{}
+    param := func(arg interface{}) string {
+        args = append(args, arg)
+        return fmt.Sprintf("$%d", len(args))
+    }
+    column := func(field ListField) string {
+        if field.Type == FieldTime {
+            return d.timestamp(field.Column)
+        }
+        return field.Column
+    }
+    value := func(field ListField, v interface{}) string {
+        if field.Type == FieldTime {
+            return d.timestamp(param(v))
+        }
+        return param(v)
+    }
+
+    for _, f := range q.Filters {
+        field := spec.Fields[f.Field]
+        switch f.Op {
+        case OpIn:
+            values := make([]string, len(f.Values))
+            for i, v := range f.Values {
+                values[i] = value(field, v)
+            }
+            conditions = append(conditions, column(field)+" IN ("+strings.Join(values, ", ")+")")
+        case OpGte:
+            conditions = append(conditions, column(field)+" >= "+value(field, f.Values[0]))
+        case OpLte:
+            conditions = append(conditions, column(field)+" <= "+value(field, f.Values[0]))
+        case OpLt:
+            conditions = append(conditions, column(field)+" < "+value(field, f.Values[0]))
+        }
+    }
+
+    sortField := spec.Fields[q.sortField()]
+    direction, after := "", ">"
+    if q.Desc {
+        direction, after = " DESC", "<"
+    }
+    if q.After != nil {
+        id := param(q.After.ID)
+        if q.sortField() == "id" {
+            conditions = append(conditions, "id "+after+" "+id)
+        } else {
+            v, _ := sortField.Type.Parse(q.After.Value)
+            sortValue := value(sortField, v)
+            conditions = append(conditions, fmt.Sprintf("(%s %s %s OR (%s = %s AND id %s %s))",
+                column(sortField), after, sortValue, column(sortField), sortValue, after, id))
+        }
+    }
+
+    var clause string
+    if len(conditions) > 0 {
+        clause = " WHERE " + strings.Join(conditions, " AND ")
+    }
+    clause += " ORDER BY "
+    if q.sortField() != "id" {
+        clause += column(sortField) + direction + ", "
+    }
+    clause += "id" + direction
+    if q.Limit > 0 {
+        clause += " LIMIT " + param(q.Limit+1)
+    }
+    return clause, args
+}
+
+// nextPage cuts the extra row asked for by sql off items and returns the
+// cursor of the page that follows, or "" when items is the last page
+func nextPage[T any](items []T, q ListQuery) ([]T, string) {
+    if q.Limit == 0 || len(items) <= q.Limit {
+        return items, ""
+    }
+    items = items[:q.Limit]
+    last := items[len(items)-1]
+    id, _ := fieldValue(last, "id").(int)
+    c := Cursor{Sort: q.sortField(), Desc: q.Desc, Value: formatValue(fieldValue(last, q.sortField())), ID: id}
+    return items, c.String()
+}
+
+// listMemory applies q to every row of a list held in memory the way the
+// SQL implementation does, including the extra row
+func listMemory[T any](items []T, q ListQuery) []T {
+    matched := []T{}
+    for _, item := range items {
+        if q.matches(item) {
+            matched = append(matched, item)
+        }
+    }
+
+    sortField := q.sortField()
+    sort.SliceStable(matched, func(i, j int) bool {
+        c := compareValues(fieldValue(matched[i], sortField), fieldValue(matched[j], sortField))
+        if c == 0 {
+            c = compareValues(fieldValue(matched[i], "id"), fieldValue(matched[j], "id"))
+        }
+        if q.Desc {
+            return c > 0
+        }
+        return c < 0
+    })
+
+    if q.Limit > 0 && len(matched) > q.Limit+1 {
+        matched = matched[:q.Limit+1]
+    }
+    return matched
+}
+
+func (q ListQuery) matches(item interface{}) bool {
+    for _, f := range q.Filters {
+        v := fieldValue(item, f.Field)
+        if v == nil {
+            return false
+        }
+        ok := false
+        switch f.Op {
+        case OpIn:
+            for _, want := range f.Values {
+                ok = ok || compareValues(v, want) == 0
+            }
+        case OpGte:
+            ok = compareValues(v, f.Values[0]) >= 0
+        case OpLte:
+            ok = compareValues(v, f.Values[0]) <= 0
+        case OpLt:
+            ok = compareValues(v, f.Values[0]) < 0
+        }
+        if !ok {
+            return false
+        }
+    }
+
+    if q.After != nil {
+        id := fieldValue(item, "id")
+        c := compareValues(id, q.After.ID)
+        if sortField := q.sortField(); sortField != "id" {
+            v := fieldValue(item, sortField)
+            after, _ := parseAs(v, q.After.Value)
+            if sc := compareValues(v, after); sc != 0 {
+                c = sc
+            }
+        }
+        if q.Desc {
+            return c < 0
+        }
+        return c > 0
+    }
+    return true
+}
+
+// parseAs reads s as a value of the same type as v
+func parseAs(v interface{}, s string) (interface{}, error) {
+    switch v.(type) {
+    case int:
+        return FieldInt.Parse(s)
+    case float64:
+        return FieldFloat.Parse(s)
+    case time.Time:
+        return FieldTime.Parse(s)
+    case bool:
+        return FieldBool.Parse(s)
+    }
+    return s, nil
+}
+
+// fieldValue returns the field of a model with the given JSON name, or nil
+// when the field is a nil pointer
+func fieldValue(item interface{}, name string) interface{} {
+    v := reflect.Indirect(reflect.ValueOf(item))
+    t := v.Type()
+    for i := 0; i < t.NumField(); i++ {
+        tag, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+        if tag != name {
+            continue
+        }
+        f := v.Field(i)
+        if f.Kind() == reflect.Ptr {
+            if f.IsNil() {
+                return nil
+            }
+            f = f.Elem()
+        }
+        return f.Interface()
+    }
+    panic(fmt.Sprintf("models: %s has no field %q", t, name))
+}
+
+func compareValues(a, b interface{}) int {
+    switch a := a.(type) {
+    case int:
+        return compareOrdered(a, b.(int))
+    case float64:
+        return compareOrdered(a, b.(float64))
+    case string:
+        return strings.Compare(a, b.(string))
+    case time.Time:
+        return a.Compare(b.(time.Time))
+    case bool:
+        if a == b.(bool) {
+            return 0
+        }
+        if !a {
+            return -1
+        }
+        return 1
+    }
+    panic(fmt.Sprintf("models: values of type %T can't be compared", a))
+}
+
+func compareOrdered[T int | float64](a, b T) int {
+    switch {
+    case a < b:
+        return -1
+    case a > b:
+        return 1
+    }
+    return 0
+}
@@ -0,0 +1,195 @@
+package models
+
+import (
+    "context"
+    "database/sql"
+    "errors"
+    "math"
+    "strings"
+    "time"
+)
+
+// ThrottlePolicy describes how failed logins against one key (a username or a
+// client IP) slow down further attempts. The first FreeAttempts failures are
+// not delayed, each further failure doubles the delay starting at BaseDelay up
+// to MaxDelay, and reaching LockoutAfter failures locks the key for LockoutFor.
+// Failures older than Window are forgotten.
+type ThrottlePolicy struct {
+    FreeAttempts int
+    BaseDelay    time.Duration
+    MaxDelay     time.Duration
+    LockoutAfter int
+    LockoutFor   time.Duration
+    Window       time.Duration
+}
+
+// LoginThrottle holds the policies applied per username and per client IP
+type LoginThrottle struct {
+    User ThrottlePolicy
+    IP   ThrottlePolicy
+}
+
+// DefaultLoginThrottle is lenient per IP because many users can share one NAT address
+var DefaultLoginThrottle = LoginThrottle{
+    User: ThrottlePolicy{FreeAttempts: 3, BaseDelay: time.Second, MaxDelay: time.Minute, LockoutAfter: 10, LockoutFor: 15 * time.Minute, Window: 24 * time.Hour},
+    IP:   ThrottlePolicy{FreeAttempts: 20, BaseDelay: time.Second, MaxDelay: time.Minute, LockoutAfter: 100, LockoutFor: 15 * time.Minute, Window: time.Hour},
+}
+
+// DefaultPasswordResetThrottle limits forgot-password requests, counted like
+// failed logins under keys of their own. Every request for a login starts a
+// cooldown that doubles up to an hour, so nobody can flood a mailbox.
+var DefaultPasswordResetThrottle = LoginThrottle{
+    User: ThrottlePolicy{FreeAttempts: 0, BaseDelay: time.Minute, MaxDelay: time.Hour, Window: 24 * time.Hour},
+    IP:   ThrottlePolicy{FreeAttempts: 5, BaseDelay: time.Minute, MaxDelay: 15 * time.Minute, LockoutAfter: 30, LockoutFor: time.Hour, Window: time.Hour},
+}
+
+// Lockout is a throttled key that currently cannot log in
+type Lockout struct {
+    Key         string    `json:"key"`
+    Failures    int       `json:"failures"`
+    LockedUntil time.Time `json:"locked_until"`
+}
+
+// LockDuration returns how long a key stays blocked after its n-th consecutive failure
+func (p ThrottlePolicy) LockDuration(failures int) time.Duration {
+    if p.LockoutAfter > 0 && failures >= p.LockoutAfter {
+        return p.LockoutFor
+    }
+    if failures <= p.FreeAttempts {
+        return 0
+    }
+    delay := float64(p.BaseDelay) * math.Pow(2, float64(failures-p.FreeAttempts-1))
+    if delay > float64(p.MaxDelay) {
+        return p.MaxDelay
+    }
+    return time.Duration(delay)
+}
+
+// UserThrottleKey returns the throttle key of a submitted username. It doesn't
+// matter whether the account exists, which keeps responses identical for both.
+func UserThrottleKey(username string) string {
+    return "user:" + strings.ToLower(strings.TrimSpace(username))
+}
+
+// IPThrottleKey returns the throttle key of a client IP
+func IPThrottleKey(ip string) string {
+    return "ip:" + ip
+}
+
+// PasswordResetThrottleKey returns the key under which forgot-password
+// requests are counted for a login or IP throttle key
+func PasswordResetThrottleKey(key string) string {
+    return "reset:" + key
+}
+
+// LoginLockedUntil returns the latest time until which any of the keys is blocked,
+// or the zero time if none is blocked at now
+func LoginLockedUntil(ctx context.Context, db *sql.DB, now time.Time, keys ...string) (time.Time, error) {
+    var lockedUntil time.Time
+    for _, key := range keys {
+        var until sql.NullTime
+        err := db.QueryRowContext(ctx, `SELECT locked_until FROM login_throttles WHERE key = $1`, key).Scan(&until)
+        if errors.Is(err, sql.ErrNoRows) {
+            continue
+        }
+        if err != nil {
+            return time.Time{}, err
+        }
+        if until.Valid && until.Time.After(now) && until.Time.After(lockedUntil) {
+            lockedUntil = until.Time
+        }
+    }
+    return lockedUntil, nil
+}
+
+// RecordLoginFailure counts a failed login against key and blocks it according to policy
+func RecordLoginFailure(ctx context.Context, db *sql.DB, key string, policy ThrottlePolicy, now time.Time) error {
+    now = now.UTC()
+    var failures int
+    query := `
+        INSERT INTO login_throttles (key, failures, last_failure_at)
+        VALUES ($1, 1, $2)
+        ON CONFLICT (key) DO UPDATE SET
+            failures = CASE WHEN login_throttles.last_failure_at < $3 THEN 1 ELSE login_throttles.failures + 1 END,
+            last_failure_at = EXCLUDED.last_failure_at
+        RETURNING failures`
+    err := db.QueryRowContext(ctx, query, key, now, now.Add(-policy.Window)).Scan(&failures)
+    if err != nil {
+        return err
+    }
+
+    lock := policy.LockDuration(failures)
+    if lock == 0 {
+        return nil
+    }
+    _, err = db.ExecContext(ctx, `UPDATE login_throttles SET locked_until = $1 WHERE key = $2`, now.Add(lock), key)
+    return err
+}
+
+// ClearLoginFailures forgets all failures recorded against key
+func ClearLoginFailures(ctx context.Context, db *sql.DB, key string) error {
+    _, err := db.ExecContext(ctx, `DELETE FROM login_throttles WHERE key = $1`, key)
+    return err
+}
+
+// FetchActiveLockouts lists keys that are blocked at now
+func FetchActiveLockouts(ctx context.Context, db *sql.DB, now time.Time) ([]Lockout, error) {
+    rows, err := db.QueryContext(ctx, `SELECT key, failures, locked_until FROM login_throttles WHERE locked_until > $1 ORDER BY locked_until DESC`, now.UTC())
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    lockouts := []Lockout{}
+    for rows.Next() {
+        var l Lockout
+        if err := rows.Scan(&l.Key, &l.Failures, &l.LockedUntil); err != nil {
+            return nil, err
+        }
+        lockouts = append(lockouts, l)
+    }
+    return lockouts, rows.Err()
+}
+
+// UnlockUser clears the failed logins recorded against a user's username
+func UnlockUser(ctx context.Context, db *sql.DB, userID int, by AuditActor) error {
+    tx, err := db.BeginTx(ctx, nil)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    var username string
+    err = tx.QueryRowContext(ctx, `SELECT username FROM users WHERE id = $1`, userID).Scan(&username)
+    if errors.Is(err, sql.ErrNoRows) {
+        return ErrUserNotFound
+    }
+    if err != nil {
+        return err
+    }
+
+    if _, err := tx.ExecContext(ctx, `DELETE FROM login_throttles WHERE key = $1`, UserThrottleKey(username)); err != nil {
+        return err
+    }
+    if err := recordChange(ctx, tx, by, "user.unlock", "user", userID, nil, nil); err != nil {
+        return err
+    }
+    return tx.Commit()
+}
+
+// UnlockIP clears the failed logins recorded against a client IP
+func UnlockIP(ctx context.Context, db *sql.DB, ip string, by AuditActor) error {
+    tx, err := db.BeginTx(ctx, nil)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    if _, err := tx.ExecContext(ctx, `DELETE FROM login_throttles WHERE key = $1`, IPThrottleKey(ip)); err != nil {
+        return err
+    }
+    if err := recordChange(ctx, tx, by, "ip.unlock", "ip", ip, nil, nil); err != nil {
+        return err
+    }
+    return tx.Commit()
+}
@@ -0,0 +1,1377 @@
+package models
+
+import (
+    "context"
+    "sort"
+    "strconv"
+    "sync"
+    "time"
+
+    "golang.org/x/crypto/bcrypt"
+)
+
+// MemoryStore implements the stores in memory, for handler tests that don't
+// need a database. It follows the same rules as the SQL implementation but
+// keeps nothing across restarts.
+type MemoryStore struct {
+    mu            sync.Mutex
+    users         map[int]User
+    roles         map[string]Role
+    permissions   map[string]string
+    vehicles      map[int]Vehicle
+    bookings      map[int]Booking
+    assignments   []VehicleAssignment
+    audit         []AuditEntry
+    refreshTokens map[string]RefreshToken
+    throttles     map[string]memoryThrottle
+    mfa           map[int]MFAState
+    recoveryCodes map[int]map[string]bool
+    apiKeys       map[int]memoryAPIKey
+    resetTokens   map[string]memoryResetToken
+    nextID        int
+    // now is used for timestamps and can be replaced to control time in tests
+    now func() time.Time
+}
+
+var (
+    _ BookingStore   = (*MemoryStore)(nil)
+    _ VehicleStore   = (*MemoryStore)(nil)
+    _ UserStore      = (*MemoryStore)(nil)
+    _ SessionStore   = (*MemoryStore)(nil)
+    _ ThrottleStore  = (*MemoryStore)(nil)
+    _ RoleStore      = (*MemoryStore)(nil)
+    _ MFAStore       = (*MemoryStore)(nil)
+    _ APIKeyStore    = (*MemoryStore)(nil)
+    _ PasswordStore  = (*MemoryStore)(nil)
+    _ AnalyticsStore = (*MemoryStore)(nil)
+    _ AuditStore     = (*MemoryStore)(nil)
+)
+
+// memoryThrottle is a row of login_throttles
+type memoryThrottle struct {
+    failures      int
+    lastFailureAt time.Time
+    lockedUntil   time.Time
+}
+
+// memoryAPIKey is an API key with the hash it is looked up by
+type memoryAPIKey struct {
+    APIKey
+    hash string
+}
+
+// memoryResetToken is a row of password_reset_tokens
+type memoryResetToken struct {
+    userID    int
+    expiresAt time.Time
+    used      bool
+}
+
+// NewMemoryStore returns an empty store that knows the built-in roles and
+// permissions, as seeded by the migrations
+func NewMemoryStore() *MemoryStore {
+    return &MemoryStore{
+        users: map[int]User{},
+        roles: map[string]Role{
+            RoleAdmin: {Name: RoleAdmin, Description: "Full access to fleet administration", Permissions: []string{
+                PermAnalyticsRead, PermAPIKeysManage, PermAuditRead, PermBookingsAccept, PermBookingsCancel, PermBookingsCancelAny,
+                PermBookingsComplete, PermBookingsCreate, PermBookingsRead, PermRolesManage, PermUsersRead, PermUsersWrite,
+                PermVehiclesRead, PermVehiclesWrite,
+            }},
+            RoleDriver:  {Name: RoleDriver, Description: "Accepts and delivers bookings", Permissions: []string{PermBookingsAccept}},
+            RoleUser:    {Name: RoleUser, Description: "Books vehicles", Permissions: []string{PermBookingsCancel, PermBookingsCreate}},
+            RoleService: {Name: RoleService, Description: "Machine-to-machine integrations authenticated with API keys", Permissions: []string{}},
+        },
+        permissions: map[string]string{
+            PermBookingsCreate:    "Create bookings",
+            PermBookingsAccept:    "View pending bookings, accept them and carry them out",
+            PermBookingsRead:      "View all bookings",
+            PermBookingsComplete:  "Mark bookings as completed",
+            PermBookingsCancel:    "Cancel own bookings before pickup",
+            PermBookingsCancelAny: "Cancel any booking before pickup",
+            PermVehiclesRead:      "View the fleet",
+            PermVehiclesWrite:     "Add and modify vehicles",
+            PermAnalyticsRead:     "View fleet and revenue analytics",
+            PermUsersRead:         "View user accounts",
+            PermUsersWrite:        "Create, modify and disable user accounts",
+            PermRolesManage:       "Define roles and their permissions",
+            PermAPIKeysManage:     "Create and revoke API keys",
+            PermAuditRead:         "Query the audit log",
+        },
+        vehicles:      map[int]Vehicle{},
+        bookings:      map[int]Booking{},
+        refreshTokens: map[string]RefreshToken{},
+        throttles:     map[string]memoryThrottle{},
+        mfa:           map[int]MFAState{},
+        recoveryCodes: map[int]map[string]bool{},
+        apiKeys:       map[int]memoryAPIKey{},
+        resetTokens:   map[string]memoryResetToken{},
+        now:           time.Now,
+    }
+}
+
+func (s *MemoryStore) id() int {
+    s.nextID++
+    return s.nextID
+}
+
+// record appends the audit entry of a change. The caller holds s.mu, so the
+// entry is written together with the change like in a transaction.
+func (s *MemoryStore) record(by AuditActor, action, entityType string, entityID interface{}, before, after interface{}) error {
+    entry, err := auditEntry(by, action, entityType, entityID, before, after)
+    if err != nil {
+        return err
+    }
+    entry.ID = int64(len(s.audit) + 1)
+    s.audit = append(s.audit, entry)
+    return nil
+}
+
+func (s *MemoryStore) CreateBooking(ctx context.Context, userID int, pickupLocation, dropoffLocation, vehicleType string, estimatedCost float64, by AuditActor) (int, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    id := s.id()
+    b := Booking{
+        ID:              id,
+        UserID:          userID,
+        PickupLocation:  pickupLocation,
+        DropoffLocation: dropoffLocation,
+        VehicleType:     vehicleType,
+        EstimatedCost:   estimatedCost,
+        Status:          BookingPending,
+        CreatedAt:       s.now().UTC(),
+    }
+    if err := s.record(by, "booking.create", "booking", id, nil, b); err != nil {
+        return 0, err
+    }
+    s.bookings[id] = b
+    return id, nil
+}
+
+func (s *MemoryStore) GetBooking(ctx context.Context, bookingID int) (*Booking, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    b, ok := s.bookings[bookingID]
+    if !ok {
+        return nil, ErrBookingNotFound
+    }
+    return &b, nil
+}
+
+func (s *MemoryStore) ListBookings(ctx context.Context, q ListQuery) ([]Booking, string, error) {
+    bookings, next := nextPage(listMemory(s.filterBookings(func(Booking) bool { return true }), q), q)
+    return bookings, next, nil
+}
+
+func (s *MemoryStore) FetchPendingBookings(ctx context.Context) ([]Booking, error) {
+    return s.filterBookings(func(b Booking) bool { return b.Status == BookingPending && b.DriverID == nil }), nil
+}
+
+func (s *MemoryStore) filterBookings(match func(Booking) bool) []Booking {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    bookings := []Booking{}
+    for _, b := range s.bookings {
+        if match(b) {
+            bookings = append(bookings, b)
+        }
+    }
+    sort.Slice(bookings, func(i, j int) bool { return bookings[i].ID < bookings[j].ID })
+    return bookings
+}
+
+func (s *MemoryStore) AcceptBooking(ctx context.Context, driverID, bookingID int, by AuditActor) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    b, ok := s.bookings[bookingID]
+    if !ok {
+        return ErrBookingNotFound
+    }
+    if b.Status != BookingPending {
+        return ErrBookingNotAvailable
+    }
+    vehicle, ok := s.driverVehicle(driverID)
+    if !ok {
+        return ErrNoVehicleAssigned
+    }
+    if !vehicle.Availability {
+        return ErrVehicleUnavailable
+    }
+    if b.VehicleType != vehicle.Type {
+        return ErrVehicleTypeMismatch
+    }
+    before := b
+    b.DriverID = &driverID
+    b.VehicleID = &vehicle.ID
+    b.Status = BookingAccepted
+    if err := s.record(by, "booking.accept", "booking", bookingID, before, b); err != nil {
+        return err
+    }
+    s.bookings[bookingID] = b
+    vehicle.Availability = false
+    s.vehicles[vehicle.ID] = vehicle
+    return nil
+}
+
+func (s *MemoryStore) TransitionBooking(ctx context.Context, bookingID int, to string, actor Actor, actorID int, by AuditActor) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    b, ok := s.bookings[bookingID]
+    if !ok {
+        return ErrBookingNotFound
+    }
+    if err := checkTransition(&b, to, actor, actorID); err != nil {
+        return err
+    }
+    before := b
+    b.Status = to
+    if err := s.record(by, transitionAction(to), "booking", bookingID, before, b); err != nil {
+        return err
+    }
+    s.bookings[bookingID] = b
+    if BookingActive(before.Status) && !BookingActive(to) {
+        s.releaseVehicle(b)
+    }
+    return nil
+}
+
+func (s *MemoryStore) ExpireBookings(ctx context.Context, before time.Time) (int64, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    var expired int64
+    now := time.Now()
+    for id, b := range s.bookings {
+        if b.Status == BookingPending && b.CreatedAt.Before(before) {
+            b.Status = BookingExpired
+            s.bookings[id] = b
+            entry := expiryAuditEntry(id, now)
+            entry.ID = int64(len(s.audit) + 1)
+            s.audit = append(s.audit, entry)
+            expired++
+        }
+    }
+    return expired, nil
+}
+
+// releaseVehicle makes the vehicle of a booking that has ended available again
+func (s *MemoryStore) releaseVehicle(b Booking) {
+    if b.VehicleID == nil {
+        return
+    }
+    if v, ok := s.vehicles[*b.VehicleID]; ok {
+        v.Availability = true
+        s.vehicles[v.ID] = v
+    }
+}
+
+// vehicleBusy reports whether a vehicle is on an active booking
+func (s *MemoryStore) vehicleBusy(vehicleID int) bool {
+    for _, b := range s.bookings {
+        if b.VehicleID != nil && *b.VehicleID == vehicleID && BookingActive(b.Status) {
+            return true
+        }
+    }
+    return false
+}
+
+func (s *MemoryStore) ListVehicles(ctx context.Context, q ListQuery) ([]Vehicle, string, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    vehicles := []Vehicle{}
+    for _, v := range s.vehicles {
+        if v.RetiredAt == nil {
+            vehicles = append(vehicles, v)
+        }
+    }
+    vehicles, next := nextPage(listMemory(vehicles, q), q)
+    return vehicles, next, nil
+}
+
+func (s *MemoryStore) GetVehicle(ctx context.Context, vehicleID int) (*Vehicle, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    v, ok := s.vehicles[vehicleID]
+    if !ok {
+        return nil, ErrVehicleNotFound
+    }
+    return &v, nil
+}
+
+func (s *MemoryStore) CreateVehicle(ctx context.Context, vehicleType string, availability bool, by AuditActor) (int, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    id := s.id()
+    v := Vehicle{ID: id, Type: vehicleType, Availability: availability}
+    if err := s.record(by, "vehicle.create", "vehicle", id, nil, v); err != nil {
+        return 0, err
+    }
+    s.vehicles[id] = v
+    return id, nil
+}
+
+func (s *MemoryStore) UpdateVehicle(ctx context.Context, vehicleID int, update VehicleUpdate, by AuditActor) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    v, ok := s.vehicles[vehicleID]
+    if !ok {
+        return ErrVehicleNotFound
+    }
+    if v.RetiredAt != nil {
+        return ErrVehicleRetired
+    }
+    if s.vehicleBusy(vehicleID) {
+        return ErrVehicleInUse
+    }
+    before := v
+    if update.Type != nil {
+        v.Type = *update.Type
+    }
+    if update.Availability != nil {
+        v.Availability = *update.Availability
+    }
+    if err := s.record(by, "vehicle.update", "vehicle", vehicleID, before, v); err != nil {
+        return err
+    }
+    s.vehicles[vehicleID] = v
+    return nil
+}
+
+func (s *MemoryStore) RetireVehicle(ctx context.Context, vehicleID int, at time.Time, by AuditActor) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    v, ok := s.vehicles[vehicleID]
+    if !ok {
+        return ErrVehicleNotFound
+    }
+    if v.RetiredAt != nil {
+        return ErrVehicleRetired
+    }
+    if v.DriverID != nil {
+        return ErrVehicleAssigned
+    }
+    before := v
+    at = at.UTC()
+    v.RetiredAt = &at
+    if err := s.record(by, "vehicle.retire", "vehicle", vehicleID, before, v); err != nil {
+        return err
+    }
+    s.vehicles[vehicleID] = v
+    return nil
+}
+
+// driverVehicle returns the vehicle a driver holds
+func (s *MemoryStore) driverVehicle(driverID int) (Vehicle, bool) {
+    for _, v := range s.vehicles {
+        if v.DriverID != nil && *v.DriverID == driverID && v.RetiredAt == nil {
+            return v, true
+        }
+    }
+    return Vehicle{}, false
+}
+
+func (s *MemoryStore) AssignVehicle(ctx context.Context, vehicleID, driverID int, at time.Time, by AuditActor) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    u, ok := s.users[driverID]
+    if !ok {
+        return ErrUserNotFound
+    }
+    if u.Role != RoleDriver {
+        return ErrNotADriver
+    }
+    v, ok := s.vehicles[vehicleID]
+    switch {
+    case !ok:
+        return ErrVehicleNotFound
+    case v.RetiredAt != nil:
+        return ErrVehicleRetired
+    case v.DriverID != nil && *v.DriverID == driverID:
+        return nil
+    case v.DriverID != nil:
+        return ErrVehicleAssigned
+    }
+    if _, ok := s.driverVehicle(driverID); ok {
+        return ErrDriverHasVehicle
+    }
+
+    before := v
+    v.DriverID = &driverID
+    if err := s.record(by, "vehicle.assign", "vehicle", vehicleID, before, v); err != nil {
+        return err
+    }
+    s.vehicles[vehicleID] = v
+    s.assignments = append(s.assignments, VehicleAssignment{ID: len(s.assignments) + 1, VehicleID: vehicleID, DriverID: driverID, AssignedAt: at.UTC()})
+    return nil
+}
+
+func (s *MemoryStore) UnassignVehicle(ctx context.Context, vehicleID int, at time.Time, by AuditActor) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    v, ok := s.vehicles[vehicleID]
+    if !ok {
+        return ErrVehicleNotFound
+    }
+    if v.DriverID == nil {
+        return ErrVehicleNotAssigned
+    }
+    if s.vehicleBusy(vehicleID) {
+        return ErrVehicleInUse
+    }
+
+    before := v
+    v.DriverID = nil
+    if err := s.record(by, "vehicle.unassign", "vehicle", vehicleID, before, v); err != nil {
+        return err
+    }
+    s.vehicles[vehicleID] = v
+    at = at.UTC()
+    for i, a := range s.assignments {
+        if a.VehicleID == vehicleID && a.UnassignedAt == nil {
+            s.assignments[i].UnassignedAt = &at
+        }
+    }
+    return nil
+}
+
+func (s *MemoryStore) ListAssignments(ctx context.Context, q ListQuery) ([]VehicleAssignment, string, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    assignments, next := nextPage(listMemory(s.assignments, q), q)
+    return assignments, next, nil
+}
+
+func (s *MemoryStore) RegisterUser(ctx context.Context, username, email, password, role, status string, by AuditActor) (int, error) {
+    hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+    if err != nil {
+        return 0, err
+    }
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    email = NormalizeEmail(email)
+    for _, u := range s.users {
+        if u.Username == username || (email != "" && u.Email != nil && *u.Email == email) {
+            return 0, ErrUsernameTaken
+        }
+    }
+
+    user := User{ID: s.id(), Username: username, Password: string(hashedPassword), Role: role, Status: status}
+    if email != "" {
+        user.Email = &email
+    }
+    action := "user.create"
+    if by.UserID == nil {
+        action = "user.register"
+        by.UserID, by.Role = &user.ID, &role
+    }
+    if err := s.record(by, action, "user", user.ID, nil, user); err != nil {
+        return 0, err
+    }
+    s.users[user.ID] = user
+    return user.ID, nil
+}
+
+func (s *MemoryStore) GetUser(ctx context.Context, userID int) (*User, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    u, ok := s.users[userID]
+    if !ok {
+        return nil, ErrUserNotFound
+    }
+    u.Password = ""
+    return &u, nil
+}
+
+func (s *MemoryStore) ListUsers(ctx context.Context, q ListQuery) ([]User, string, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    users := []User{}
+    for _, u := range s.users {
+        u.Password = ""
+        users = append(users, u)
+    }
+    users, next := nextPage(listMemory(users, q), q)
+    return users, next, nil
+}
+
+func (s *MemoryStore) UpdateUserRole(ctx context.Context, userID int, role string, by AuditActor) error {
+    return s.updateUser(userID, by, "user.role_update", func(u *User) {
+        u.Role = role
+        // updateUser stores u afterwards, so the epoch is bumped on u itself
+        u.SessionEpoch++
+        s.revokeRefreshTokens(userID)
+    })
+}
+
+func (s *MemoryStore) UpdateUserStatus(ctx context.Context, userID int, status string, by AuditActor) error {
+    return s.updateUser(userID, by, "user.status_update", func(u *User) {
+        u.Status = status
+        if status != UserStatusActive {
+            u.SessionEpoch++
+            s.revokeRefreshTokens(userID)
+        }
+    })
+}
+
+func (s *MemoryStore) updateUser(userID int, by AuditActor, action string, update func(*User)) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    u, ok := s.users[userID]
+    if !ok {
+        return ErrUserNotFound
+    }
+    before := u
+    update(&u)
+    if err := s.record(by, action, "user", userID, before, u); err != nil {
+        return err
+    }
+    s.users[userID] = u
+    return nil
+}
+
+func (s *MemoryStore) DeleteUser(ctx context.Context, userID int, by AuditActor) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    before, ok := s.users[userID]
+    if !ok {
+        return ErrUserNotFound
+    }
+    for _, b := range s.bookings {
+        if b.UserID == userID || (b.DriverID != nil && *b.DriverID == userID) {
+            return ErrUserInUse
+        }
+    }
+    for _, a := range s.assignments {
+        if a.DriverID == userID {
+            return ErrUserInUse
+        }
+    }
+    if err := s.record(by, "user.delete", "user", userID, before, nil); err != nil {
+        return err
+    }
+    delete(s.users, userID)
+    return nil
+}
+
+func (s *MemoryStore) RevokeUserSessions(ctx context.Context, userID int, by AuditActor) (int64, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    revoked := s.revokeSessions(userID)
+    if err := s.record(by, "user.sessions_revoke", "user", userID, nil, map[string]int64{"revoked_sessions": revoked}); err != nil {
+        return 0, err
+    }
+    return revoked, nil
+}
+
+// revokeSessions revokes the live refresh tokens of a user, bumps their
+// session epoch and returns how many tokens were revoked. The caller holds s.mu.
+func (s *MemoryStore) revokeSessions(userID int) int64 {
+    if u, ok := s.users[userID]; ok {
+        u.SessionEpoch++
+        s.users[userID] = u
+    }
+    return s.revokeRefreshTokens(userID)
+}
+
+// revokeRefreshTokens revokes the live refresh tokens of a user and returns
+// how many were revoked. The caller holds s.mu.
+func (s *MemoryStore) revokeRefreshTokens(userID int) int64 {
+    var revoked int64
+    now := s.now().UTC()
+    for hash, t := range s.refreshTokens {
+        if t.UserID == userID && t.RevokedAt == nil {
+            t.RevokedAt = &now
+            s.refreshTokens[hash] = t
+            revoked++
+        }
+    }
+    return revoked
+}
+
+func (s *MemoryStore) AuthenticateUser(ctx context.Context, username, password string) (*User, error) {
+    s.mu.Lock()
+    user, ok := s.userByUsername(username)
+    s.mu.Unlock()
+
+    if !ok {
+        comparePassword(ctx, dummyPasswordHash(), password)
+        return nil, ErrInvalidCredentials
+    }
+    if err := comparePassword(ctx, []byte(user.Password), password); err != nil {
+        return nil, ErrInvalidCredentials
+    }
+    if user.Status != UserStatusActive {
+        return nil, ErrAccountNotActive
+    }
+    return &user, nil
+}
+
+func (s *MemoryStore) userByUsername(username string) (User, bool) {
+    for _, u := range s.users {
+        if u.Username == username {
+            return u, true
+        }
+    }
+    return User{}, false
+}
+
+func (s *MemoryStore) CreateRefreshToken(ctx context.Context, userID int, familyID, tokenHash string, expiresAt time.Time) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    s.refreshTokens[tokenHash] = RefreshToken{ID: s.id(), UserID: userID, FamilyID: familyID, ExpiresAt: expiresAt.UTC()}
+    return nil
+}
+
+func (s *MemoryStore) RotateRefreshToken(ctx context.Context, oldHash, newHash string, expiresAt time.Time) (*User, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    token, ok := s.refreshTokens[oldHash]
+    if !ok {
+        return nil, ErrInvalidRefreshToken
+    }
+    if token.RevokedAt != nil {
+        s.revokeFamily(token.FamilyID)
+        return nil, ErrRefreshTokenReused
+    }
+    now := s.now().UTC()
+    if !now.Before(token.ExpiresAt) {
+        return nil, ErrInvalidRefreshToken
+    }
+    user, ok := s.users[token.UserID]
+    if !ok {
+        return nil, ErrInvalidRefreshToken
+    }
+    if user.Status != UserStatusActive {
+        return nil, ErrAccountNotActive
+    }
+
+    token.RevokedAt = &now
+    s.refreshTokens[oldHash] = token
+    s.refreshTokens[newHash] = RefreshToken{ID: s.id(), UserID: token.UserID, FamilyID: token.FamilyID, ExpiresAt: expiresAt.UTC()}
+    user.Password = ""
+    user.Email = nil
+    return &user, nil
+}
+
+func (s *MemoryStore) RevokeRefreshToken(ctx context.Context, tokenHash string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if token, ok := s.refreshTokens[tokenHash]; ok {
+        s.revokeFamily(token.FamilyID)
+    }
+    return nil
+}
+
+func (s *MemoryStore) SessionEpoch(ctx context.Context, userID int) (int, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    u, ok := s.users[userID]
+    if !ok {
+        return 0, ErrUserNotFound
+    }
+    return u.SessionEpoch, nil
+}
+
+func (s *MemoryStore) revokeFamily(familyID string) {
+    now := s.now().UTC()
+    for hash, t := range s.refreshTokens {
+        if t.FamilyID == familyID && t.RevokedAt == nil {
+            t.RevokedAt = &now
+            s.refreshTokens[hash] = t
+        }
+    }
+}
+
+func (s *MemoryStore) LoginLockedUntil(ctx context.Context, now time.Time, keys ...string) (time.Time, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    var lockedUntil time.Time
+    for _, key := range keys {
+        if until := s.throttles[key].lockedUntil; until.After(now) && until.After(lockedUntil) {
+            lockedUntil = until
+        }
+    }
+    return lockedUntil, nil
+}
+
+func (s *MemoryStore) RecordLoginFailure(ctx context.Context, key string, policy ThrottlePolicy, now time.Time) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    now = now.UTC()
+    t, ok := s.throttles[key]
+    if !ok || t.lastFailureAt.Before(now.Add(-policy.Window)) {
+        t.failures = 0
+    }
+    t.failures++
+    t.lastFailureAt = now
+    if lock := policy.LockDuration(t.failures); lock > 0 {
+        t.lockedUntil = now.Add(lock)
+    }
+    s.throttles[key] = t
+    return nil
+}
+
+func (s *MemoryStore) ClearLoginFailures(ctx context.Context, key string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    delete(s.throttles, key)
+    return nil
+}
+
+func (s *MemoryStore) FetchActiveLockouts(ctx context.Context, now time.Time) ([]Lockout, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    lockouts := []Lockout{}
+    for key, t := range s.throttles {
+        if t.lockedUntil.After(now) {
+            lockouts = append(lockouts, Lockout{Key: key, Failures: t.failures, LockedUntil: t.lockedUntil})
+        }
+    }
+    sort.Slice(lockouts, func(i, j int) bool { return lockouts[i].LockedUntil.After(lockouts[j].LockedUntil) })
+    return lockouts, nil
+}
+
+func (s *MemoryStore) UnlockUser(ctx context.Context, userID int, by AuditActor) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    u, ok := s.users[userID]
+    if !ok {
+        return ErrUserNotFound
+    }
+    if err := s.record(by, "user.unlock", "user", userID, nil, nil); err != nil {
+        return err
+    }
+    delete(s.throttles, UserThrottleKey(u.Username))
+    return nil
+}
+
+func (s *MemoryStore) UnlockIP(ctx context.Context, ip string, by AuditActor) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if err := s.record(by, "ip.unlock", "ip", ip, nil, nil); err != nil {
+        return err
+    }
+    delete(s.throttles, IPThrottleKey(ip))
+    return nil
+}
+
+func (s *MemoryStore) RoleExists(ctx context.Context, role string) (bool, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    _, ok := s.roles[role]
+    return ok, nil
+}
+
+func (s *MemoryStore) FetchRolePermissions(ctx context.Context, role string) ([]string, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    return s.rolePermissions(role), nil
+}
+
+// rolePermissions returns a sorted copy of the permissions of a role, empty for unknown roles
+func (s *MemoryStore) rolePermissions(role string) []string {
+    permissions := append([]string{}, s.roles[role].Permissions...)
+    sort.Strings(permissions)
+    return permissions
+}
+
+func (s *MemoryStore) FetchAllRoles(ctx context.Context) ([]Role, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    roles := []Role{}
+    for name, role := range s.roles {
+        role.Permissions = s.rolePermissions(name)
+        roles = append(roles, role)
+    }
+    sort.Slice(roles, func(i, j int) bool { return roles[i].Name < roles[j].Name })
+    return roles, nil
+}
+
+func (s *MemoryStore) FetchAllPermissions(ctx context.Context) ([]Permission, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    permissions := []Permission{}
+    for name, description := range s.permissions {
+        permissions = append(permissions, Permission{Name: name, Description: description})
+    }
+    sort.Slice(permissions, func(i, j int) bool { return permissions[i].Name < permissions[j].Name })
+    return permissions, nil
+}
+
+func (s *MemoryStore) CreateRole(ctx context.Context, role Role, by AuditActor) error {
+    if !roleNamePattern.MatchString(role.Name) {
+        return ErrInvalidRoleName
+    }
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if _, ok := s.roles[role.Name]; ok {
+        return ErrRoleExists
+    }
+    permissions, err := s.grantablePermissions(role.Permissions)
+    if err != nil {
+        return err
+    }
+    if err := s.record(by, "role.create", "role", role.Name, nil, role); err != nil {
+        return err
+    }
+    s.roles[role.Name] = Role{Name: role.Name, Description: role.Description, MFARequired: role.MFARequired, Permissions: permissions}
+    return nil
+}
+
+// grantablePermissions returns the distinct permissions, or
+// ErrUnknownPermission if one of them doesn't exist
+func (s *MemoryStore) grantablePermissions(names []string) ([]string, error) {
+    permissions := []string{}
+    for _, name := range names {
+        if _, ok := s.permissions[name]; !ok {
+            return nil, ErrUnknownPermission
+        }
+        if !containsString(permissions, name) {
+            permissions = append(permissions, name)
+        }
+    }
+    return permissions, nil
+}
+
+func (s *MemoryStore) SetRolePermissions(ctx context.Context, role string, permissions []string, by AuditActor) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    r, ok := s.roles[role]
+    if !ok {
+        return ErrRoleNotFound
+    }
+    granted, err := s.grantablePermissions(permissions)
+    if err != nil {
+        return err
+    }
+    before := s.rolePermissions(role)
+    r.Permissions = granted
+    s.roles[role] = r
+
+    after := s.rolePermissions(role)
+    err = s.record(by, "role.permissions_update", "role", role, map[string][]string{"permissions": before}, map[string][]string{"permissions": after})
+    if err != nil {
+        r.Permissions = before
+        s.roles[role] = r
+        return err
+    }
+    return nil
+}
+
+func (s *MemoryStore) DeleteRole(ctx context.Context, role string, by AuditActor) error {
+    if IsBuiltinRole(role) {
+        return ErrBuiltinRole
+    }
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    for _, u := range s.users {
+        if u.Role == role {
+            return ErrRoleInUse
+        }
+    }
+    if _, ok := s.roles[role]; !ok {
+        return ErrRoleNotFound
+    }
+    if err := s.record(by, "role.delete", "role", role, map[string][]string{"permissions": s.rolePermissions(role)}, nil); err != nil {
+        return err
+    }
+    delete(s.roles, role)
+    return nil
+}
+
+func (s *MemoryStore) RoleRequiresMFA(ctx context.Context, role string) (bool, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    return s.roles[role].MFARequired, nil
+}
+
+func (s *MemoryStore) SetRoleMFARequired(ctx context.Context, role string, required bool, by AuditActor) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    r, ok := s.roles[role]
+    if !ok {
+        return ErrRoleNotFound
+    }
+    err := s.record(by, "role.mfa_update", "role", role, map[string]bool{"mfa_required": r.MFARequired}, map[string]bool{"mfa_required": required})
+    if err != nil {
+        return err
+    }
+    r.MFARequired = required
+    s.roles[role] = r
+    return nil
+}
+
+func (s *MemoryStore) GetMFAState(ctx context.Context, userID int) (*MFAState, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if _, ok := s.users[userID]; !ok {
+        return nil, ErrUserNotFound
+    }
+    state := s.mfa[userID]
+    return &state, nil
+}
+
+func (s *MemoryStore) StartMFAEnrollment(ctx context.Context, userID int, secret string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if _, ok := s.users[userID]; !ok || s.mfa[userID].Enabled {
+        return ErrMFAAlreadyEnabled
+    }
+    s.mfa[userID] = MFAState{Secret: &secret}
+    return nil
+}
+
+func (s *MemoryStore) ConfirmMFAEnrollment(ctx context.Context, userID int, step int64, recoveryCodeHashes []string, by AuditActor) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    state := s.mfa[userID]
+    if state.Enabled || state.Secret == nil {
+        return ErrMFAAlreadyEnabled
+    }
+    if err := s.record(by, "user.mfa_enable", "user", userID, nil, nil); err != nil {
+        return err
+    }
+    state.Enabled = true
+    state.LastStep = step
+    s.setMFA(userID, state)
+    s.replaceRecoveryCodes(userID, recoveryCodeHashes)
+    return nil
+}
+
+// setMFA stores the MFA state of a user and mirrors it in the user's
+// mfa_enabled flag. The caller holds s.mu.
+func (s *MemoryStore) setMFA(userID int, state MFAState) {
+    s.mfa[userID] = state
+    if u, ok := s.users[userID]; ok {
+        u.MFAEnabled = state.Enabled
+        s.users[userID] = u
+    }
+}
+
+func (s *MemoryStore) replaceRecoveryCodes(userID int, codeHashes []string) {
+    codes := map[string]bool{}
+    for _, hash := range codeHashes {
+        codes[hash] = false
+    }
+    s.recoveryCodes[userID] = codes
+}
+
+func (s *MemoryStore) ConsumeMFAStep(ctx context.Context, userID int, step int64) (bool, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    state, ok := s.mfa[userID]
+    if !ok || state.LastStep >= step {
+        return false, nil
+    }
+    state.LastStep = step
+    s.mfa[userID] = state
+    return true, nil
+}
+
+func (s *MemoryStore) ConsumeRecoveryCode(ctx context.Context, userID int, codeHash string) (bool, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    used, ok := s.recoveryCodes[userID][codeHash]
+    if !ok || used {
+        return false, nil
+    }
+    s.recoveryCodes[userID][codeHash] = true
+    return true, nil
+}
+
+func (s *MemoryStore) ReplaceRecoveryCodes(ctx context.Context, userID int, codeHashes []string, by AuditActor) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if err := s.record(by, "user.mfa_recovery_codes", "user", userID, nil, nil); err != nil {
+        return err
+    }
+    s.replaceRecoveryCodes(userID, codeHashes)
+    return nil
+}
+
+func (s *MemoryStore) DisableMFA(ctx context.Context, userID int, by AuditActor) error {
+    return s.disableMFA(userID, by, "user.mfa_disable")
+}
+
+func (s *MemoryStore) ResetMFA(ctx context.Context, userID int, by AuditActor) error {
+    return s.disableMFA(userID, by, "user.mfa_reset")
+}
+
+// disableMFA removes the second factor of a user. An admin reset also ends the user's sessions.
+func (s *MemoryStore) disableMFA(userID int, by AuditActor, action string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if _, ok := s.users[userID]; !ok {
+        return ErrUserNotFound
+    }
+    if err := s.record(by, action, "user", userID, nil, nil); err != nil {
+        return err
+    }
+    s.setMFA(userID, MFAState{})
+    delete(s.recoveryCodes, userID)
+    if action == "user.mfa_reset" {
+        s.revokeSessions(userID)
+    }
+    return nil
+}
+
+func (s *MemoryStore) CreateAPIKey(ctx context.Context, key APIKey, keyHash string, by AuditActor) (int, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    u, ok := s.users[key.UserID]
+    if !ok {
+        return 0, ErrUserNotFound
+    }
+    if u.Role != RoleService {
+        return 0, ErrNotServiceUser
+    }
+    if _, err := s.grantablePermissions(key.Scopes); err != nil {
+        return 0, err
+    }
+
+    key.ID = s.id()
+    key.CreatedAt = s.now().UTC()
+    if key.ExpiresAt != nil {
+        expiresAt := key.ExpiresAt.UTC()
+        key.ExpiresAt = &expiresAt
+    }
+    if err := s.record(by, "api_key.create", "api_key", key.ID, nil, key); err != nil {
+        return 0, err
+    }
+    s.apiKeys[key.ID] = memoryAPIKey{APIKey: key, hash: keyHash}
+    return key.ID, nil
+}
+
+func (s *MemoryStore) CheckAPIKeyScopes(ctx context.Context, scopes, held []string) error {
+    s.mu.Lock()
+    _, err := s.grantablePermissions(scopes)
+    s.mu.Unlock()
+
+    if err != nil {
+        return err
+    }
+    return checkScopesGrantable(scopes, held)
+}
+
+func (s *MemoryStore) CreateServiceAccount(ctx context.Context, username, randomPassword string, by AuditActor) (int, error) {
+    return s.RegisterUser(ctx, username, "", randomPassword, RoleService, UserStatusActive, by)
+}
+
+func (s *MemoryStore) FetchAllAPIKeys(ctx context.Context) ([]APIKey, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    keys := []APIKey{}
+    for _, k := range s.apiKeys {
+        keys = append(keys, k.APIKey)
+    }
+    sort.Slice(keys, func(i, j int) bool { return keys[i].ID > keys[j].ID })
+    return keys, nil
+}
+
+func (s *MemoryStore) RevokeAPIKey(ctx context.Context, keyID int, by AuditActor) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    k, ok := s.apiKeys[keyID]
+    if !ok || k.RevokedAt != nil {
+        return ErrAPIKeyNotFound
+    }
+    if err := s.record(by, "api_key.revoke", "api_key", keyID, nil, nil); err != nil {
+        return err
+    }
+    now := s.now().UTC()
+    k.RevokedAt = &now
+    s.apiKeys[keyID] = k
+    return nil
+}
+
+func (s *MemoryStore) ResolveAPIKey(ctx context.Context, keyHash string, now time.Time) (*APIKey, string, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    for id, k := range s.apiKeys {
+        if k.hash != keyHash {
+            continue
+        }
+        u, ok := s.users[k.UserID]
+        if !ok || k.RevokedAt != nil || (k.ExpiresAt != nil && !now.Before(*k.ExpiresAt)) || u.Status != UserStatusActive {
+            return nil, "", ErrInvalidAPIKey
+        }
+        now = now.UTC()
+        if k.LastUsedAt == nil || k.LastUsedAt.Before(now.Add(-lastUsedResolution)) {
+            k.LastUsedAt = &now
+            s.apiKeys[id] = k
+        }
+        key := k.APIKey
+        return &key, u.Role, nil
+    }
+    return nil, "", ErrInvalidAPIKey
+}
+
+func (s *MemoryStore) ChangePassword(ctx context.Context, userID int, currentPassword, newPassword string, by AuditActor) error {
+    s.mu.Lock()
+    u, ok := s.users[userID]
+    s.mu.Unlock()
+
+    if !ok {
+        return ErrUserNotFound
+    }
+    if err := comparePassword(ctx, []byte(u.Password), currentPassword); err != nil {
+        return ErrWrongPassword
+    }
+    hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.MinCost)
+    if err != nil {
+        return err
+    }
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    u, ok = s.users[userID]
+    if !ok {
+        return ErrUserNotFound
+    }
+    if err := s.record(by, "user.password_change", "user", userID, nil, nil); err != nil {
+        return err
+    }
+    u.Password = string(hashedPassword)
+    s.users[userID] = u
+    s.revokeSessions(userID)
+    return nil
+}
+
+func (s *MemoryStore) FindUserByLogin(ctx context.Context, login string) (*User, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    email := NormalizeEmail(login)
+    for _, u := range s.users {
+        if (u.Username == login || (u.Email != nil && *u.Email == email)) && u.Status == UserStatusActive {
+            u.Password = ""
+            return &u, nil
+        }
+    }
+    return nil, ErrUserNotFound
+}
+
+func (s *MemoryStore) CreatePasswordResetToken(ctx context.Context, userID int, tokenHash string, expiresAt time.Time) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    for hash, t := range s.resetTokens {
+        if t.userID == userID {
+            t.used = true
+            s.resetTokens[hash] = t
+        }
+    }
+    s.resetTokens[tokenHash] = memoryResetToken{userID: userID, expiresAt: expiresAt.UTC()}
+    return nil
+}
+
+func (s *MemoryStore) ResetPassword(ctx context.Context, tokenHash, newPassword string, by AuditActor) (int, error) {
+    hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.MinCost)
+    if err != nil {
+        return 0, err
+    }
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    t, ok := s.resetTokens[tokenHash]
+    if !ok || t.used || !s.now().Before(t.expiresAt) {
+        return 0, ErrInvalidResetToken
+    }
+    u, ok := s.users[t.userID]
+    if !ok {
+        return 0, ErrInvalidResetToken
+    }
+    if by.UserID == nil {
+        by.UserID, by.Role = &u.ID, &u.Role
+    }
+    if err := s.record(by, "user.password_reset", "user", u.ID, nil, nil); err != nil {
+        return 0, err
+    }
+
+    t.used = true
+    s.resetTokens[tokenHash] = t
+    u.Password = string(hashedPassword)
+    s.users[u.ID] = u
+    s.revokeSessions(u.ID)
+    return u.ID, nil
+}
+
+func (s *MemoryStore) FetchVehicleStatus(ctx context.Context) (VehicleStatus, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    var status VehicleStatus
+    for _, v := range s.vehicles {
+        if v.RetiredAt != nil {
+            continue
+        }
+        if v.Availability {
+            status.Idle++
+        } else {
+            status.Active++
+        }
+    }
+    return status, nil
+}
+
+// FetchDriverPerformance names drivers by username, as there is no drivers table
+func (s *MemoryStore) FetchDriverPerformance(ctx context.Context) ([]DriverPerformance, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    counts := map[string]int{}
+    for _, b := range s.bookings {
+        if b.Status == BookingCompleted && b.DriverID != nil {
+            name := strconv.Itoa(*b.DriverID)
+            if u, ok := s.users[*b.DriverID]; ok {
+                name = u.Username
+            }
+            counts[name]++
+        }
+    }
+
+    data := []DriverPerformance{}
+    for name, count := range counts {
+        data = append(data, DriverPerformance{DriverName: name, Deliveries: count})
+    }
+    sort.Slice(data, func(i, j int) bool { return data[i].DriverName < data[j].DriverName })
+    return data, nil
+}
+
+func (s *MemoryStore) FetchRevenueOverTime(ctx context.Context) ([]RevenueData, error) {
+    revenue := map[time.Time]float64{}
+    for _, b := range s.filterBookings(func(b Booking) bool { return b.Status == BookingCompleted }) {
+        revenue[truncateDay(b.CreatedAt)] += b.EstimatedCost
+    }
+
+    data := []RevenueData{}
+    for day, sum := range revenue {
+        data = append(data, RevenueData{Date: day, Revenue: sum})
+    }
+    sort.Slice(data, func(i, j int) bool { return data[i].Date.Before(data[j].Date) })
+    return data, nil
+}
+
+func (s *MemoryStore) FetchBookingStatusDistribution(ctx context.Context) ([]BookingStatus, error) {
+    counts := map[string]int{}
+    for _, b := range s.filterBookings(func(Booking) bool { return true }) {
+        counts[b.Status]++
+    }
+
+    data := []BookingStatus{}
+    for status, count := range counts {
+        data = append(data, BookingStatus{Status: status, Count: count})
+    }
+    sort.Slice(data, func(i, j int) bool { return data[i].Status < data[j].Status })
+    return data, nil
+}
+
+func (s *MemoryStore) FetchBookingsOverTime(ctx context.Context, since time.Time) ([]BookingsOverTime, error) {
+    counts := map[time.Time]int{}
+    for _, b := range s.filterBookings(func(b Booking) bool { return !b.CreatedAt.Before(since) }) {
+        counts[truncateDay(b.CreatedAt)]++
+    }
+
+    data := []BookingsOverTime{}
+    for day, count := range counts {
+        data = append(data, BookingsOverTime{Date: day, Count: count})
+    }
+    sort.Slice(data, func(i, j int) bool { return data[i].Date.Before(data[j].Date) })
+    return data, nil
+}
+
+func (s *MemoryStore) FetchDriverActiveBookings(ctx context.Context) ([]DriverActiveBookings, error) {
+    counts := map[int]int{}
+    for _, b := range s.filterBookings(func(b Booking) bool { return BookingActive(b.Status) && b.DriverID != nil }) {
+        counts[*b.DriverID]++
+    }
+
+    data := []DriverActiveBookings{}
+    for driverID, count := range counts {
+        data = append(data, DriverActiveBookings{DriverID: driverID, ActiveBookings: count})
+    }
+    sort.Slice(data, func(i, j int) bool { return data[i].DriverID < data[j].DriverID })
+    return data, nil
+}
+
+func (s *MemoryStore) QueryAudit(ctx context.Context, filter AuditFilter) ([]AuditEntry, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    entries := []AuditEntry{}
+    for i := len(s.audit) - 1; i >= 0 && (filter.Limit == 0 || len(entries) < filter.Limit); i-- {
+        e := s.audit[i]
+        switch {
+        case filter.ActorUserID != 0 && (e.ActorUserID == nil || *e.ActorUserID != filter.ActorUserID),
+            filter.Action != "" && e.Action != filter.Action,
+            filter.EntityType != "" && e.EntityType != filter.EntityType,
+            filter.EntityID != "" && (e.EntityID == nil || *e.EntityID != filter.EntityID),
+            !filter.From.IsZero() && e.OccurredAt.Before(filter.From),
+            !filter.To.IsZero() && !e.OccurredAt.Before(filter.To),
+            filter.BeforeID != 0 && e.ID >= filter.BeforeID:
+            continue
+        }
+        entries = append(entries, e)
+    }
+    return entries, nil
+}
+
+// truncateDay returns midnight UTC of the day t falls on, like date_trunc('day', ...)
+func truncateDay(t time.Time) time.Time {
+    t = t.UTC()
+    return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
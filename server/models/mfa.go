@@ -0,0 +1,203 @@
+package models
+
+import (
+    "context"
+    "database/sql"
+    "errors"
+    "time"
+)
+
+var (
+    ErrMFANotEnrolled     = Conflict("mfa_not_enrolled", "two-factor authentication is not set up")
+    ErrMFAAlreadyEnabled  = Conflict("mfa_already_enabled", "two-factor authentication is already enabled")
+    ErrMFARequiredForRole = Conflict("mfa_required_for_role", "two-factor authentication is required for this role")
+)
+
+// MFAState is the TOTP enrollment of a user. A secret without Enabled is an
+// enrollment that hasn't been confirmed with a code yet.
+type MFAState struct {
+    Secret   *string
+    Enabled  bool
+    LastStep int64
+}
+
+// GetMFAState fetches the TOTP enrollment of a user
+func GetMFAState(ctx context.Context, db *sql.DB, userID int) (*MFAState, error) {
+    state := &MFAState{}
+    query := `SELECT mfa_secret, mfa_enabled, mfa_last_step FROM users WHERE id = $1`
+    err := db.QueryRowContext(ctx, query, userID).Scan(&state.Secret, &state.Enabled, &state.LastStep)
+    if errors.Is(err, sql.ErrNoRows) {
+        return nil, ErrUserNotFound
+    }
+    if err != nil {
+        return nil, err
+    }
+    return state, nil
+}
+
+// StartMFAEnrollment stores a new, unconfirmed TOTP secret for a user
+func StartMFAEnrollment(ctx context.Context, db *sql.DB, userID int, secret string) error {
+    result, err := db.ExecContext(ctx, `UPDATE users SET mfa_secret = $1, mfa_last_step = 0 WHERE id = $2 AND mfa_enabled = FALSE`, secret, userID)
+    return expectAffected(result, err, ErrMFAAlreadyEnabled)
+}
+
+// ConfirmMFAEnrollment enables TOTP for a user after a valid code was
+// presented for the pending secret and stores the recovery code hashes
+func ConfirmMFAEnrollment(ctx context.Context, db *sql.DB, userID int, step int64, recoveryCodeHashes []string, by AuditActor) error {
+    tx, err := db.BeginTx(ctx, nil)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    query := `UPDATE users SET mfa_enabled = TRUE, mfa_last_step = $1 WHERE id = $2 AND mfa_enabled = FALSE AND mfa_secret IS NOT NULL`
+    result, err := tx.ExecContext(ctx, query, step, userID)
+    if err := expectAffected(result, err, ErrMFAAlreadyEnabled); err != nil {
+        return err
+    }
+
+    if err := replaceRecoveryCodes(ctx, tx, userID, recoveryCodeHashes); err != nil {
+        return err
+    }
+    if err := recordChange(ctx, tx, by, "user.mfa_enable", "user", userID, nil, nil); err != nil {
+        return err
+    }
+    return tx.Commit()
+}
+
+// ConsumeMFAStep records that the code of a time step was used. It returns
+// false if that step or a later one was already used, so a code can't be replayed.
+func ConsumeMFAStep(ctx context.Context, db *sql.DB, userID int, step int64) (bool, error) {
+    result, err := db.ExecContext(ctx, `UPDATE users SET mfa_last_step = $1 WHERE id = $2 AND mfa_last_step < $3`, step, userID, step)
+    if err != nil {
+        return false, err
+    }
+    rowsAffected, err := result.RowsAffected()
+    return rowsAffected == 1, err
+}
+
+// ConsumeRecoveryCode marks an unused recovery code of the user as used. It
+// returns false if no unused code matches.
+func ConsumeRecoveryCode(ctx context.Context, db *sql.DB, userID int, codeHash string) (bool, error) {
+    query := `UPDATE mfa_recovery_codes SET used_at = $1 WHERE user_id = $2 AND code_hash = $3 AND used_at IS NULL`
+    result, err := db.ExecContext(ctx, query, time.Now().UTC(), userID, codeHash)
+    if err != nil {
+        return false, err
+    }
+    rowsAffected, err := result.RowsAffected()
+    return rowsAffected > 0, err
+}
+
+// ReplaceRecoveryCodes invalidates all recovery codes of a user and stores new ones
+func ReplaceRecoveryCodes(ctx context.Context, db *sql.DB, userID int, codeHashes []string, by AuditActor) error {
+    tx, err := db.BeginTx(ctx, nil)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    if err := replaceRecoveryCodes(ctx, tx, userID, codeHashes); err != nil {
+        return err
+    }
+    if err := recordChange(ctx, tx, by, "user.mfa_recovery_codes", "user", userID, nil, nil); err != nil {
+        return err
+    }
+    return tx.Commit()
+}
+
+// DisableMFA removes the TOTP enrollment and recovery codes of a user
+func DisableMFA(ctx context.Context, db *sql.DB, userID int, by AuditActor) error {
+    tx, err := db.BeginTx(ctx, nil)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    if err := disableMFA(ctx, tx, userID); err != nil {
+        return err
+    }
+    if err := recordChange(ctx, tx, by, "user.mfa_disable", "user", userID, nil, nil); err != nil {
+        return err
+    }
+    return tx.Commit()
+}
+
+// ResetMFA is DisableMFA for an admin helping a user who lost their device.
+// The user's sessions are revoked along with the second factor.
+func ResetMFA(ctx context.Context, db *sql.DB, userID int, by AuditActor) error {
+    tx, err := db.BeginTx(ctx, nil)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    if err := disableMFA(ctx, tx, userID); err != nil {
+        return err
+    }
+    if _, err := revokeUserSessions(ctx, tx, userID, time.Now().UTC()); err != nil {
+        return err
+    }
+    if err := recordChange(ctx, tx, by, "user.mfa_reset", "user", userID, nil, nil); err != nil {
+        return err
+    }
+    return tx.Commit()
+}
+
+func disableMFA(ctx context.Context, tx *sql.Tx, userID int) error {
+    result, err := tx.ExecContext(ctx, `UPDATE users SET mfa_secret = NULL, mfa_enabled = FALSE, mfa_last_step = 0 WHERE id = $1`, userID)
+    if err := expectAffected(result, err, ErrUserNotFound); err != nil {
+        return err
+    }
+    _, err = tx.ExecContext(ctx, `DELETE FROM mfa_recovery_codes WHERE user_id = $1`, userID)
+    return err
+}
+
+// RoleRequiresMFA reports whether accounts with the role must use two-factor authentication
+func RoleRequiresMFA(ctx context.Context, db *sql.DB, role string) (bool, error) {
+    var required bool
+    err := db.QueryRowContext(ctx, `SELECT mfa_required FROM roles WHERE name = $1`, role).Scan(&required)
+    if errors.Is(err, sql.ErrNoRows) {
+        return false, nil
+    }
+    return required, err
+}
+
+// SetRoleMFARequired turns enforcement of two-factor authentication for a role on or off
+func SetRoleMFARequired(ctx context.Context, db *sql.DB, role string, required bool, by AuditActor) error {
+    tx, err := db.BeginTx(ctx, nil)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    var before bool
+    err = tx.QueryRowContext(ctx, `SELECT mfa_required FROM roles WHERE name = $1`, role).Scan(&before)
+    if errors.Is(err, sql.ErrNoRows) {
+        return ErrRoleNotFound
+    }
+    if err != nil {
+        return err
+    }
+
+    if _, err := tx.ExecContext(ctx, `UPDATE roles SET mfa_required = $1 WHERE name = $2`, required, role); err != nil {
+        return err
+    }
+    err = recordChange(ctx, tx, by, "role.mfa_update", "role", role,
+        map[string]bool{"mfa_required": before}, map[string]bool{"mfa_required": required})
+    if err != nil {
+        return err
+    }
+    return tx.Commit()
+}
+
+func replaceRecoveryCodes(ctx context.Context, tx *sql.Tx, userID int, codeHashes []string) error {
+    if _, err := tx.ExecContext(ctx, `DELETE FROM mfa_recovery_codes WHERE user_id = $1`, userID); err != nil {
+        return err
+    }
+    for _, hash := range codeHashes {
+        if _, err := tx.ExecContext(ctx, `INSERT INTO mfa_recovery_codes (user_id, code_hash) VALUES ($1, $2)`, userID, hash); err != nil {
+            return err
+        }
+    }
+    return nil
+}
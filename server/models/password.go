@@ -0,0 +1,170 @@
+package models
+
+import (
+    "context"
+    "database/sql"
+    "errors"
+    "time"
+
+    "fmc/tracing"
+
+    "golang.org/x/crypto/bcrypt"
+)
+
+const MinPasswordLength = 8
+
+var (
+    ErrWeakPassword      = Validation("weak_password", "", "password must be at least 8 characters")
+    ErrInvalidResetToken = Validation("invalid_reset_token", "token", "invalid or expired reset token")
+    // ErrWrongPassword is a mismatch of the current password of a signed in
+    // user, who must not be told to log in again
+    ErrWrongPassword = Forbidden("wrong_password", "current password is incorrect")
+)
+
+// ValidatePassword checks a new password against the password policy
+func ValidatePassword(password string) error {
+    if len(password) < MinPasswordLength {
+        return ErrWeakPassword
+    }
+    return nil
+}
+
+// ChangePassword replaces a user's password after verifying the current one
+// and revokes all their sessions. Neither happens without the other.
+func ChangePassword(ctx context.Context, db *sql.DB, userID int, currentPassword, newPassword string, by AuditActor) error {
+    var hash string
+    err := db.QueryRowContext(ctx, `SELECT password FROM users WHERE id = $1`, userID).Scan(&hash)
+    if errors.Is(err, sql.ErrNoRows) {
+        return ErrUserNotFound
+    }
+    if err != nil {
+        return err
+    }
+
+    if err := comparePassword(ctx, []byte(hash), currentPassword); err != nil {
+        return ErrWrongPassword
+    }
+
+    hashedPassword, err := hashPassword(ctx, newPassword)
+    if err != nil {
+        return err
+    }
+
+    tx, err := db.BeginTx(ctx, nil)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    result, err := tx.ExecContext(ctx, `UPDATE users SET password = $1 WHERE id = $2`, hashedPassword, userID)
+    if err := expectAffected(result, err, ErrUserNotFound); err != nil {
+        return err
+    }
+    if _, err := revokeUserSessions(ctx, tx, userID, time.Now().UTC()); err != nil {
+        return err
+    }
+    if err := recordChange(ctx, tx, by, "user.password_change", "user", userID, nil, nil); err != nil {
+        return err
+    }
+    return tx.Commit()
+}
+
+// FindUserByLogin looks up an active user by username or email for a password reset
+func FindUserByLogin(ctx context.Context, db *sql.DB, login string) (*User, error) {
+    user := &User{}
+    query := `SELECT id, username, email, role, status FROM users WHERE (username = $1 OR email = $2) AND status = $3`
+    err := db.QueryRowContext(ctx, query, login, NormalizeEmail(login), UserStatusActive).Scan(&user.ID, &user.Username, &user.Email, &user.Role, &user.Status)
+    if errors.Is(err, sql.ErrNoRows) {
+        return nil, ErrUserNotFound
+    }
+    if err != nil {
+        return nil, err
+    }
+    return user, nil
+}
+
+// CreatePasswordResetToken stores the hash of a new reset token for a user.
+// Earlier unused tokens of the user stop working.
+func CreatePasswordResetToken(ctx context.Context, db *sql.DB, userID int, tokenHash string, expiresAt time.Time) error {
+    tx, err := db.BeginTx(ctx, nil)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    now := time.Now().UTC()
+    _, err = tx.ExecContext(ctx, `UPDATE password_reset_tokens SET used_at = $1 WHERE user_id = $2 AND used_at IS NULL`, now, userID)
+    if err != nil {
+        return err
+    }
+
+    query := `INSERT INTO password_reset_tokens (user_id, token_hash, expires_at, created_at) VALUES ($1, $2, $3, $4)`
+    if _, err := tx.ExecContext(ctx, query, userID, tokenHash, expiresAt.UTC(), now); err != nil {
+        return err
+    }
+    return tx.Commit()
+}
+
+// ResetPassword consumes a reset token, sets the new password of its user and
+// revokes all of their sessions in one transaction, so a session stolen with
+// the old password can't outlive the reset. It returns the ID of the user
+// whose password was reset. Without a user in by, that user is recorded as
+// the actor.
+func ResetPassword(ctx context.Context, db *sql.DB, tokenHash, newPassword string, by AuditActor) (int, error) {
+    hashedPassword, err := hashPassword(ctx, newPassword)
+    if err != nil {
+        return 0, err
+    }
+
+    tx, err := db.BeginTx(ctx, nil)
+    if err != nil {
+        return 0, err
+    }
+    defer tx.Rollback()
+
+    // Consuming the token in the same statement that checks it keeps it single-use
+    var userID int
+    now := time.Now().UTC()
+    query := `
+        UPDATE password_reset_tokens SET used_at = $1
+        WHERE token_hash = $2 AND used_at IS NULL AND expires_at > $3
+        RETURNING user_id`
+    err = tx.QueryRowContext(ctx, query, now, tokenHash, now).Scan(&userID)
+    if errors.Is(err, sql.ErrNoRows) {
+        return 0, ErrInvalidResetToken
+    }
+    if err != nil {
+        return 0, err
+    }
+
+    var role string
+    err = tx.QueryRowContext(ctx, `UPDATE users SET password = $1 WHERE id = $2 RETURNING role`, hashedPassword, userID).Scan(&role)
+    if err != nil {
+        return 0, err
+    }
+    if _, err := revokeUserSessions(ctx, tx, userID, now); err != nil {
+        return 0, err
+    }
+
+    if by.UserID == nil {
+        by.UserID, by.Role = &userID, &role
+    }
+    if err := recordChange(ctx, tx, by, "user.password_reset", "user", userID, nil, nil); err != nil {
+        return 0, err
+    }
+    return userID, tx.Commit()
+}
+
+// hashPassword and comparePassword run bcrypt in spans of their own, since it
+// is slow on purpose and a large part of login and registration latency
+func hashPassword(ctx context.Context, password string) ([]byte, error) {
+    _, span := tracing.Start(ctx, "bcrypt.hash")
+    defer span.End()
+    return bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+}
+
+func comparePassword(ctx context.Context, hash []byte, password string) error {
+    _, span := tracing.Start(ctx, "bcrypt.compare")
+    defer span.End()
+    return bcrypt.CompareHashAndPassword(hash, []byte(password))
+}
@@ -0,0 +1,271 @@
+package models
+
+import (
+    "context"
+    "database/sql"
+    "regexp"
+)
+
+// Permissions checked by the API. Roles are stored in the database and map to
+// any subset of these, so new roles need no code changes.
+const (
+    PermBookingsCreate    = "bookings:create"
+    PermBookingsAccept    = "bookings:accept"
+    PermBookingsRead      = "bookings:read"
+    PermBookingsComplete  = "bookings:complete"
+    PermBookingsCancel    = "bookings:cancel"
+    PermBookingsCancelAny = "bookings:cancel_any"
+    PermVehiclesRead      = "vehicles:read"
+    PermVehiclesWrite     = "vehicles:write"
+    PermAnalyticsRead     = "analytics:read"
+    PermUsersRead         = "users:read"
+    PermUsersWrite        = "users:write"
+    PermRolesManage       = "roles:manage"
+    PermAPIKeysManage     = "api_keys:manage"
+    PermAuditRead         = "audit:read"
+)
+
+var (
+    ErrRoleNotFound      = NotFound("role_not_found", "role not found")
+    ErrRoleExists        = Conflict("role_exists", "role already exists")
+    ErrRoleInUse         = Conflict("role_in_use", "role is assigned to users")
+    ErrBuiltinRole       = Conflict("builtin_role", "built-in roles cannot be deleted")
+    ErrUnknownPermission = Validation("unknown_permission", "", "unknown permission")
+    ErrInvalidRoleName   = Validation("invalid_role_name", "name", "role names must be lowercase letters, digits, '-' or '_'")
+    ErrRoleNotHeld       = Forbidden("role_not_held", "accounts can only be given roles whose permissions the caller holds")
+)
+
+var roleNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_-]{1,31}$`)
+
+type Role struct {
+    Name        string   `json:"name" validate:"required"`
+    Description string   `json:"description" validate:"max=255"`
+    MFARequired bool     `json:"mfa_required"`
+    Permissions []string `json:"permissions"`
+}
+
+type Permission struct {
+    Name        string `json:"name"`
+    Description string `json:"description"`
+}
+
+// IsBuiltinRole reports whether role is one of the roles the application relies on
+func IsBuiltinRole(role string) bool {
+    switch role {
+    case RoleAdmin, RoleDriver, RoleUser, RoleService:
+        return true
+    }
+    return false
+}
+
+// RoleExists reports whether a role with the given name is defined
+func RoleExists(ctx context.Context, db *sql.DB, role string) (bool, error) {
+    var exists bool
+    err := db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM roles WHERE name = $1)`, role).Scan(&exists)
+    return exists, err
+}
+
+// FetchRolePermissions returns the permissions granted to a role
+func FetchRolePermissions(ctx context.Context, db *sql.DB, role string) ([]string, error) {
+    return fetchRolePermissions(ctx, db, role)
+}
+
+func fetchRolePermissions(ctx context.Context, q querier, role string) ([]string, error) {
+    rows, err := q.QueryContext(ctx, `SELECT permission FROM role_permissions WHERE role = $1 ORDER BY permission`, role)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    permissions := []string{}
+    for rows.Next() {
+        var p string
+        if err := rows.Scan(&p); err != nil {
+            return nil, err
+        }
+        permissions = append(permissions, p)
+    }
+    return permissions, rows.Err()
+}
+
+// FetchAllPermissions lists every permission that can be granted
+func FetchAllPermissions(ctx context.Context, db *sql.DB) ([]Permission, error) {
+    rows, err := db.QueryContext(ctx, `SELECT name, description FROM permissions ORDER BY name`)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    permissions := []Permission{}
+    for rows.Next() {
+        var p Permission
+        if err := rows.Scan(&p.Name, &p.Description); err != nil {
+            return nil, err
+        }
+        permissions = append(permissions, p)
+    }
+    return permissions, rows.Err()
+}
+
+// FetchAllRoles lists every role with its permissions
+func FetchAllRoles(ctx context.Context, db *sql.DB) ([]Role, error) {
+    rows, err := db.QueryContext(ctx, `
+        SELECT roles.name, roles.description, roles.mfa_required, role_permissions.permission
+        FROM roles
+        LEFT JOIN role_permissions ON role_permissions.role = roles.name
+        ORDER BY roles.name, role_permissions.permission
+    `)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    roles := []Role{}
+    for rows.Next() {
+        var name, description string
+        var mfaRequired bool
+        var permission sql.NullString
+        if err := rows.Scan(&name, &description, &mfaRequired, &permission); err != nil {
+            return nil, err
+        }
+        if len(roles) == 0 || roles[len(roles)-1].Name != name {
+            roles = append(roles, Role{Name: name, Description: description, MFARequired: mfaRequired, Permissions: []string{}})
+        }
+        if permission.Valid {
+            last := &roles[len(roles)-1]
+            last.Permissions = append(last.Permissions, permission.String)
+        }
+    }
+    return roles, rows.Err()
+}
+
+// CreateRole defines a new role with the given permissions
+func CreateRole(ctx context.Context, db *sql.DB, role Role, by AuditActor) error {
+    if !roleNamePattern.MatchString(role.Name) {
+        return ErrInvalidRoleName
+    }
+
+    tx, err := db.BeginTx(ctx, nil)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    _, err = tx.ExecContext(ctx, `INSERT INTO roles (name, description, mfa_required) VALUES ($1, $2, $3)`, role.Name, role.Description, role.MFARequired)
+    if isUniqueViolation(err) {
+        return ErrRoleExists
+    }
+    if err != nil {
+        return err
+    }
+
+    if err := insertRolePermissions(ctx, tx, role.Name, role.Permissions); err != nil {
+        return err
+    }
+    if err := recordChange(ctx, tx, by, "role.create", "role", role.Name, nil, role); err != nil {
+        return err
+    }
+    return tx.Commit()
+}
+
+// SetRolePermissions replaces the permissions granted to a role
+func SetRolePermissions(ctx context.Context, db *sql.DB, role string, permissions []string, by AuditActor) error {
+    tx, err := db.BeginTx(ctx, nil)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    var exists bool
+    if err := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM roles WHERE name = $1)`, role).Scan(&exists); err != nil {
+        return err
+    }
+    if !exists {
+        return ErrRoleNotFound
+    }
+    before, err := fetchRolePermissions(ctx, tx, role)
+    if err != nil {
+        return err
+    }
+
+    if _, err := tx.ExecContext(ctx, `DELETE FROM role_permissions WHERE role = $1`, role); err != nil {
+        return err
+    }
+    if err := insertRolePermissions(ctx, tx, role, permissions); err != nil {
+        return err
+    }
+    after, err := fetchRolePermissions(ctx, tx, role)
+    if err != nil {
+        return err
+    }
+
+    err = recordChange(ctx, tx, by, "role.permissions_update", "role", role,
+        map[string][]string{"permissions": before}, map[string][]string{"permissions": after})
+    if err != nil {
+        return err
+    }
+    return tx.Commit()
+}
+
+// DeleteRole removes a custom role that no user holds
+func DeleteRole(ctx context.Context, db *sql.DB, role string, by AuditActor) error {
+    if IsBuiltinRole(role) {
+        return ErrBuiltinRole
+    }
+
+    tx, err := db.BeginTx(ctx, nil)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    var inUse bool
+    if err := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM users WHERE role = $1)`, role).Scan(&inUse); err != nil {
+        return err
+    }
+    if inUse {
+        return ErrRoleInUse
+    }
+    before, err := fetchRolePermissions(ctx, tx, role)
+    if err != nil {
+        return err
+    }
+
+    result, err := tx.ExecContext(ctx, `DELETE FROM roles WHERE name = $1`, role)
+    if err := expectAffected(result, err, ErrRoleNotFound); err != nil {
+        return err
+    }
+    if err := recordChange(ctx, tx, by, "role.delete", "role", role, map[string][]string{"permissions": before}, nil); err != nil {
+        return err
+    }
+    return tx.Commit()
+}
+
+// CheckRoleGrantable returns ErrRoleNotHeld unless a caller who holds the
+// permissions in held also holds every permission a role grants. Accounts
+// never get more than the caller who provisions them.
+func CheckRoleGrantable(granted, held []string) error {
+    holds := make(map[string]bool, len(held))
+    for _, p := range held {
+        holds[p] = true
+    }
+    for _, p := range granted {
+        if !holds[p] {
+            return ErrRoleNotHeld
+        }
+    }
+    return nil
+}
+
+func insertRolePermissions(ctx context.Context, tx *sql.Tx, role string, permissions []string) error {
+    for _, p := range permissions {
+        _, err := tx.ExecContext(ctx, `INSERT INTO role_permissions (role, permission) VALUES ($1, $2) ON CONFLICT DO NOTHING`, role, p)
+        if isForeignKeyViolation(err) {
+            return ErrUnknownPermission
+        }
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
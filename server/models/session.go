@@ -0,0 +1,173 @@
+package models
+
+import (
+    "context"
+    "database/sql"
+    "errors"
+    "time"
+)
+
+var (
+    ErrInvalidRefreshToken = Unauthorized("invalid_refresh_token", "invalid or expired refresh token")
+    ErrRefreshTokenReused  = Unauthorized("refresh_token_reused", "refresh token reuse detected")
+)
+
+// RefreshToken is a long-lived credential used to obtain new access tokens.
+// Tokens issued from the same login share a family so that a replayed token
+// can revoke every descendant of that login at once.
+type RefreshToken struct {
+    ID        int
+    UserID    int
+    FamilyID  string
+    ExpiresAt time.Time
+    RevokedAt *time.Time
+}
+
+// CreateRefreshToken stores the hash of a newly issued refresh token
+func CreateRefreshToken(ctx context.Context, db *sql.DB, userID int, familyID, tokenHash string, expiresAt time.Time) error {
+    query := `INSERT INTO refresh_tokens (user_id, family_id, token_hash, expires_at, created_at) VALUES ($1, $2, $3, $4, $5)`
+    _, err := db.ExecContext(ctx, query, userID, familyID, tokenHash, expiresAt.UTC(), time.Now().UTC())
+    return err
+}
+
+// RotateRefreshToken exchanges the refresh token identified by oldHash for a new
+// one in the same family and returns the owning user. Presenting a token that
+// was already rotated or revoked revokes the whole family.
+func RotateRefreshToken(ctx context.Context, db *sql.DB, oldHash, newHash string, expiresAt time.Time) (*User, error) {
+    tx, err := db.BeginTx(ctx, nil)
+    if err != nil {
+        return nil, err
+    }
+    defer tx.Rollback()
+
+    var token RefreshToken
+    query := `SELECT id, user_id, family_id, expires_at, revoked_at FROM refresh_tokens WHERE token_hash = $1`
+    err = tx.QueryRowContext(ctx, query, oldHash).Scan(&token.ID, &token.UserID, &token.FamilyID, &token.ExpiresAt, &token.RevokedAt)
+    if errors.Is(err, sql.ErrNoRows) {
+        return nil, ErrInvalidRefreshToken
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    now := time.Now().UTC()
+    if token.RevokedAt != nil {
+        tx.Rollback()
+        return nil, revokeFamilyAfterReuse(ctx, db, token.FamilyID)
+    }
+    if !now.Before(token.ExpiresAt) {
+        return nil, ErrInvalidRefreshToken
+    }
+
+    // Only one concurrent rotation of the same token may win
+    result, err := tx.ExecContext(ctx, `UPDATE refresh_tokens SET revoked_at = $1 WHERE id = $2 AND revoked_at IS NULL`, now, token.ID)
+    if err != nil {
+        return nil, err
+    }
+    rowsAffected, err := result.RowsAffected()
+    if err != nil {
+        return nil, err
+    }
+    if rowsAffected == 0 {
+        tx.Rollback()
+        return nil, revokeFamilyAfterReuse(ctx, db, token.FamilyID)
+    }
+
+    user := &User{}
+    err = tx.QueryRowContext(ctx, `SELECT id, username, role, status, mfa_enabled, session_epoch FROM users WHERE id = $1`, token.UserID).Scan(&user.ID, &user.Username, &user.Role, &user.Status, &user.MFAEnabled, &user.SessionEpoch)
+    if errors.Is(err, sql.ErrNoRows) {
+        return nil, ErrInvalidRefreshToken
+    }
+    if err != nil {
+        return nil, err
+    }
+    if user.Status != UserStatusActive {
+        return nil, ErrAccountNotActive
+    }
+
+    _, err = tx.ExecContext(ctx, `INSERT INTO refresh_tokens (user_id, family_id, token_hash, expires_at, created_at) VALUES ($1, $2, $3, $4, $5)`,
+        token.UserID, token.FamilyID, newHash, expiresAt.UTC(), now)
+    if err != nil {
+        return nil, err
+    }
+
+    if err := tx.Commit(); err != nil {
+        return nil, err
+    }
+    return user, nil
+}
+
+// revokeFamilyAfterReuse revokes every token descended from the same login
+// and reports the reuse to the caller
+func revokeFamilyAfterReuse(ctx context.Context, db *sql.DB, familyID string) error {
+    if err := RevokeRefreshTokenFamily(ctx, db, familyID); err != nil {
+        return err
+    }
+    return ErrRefreshTokenReused
+}
+
+// RevokeRefreshToken ends the session the given refresh token belongs to.
+// Unknown tokens are ignored so that logout is idempotent.
+func RevokeRefreshToken(ctx context.Context, db *sql.DB, tokenHash string) error {
+    var familyID string
+    err := db.QueryRowContext(ctx, `SELECT family_id FROM refresh_tokens WHERE token_hash = $1`, tokenHash).Scan(&familyID)
+    if errors.Is(err, sql.ErrNoRows) {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+    return RevokeRefreshTokenFamily(ctx, db, familyID)
+}
+
+// RevokeRefreshTokenFamily revokes all live tokens of a family
+func RevokeRefreshTokenFamily(ctx context.Context, db *sql.DB, familyID string) error {
+    query := `UPDATE refresh_tokens SET revoked_at = $1 WHERE family_id = $2 AND revoked_at IS NULL`
+    _, err := db.ExecContext(ctx, query, time.Now().UTC(), familyID)
+    return err
+}
+
+// RevokeUserSessions revokes every live refresh token of a user and returns
+// how many were revoked. It also moves the user to a new session epoch, so
+// access tokens issued before are rejected too.
+func RevokeUserSessions(ctx context.Context, db *sql.DB, userID int, by AuditActor) (int64, error) {
+    tx, err := db.BeginTx(ctx, nil)
+    if err != nil {
+        return 0, err
+    }
+    defer tx.Rollback()
+
+    revoked, err := revokeUserSessions(ctx, tx, userID, time.Now().UTC())
+    if err != nil {
+        return 0, err
+    }
+    if err := recordChange(ctx, tx, by, "user.sessions_revoke", "user", userID, nil, map[string]int64{"revoked_sessions": revoked}); err != nil {
+        return 0, err
+    }
+    return revoked, tx.Commit()
+}
+
+// SessionEpoch returns the session epoch of a user. Access tokens issued in an
+// older epoch belong to revoked sessions.
+func SessionEpoch(ctx context.Context, db *sql.DB, userID int) (int, error) {
+    var epoch int
+    err := db.QueryRowContext(ctx, `SELECT session_epoch FROM users WHERE id = $1`, userID).Scan(&epoch)
+    if errors.Is(err, sql.ErrNoRows) {
+        return 0, ErrUserNotFound
+    }
+    return epoch, err
+}
+
+// revokeUserSessions revokes every live refresh token of a user and bumps
+// their session epoch as part of a larger change, such as a new password
+func revokeUserSessions(ctx context.Context, tx *sql.Tx, userID int, now time.Time) (int64, error) {
+    if _, err := tx.ExecContext(ctx, `UPDATE users SET session_epoch = session_epoch + 1 WHERE id = $1`, userID); err != nil {
+        return 0, err
+    }
+    query := `UPDATE refresh_tokens SET revoked_at = $1 WHERE user_id = $2 AND revoked_at IS NULL`
+    result, err := tx.ExecContext(ctx, query, now, userID)
+    if err != nil {
+        return 0, err
+    }
+    return result.RowsAffected()
+}
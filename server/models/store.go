@@ -0,0 +1,421 @@
+package models
+
+import (
+    "context"
+    "database/sql"
+    "time"
+)
+
+// BookingStore reads and changes bookings
+type BookingStore interface {
+    CreateBooking(ctx context.Context, userID int, pickupLocation, dropoffLocation, vehicleType string, estimatedCost float64, by AuditActor) (int, error)
+    GetBooking(ctx context.Context, bookingID int) (*Booking, error)
+    ListBookings(ctx context.Context, q ListQuery) ([]Booking, string, error)
+    FetchPendingBookings(ctx context.Context) ([]Booking, error)
+    AcceptBooking(ctx context.Context, driverID, bookingID int, by AuditActor) error
+    TransitionBooking(ctx context.Context, bookingID int, to string, actor Actor, actorID int, by AuditActor) error
+    ExpireBookings(ctx context.Context, before time.Time) (int64, error)
+}
+
+// VehicleStore reads and changes the fleet
+type VehicleStore interface {
+    ListVehicles(ctx context.Context, q ListQuery) ([]Vehicle, string, error)
+    GetVehicle(ctx context.Context, vehicleID int) (*Vehicle, error)
+    CreateVehicle(ctx context.Context, vehicleType string, availability bool, by AuditActor) (int, error)
+    UpdateVehicle(ctx context.Context, vehicleID int, update VehicleUpdate, by AuditActor) error
+    RetireVehicle(ctx context.Context, vehicleID int, at time.Time, by AuditActor) error
+    AssignVehicle(ctx context.Context, vehicleID, driverID int, at time.Time, by AuditActor) error
+    UnassignVehicle(ctx context.Context, vehicleID int, at time.Time, by AuditActor) error
+    ListAssignments(ctx context.Context, q ListQuery) ([]VehicleAssignment, string, error)
+}
+
+// UserStore manages accounts. Sessions and roles are included as far as
+// account administration needs them.
+type UserStore interface {
+    RegisterUser(ctx context.Context, username, email, password, role, status string, by AuditActor) (int, error)
+    AuthenticateUser(ctx context.Context, username, password string) (*User, error)
+    GetUser(ctx context.Context, userID int) (*User, error)
+    ListUsers(ctx context.Context, q ListQuery) ([]User, string, error)
+    UpdateUserRole(ctx context.Context, userID int, role string, by AuditActor) error
+    UpdateUserStatus(ctx context.Context, userID int, status string, by AuditActor) error
+    DeleteUser(ctx context.Context, userID int, by AuditActor) error
+    RoleExists(ctx context.Context, role string) (bool, error)
+    RevokeUserSessions(ctx context.Context, userID int, by AuditActor) (int64, error)
+}
+
+// SessionStore keeps the refresh tokens behind login sessions
+type SessionStore interface {
+    CreateRefreshToken(ctx context.Context, userID int, familyID, tokenHash string, expiresAt time.Time) error
+    RotateRefreshToken(ctx context.Context, oldHash, newHash string, expiresAt time.Time) (*User, error)
+    RevokeRefreshToken(ctx context.Context, tokenHash string) error
+    SessionEpoch(ctx context.Context, userID int) (int, error)
+}
+
+// ThrottleStore counts failed logins and password reset requests per key
+type ThrottleStore interface {
+    LoginLockedUntil(ctx context.Context, now time.Time, keys ...string) (time.Time, error)
+    RecordLoginFailure(ctx context.Context, key string, policy ThrottlePolicy, now time.Time) error
+    ClearLoginFailures(ctx context.Context, key string) error
+    FetchActiveLockouts(ctx context.Context, now time.Time) ([]Lockout, error)
+    UnlockUser(ctx context.Context, userID int, by AuditActor) error
+    UnlockIP(ctx context.Context, ip string, by AuditActor) error
+}
+
+// RoleStore defines roles, the permissions they grant and whether they require MFA
+type RoleStore interface {
+    RoleExists(ctx context.Context, role string) (bool, error)
+    FetchRolePermissions(ctx context.Context, role string) ([]string, error)
+    FetchAllRoles(ctx context.Context) ([]Role, error)
+    FetchAllPermissions(ctx context.Context) ([]Permission, error)
+    CreateRole(ctx context.Context, role Role, by AuditActor) error
+    SetRolePermissions(ctx context.Context, role string, permissions []string, by AuditActor) error
+    DeleteRole(ctx context.Context, role string, by AuditActor) error
+    RoleRequiresMFA(ctx context.Context, role string) (bool, error)
+    SetRoleMFARequired(ctx context.Context, role string, required bool, by AuditActor) error
+}
+
+// MFAStore keeps the TOTP enrollments and recovery codes of users
+type MFAStore interface {
+    GetMFAState(ctx context.Context, userID int) (*MFAState, error)
+    StartMFAEnrollment(ctx context.Context, userID int, secret string) error
+    ConfirmMFAEnrollment(ctx context.Context, userID int, step int64, recoveryCodeHashes []string, by AuditActor) error
+    ConsumeMFAStep(ctx context.Context, userID int, step int64) (bool, error)
+    ConsumeRecoveryCode(ctx context.Context, userID int, codeHash string) (bool, error)
+    ReplaceRecoveryCodes(ctx context.Context, userID int, codeHashes []string, by AuditActor) error
+    DisableMFA(ctx context.Context, userID int, by AuditActor) error
+    ResetMFA(ctx context.Context, userID int, by AuditActor) error
+}
+
+// APIKeyStore issues, lists, revokes and resolves API keys
+type APIKeyStore interface {
+    CreateAPIKey(ctx context.Context, key APIKey, keyHash string, by AuditActor) (int, error)
+    CheckAPIKeyScopes(ctx context.Context, scopes, held []string) error
+    CreateServiceAccount(ctx context.Context, username, randomPassword string, by AuditActor) (int, error)
+    FetchAllAPIKeys(ctx context.Context) ([]APIKey, error)
+    RevokeAPIKey(ctx context.Context, keyID int, by AuditActor) error
+    ResolveAPIKey(ctx context.Context, keyHash string, now time.Time) (*APIKey, string, error)
+}
+
+// PasswordStore changes passwords and runs the emailed reset flow
+type PasswordStore interface {
+    ChangePassword(ctx context.Context, userID int, currentPassword, newPassword string, by AuditActor) error
+    FindUserByLogin(ctx context.Context, login string) (*User, error)
+    CreatePasswordResetToken(ctx context.Context, userID int, tokenHash string, expiresAt time.Time) error
+    ResetPassword(ctx context.Context, tokenHash, newPassword string, by AuditActor) (int, error)
+}
+
+// AnalyticsStore computes the figures shown on the admin dashboard
+type AnalyticsStore interface {
+    FetchVehicleStatus(ctx context.Context) (VehicleStatus, error)
+    FetchDriverPerformance(ctx context.Context) ([]DriverPerformance, error)
+    FetchRevenueOverTime(ctx context.Context) ([]RevenueData, error)
+    FetchBookingStatusDistribution(ctx context.Context) ([]BookingStatus, error)
+    FetchBookingsOverTime(ctx context.Context, since time.Time) ([]BookingsOverTime, error)
+    FetchDriverActiveBookings(ctx context.Context) ([]DriverActiveBookings, error)
+}
+
+// AuditStore queries the audit log. Entries are written by the methods of
+// the other stores, together with the change they record.
+type AuditStore interface {
+    QueryAudit(ctx context.Context, filter AuditFilter) ([]AuditEntry, error)
+}
+
+// SQLStore implements the stores on top of the database, using the package
+// functions that take a *sql.DB
+type SQLStore struct {
+    DB      *sql.DB
+    Dialect Dialect
+}
+
+var (
+    _ BookingStore   = (*SQLStore)(nil)
+    _ VehicleStore   = (*SQLStore)(nil)
+    _ UserStore      = (*SQLStore)(nil)
+    _ SessionStore   = (*SQLStore)(nil)
+    _ ThrottleStore  = (*SQLStore)(nil)
+    _ RoleStore      = (*SQLStore)(nil)
+    _ MFAStore       = (*SQLStore)(nil)
+    _ APIKeyStore    = (*SQLStore)(nil)
+    _ PasswordStore  = (*SQLStore)(nil)
+    _ AnalyticsStore = (*SQLStore)(nil)
+    _ AuditStore     = (*SQLStore)(nil)
+)
+
+// NewPostgresStore returns the stores backed by a Postgres database
+func NewPostgresStore(db *sql.DB) *SQLStore {
+    return &SQLStore{DB: db, Dialect: DialectPostgres}
+}
+
+// NewSQLiteStore returns the stores backed by a SQLite database, for local
+// development and tests
+func NewSQLiteStore(db *sql.DB) *SQLStore {
+    return &SQLStore{DB: db, Dialect: DialectSQLite}
+}
+
+func (s *SQLStore) CreateBooking(ctx context.Context, userID int, pickupLocation, dropoffLocation, vehicleType string, estimatedCost float64, by AuditActor) (int, error) {
+    return CreateBooking(ctx, s.DB, userID, pickupLocation, dropoffLocation, vehicleType, estimatedCost, by)
+}
+
+func (s *SQLStore) GetBooking(ctx context.Context, bookingID int) (*Booking, error) {
+    return GetBooking(ctx, s.DB, bookingID)
+}
+
+func (s *SQLStore) ListBookings(ctx context.Context, q ListQuery) ([]Booking, string, error) {
+    return ListBookings(ctx, s.DB, s.Dialect, q)
+}
+
+func (s *SQLStore) FetchPendingBookings(ctx context.Context) ([]Booking, error) {
+    return FetchPendingBookings(ctx, s.DB)
+}
+
+func (s *SQLStore) AcceptBooking(ctx context.Context, driverID, bookingID int, by AuditActor) error {
+    return AcceptBooking(ctx, s.DB, driverID, bookingID, by)
+}
+
+func (s *SQLStore) TransitionBooking(ctx context.Context, bookingID int, to string, actor Actor, actorID int, by AuditActor) error {
+    return TransitionBooking(ctx, s.DB, bookingID, to, actor, actorID, by)
+}
+
+func (s *SQLStore) ExpireBookings(ctx context.Context, before time.Time) (int64, error) {
+    return ExpireBookings(ctx, s.DB, s.Dialect, before)
+}
+
+func (s *SQLStore) ListVehicles(ctx context.Context, q ListQuery) ([]Vehicle, string, error) {
+    return ListVehicles(ctx, s.DB, s.Dialect, q)
+}
+
+func (s *SQLStore) GetVehicle(ctx context.Context, vehicleID int) (*Vehicle, error) {
+    return GetVehicle(ctx, s.DB, vehicleID)
+}
+
+func (s *SQLStore) CreateVehicle(ctx context.Context, vehicleType string, availability bool, by AuditActor) (int, error) {
+    return CreateVehicle(ctx, s.DB, vehicleType, availability, by)
+}
+
+func (s *SQLStore) UpdateVehicle(ctx context.Context, vehicleID int, update VehicleUpdate, by AuditActor) error {
+    return UpdateVehicle(ctx, s.DB, vehicleID, update, by)
+}
+
+func (s *SQLStore) RetireVehicle(ctx context.Context, vehicleID int, at time.Time, by AuditActor) error {
+    return RetireVehicle(ctx, s.DB, vehicleID, at, by)
+}
+
+func (s *SQLStore) AssignVehicle(ctx context.Context, vehicleID, driverID int, at time.Time, by AuditActor) error {
+    return AssignVehicle(ctx, s.DB, vehicleID, driverID, at, by)
+}
+
+func (s *SQLStore) UnassignVehicle(ctx context.Context, vehicleID int, at time.Time, by AuditActor) error {
+    return UnassignVehicle(ctx, s.DB, vehicleID, at, by)
+}
+
+func (s *SQLStore) ListAssignments(ctx context.Context, q ListQuery) ([]VehicleAssignment, string, error) {
+    return ListAssignments(ctx, s.DB, s.Dialect, q)
+}
+
+func (s *SQLStore) RegisterUser(ctx context.Context, username, email, password, role, status string, by AuditActor) (int, error) {
+    return RegisterUser(ctx, s.DB, username, email, password, role, status, by)
+}
+
+func (s *SQLStore) AuthenticateUser(ctx context.Context, username, password string) (*User, error) {
+    return AuthenticateUser(ctx, s.DB, username, password)
+}
+
+func (s *SQLStore) GetUser(ctx context.Context, userID int) (*User, error) {
+    return GetUser(ctx, s.DB, userID)
+}
+
+func (s *SQLStore) ListUsers(ctx context.Context, q ListQuery) ([]User, string, error) {
+    return ListUsers(ctx, s.DB, s.Dialect, q)
+}
+
+func (s *SQLStore) UpdateUserRole(ctx context.Context, userID int, role string, by AuditActor) error {
+    return UpdateUserRole(ctx, s.DB, userID, role, by)
+}
+
+func (s *SQLStore) UpdateUserStatus(ctx context.Context, userID int, status string, by AuditActor) error {
+    return UpdateUserStatus(ctx, s.DB, userID, status, by)
+}
+
+func (s *SQLStore) DeleteUser(ctx context.Context, userID int, by AuditActor) error {
+    return DeleteUser(ctx, s.DB, userID, by)
+}
+
+func (s *SQLStore) RoleExists(ctx context.Context, role string) (bool, error) {
+    return RoleExists(ctx, s.DB, role)
+}
+
+func (s *SQLStore) RevokeUserSessions(ctx context.Context, userID int, by AuditActor) (int64, error) {
+    return RevokeUserSessions(ctx, s.DB, userID, by)
+}
+
+func (s *SQLStore) CreateRefreshToken(ctx context.Context, userID int, familyID, tokenHash string, expiresAt time.Time) error {
+    return CreateRefreshToken(ctx, s.DB, userID, familyID, tokenHash, expiresAt)
+}
+
+func (s *SQLStore) RotateRefreshToken(ctx context.Context, oldHash, newHash string, expiresAt time.Time) (*User, error) {
+    return RotateRefreshToken(ctx, s.DB, oldHash, newHash, expiresAt)
+}
+
+func (s *SQLStore) RevokeRefreshToken(ctx context.Context, tokenHash string) error {
+    return RevokeRefreshToken(ctx, s.DB, tokenHash)
+}
+
+func (s *SQLStore) SessionEpoch(ctx context.Context, userID int) (int, error) {
+    return SessionEpoch(ctx, s.DB, userID)
+}
+
+func (s *SQLStore) LoginLockedUntil(ctx context.Context, now time.Time, keys ...string) (time.Time, error) {
+    return LoginLockedUntil(ctx, s.DB, now, keys...)
+}
+
+func (s *SQLStore) RecordLoginFailure(ctx context.Context, key string, policy ThrottlePolicy, now time.Time) error {
+    return RecordLoginFailure(ctx, s.DB, key, policy, now)
+}
+
+func (s *SQLStore) ClearLoginFailures(ctx context.Context, key string) error {
+    return ClearLoginFailures(ctx, s.DB, key)
+}
+
+func (s *SQLStore) FetchActiveLockouts(ctx context.Context, now time.Time) ([]Lockout, error) {
+    return FetchActiveLockouts(ctx, s.DB, now)
+}
+
+func (s *SQLStore) UnlockUser(ctx context.Context, userID int, by AuditActor) error {
+    return UnlockUser(ctx, s.DB, userID, by)
+}
+
+func (s *SQLStore) UnlockIP(ctx context.Context, ip string, by AuditActor) error {
+    return UnlockIP(ctx, s.DB, ip, by)
+}
+
+func (s *SQLStore) FetchRolePermissions(ctx context.Context, role string) ([]string, error) {
+    return FetchRolePermissions(ctx, s.DB, role)
+}
+
+func (s *SQLStore) FetchAllRoles(ctx context.Context) ([]Role, error) {
+    return FetchAllRoles(ctx, s.DB)
+}
+
+func (s *SQLStore) FetchAllPermissions(ctx context.Context) ([]Permission, error) {
+    return FetchAllPermissions(ctx, s.DB)
+}
+
+func (s *SQLStore) CreateRole(ctx context.Context, role Role, by AuditActor) error {
+    return CreateRole(ctx, s.DB, role, by)
+}
+
+func (s *SQLStore) SetRolePermissions(ctx context.Context, role string, permissions []string, by AuditActor) error {
+    return SetRolePermissions(ctx, s.DB, role, permissions, by)
+}
+
+func (s *SQLStore) DeleteRole(ctx context.Context, role string, by AuditActor) error {
+    return DeleteRole(ctx, s.DB, role, by)
+}
+
+func (s *SQLStore) RoleRequiresMFA(ctx context.Context, role string) (bool, error) {
+    return RoleRequiresMFA(ctx, s.DB, role)
+}
+
+func (s *SQLStore) SetRoleMFARequired(ctx context.Context, role string, required bool, by AuditActor) error {
+    return SetRoleMFARequired(ctx, s.DB, role, required, by)
+}
+
+func (s *SQLStore) GetMFAState(ctx context.Context, userID int) (*MFAState, error) {
+    return GetMFAState(ctx, s.DB, userID)
+}
+
+func (s *SQLStore) StartMFAEnrollment(ctx context.Context, userID int, secret string) error {
+    return StartMFAEnrollment(ctx, s.DB, userID, secret)
+}
+
+func (s *SQLStore) ConfirmMFAEnrollment(ctx context.Context, userID int, step int64, recoveryCodeHashes []string, by AuditActor) error {
+    return ConfirmMFAEnrollment(ctx, s.DB, userID, step, recoveryCodeHashes, by)
+}
+
+func (s *SQLStore) ConsumeMFAStep(ctx context.Context, userID int, step int64) (bool, error) {
+    return ConsumeMFAStep(ctx, s.DB, userID, step)
+}
+
+func (s *SQLStore) ConsumeRecoveryCode(ctx context.Context, userID int, codeHash string) (bool, error) {
+    return ConsumeRecoveryCode(ctx, s.DB, userID, codeHash)
+}
+
+func (s *SQLStore) ReplaceRecoveryCodes(ctx context.Context, userID int, codeHashes []string, by AuditActor) error {
+    return ReplaceRecoveryCodes(ctx, s.DB, userID, codeHashes, by)
+}
+
+func (s *SQLStore) DisableMFA(ctx context.Context, userID int, by AuditActor) error {
+    return DisableMFA(ctx, s.DB, userID, by)
+}
+
+func (s *SQLStore) ResetMFA(ctx context.Context, userID int, by AuditActor) error {
+    return ResetMFA(ctx, s.DB, userID, by)
+}
+
+func (s *SQLStore) CreateAPIKey(ctx context.Context, key APIKey, keyHash string, by AuditActor) (int, error) {
+    return CreateAPIKey(ctx, s.DB, key, keyHash, by)
+}
+
+func (s *SQLStore) CheckAPIKeyScopes(ctx context.Context, scopes, held []string) error {
+    return CheckAPIKeyScopes(ctx, s.DB, scopes, held)
+}
+
+func (s *SQLStore) CreateServiceAccount(ctx context.Context, username, randomPassword string, by AuditActor) (int, error) {
+    return CreateServiceAccount(ctx, s.DB, username, randomPassword, by)
+}
+
+func (s *SQLStore) FetchAllAPIKeys(ctx context.Context) ([]APIKey, error) {
+    return FetchAllAPIKeys(ctx, s.DB)
+}
+
+func (s *SQLStore) RevokeAPIKey(ctx context.Context, keyID int, by AuditActor) error {
+    return RevokeAPIKey(ctx, s.DB, keyID, by)
+}
+
+func (s *SQLStore) ResolveAPIKey(ctx context.Context, keyHash string, now time.Time) (*APIKey, string, error) {
+    return ResolveAPIKey(ctx, s.DB, keyHash, now)
+}
+
+func (s *SQLStore) ChangePassword(ctx context.Context, userID int, currentPassword, newPassword string, by AuditActor) error {
+    return ChangePassword(ctx, s.DB, userID, currentPassword, newPassword, by)
+}
+
+func (s *SQLStore) FindUserByLogin(ctx context.Context, login string) (*User, error) {
+    return FindUserByLogin(ctx, s.DB, login)
+}
+
+func (s *SQLStore) CreatePasswordResetToken(ctx context.Context, userID int, tokenHash string, expiresAt time.Time) error {
+    return CreatePasswordResetToken(ctx, s.DB, userID, tokenHash, expiresAt)
+}
+
+func (s *SQLStore) ResetPassword(ctx context.Context, tokenHash, newPassword string, by AuditActor) (int, error) {
+    return ResetPassword(ctx, s.DB, tokenHash, newPassword, by)
+}
+
+func (s *SQLStore) FetchVehicleStatus(ctx context.Context) (VehicleStatus, error) {
+    return FetchVehicleStatus(ctx, s.DB)
+}
+
+func (s *SQLStore) FetchDriverPerformance(ctx context.Context) ([]DriverPerformance, error) {
+    return FetchDriverPerformance(ctx, s.DB)
+}
+
+func (s *SQLStore) FetchRevenueOverTime(ctx context.Context) ([]RevenueData, error) {
+    return FetchRevenueOverTime(ctx, s.DB, s.Dialect)
+}
+
+func (s *SQLStore) FetchBookingStatusDistribution(ctx context.Context) ([]BookingStatus, error) {
+    return FetchBookingStatusDistribution(ctx, s.DB)
+}
+
+func (s *SQLStore) FetchBookingsOverTime(ctx context.Context, since time.Time) ([]BookingsOverTime, error) {
+    return FetchBookingsOverTime(ctx, s.DB, s.Dialect, since)
+}
+
+func (s *SQLStore) FetchDriverActiveBookings(ctx context.Context) ([]DriverActiveBookings, error) {
+    return FetchDriverActiveBookings(ctx, s.DB)
+}
+
+func (s *SQLStore) QueryAudit(ctx context.Context, filter AuditFilter) ([]AuditEntry, error) {
+    return QueryAudit(ctx, s.DB, filter)
+}
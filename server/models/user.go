@@ -1,46 +1,300 @@
 package models
 
 import (
+    "context"
     "database/sql"
+    "errors"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/lib/pq"
     "golang.org/x/crypto/bcrypt"
 )
 
+// Built-in roles. Further roles can be defined by admins, see role.go.
+const (
+    RoleAdmin   = "admin"
+    RoleDriver  = "driver"
+    RoleUser    = "user"
+    // RoleService is held by the service accounts API keys act as
+    RoleService = "service"
+)
+
+// Account states. Self-registered drivers start out pending until an admin approves them.
+const (
+    UserStatusActive   = "active"
+    UserStatusPending  = "pending"
+    UserStatusDisabled = "disabled"
+)
+
+var (
+    ErrUserNotFound       = NotFound("user_not_found", "user not found")
+    ErrInvalidCredentials = Unauthorized("invalid_credentials", "invalid credentials")
+    ErrUsernameTaken      = Conflict("username_taken", "username or email already taken")
+    ErrAccountNotActive   = Forbidden("account_not_active", "account is not active")
+    ErrUserInUse          = Conflict("user_in_use", "user has bookings or vehicle assignments; disable the account instead")
+)
+
 type User struct {
-    ID       int
-    Username string
-    Password string
-    Role     string
+    ID         int     `json:"id"`
+    Username   string  `json:"username"`
+    Email      *string `json:"email"`
+    Password   string  `json:"-"`
+    Role       string  `json:"role"`
+    Status     string  `json:"status"`
+    MFAEnabled bool    `json:"mfa_enabled"`
+    // SessionEpoch is carried by access tokens, see RevokeUserSessions
+    SessionEpoch int `json:"-"`
 }
 
-// Register a new user
-func RegisterUser(db *sql.DB, username, password, role string) error {
-    hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+// ValidUserStatus reports whether status is one of the known account states
+func ValidUserStatus(status string) bool {
+    switch status {
+    case UserStatusActive, UserStatusPending, UserStatusDisabled:
+        return true
+    }
+    return false
+}
+
+// Register a new user and return its ID. The email is optional and only used
+// for password resets. by is who creates the account; without a user, as on
+// sign-up, the new account is recorded as its own actor.
+func RegisterUser(ctx context.Context, db *sql.DB, username, email, password, role, status string, by AuditActor) (int, error) {
+    hashedPassword, err := hashPassword(ctx, password)
     if err != nil {
-        return err
+        return 0, err
     }
 
-    query := `INSERT INTO users (username, password, role) VALUES ($1, $2, $3)`
-    _, err = db.Exec(query, username, hashedPassword, role)
+    tx, err := db.BeginTx(ctx, nil)
     if err != nil {
-        return err
+        return 0, err
     }
+    defer tx.Rollback()
 
-    return nil
+    var userID int
+    query := `INSERT INTO users (username, email, password, role, status) VALUES ($1, $2, $3, $4, $5) RETURNING id`
+    err = tx.QueryRowContext(ctx, query, username, nullIfEmpty(NormalizeEmail(email)), hashedPassword, role, status).Scan(&userID)
+    if isUniqueViolation(err) {
+        return 0, ErrUsernameTaken
+    }
+    if err != nil {
+        return 0, err
+    }
+
+    after, err := getUser(ctx, tx, userID)
+    if err != nil {
+        return 0, err
+    }
+    action := "user.create"
+    if by.UserID == nil {
+        action = "user.register"
+        by.UserID, by.Role = &userID, &role
+    }
+    if err := recordChange(ctx, tx, by, action, "user", userID, nil, after); err != nil {
+        return 0, err
+    }
+    return userID, tx.Commit()
 }
 
-// Authenticate a user
-func AuthenticateUser(db *sql.DB, username, password string) (*User, error) {
+// Authenticate a user. Only active accounts may log in. Unknown usernames and
+// wrong passwords both return ErrInvalidCredentials after a bcrypt comparison,
+// so neither the error nor the response time reveals which accounts exist.
+func AuthenticateUser(ctx context.Context, db *sql.DB, username, password string) (*User, error) {
     user := &User{}
-    query := `SELECT id, username, password, role FROM users WHERE username=$1`
-    err := db.QueryRow(query, username).Scan(&user.ID, &user.Username, &user.Password, &user.Role)
+    query := `SELECT id, username, password, role, status, mfa_enabled, session_epoch FROM users WHERE username=$1`
+    err := db.QueryRowContext(ctx, query, username).Scan(&user.ID, &user.Username, &user.Password, &user.Role, &user.Status, &user.MFAEnabled, &user.SessionEpoch)
+    if errors.Is(err, sql.ErrNoRows) {
+        comparePassword(ctx, dummyPasswordHash(), password)
+        return nil, ErrInvalidCredentials
+    }
     if err != nil {
         return nil, err
     }
 
-    err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password))
+    err = comparePassword(ctx, []byte(user.Password), password)
     if err != nil {
-        return nil, err
+        return nil, ErrInvalidCredentials
+    }
+
+    if user.Status != UserStatusActive {
+        return nil, ErrAccountNotActive
     }
 
     return user, nil
 }
+
+var (
+    dummyHashOnce sync.Once
+    dummyHash     []byte
+)
+
+// dummyPasswordHash returns a hash with the default cost to compare against
+// when the username doesn't exist
+func dummyPasswordHash() []byte {
+    dummyHashOnce.Do(func() {
+        dummyHash, _ = bcrypt.GenerateFromPassword([]byte("fleetfy-dummy-password"), bcrypt.DefaultCost)
+    })
+    return dummyHash
+}
+
+// GetUser fetches a single user by ID
+func GetUser(ctx context.Context, db *sql.DB, userID int) (*User, error) {
+    return getUser(ctx, db, userID)
+}
+
+func getUser(ctx context.Context, q querier, userID int) (*User, error) {
+    user := &User{}
+    query := `SELECT id, username, email, role, status, mfa_enabled, session_epoch FROM users WHERE id = $1`
+    err := q.QueryRowContext(ctx, query, userID).Scan(&user.ID, &user.Username, &user.Email, &user.Role, &user.Status, &user.MFAEnabled, &user.SessionEpoch)
+    if errors.Is(err, sql.ErrNoRows) {
+        return nil, ErrUserNotFound
+    }
+    if err != nil {
+        return nil, err
+    }
+    return user, nil
+}
+
+// ListUsers returns a page of accounts and the cursor of the next page, which
+// is empty on the last page
+func ListUsers(ctx context.Context, db *sql.DB, d Dialect, q ListQuery) ([]User, string, error) {
+    clause, args := q.sql(UserListSpec, d)
+    rows, err := db.QueryContext(ctx, `SELECT id, username, email, role, status, mfa_enabled FROM users`+clause, args...)
+    if err != nil {
+        return nil, "", err
+    }
+    defer rows.Close()
+
+    users := []User{}
+    for rows.Next() {
+        var u User
+        if err := rows.Scan(&u.ID, &u.Username, &u.Email, &u.Role, &u.Status, &u.MFAEnabled); err != nil {
+            return nil, "", err
+        }
+        users = append(users, u)
+    }
+    if err := rows.Err(); err != nil {
+        return nil, "", err
+    }
+
+    users, next := nextPage(users, q)
+    return users, next, nil
+}
+
+// UpdateUserRole changes the role of a user and ends their sessions, so the
+// new role takes effect on the next login
+func UpdateUserRole(ctx context.Context, db *sql.DB, userID int, role string, by AuditActor) error {
+    return changeUser(ctx, db, userID, by, "user.role_update", func(tx *sql.Tx, now time.Time) error {
+        if _, err := tx.ExecContext(ctx, `UPDATE users SET role = $1 WHERE id = $2`, role, userID); err != nil {
+            return err
+        }
+        _, err := revokeUserSessions(ctx, tx, userID, now)
+        return err
+    })
+}
+
+// UpdateUserStatus changes the account state of a user. Accounts that are
+// no longer active lose their sessions.
+func UpdateUserStatus(ctx context.Context, db *sql.DB, userID int, status string, by AuditActor) error {
+    return changeUser(ctx, db, userID, by, "user.status_update", func(tx *sql.Tx, now time.Time) error {
+        if _, err := tx.ExecContext(ctx, `UPDATE users SET status = $1 WHERE id = $2`, status, userID); err != nil {
+            return err
+        }
+        if status == UserStatusActive {
+            return nil
+        }
+        _, err := revokeUserSessions(ctx, tx, userID, now)
+        return err
+    })
+}
+
+// changeUser runs change on an existing user in a transaction and records
+// it as action, with the user as it was before and after
+func changeUser(ctx context.Context, db *sql.DB, userID int, by AuditActor, action string, change func(tx *sql.Tx, now time.Time) error) error {
+    tx, err := db.BeginTx(ctx, nil)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    before, err := getUser(ctx, tx, userID)
+    if err != nil {
+        return err
+    }
+    if err := change(tx, time.Now().UTC()); err != nil {
+        return err
+    }
+    after, err := getUser(ctx, tx, userID)
+    if err != nil {
+        return err
+    }
+    if err := recordChange(ctx, tx, by, action, "user", userID, before, after); err != nil {
+        return err
+    }
+    return tx.Commit()
+}
+
+// DeleteUser removes a user account
+func DeleteUser(ctx context.Context, db *sql.DB, userID int, by AuditActor) error {
+    tx, err := db.BeginTx(ctx, nil)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    before, err := getUser(ctx, tx, userID)
+    if err != nil {
+        return err
+    }
+    result, err := tx.ExecContext(ctx, `DELETE FROM users WHERE id = $1`, userID)
+    if isForeignKeyViolation(err) {
+        return ErrUserInUse
+    }
+    if err := expectAffected(result, err, ErrUserNotFound); err != nil {
+        return err
+    }
+    if err := recordChange(ctx, tx, by, "user.delete", "user", userID, before, nil); err != nil {
+        return err
+    }
+    return tx.Commit()
+}
+
+// NormalizeEmail lowercases and trims an email address so lookups are case-insensitive
+func NormalizeEmail(email string) string {
+    return strings.ToLower(strings.TrimSpace(email))
+}
+
+func nullIfEmpty(s string) interface{} {
+    if s == "" {
+        return nil
+    }
+    return s
+}
+
+// expectAffected turns an update that touched no rows into notFound
+func expectAffected(result sql.Result, err error, notFound error) error {
+    if err != nil {
+        return err
+    }
+    rowsAffected, err := result.RowsAffected()
+    if err != nil {
+        return err
+    }
+    if rowsAffected == 0 {
+        return notFound
+    }
+    return nil
+}
+
+// isUniqueViolation reports whether err is a unique constraint violation
+func isUniqueViolation(err error) bool {
+    var pqErr *pq.Error
+    return (errors.As(err, &pqErr) && pqErr.Code == "23505") || isSQLiteUniqueViolation(err)
+}
+
+// isForeignKeyViolation reports whether err is a foreign key constraint violation
+func isForeignKeyViolation(err error) bool {
+    var pqErr *pq.Error
+    return (errors.As(err, &pqErr) && pqErr.Code == "23503") || isSQLiteForeignKeyViolation(err)
+}
@@ -1,56 +1,181 @@
 package models
 
 import (
+    "context"
     "database/sql"
-	"log"
+    "errors"
+    "time"
+
+    "fmc/logging"
+)
+
+var (
+    ErrVehicleNotFound = NotFound("vehicle_not_found", "vehicle not found")
+    ErrVehicleRetired  = Conflict("vehicle_retired", "vehicle is retired")
+    ErrVehicleInUse    = Conflict("vehicle_in_use", "vehicle is in use by an active booking")
 )
 
-// Vehicle represents a vehicle in the fleet
+// Vehicle types, from the smallest load to the largest. Bookings ask for one
+// of them and vehicles are one of them.
+const (
+    VehicleSmall  = "small"
+    VehicleMedium = "medium"
+    VehicleLarge  = "large"
+)
+
+// Vehicle represents a vehicle in the fleet. Retired vehicles are kept for
+// the bookings that reference them but are no longer part of the fleet.
 type Vehicle struct {
-    ID          int    `json:"id"`
-    Type        string `json:"type"`
-    Availability bool   `json:"availability"`
-    DriverID    *int    `json:"driver_id"`
+    ID           int        `json:"id"`
+    Type         string     `json:"type"`
+    Availability bool       `json:"availability"`
+    DriverID     *int       `json:"driver_id"`
+    RetiredAt    *time.Time `json:"retired_at"`
 }
 
-// FetchAllVehicles fetches all vehicles from the database
-func FetchAllVehicles(db *sql.DB) ([]Vehicle, error) {
-    log.Println("Fetching all vehicles...")
+// VehicleUpdate changes the fields of a vehicle that aren't nil
+type VehicleUpdate struct {
+    Type         *string
+    Availability *bool
+}
 
-    rows, err := db.Query(`SELECT id, type, availability, driver_id FROM vehicles`)
-    if err != nil {
-        log.Printf("Error executing query: %v", err)
+const vehicleColumns = `id, type, availability, driver_id, retired_at`
+
+func scanVehicle(row rowScanner) (*Vehicle, error) {
+    var v Vehicle
+    if err := row.Scan(&v.ID, &v.Type, &v.Availability, &v.DriverID, &v.RetiredAt); err != nil {
         return nil, err
     }
+    return &v, nil
+}
+
+// ListVehicles returns a page of the fleet and the cursor of the next page,
+// which is empty on the last page. Retired vehicles aren't listed.
+func ListVehicles(ctx context.Context, db *sql.DB, d Dialect, q ListQuery) ([]Vehicle, string, error) {
+    clause, args := q.sql(VehicleListSpec, d)
+    rows, err := db.QueryContext(ctx, `SELECT `+vehicleColumns+` FROM vehicles`+clause, args...)
+    if err != nil {
+        return nil, "", err
+    }
     defer rows.Close()
 
     vehicles := []Vehicle{}
     for rows.Next() {
-        var v Vehicle
-        err := rows.Scan(&v.ID, &v.Type, &v.Availability, &v.DriverID)
+        v, err := scanVehicle(rows)
         if err != nil {
-            log.Printf("Error scanning row: %v", err)
-            return nil, err
+            return nil, "", err
         }
-        log.Printf("Vehicle fetched: %+v", v) // Logging each vehicle fetched
-        vehicles = append(vehicles, v)
+        vehicles = append(vehicles, *v)
     }
 
     // Check for errors after iterating over rows
     if err = rows.Err(); err != nil {
-        log.Printf("Error during row iteration: %v", err)
-        return nil, err
+        return nil, "", err
     }
 
-    log.Printf("Total vehicles fetched: %d", len(vehicles))
-    return vehicles, nil
+    vehicles, next := nextPage(vehicles, q)
+    logging.FromContext(ctx).Debug("Fetched vehicles", "count", len(vehicles))
+    return vehicles, next, nil
 }
-func CreateVehicle(db *sql.DB, vehicleType string, availability bool) (int, error) {
+
+func CreateVehicle(ctx context.Context, db *sql.DB, vehicleType string, availability bool, by AuditActor) (int, error) {
+    tx, err := db.BeginTx(ctx, nil)
+    if err != nil {
+        return 0, err
+    }
+    defer tx.Rollback()
+
     var vehicleID int
     query := `INSERT INTO vehicles (type, availability) VALUES ($1, $2) RETURNING id`
-    err := db.QueryRow(query, vehicleType, availability).Scan(&vehicleID)
+    err = tx.QueryRowContext(ctx, query, vehicleType, availability).Scan(&vehicleID)
     if err != nil {
         return 0, err
     }
-    return vehicleID, nil
-}
\ No newline at end of file
+
+    after, err := getVehicle(ctx, tx, vehicleID)
+    if err != nil {
+        return 0, err
+    }
+    if err := recordChange(ctx, tx, by, "vehicle.create", "vehicle", vehicleID, nil, after); err != nil {
+        return 0, err
+    }
+    return vehicleID, tx.Commit()
+}
+
+// GetVehicle fetches a single vehicle by ID, retired or not
+func GetVehicle(ctx context.Context, db *sql.DB, vehicleID int) (*Vehicle, error) {
+    return getVehicle(ctx, db, vehicleID)
+}
+
+func getVehicle(ctx context.Context, q querier, vehicleID int) (*Vehicle, error) {
+    v, err := scanVehicle(q.QueryRowContext(ctx, `SELECT `+vehicleColumns+` FROM vehicles WHERE id = $1`, vehicleID))
+    if errors.Is(err, sql.ErrNoRows) {
+        return nil, ErrVehicleNotFound
+    }
+    return v, err
+}
+
+// UpdateVehicle changes the type or availability of a vehicle in the fleet.
+// A vehicle busy with a booking can't be changed until the booking ends.
+func UpdateVehicle(ctx context.Context, db *sql.DB, vehicleID int, update VehicleUpdate, by AuditActor) error {
+    return changeVehicle(ctx, db, vehicleID, ErrVehicleInUse, by, "vehicle.update", `
+        UPDATE vehicles SET type = COALESCE($1, type), availability = COALESCE($2, availability)
+        WHERE id = $3 AND retired_at IS NULL AND NOT `+vehicleBusy, update.Type, update.Availability, vehicleID)
+}
+
+// RetireVehicle takes a vehicle without a driver out of the fleet
+func RetireVehicle(ctx context.Context, db *sql.DB, vehicleID int, at time.Time, by AuditActor) error {
+    return changeVehicle(ctx, db, vehicleID, ErrVehicleAssigned, by, "vehicle.retire", `
+        UPDATE vehicles SET retired_at = $1
+        WHERE id = $2 AND retired_at IS NULL AND driver_id IS NULL`, at.UTC(), vehicleID)
+}
+
+// changeVehicle runs an update of one vehicle and records it as action. An
+// update that matches no row fails with the error of vehicleStateError.
+func changeVehicle(ctx context.Context, db *sql.DB, vehicleID int, stateErr error, by AuditActor, action, query string, args ...interface{}) error {
+    tx, err := db.BeginTx(ctx, nil)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    before, err := getVehicle(ctx, tx, vehicleID)
+    if err != nil {
+        return err
+    }
+    result, err := tx.ExecContext(ctx, query, args...)
+    err = expectAffected(result, err, stateErr)
+    if errors.Is(err, stateErr) {
+        tx.Rollback()
+        return vehicleStateError(ctx, db, vehicleID, err)
+    }
+    if err != nil {
+        return err
+    }
+
+    after, err := getVehicle(ctx, tx, vehicleID)
+    if err != nil {
+        return err
+    }
+    if err := recordChange(ctx, tx, by, action, "vehicle", vehicleID, before, after); err != nil {
+        return err
+    }
+    return tx.Commit()
+}
+
+// vehicleBusy is an SQL condition on the vehicles table that holds while the
+// vehicle is on an active booking
+var vehicleBusy = `EXISTS (SELECT 1 FROM bookings WHERE bookings.vehicle_id = vehicles.id AND bookings.status IN ` + activeBookingStatuses + `)`
+
+// vehicleStateError explains why a change of a vehicle matched no row: the
+// vehicle doesn't exist or is retired, or else stateErr
+func vehicleStateError(ctx context.Context, db *sql.DB, vehicleID int, stateErr error) error {
+    v, err := GetVehicle(ctx, db, vehicleID)
+    if err != nil {
+        return err
+    }
+    if v.RetiredAt != nil {
+        return ErrVehicleRetired
+    }
+    return stateErr
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "fmc/auth"
+    "fmc/config"
+    "fmc/handler"
+    "fmc/mailer"
+    "fmc/metrics"
+    "fmc/middleware"
+    "fmc/models"
+    "fmc/tracing"
+    "fmt"
+    "log/slog"
+    "net/http"
+
+    "github.com/gorilla/mux"
+    "github.com/gorilla/handlers"
+    "go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+// NewRouter builds the complete HTTP API on top of a migrated database. Every
+// request is logged to logger.
+func NewRouter(cfg *config.Config, db *sql.DB, logger *slog.Logger) (http.Handler, error) {
+    // Access tokens are signed with a shared secret so every instance behind the load balancer accepts them
+    tokens, err := auth.NewTokenManager(cfg.Auth.JWTSecret, cfg.Auth.AccessTokenTTL, cfg.Auth.RefreshTokenTTL)
+    if err != nil {
+        return nil, fmt.Errorf("configuring access tokens: %w", err)
+    }
+
+    // Password reset links are delivered by mail; the log mailer is enough for local development
+    mail, err := mailer.New(cfg.Mail.Mailer, cfg.Mail.Dir, cfg.Mail.SMTPAddr, cfg.Mail.SMTPUsername, cfg.Mail.SMTPPassword, cfg.Mail.From)
+    if err != nil {
+        return nil, fmt.Errorf("configuring mailer: %w", err)
+    }
+    passwordReset := handler.PasswordReset{Mailer: mail, URL: cfg.Mail.PasswordResetURL, TTL: cfg.Mail.PasswordResetTTL}
+
+    // Handlers reach the database only through these stores
+    store := newStore(cfg, db)
+
+    // Initialize the router
+    r := mux.NewRouter()
+
+    // Only nginx may tell us the real client address
+    trustedProxies, err := middleware.ParseTrustedProxies(cfg.TrustedProxies)
+    if err != nil {
+        return nil, fmt.Errorf("parsing TRUSTED_PROXIES: %w", err)
+    }
+
+    // Apply global middleware
+    r.Use(tracing.Route)
+    r.Use(metrics.Instrument)
+
+    // Unknown paths and methods get the same JSON errors as everything else
+    r.NotFoundHandler = handler.NotFoundHandler()
+    r.MethodNotAllowedHandler = handler.MethodNotAllowedHandler()
+
+    // Probes for nginx and the deploy scripts; they need no credentials
+    r.HandleFunc("/healthz", handler.HealthzHandler()).Methods("GET")
+    r.HandleFunc("/readyz", handler.ReadyzHandler(db, cfg.Database.Driver)).Methods("GET")
+
+    // Prometheus scrapes request latency, the connection pool and booking figures
+    r.Handle("/metrics", metrics.Handler(metrics.NewRegistry(db, store), cfg.MetricsToken)).Methods("GET")
+
+    // Permissions are granted to roles in the database and access tokens are
+    // checked against the session epoch of their user; cache both briefly per instance
+    authz := auth.NewAuthorizer(func(ctx context.Context, role string) ([]string, error) {
+        return store.FetchRolePermissions(ctx, role)
+    }, handler.SessionEpochLoader(store), cfg.Auth.PermissionCacheTTL)
+
+    // Authentication routes (User registration and login)
+    r.HandleFunc("/register", handler.RegisterHandler(store)).Methods("POST")
+    r.HandleFunc("/login", handler.LoginHandler(store, store, store, store, tokens, models.DefaultLoginThrottle)).Methods("POST")
+    r.HandleFunc("/login/mfa", handler.LoginMFAHandler(store, store, store, store, tokens, models.DefaultLoginThrottle)).Methods("POST")  // Second login step for accounts with MFA
+    r.HandleFunc("/refresh", handler.RefreshHandler(store, store, tokens)).Methods("POST")
+    r.HandleFunc("/logout", handler.LogoutHandler(store)).Methods("POST")
+    r.HandleFunc("/password/forgot", handler.ForgotPasswordHandler(store, store, passwordReset, models.DefaultPasswordResetThrottle)).Methods("POST")
+    r.HandleFunc("/password/reset", handler.ResetPasswordHandler(store, store, store, authz)).Methods("POST")
+
+    // can wraps a handler so it only runs for principals whose role grants the permission
+    can := func(permission string, h http.HandlerFunc) http.Handler {
+        return middleware.RequirePermission(authz, permission)(h)
+    }
+
+    // Routes for any logged in account. MFA enrollment also accepts the limited
+    // token given to accounts whose role requires MFA but that haven't enrolled yet.
+    // API keys are only accepted on the role-protected API, not on account routes.
+    session := middleware.Authenticate(tokens, authz, nil)
+    sessionOrAPIKey := middleware.Authenticate(tokens, authz, handler.APIKeyResolver(store))
+    enrolling := middleware.AuthenticateEnrollment(tokens, authz)
+    accountRouter := r.PathPrefix("/account").Subrouter()
+    accountRouter.Handle("/password", session(handler.ChangePasswordHandler(store, store, store, tokens, authz))).Methods("PUT")
+    accountRouter.Handle("/mfa/enroll", enrolling(handler.EnrollMFAHandler(store, store))).Methods("POST")
+    accountRouter.Handle("/mfa/confirm", enrolling(handler.ConfirmMFAHandler(store))).Methods("POST")
+    accountRouter.Handle("/mfa/recovery-codes", session(handler.RegenerateRecoveryCodesHandler(store))).Methods("POST")
+    accountRouter.Handle("/mfa", session(handler.DisableMFAHandler(store, store))).Methods("DELETE")
+
+    // Protected routes for Admin
+    adminRouter := r.PathPrefix("/admin").Subrouter()
+    adminRouter.Use(sessionOrAPIKey)
+    adminRouter.Handle("/vehicles", can(models.PermVehiclesRead, handler.GetAllVehiclesHandler(store))).Methods("GET")  // Admin lists the fleet
+    adminRouter.Handle("/vehicles", can(models.PermVehiclesWrite, handler.CreateVehicleHandler(store))).Methods("POST")  // Admin creates a vehicle
+    adminRouter.Handle("/vehicles/{id}", can(models.PermVehiclesRead, handler.GetVehicleHandler(store))).Methods("GET")
+    adminRouter.Handle("/vehicles/{id}", can(models.PermVehiclesWrite, handler.UpdateVehicleHandler(store))).Methods("PATCH")
+    adminRouter.Handle("/vehicles/{id}", can(models.PermVehiclesWrite, handler.RetireVehicleHandler(store))).Methods("DELETE")  // Retires the vehicle, see RetireVehicleHandler
+    adminRouter.Handle("/vehicles/{id}/driver", can(models.PermVehiclesWrite, handler.AssignVehicleHandler(store))).Methods("PUT")
+    adminRouter.Handle("/vehicles/{id}/driver", can(models.PermVehiclesWrite, handler.UnassignVehicleHandler(store))).Methods("DELETE")
+    adminRouter.Handle("/vehicle-assignments", can(models.PermVehiclesRead, handler.ListAssignmentsHandler(store))).Methods("GET")  // Who drove what when
+    adminRouter.Handle("/bookings", can(models.PermBookingsRead, handler.GetAllBookingsHandler(store))).Methods("GET")  // Get all bookings
+    adminRouter.Handle("/bookings/{id}/complete", can(models.PermBookingsComplete, handler.CompleteBookingHandler(store))).Methods("PUT")  // Mark a booking as complete
+    adminRouter.Handle("/bookings/{id}/cancel", can(models.PermBookingsCancelAny, handler.CancelBookingHandler(store, models.ActorAdmin))).Methods("PUT")  // Cancel anyone's booking
+    adminRouter.Handle("/users", can(models.PermUsersRead, handler.ListUsersHandler(store))).Methods("GET")
+    adminRouter.Handle("/users", can(models.PermUsersWrite, handler.CreateUserHandler(store, store))).Methods("POST")  // Provision an account with any role
+    adminRouter.Handle("/users/{id}/role", can(models.PermUsersWrite, handler.UpdateUserRoleHandler(store, store, authz))).Methods("PUT")
+    adminRouter.Handle("/users/{id}/status", can(models.PermUsersWrite, handler.UpdateUserStatusHandler(store, authz))).Methods("PUT")  // Approve, disable or re-enable an account
+    adminRouter.Handle("/users/{id}", can(models.PermUsersWrite, handler.DeleteUserHandler(store, authz))).Methods("DELETE")
+    adminRouter.Handle("/users/{id}/unlock", can(models.PermUsersWrite, handler.UnlockUserHandler(store))).Methods("POST")  // Lift a login lockout
+    adminRouter.Handle("/lockouts", can(models.PermUsersRead, handler.ListLockoutsHandler(store))).Methods("GET")
+    adminRouter.Handle("/lockouts/ip/{ip}", can(models.PermUsersWrite, handler.UnlockIPHandler(store))).Methods("DELETE")
+    adminRouter.Handle("/users/{id}/mfa", can(models.PermUsersWrite, handler.ResetUserMFAHandler(store, authz))).Methods("DELETE")  // Remove a lost second factor
+    adminRouter.Handle("/users/{id}/sessions", can(models.PermUsersWrite, handler.RevokeUserSessionsHandler(store, authz))).Methods("DELETE")  // Kill all sessions of a user
+    adminRouter.Handle("/roles", can(models.PermRolesManage, handler.ListRolesHandler(store))).Methods("GET")
+    adminRouter.Handle("/roles", can(models.PermRolesManage, handler.CreateRoleHandler(store))).Methods("POST")  // Define a role such as "dispatcher"
+    adminRouter.Handle("/roles/{name}/permissions", can(models.PermRolesManage, handler.UpdateRolePermissionsHandler(store, authz))).Methods("PUT")
+    adminRouter.Handle("/roles/{name}/mfa", can(models.PermRolesManage, handler.SetRoleMFAHandler(store))).Methods("PUT")  // Enforce MFA for a role
+    adminRouter.Handle("/roles/{name}", can(models.PermRolesManage, handler.DeleteRoleHandler(store, authz))).Methods("DELETE")
+    adminRouter.Handle("/permissions", can(models.PermRolesManage, handler.ListPermissionsHandler(store))).Methods("GET")
+    adminRouter.Handle("/api-keys", can(models.PermAPIKeysManage, handler.ListAPIKeysHandler(store))).Methods("GET")
+    adminRouter.Handle("/api-keys", can(models.PermAPIKeysManage, handler.CreateAPIKeyHandler(store, store))).Methods("POST")  // Issue a scoped key for an integration
+    adminRouter.Handle("/api-keys/{id}", can(models.PermAPIKeysManage, handler.RevokeAPIKeyHandler(store))).Methods("DELETE")
+    adminRouter.Handle("/audit", can(models.PermAuditRead, handler.ListAuditHandler(store))).Methods("GET")  // Who changed what, filterable by actor, entity and time
+    adminRouter.Handle("/drivers/active-bookings", can(models.PermBookingsRead, handler.GetDriverActiveBookingsCount(store))).Methods("GET")  // Get active bookings count per driver
+    adminRouter.Handle("/analytics/vehicle-status", can(models.PermAnalyticsRead, handler.GetVehicleStatus(store))).Methods("GET")
+    adminRouter.Handle("/analytics/driver-performance", can(models.PermAnalyticsRead, handler.GetDriverPerformance(store))).Methods("GET")
+    adminRouter.Handle("/analytics/revenue-over-time", can(models.PermAnalyticsRead, handler.GetRevenueOverTime(store))).Methods("GET")
+    adminRouter.Handle("/analytics/booking-status-distribution", can(models.PermAnalyticsRead, handler.GetBookingStatusDistribution(store))).Methods("GET")
+    adminRouter.Handle("/analytics/bookings-over-time", can(models.PermAnalyticsRead, handler.GetBookingsOverTime(store))).Methods("GET")
+
+    // Routes for Users to book vehicles
+    userRouter := r.PathPrefix("/user").Subrouter()
+    userRouter.Use(sessionOrAPIKey)
+    userRouter.Handle("/bookings", can(models.PermBookingsCreate, handler.CreateBookingHandler(store))).Methods("POST")  // Create a booking
+    userRouter.Handle("/bookings/{id}/cancel", can(models.PermBookingsCancel, handler.CancelBookingHandler(store, models.ActorCustomer))).Methods("PUT")  // Customer cancels their booking
+
+    // Routes for Drivers to accept bookings and carry them out
+    driverRouter := r.PathPrefix("/driver").Subrouter()
+    driverRouter.Use(sessionOrAPIKey)
+    driverRouter.Handle("/bookings/pending", can(models.PermBookingsAccept, handler.GetPendingBookingsHandler(store))).Methods("GET")
+    driverRouter.Handle("/bookings/{id}/accept", can(models.PermBookingsAccept, handler.AcceptBookingHandler(store))).Methods("PUT")  // Driver accepts booking
+    driverRouter.Handle("/bookings/{id}/status", can(models.PermBookingsAccept, handler.UpdateTripStatusHandler(store))).Methods("PUT")  // Driver advances their trip
+
+    // CORS for the frontend, answering preflight requests before routing
+    headers := handlers.AllowedHeaders([]string{"X-Requested-With", "Content-Type", "Authorization", "X-API-Key", "X-Request-ID"})
+    exposed := handlers.ExposedHeaders([]string{"X-Request-ID"})
+    methods := handlers.AllowedMethods([]string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"})
+    origins := handlers.AllowedOrigins(cfg.AllowedOrigins)
+    var h http.Handler = handlers.CORS(origins, headers, methods, exposed)(r)
+
+    // Request IDs, client addresses and request logs wrap everything, so
+    // unknown routes and preflight requests are logged too. The request span
+    // continues the trace of a traceparent header.
+    h = middleware.RequestLogger(logger)(h)
+    h = middleware.RealIP(trustedProxies)(h)
+    h = middleware.RequestID(h)
+    return otelhttp.NewHandler(h, "HTTP request", otelhttp.WithPropagators(tracing.Propagator)), nil
+}
+
+// newStore returns the stores for the configured database driver
+func newStore(cfg *config.Config, db *sql.DB) *models.SQLStore {
+    if cfg.Database.Driver == config.DriverSQLite {
+        return models.NewSQLiteStore(db)
+    }
+    return models.NewPostgresStore(db)
+}
@@ -0,0 +1,117 @@
+// Package tracing sets up OpenTelemetry: spans are exported over OTLP, or
+// written as JSON to stdout or a file when no collector runs, and trace
+// context is propagated in W3C traceparent headers.
+package tracing
+
+import (
+    "context"
+    "fmt"
+    "io"
+    "net/http"
+    "os"
+
+    "fmc/config"
+
+    "github.com/gorilla/mux"
+    "go.opentelemetry.io/otel"
+    "go.opentelemetry.io/otel/attribute"
+    "go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+    "go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+    "go.opentelemetry.io/otel/propagation"
+    "go.opentelemetry.io/otel/sdk/resource"
+    sdktrace "go.opentelemetry.io/otel/sdk/trace"
+    semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+    "go.opentelemetry.io/otel/trace"
+)
+
+// ServiceName identifies the API in traces unless OTEL_SERVICE_NAME says otherwise
+const ServiceName = "fleetfy-server"
+
+// Propagator reads and writes W3C trace context and baggage headers
+var Propagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+// Setup installs the global tracer provider for cfg.Exporter. The returned
+// function flushes buffered spans and must be called before exiting.
+// Without an exporter spans aren't recorded, but trace context is still
+// passed on.
+func Setup(ctx context.Context, cfg config.Tracing) (func(context.Context) error, error) {
+    otel.SetTextMapPropagator(Propagator)
+
+    var exporter sdktrace.SpanExporter
+    var closer io.Closer
+    switch cfg.Exporter {
+    case "", config.TracingNone:
+        return func(context.Context) error { return nil }, nil
+    case config.TracingOTLP:
+        // The collector is configured with the standard OTEL_EXPORTER_OTLP_* variables
+        otlp, err := otlptracehttp.New(ctx)
+        if err != nil {
+            return nil, fmt.Errorf("creating OTLP exporter: %w", err)
+        }
+        exporter = otlp
+    case config.TracingStdout:
+        stdout, err := stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+        if err != nil {
+            return nil, err
+        }
+        exporter = stdout
+    case config.TracingFile:
+        f, err := os.OpenFile(cfg.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+        if err != nil {
+            return nil, fmt.Errorf("opening trace file: %w", err)
+        }
+        stdout, err := stdouttrace.New(stdouttrace.WithWriter(f))
+        if err != nil {
+            f.Close()
+            return nil, err
+        }
+        exporter, closer = stdout, f
+    default:
+        return nil, fmt.Errorf("unknown tracing exporter %q", cfg.Exporter)
+    }
+
+    // OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override the defaults
+    res, err := resource.Merge(
+        resource.NewSchemaless(semconv.ServiceName(ServiceName)),
+        resource.Environment(),
+    )
+    if err != nil {
+        return nil, fmt.Errorf("describing the service: %w", err)
+    }
+
+    // The sampler follows OTEL_TRACES_SAMPLER and defaults to sampling every
+    // trace that isn't sampled out upstream
+    provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+    otel.SetTracerProvider(provider)
+
+    return func(ctx context.Context) error {
+        err := provider.Shutdown(ctx)
+        if closer != nil {
+            if cerr := closer.Close(); err == nil {
+                err = cerr
+            }
+        }
+        return err
+    }, nil
+}
+
+// Start begins a span for work inside the server that isn't a request or a
+// query, such as hashing a password
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+    return otel.Tracer("fmc").Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// Route names the request's span after the mux route it matched, so spans of
+// the same endpoint group together whatever IDs are in the path
+func Route(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if route := mux.CurrentRoute(r); route != nil {
+            if template, err := route.GetPathTemplate(); err == nil {
+                span := trace.SpanFromContext(r.Context())
+                span.SetName(r.Method + " " + template)
+                span.SetAttributes(semconv.HTTPRoute(template))
+            }
+        }
+        next.ServeHTTP(w, r)
+    })
+}
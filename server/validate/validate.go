@@ -0,0 +1,190 @@
+// Package validate checks request structs against rules declared in their
+// `validate` tags, e.g.
+//
+//	VehicleType string `json:"vehicle_type" validate:"required,oneof=small medium large"`
+//
+// Rules are separated by commas:
+//
+//	required   the value is set: non-blank strings, non-nil pointers, non-empty slices
+//	min=N      strings have at least N characters, slices N items, numbers are at least N
+//	max=N      the upper bound counterpart of min
+//	oneof=a b  strings are one of the listed values
+//	email      strings are a bare email address
+//
+// Rules other than required are skipped for zero values, so optional fields
+// are only checked when they are given.
+package validate
+
+import (
+    "fmt"
+    "net/mail"
+    "reflect"
+    "strconv"
+    "strings"
+    "sync"
+    "unicode/utf8"
+
+    "fmc/models"
+)
+
+// Struct checks every field of the struct v points to and reports all
+// failures at once as a validation error
+func Struct(v interface{}) error {
+    rv := reflect.Indirect(reflect.ValueOf(v))
+    if rv.Kind() != reflect.Struct {
+        panic(fmt.Sprintf("validate: %T is not a struct", v))
+    }
+
+    var details []models.FieldError
+    for _, f := range fieldsOf(rv.Type()) {
+        if msg := f.check(rv.FieldByIndex(f.index)); msg != "" {
+            details = append(details, models.FieldError{Field: f.name, Message: msg})
+        }
+    }
+    if len(details) == 0 {
+        return nil
+    }
+    return models.InvalidFields("validation_failed", details...)
+}
+
+// Email reports whether s is a bare email address such as a@example.com
+func Email(s string) bool {
+    addr, err := mail.ParseAddress(s)
+    return err == nil && addr.Address == s
+}
+
+type field struct {
+    name  string
+    index []int
+    rules []rule
+}
+
+type rule struct {
+    name string
+    arg  string
+}
+
+// fields caches the parsed rules per struct type
+var fields sync.Map
+
+func fieldsOf(t reflect.Type) []field {
+    if cached, ok := fields.Load(t); ok {
+        return cached.([]field)
+    }
+
+    var parsed []field
+    for i := 0; i < t.NumField(); i++ {
+        sf := t.Field(i)
+        tag := sf.Tag.Get("validate")
+        if tag == "" || tag == "-" {
+            continue
+        }
+        f := field{name: jsonName(sf), index: sf.Index}
+        for _, r := range strings.Split(tag, ",") {
+            name, arg, _ := strings.Cut(r, "=")
+            switch name {
+            case "required", "email":
+            case "min", "max":
+                if _, err := strconv.ParseFloat(arg, 64); err != nil {
+                    panic(fmt.Sprintf("validate: %s.%s: %s needs a number", t, sf.Name, name))
+                }
+            case "oneof":
+                if arg == "" {
+                    panic(fmt.Sprintf("validate: %s.%s: oneof needs values", t, sf.Name))
+                }
+            default:
+                panic(fmt.Sprintf("validate: %s.%s: unknown rule %q", t, sf.Name, name))
+            }
+            f.rules = append(f.rules, rule{name: name, arg: arg})
+        }
+        parsed = append(parsed, f)
+    }
+
+    fields.Store(t, parsed)
+    return parsed
+}
+
+// jsonName is the name clients know the field by
+func jsonName(sf reflect.StructField) string {
+    name, _, _ := strings.Cut(sf.Tag.Get("json"), ",")
+    if name == "" || name == "-" {
+        return sf.Name
+    }
+    return name
+}
+
+// check returns why v breaks the field's rules, or "" when it doesn't
+func (f field) check(v reflect.Value) string {
+    if isZero(v) {
+        for _, r := range f.rules {
+            if r.name == "required" {
+                return "is required"
+            }
+        }
+        return ""
+    }
+
+    v = reflect.Indirect(v)
+    for _, r := range f.rules {
+        if msg := r.check(v); msg != "" {
+            return msg
+        }
+    }
+    return ""
+}
+
+func (r rule) check(v reflect.Value) string {
+    switch r.name {
+    case "min", "max":
+        limit, _ := strconv.ParseFloat(r.arg, 64)
+        size, unit := measure(v)
+        if r.name == "min" && size < limit {
+            return "must be at least " + r.arg + unit
+        }
+        if r.name == "max" && size > limit {
+            return "must be at most " + r.arg + unit
+        }
+    case "oneof":
+        allowed := strings.Fields(r.arg)
+        for _, a := range allowed {
+            if v.String() == a {
+                return ""
+            }
+        }
+        return "must be one of " + strings.Join(allowed, ", ")
+    case "email":
+        if !Email(v.String()) {
+            return "must be an email address"
+        }
+    }
+    return ""
+}
+
+// measure returns what min and max compare: the length of strings and
+// slices, or the value of numbers
+func measure(v reflect.Value) (float64, string) {
+    switch v.Kind() {
+    case reflect.String:
+        return float64(utf8.RuneCountInString(v.String())), " characters"
+    case reflect.Slice, reflect.Map:
+        return float64(v.Len()), " items"
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+        return float64(v.Int()), ""
+    case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+        return float64(v.Uint()), ""
+    case reflect.Float32, reflect.Float64:
+        return v.Float(), ""
+    }
+    panic(fmt.Sprintf("validate: min and max don't apply to %s", v.Type()))
+}
+
+// isZero treats blank strings as missing
+func isZero(v reflect.Value) bool {
+    switch v.Kind() {
+    case reflect.String:
+        return strings.TrimSpace(v.String()) == ""
+    case reflect.Slice, reflect.Map:
+        return v.Len() == 0
+    }
+    return v.IsZero()
+}